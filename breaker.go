@@ -0,0 +1,303 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/couchbase/cbft/protobuf"
+	"github.com/couchbase/query/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// breakerFailureThreshold is the number of consecutive failed searches
+// (within breakerFailureWindow) past which an FTS node's circuit breaker
+// trips, with the searches routed to the other nodes for the cooldown;
+// 0 disables the breakers; as set by the "breakerFailureThreshold" config
+var breakerFailureThreshold = int64(5)
+
+func GetBreakerFailureThreshold() int64 {
+	return atomic.LoadInt64(&breakerFailureThreshold)
+}
+
+func SetBreakerFailureThreshold(v int64) {
+	atomic.StoreInt64(&breakerFailureThreshold, v)
+}
+
+// breakerFailureWindow is the window the consecutive failures of an FTS
+// node are counted within; as set by the "breakerFailureWindowMS" config
+// (in ms)
+var breakerFailureWindow = int64(30 * time.Second)
+
+func GetBreakerFailureWindow() time.Duration {
+	return time.Duration(atomic.LoadInt64(&breakerFailureWindow))
+}
+
+func SetBreakerFailureWindow(v time.Duration) {
+	atomic.StoreInt64(&breakerFailureWindow, int64(v))
+}
+
+// breakerCooldown is the duration an FTS node's tripped breaker stays open
+// for, after which a single search probes the node's recovery; as set by
+// the "breakerCooldownMS" config (in ms)
+var breakerCooldown = int64(10 * time.Second)
+
+func GetBreakerCooldown() time.Duration {
+	return time.Duration(atomic.LoadInt64(&breakerCooldown))
+}
+
+func SetBreakerCooldown(v time.Duration) {
+	atomic.StoreInt64(&breakerCooldown, int64(v))
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker tracks the failures of the searches sent to an FTS node,
+// opening once the node fails repeatedly so the searches are routed
+// elsewhere, until after a cooldown a probe search (half-open) succeeds.
+type circuitBreaker struct {
+	server string
+	trips  *int64 // stats counter of the breakers tripped, if any
+
+	m            sync.Mutex
+	state        breakerState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	probeAt      time.Time // when the probe (if half-open) was let through
+	probing      bool
+}
+
+func newCircuitBreaker(server string, trips *int64) *circuitBreaker {
+	return &circuitBreaker{server: server, trips: trips}
+}
+
+// allow returns true if a search may be sent to the node, letting a single
+// probe through once an open breaker has cooled down; a probe that never
+// reports its outcome (for ex. as its stream was abandoned) is given up on
+// after a cooldown.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b == nil || GetBreakerFailureThreshold() <= 0 {
+		return true
+	}
+
+	cooldown := GetBreakerCooldown()
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		logging.Infof("client: breaker for node: %s half-open, probing",
+			b.server)
+	case breakerHalfOpen:
+		if b.probing && now.Sub(b.probeAt) < cooldown {
+			return false
+		}
+	default:
+		return true
+	}
+
+	b.probing, b.probeAt = true, now
+	return true
+}
+
+// success records a search that the node served, closing the breaker.
+func (b *circuitBreaker) success() {
+	if b == nil {
+		return
+	}
+
+	b.m.Lock()
+	if b.state != breakerClosed {
+		logging.Infof("client: breaker for node: %s closed, node recovered",
+			b.server)
+	}
+	b.state, b.failures, b.probing = breakerClosed, 0, false
+	b.m.Unlock()
+}
+
+// failure records a search that the node failed, tripping the breaker
+// on the threshold being reached, or on the failure of a probe.
+func (b *circuitBreaker) failure(now time.Time, err error) {
+	threshold := GetBreakerFailureThreshold()
+	if b == nil || threshold <= 0 {
+		return
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	switch b.state {
+	case breakerHalfOpen:
+		b.state, b.openedAt, b.probing = breakerOpen, now, false
+		logging.Warnf("client: breaker for node: %s re-opened, probe"+
+			" failed, err: %v", b.server, err)
+		return
+	case breakerOpen:
+		return
+	}
+
+	if b.failures == 0 || now.Sub(b.firstFailure) > GetBreakerFailureWindow() {
+		b.failures, b.firstFailure = 0, now
+	}
+	b.failures++
+
+	if int64(b.failures) >= threshold {
+		b.state, b.openedAt = breakerOpen, now
+		if b.trips != nil {
+			atomic.AddInt64(b.trips, 1)
+		}
+		logging.Warnf("client: breaker for node: %s tripped, after %d"+
+			" failures, for: %v, err: %v", b.server, b.failures,
+			GetBreakerCooldown(), err)
+	}
+}
+
+// abandon gives up on a search whose outcome isn't known (for ex. as it
+// was canceled), letting another probe through if it was the probe.
+func (b *circuitBreaker) abandon() {
+	if b == nil {
+		return
+	}
+
+	b.m.Lock()
+	b.probing = false
+	b.m.Unlock()
+}
+
+func (b *circuitBreaker) currentState() breakerState {
+	if b == nil {
+		return breakerClosed
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return b.state
+}
+
+// nodeFailure returns true if the error is down to the node (rather than
+// to the search request), i.e. the node's unreachable or the transport to
+// it broke, and false if the node's health isn't known from it, i.e. the
+// search was canceled, or it failed once the caller had given up on it.
+func nodeFailure(ctx context.Context, err error) (failed bool, known bool) {
+	if ctx.Err() != nil {
+		return false, false
+	}
+
+	st := status.Convert(err)
+	switch st.Code() {
+	case codes.Canceled:
+		return false, false
+	case codes.Unavailable:
+		return true, true
+	case codes.Internal:
+		// the stream reset, or the connection broke, under the search.
+		msg := st.Message()
+		return strings.HasPrefix(msg, "transport: ") ||
+			strings.Contains(msg, "RST_STREAM"), true
+	}
+
+	return false, true
+}
+
+// -----------------------------------------------------------------------------
+
+// breakerClient is the client to an FTS node, that reports the outcome of
+// its searches to the node's circuit breaker.
+type breakerClient struct {
+	pb.SearchServiceClient
+	breaker *circuitBreaker
+}
+
+func (c *breakerClient) Search(ctx context.Context, in *pb.SearchRequest,
+	opts ...grpc.CallOption) (pb.SearchService_SearchClient, error) {
+	stream, err := c.SearchServiceClient.Search(ctx, in, opts...)
+	if err != nil {
+		c.report(ctx, err)
+		return nil, err
+	}
+
+	return &breakerStream{SearchService_SearchClient: stream, c: c,
+		ctx: ctx}, nil
+}
+
+func (c *breakerClient) report(ctx context.Context, err error) {
+	if err == nil {
+		c.breaker.success()
+		return
+	}
+
+	if failed, known := nodeFailure(ctx, err); !known {
+		c.breaker.abandon()
+	} else if failed {
+		c.breaker.failure(time.Now(), err)
+	} else {
+		c.breaker.success()
+	}
+}
+
+// breakerStream reports the outcome of the search, once the stream ends
+// or the search result arrives, whichever's first.
+type breakerStream struct {
+	pb.SearchService_SearchClient
+	c        *breakerClient
+	ctx      context.Context // the caller's, see nodeFailure
+	reported bool
+}
+
+func (s *breakerStream) Recv() (*pb.StreamSearchResults, error) {
+	results, err := s.SearchService_SearchClient.Recv()
+	if !s.reported {
+		if err == io.EOF {
+			s.reported = true
+			s.c.report(s.ctx, nil)
+		} else if err != nil {
+			s.reported = true
+			s.c.report(s.ctx, err)
+		} else if _, ok := results.Contents.(*pb.StreamSearchResults_SearchResult); ok {
+			s.reported = true
+			s.c.report(s.ctx, nil)
+		}
+	}
+
+	return results, err
+}
@@ -0,0 +1,209 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	pb "github.com/couchbase/cbft/protobuf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	defer SetBreakerFailureThreshold(GetBreakerFailureThreshold())
+	defer SetBreakerFailureWindow(GetBreakerFailureWindow())
+	defer SetBreakerCooldown(GetBreakerCooldown())
+
+	SetBreakerFailureThreshold(3)
+	SetBreakerFailureWindow(10 * time.Second)
+	SetBreakerCooldown(5 * time.Second)
+
+	var trips int64
+	b := newCircuitBreaker("a:9130", &trips)
+	now := time.Now()
+	errUnavailable := status.Error(codes.Unavailable, "node down")
+
+	// failures spread out past the window don't trip the breaker, nor do
+	// those interleaved with successes.
+	b.failure(now, errUnavailable)
+	b.failure(now.Add(11*time.Second), errUnavailable)
+	b.success()
+	b.failure(now.Add(12*time.Second), errUnavailable)
+	b.failure(now.Add(13*time.Second), errUnavailable)
+	if b.currentState() != breakerClosed || !b.allow(now.Add(13*time.Second)) {
+		t.Fatalf("Expected the breaker closed, got: %v", b.currentState())
+	}
+
+	now = now.Add(14 * time.Second)
+	b.failure(now, errUnavailable)
+	if b.currentState() != breakerOpen || trips != 1 {
+		t.Fatalf("Expected the breaker tripped, got: %v, trips: %d",
+			b.currentState(), trips)
+	}
+
+	if b.allow(now.Add(time.Second)) {
+		t.Fatalf("Expected the open breaker to disallow searches")
+	}
+
+	// a single probe past the cooldown, whose failure re-opens the breaker.
+	now = now.Add(GetBreakerCooldown())
+	if !b.allow(now) || b.currentState() != breakerHalfOpen {
+		t.Fatalf("Expected a probe allowed, got: %v", b.currentState())
+	}
+	if b.allow(now) {
+		t.Fatalf("Expected a single probe allowed at a time")
+	}
+
+	b.failure(now, errUnavailable)
+	if b.currentState() != breakerOpen || b.allow(now) {
+		t.Fatalf("Expected the breaker re-opened, got: %v", b.currentState())
+	}
+
+	// a successful probe closes the breaker.
+	now = now.Add(GetBreakerCooldown())
+	if !b.allow(now) {
+		t.Fatalf("Expected a probe allowed")
+	}
+	b.success()
+	if b.currentState() != breakerClosed || !b.allow(now) {
+		t.Fatalf("Expected the breaker closed, got: %v", b.currentState())
+	}
+
+	if trips != 1 {
+		t.Fatalf("Expected a single trip, got: %d", trips)
+	}
+}
+
+func TestClientPassesOverOpenBreakers(t *testing.T) {
+	defer SetSearchRoutingPolicy(GetSearchRoutingPolicy())
+	defer SetBreakerCooldown(GetBreakerCooldown())
+	SetBreakerCooldown(time.Minute)
+
+	servers := []string{"a:9130", "b:9130", "c:9130"}
+	client := &ftsClient{breakers: map[string]*circuitBreaker{}}
+	for _, server := range servers {
+		client.servers = append(client.servers, server)
+		client.breakers[server] = newCircuitBreaker(server, nil)
+	}
+
+	trip := func(server string) {
+		for k := int64(0); k < GetBreakerFailureThreshold(); k++ {
+			client.breakers[server].failure(time.Now(),
+				status.Error(codes.Unavailable, "node down"))
+		}
+	}
+
+	for _, policy := range []string{RoutingRandom, RoutingSticky} {
+		SetSearchRoutingPolicy(policy)
+
+		for _, server := range servers {
+			client.breakers[server].success()
+		}
+		trip("a:9130")
+		trip("b:9130")
+
+		for k := 0; k < 10; k++ {
+			if server := client.pickServer(fmt.Sprintf("uuid%d", k)); server != "c:9130" {
+				t.Fatalf("[%s] Expected the node with the closed breaker,"+
+					" got: %s", policy, server)
+			}
+		}
+
+		if n := client.openBreakers(); n != 2 {
+			t.Fatalf("[%s] Expected 2 open breakers, got: %d", policy, n)
+		}
+
+		// with all the breakers open, the search fails fast.
+		trip("c:9130")
+		if server := client.pickServer("uuid"); server != "" {
+			t.Fatalf("[%s] Expected no node, got: %s", policy, server)
+		}
+	}
+}
+
+func TestBreakerClientReportsOutcomes(t *testing.T) {
+	defer SetBreakerFailureThreshold(GetBreakerFailureThreshold())
+	SetBreakerFailureThreshold(2)
+
+	search := func(b *circuitBreaker, client *fakeSearchClient) {
+		searchCtx(context.Background(), b, client)
+	}
+
+	// the search failing outright, and its stream failing midway.
+	b := newCircuitBreaker("a:9130", nil)
+	search(b, &fakeSearchClient{
+		err: status.Error(codes.Unavailable, "node down")})
+	search(b, &fakeSearchClient{stream: &fakeStream{
+		err: status.Error(codes.Internal, "transport: connection reset")}})
+	if b.currentState() != breakerOpen {
+		t.Fatalf("Expected the breaker tripped, got: %v", b.currentState())
+	}
+
+	// canceled searches, and those failing over the request (rather than
+	// the node, as timing out does), don't trip the breaker.
+	b = newCircuitBreaker("a:9130", nil)
+	search(b, &fakeSearchClient{stream: &fakeStream{
+		err: status.Error(codes.Canceled, "canceled")}})
+	search(b, &fakeSearchClient{
+		err: status.Error(codes.InvalidArgument, "bad request")})
+	search(b, &fakeSearchClient{stream: &fakeStream{
+		err: status.Error(codes.DeadlineExceeded, "timed out")}})
+	search(b, &fakeSearchClient{stream: &fakeStream{
+		err: status.Error(codes.Unknown, "bleve: query err")}})
+	search(b, &fakeSearchClient{stream: &fakeStream{
+		err: status.Error(codes.Unavailable, "node down")}})
+	if b.currentState() != breakerClosed {
+		t.Fatalf("Expected the breaker closed, got: %v", b.currentState())
+	}
+
+	// a search that completes resets the failures.
+	search(b, &fakeSearchClient{stream: &fakeStream{}})
+	search(b, &fakeSearchClient{stream: &fakeStream{
+		err: status.Error(codes.Unavailable, "node down")}})
+	if b.currentState() != breakerClosed {
+		t.Fatalf("Expected the breaker closed, got: %v", b.currentState())
+	}
+
+	// the failures once the caller's given up on the search aren't
+	// the node's.
+	b = newCircuitBreaker("a:9130", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 3; i++ {
+		searchCtx(ctx, b, &fakeSearchClient{
+			err: status.Error(codes.Unavailable, "node down")})
+		searchCtx(ctx, b, &fakeSearchClient{stream: &fakeStream{
+			err: status.Error(codes.Unavailable, "node down")}})
+	}
+	if b.currentState() != breakerClosed {
+		t.Fatalf("Expected the breaker closed, got: %v", b.currentState())
+	}
+}
+
+// searchCtx searches through the breaker's client, over the context.
+func searchCtx(ctx context.Context, b *circuitBreaker,
+	client *fakeSearchClient) {
+	bc := &breakerClient{SearchServiceClient: client, breaker: b}
+	stream, err := bc.Search(ctx, &pb.SearchRequest{})
+	if err != nil {
+		return
+	}
+	for {
+		if _, err = stream.Recv(); err != nil {
+			return
+		}
+	}
+}
@@ -17,7 +17,10 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"hash/fnv"
 	"math/rand"
+	"sort"
+	"strings"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -28,8 +31,12 @@ import (
 
 	pb "github.com/couchbase/cbft/protobuf"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 )
 
 // CBAUTH security/encryption config
@@ -57,15 +64,82 @@ var DefaultGrpcConnectionHeartBeatInterval = time.Duration(60) * time.Second
 
 var DefaultGrpcMaxBackOffDelay = time.Duration(10) * time.Second
 
+// DefaultGrpcMaxRecvMsgSize bounds the size of a message received over
+// gRPC, such as a batch of hits carrying stored fields or highlights;
+// it applies to the connections set up from then on
 var DefaultGrpcMaxRecvMsgSize = 1024 * 1024 * 50 // 50 MB
+
+// DefaultGrpcMaxSendMsgSize bounds the size of a message sent over gRPC
 var DefaultGrpcMaxSendMsgSize = 1024 * 1024 * 50 // 50 MB
 
-// DefaultConnPoolSize decides the connection pool size per host
+// DefaultConnPoolSize decides the connection pool size per host, i.e. the
+// connections the pool lazily grows to, see connPool
 var DefaultConnPoolSize = 5
 
 // ErrFeatureUnavailable indicates the feature unavailability in cluster
 var ErrFeatureUnavailable = fmt.Errorf("feature unavailable in cluster")
 
+// ErrTLSConfig indicates that the TLS settings for the gRPC connections
+// couldn't be put together from the cluster's security config
+var ErrTLSConfig = fmt.Errorf("client: invalid TLS config, check the" +
+	" cluster's certificates")
+
+// grpcTLSServerName overrides the server name verified against the FTS
+// nodes' certificates, empty implies the host name dialed; as set by the
+// "grpcTLSServerName" config
+var grpcTLSServerName atomic.Value
+
+func GetGrpcTLSServerName() string {
+	if v, ok := grpcTLSServerName.Load().(string); ok {
+		return v
+	}
+	return ""
+}
+
+func SetGrpcTLSServerName(v string) {
+	grpcTLSServerName.Store(v)
+}
+
+// allowInsecureGrpcFallback permits plaintext gRPC connections when
+// encryption is enabled but the FTS nodes don't advertise a TLS port; as
+// set by the "allowInsecureGrpcFallback" config
+var allowInsecureGrpcFallback = int32(0)
+
+func GetAllowInsecureGrpcFallback() bool {
+	return loadFlag(&allowInsecureGrpcFallback)
+}
+
+func SetAllowInsecureGrpcFallback(v bool) {
+	storeFlag(&allowInsecureGrpcFallback, v)
+}
+
+// Search routing policies, deciding the FTS node a search is sent to.
+const (
+	// RoutingRandom spreads the searches across the FTS nodes at random.
+	RoutingRandom = "random"
+
+	// RoutingSticky sends the searches over an index to the same FTS node
+	// (as hashed from the index's UUID), for the FTS-side caches to be of
+	// use, failing over to the next node (as hashed) should it be down.
+	RoutingSticky = "sticky"
+)
+
+// searchRoutingPolicy is the policy the searches are routed to the FTS
+// nodes by, either of RoutingRandom or RoutingSticky; as set by the
+// "searchRoutingPolicy" config
+var searchRoutingPolicy atomic.Value
+
+func GetSearchRoutingPolicy() string {
+	if v, ok := searchRoutingPolicy.Load().(string); ok {
+		return v
+	}
+	return RoutingRandom
+}
+
+func SetSearchRoutingPolicy(v string) {
+	searchRoutingPolicy.Store(v)
+}
+
 var rsource rand.Source
 var r1 *rand.Rand
 
@@ -74,25 +148,149 @@ func init() {
 	r1 = rand.New(rsource)
 }
 
+// searchClientSource provides the gRPC client a search is sent with, as per
+// the routing key (the index's UUID), nil if there's none available; the
+// ftsClient is the one, unless substituted (for ex. with a fake serving
+// canned streams in tests), see FTSIndexer.searchClient(..).
+type searchClientSource interface {
+	getGrpcClient(routingKey string) pb.SearchServiceClient
+}
+
 type ftsClient struct {
-	gRPCConnMap map[string][]*grpc.ClientConn
-	servers     []string
+	pools   map[string]*connPool // by server, see conn_pool.go
+	servers []string
+
+	// the stat of the connections recycled, if any
+	connsRecycled *int64
+
+	// circuit breakers of the servers, see breaker.go
+	breakers map[string]*circuitBreaker
 }
 
-func (c *ftsClient) getGrpcClient() pb.SearchServiceClient {
-	if len(c.servers) == 0 {
+// getGrpcClient returns a client to the FTS node picked (as per the
+// searchRoutingPolicy) for the routing key, i.e. the index's UUID, nil
+// if none are available (for ex. with all of their breakers open).
+func (c *ftsClient) getGrpcClient(routingKey string) pb.SearchServiceClient {
+	server := c.pickServer(routingKey)
+	if server == "" {
 		return nil
 	}
-	// pick a random fts node
-	randomNodeIndex := r1.Intn(len(c.servers))
-	// pick its conn pool
-	connPool := c.gRPCConnMap[c.servers[randomNodeIndex]]
-	if len(connPool) == 0 {
+	// the connection of its pool is picked per search.
+	pool := c.pools[server]
+	if pool == nil {
 		return nil
 	}
-	// pick a random connection from pool
-	conn := connPool[r1.Intn(len(connPool))]
-	return pb.NewSearchServiceClient(conn)
+
+	return &breakerClient{SearchServiceClient: &pooledClient{pool: pool},
+		breaker: c.breakers[server]}
+}
+
+// pickServer returns the FTS node the search is to be sent to, at random
+// or, when sticky, the first one that's up in the order of the rendezvous
+// hashes of the routing key with the nodes, so that the searches fail
+// over consistently (to the next node as hashed) while a node is down.
+// The nodes whose circuit breakers are open are passed over, with none
+// returned if all of them are.
+func (c *ftsClient) pickServer(routingKey string) string {
+	if len(c.servers) == 0 {
+		return ""
+	}
+
+	now := time.Now()
+
+	if GetSearchRoutingPolicy() != RoutingSticky {
+		// pick a random fts node, else the next one whose breaker allows.
+		start := r1.Intn(len(c.servers))
+		for k := range c.servers {
+			server := c.servers[(start+k)%len(c.servers)]
+			if c.breakers[server].allow(now) {
+				return server
+			}
+		}
+
+		logging.Debugf("client: breakers open for all nodes")
+		return ""
+	}
+
+	servers := make([]string, len(c.servers))
+	copy(servers, c.servers)
+	sort.Slice(servers, func(i, j int) bool {
+		return rendezvousHash(routingKey, servers[i]) >
+			rendezvousHash(routingKey, servers[j])
+	})
+
+	for i, server := range servers {
+		if c.serverUp(server) && c.breakers[server].allow(now) {
+			if i > 0 {
+				logging.Debugf("client: routing key: %s, sticky node: %s"+
+					" down, failed over to: %s", routingKey, servers[0], server)
+			} else {
+				logging.Debugf("client: routing key: %s, sticky node: %s",
+					routingKey, server)
+			}
+			return server
+		}
+	}
+
+	// none of the nodes are up, so stick to the first as hashed whose
+	// breaker allows.
+	for _, server := range servers {
+		if c.breakers[server].allow(now) {
+			logging.Debugf("client: routing key: %s, no node up,"+
+				" sticky node: %s", routingKey, server)
+			return server
+		}
+	}
+
+	logging.Debugf("client: routing key: %s, breakers open for all nodes",
+		routingKey)
+	return ""
+}
+
+// openBreakers returns the number of nodes whose breakers aren't closed.
+func (c *ftsClient) openBreakers() int {
+	if c == nil {
+		return 0
+	}
+
+	var rv int
+	for _, b := range c.breakers {
+		if b.currentState() != breakerClosed {
+			rv++
+		}
+	}
+
+	return rv
+}
+
+// poolUtilization returns the number of connections set up to the FTS
+// nodes, and that of the streams taken (the searches in flight) over them.
+func (c *ftsClient) poolUtilization() (conns, streams int) {
+	if c == nil {
+		return 0, 0
+	}
+
+	for _, pool := range c.pools {
+		n, m := pool.utilization()
+		conns, streams = conns+n, streams+m
+	}
+
+	return conns, streams
+}
+
+// serverUp returns true unless all the connections to the FTS node have
+// failed or are shut down.
+func (c *ftsClient) serverUp(server string) bool {
+	pool := c.pools[server]
+	return pool != nil && pool.up()
+}
+
+func rendezvousHash(key, server string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(server))
+	return h.Sum64()
 }
 
 func (c *ftsClient) initConnections(hosts []string,
@@ -101,7 +299,6 @@ func (c *ftsClient) initConnections(hosts []string,
 		return ErrFeatureUnavailable
 	}
 
-OUTER:
 	for _, hostPort := range hosts {
 		cbUser, cbPasswd, err := cbauth.GetHTTPServiceAuth(hostPort)
 		if err != nil {
@@ -117,27 +314,53 @@ OUTER:
 			requireTransportSecurity: secure,
 		}))
 
-		for j := 0; j < DefaultConnPoolSize; j++ {
-			conn, err := grpc.Dial(hostPort, opts...)
-			if err != nil {
-				logging.Infof("client: grpc.Dial for host: %s, err: %v", hostPort, err)
-				continue OUTER
-			}
-			logging.Infof("client: grpc client connection #%d created for host: %v", j, hostPort)
-			c.gRPCConnMap[hostPort] = append(c.gRPCConnMap[hostPort], conn)
+		// the pool's first connection is set up ahead, the others as the
+		// searches need them.
+		pool := newConnPool(hostPort, func() (*grpc.ClientConn, error) {
+			return grpc.Dial(hostPort, opts...)
+		}, c.connsRecycled)
+		if err = pool.init(); err != nil {
+			logging.Infof("client: grpc.Dial for host: %s, err: %v", hostPort, err)
+			continue
 		}
-		// after the connections are ready, add the server to the servers list
+		c.pools[hostPort] = pool
+		// after the connection is ready, add the server to the servers list
 		c.servers = append(c.servers, hostPort)
 	}
 	return nil
 }
 
-func (c *ftsClient) Close() {
-	for _, conns := range c.gRPCConnMap {
-		for i := 0; i < len(conns); i++ {
-			conns[i].Close()
+// warmup establishes the connections to the FTS nodes that aren't ready
+// already, checking each with a health check RPC; the health service
+// being unimplemented by a node still implies that it's reachable.
+func (c *ftsClient) warmup(ctx context.Context) error {
+	for _, hostPort := range c.servers {
+		pool := c.pools[hostPort]
+		if pool == nil {
+			continue
+		}
+
+		for _, conn := range pool.connections() {
+			if conn.GetState() == connectivity.Ready {
+				continue
+			}
+
+			_, err := grpc_health_v1.NewHealthClient(conn).Check(ctx,
+				&grpc_health_v1.HealthCheckRequest{}, grpc.WaitForReady(true))
+			if err != nil && status.Code(err) != codes.Unimplemented {
+				return fmt.Errorf("client: warmup, host: %s, err: %v",
+					hostPort, err)
+			}
 		}
 	}
+
+	return nil
+}
+
+func (c *ftsClient) Close() {
+	for _, pool := range c.pools {
+		pool.Close()
+	}
 }
 
 // -----------------------------------------------------------------------------
@@ -172,14 +395,17 @@ func basicAuth(username, password string) string {
 
 // -----------------------------------------------------------------------------
 
-func setupFTSClient(nodeDefs *cbgt.NodeDefs) (*ftsClient, error) {
+func setupFTSClient(nodeDefs *cbgt.NodeDefs, st *stats) (*ftsClient, error) {
 	if nodeDefs == nil || len(nodeDefs.NodeDefs) == 0 {
 		return nil, nil
 	}
 
 	client := &ftsClient{
-		gRPCConnMap: make(map[string][]*grpc.ClientConn),
-		servers:     []string{},
+		pools:   make(map[string]*connPool),
+		servers: []string{},
+	}
+	if st != nil {
+		client.connsRecycled = &st.TotalGrpcConnsRecycled
 	}
 
 	hosts, sslHosts := extractHosts(nodeDefs)
@@ -206,28 +432,104 @@ func setupFTSClient(nodeDefs *cbgt.NodeDefs) (*ftsClient, error) {
 		// TODO: addClientInterceptor() ?
 	}
 
+	var secure bool
 	if secConfig.encryptionEnabled && len(sslHosts) != 0 {
-		certPool := x509.NewCertPool()
-		ok := certPool.AppendCertsFromPEM(secConfig.certInBytes)
-		if !ok {
-			return nil, fmt.Errorf("client: failed to append ca certs")
+		tlsConfig, err := grpcTLSConfig(secConfig)
+		if err != nil {
+			return nil, err
 		}
-		cred := credentials.NewClientTLSFromCert(certPool, "")
+		cred := credentials.NewTLS(tlsConfig)
 		gRPCOpts = append(gRPCOpts, grpc.WithTransportCredentials(cred))
 		hosts = sslHosts
+		secure = true
+	} else if secConfig.encryptionEnabled && !GetAllowInsecureGrpcFallback() {
+		return nil, fmt.Errorf("client: encryption enabled, but FTS nodes"+
+			" don't support gRPC over TLS, hosts: %v", hosts)
 	} else if len(hosts) > 0 {
 		gRPCOpts = append(gRPCOpts, grpc.WithInsecure())
 	}
 
-	err := client.initConnections(hosts, gRPCOpts,
-		secConfig.encryptionEnabled)
+	err := client.initConnections(hosts, gRPCOpts, secure)
 	if err != nil {
 		return nil, err
 	}
 
+	var trips *int64
+	if st != nil {
+		trips = &st.TotalBreakerTrips
+	}
+
+	client.breakers = make(map[string]*circuitBreaker, len(client.servers))
+	for _, server := range client.servers {
+		client.breakers[server] = newCircuitBreaker(server, trips)
+	}
+
 	return client, nil
 }
 
+// grpcTLSConfig returns the TLS settings for the gRPC connections, with
+// the cluster's certificate as the root CA and the cluster's TLS
+// preferences (minimum version, ciphers) applied; the node's certificate
+// is presented to the FTS nodes when client certificate auth is enabled.
+func grpcTLSConfig(sc *securityConfig) (*tls.Config, error) {
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(sc.certInBytes) {
+		return nil, fmt.Errorf("%v, err: failed to append ca certs", ErrTLSConfig)
+	}
+
+	rv := &tls.Config{
+		RootCAs:    certPool,
+		ServerName: GetGrpcTLSServerName(),
+	}
+
+	if sc.tlsPreference != nil {
+		rv.MinVersion = sc.tlsPreference.MinVersion
+		rv.CipherSuites = sc.tlsPreference.CipherSuites
+
+		if sc.tlsPreference.ClientAuthType != tls.NoClientCert {
+			if sc.certificate != nil {
+				rv.Certificates = []tls.Certificate{*sc.certificate}
+			} else if sc.tlsPreference.ClientAuthType ==
+				tls.RequireAndVerifyClientCert {
+				return nil, fmt.Errorf("%v, err: client certificate auth is"+
+					" mandatory, but no certificate is available", ErrTLSConfig)
+			}
+		}
+	}
+
+	return rv, nil
+}
+
+// grpcErrDesc returns the description for a failed gRPC call, calling
+// out failed TLS handshakes, which are down to certificate problems, and
+// messages over the size limits.
+func grpcErrDesc(err error, desc string) string {
+	if err == nil {
+		return desc
+	}
+
+	msg := err.Error()
+	if st, ok := status.FromError(err); ok {
+		msg = st.Message()
+
+		if st.Code() == codes.ResourceExhausted &&
+			strings.Contains(msg, "message larger than max") {
+			return desc + fmt.Sprintf(", message exceeded the gRPC max"+
+				" message size: %d bytes, raise DefaultGrpcMaxRecvMsgSize or"+
+				" fetch fewer fields, highlights or hits per batch",
+				DefaultGrpcMaxRecvMsgSize)
+		}
+	}
+
+	if strings.Contains(msg, "authentication handshake failed") ||
+		strings.Contains(msg, "x509:") || strings.Contains(msg, "tls:") {
+		return desc + ", TLS handshake with FTS failed, verify the" +
+			" cluster's certificates and TLS settings"
+	}
+
+	return desc
+}
+
 func extractHosts(nodeDefs *cbgt.NodeDefs) ([]string, []string) {
 	hosts := []string{}
 	sslHosts := []string{}
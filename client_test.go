@@ -0,0 +1,429 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/cbauth"
+	pb "github.com/couchbase/cbft/protobuf"
+	"github.com/couchbase/n1fty/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func testCertificate(t *testing.T) (*tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "n1fty-test"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &cert, certPEM
+}
+
+func TestGrpcTLSConfig(t *testing.T) {
+	cert, certPEM := testCertificate(t)
+
+	// no client certificate auth
+	tlsConfig, err := grpcTLSConfig(&securityConfig{
+		encryptionEnabled: true,
+		certificate:       cert,
+		certInBytes:       certPEM,
+		tlsPreference: &cbauth.TLSConfig{
+			MinVersion:   tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tlsConfig.RootCAs == nil || tlsConfig.MinVersion != tls.VersionTLS12 ||
+		len(tlsConfig.CipherSuites) != 1 || len(tlsConfig.Certificates) != 0 {
+		t.Fatalf("Unexpected TLS config: %+v", tlsConfig)
+	}
+
+	// mandatory client certificate auth, with the server name overridden
+	defer SetGrpcTLSServerName(GetGrpcTLSServerName())
+	SetGrpcTLSServerName("fts.example.com")
+
+	tlsConfig, err = grpcTLSConfig(&securityConfig{
+		encryptionEnabled: true,
+		certificate:       cert,
+		certInBytes:       certPEM,
+		tlsPreference: &cbauth.TLSConfig{
+			ClientAuthType: tls.RequireAndVerifyClientCert,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tlsConfig.Certificates) != 1 ||
+		tlsConfig.ServerName != "fts.example.com" {
+		t.Fatalf("Unexpected TLS config: %+v", tlsConfig)
+	}
+
+	// mandatory client certificate auth, without a certificate
+	_, err = grpcTLSConfig(&securityConfig{
+		encryptionEnabled: true,
+		certInBytes:       certPEM,
+		tlsPreference: &cbauth.TLSConfig{
+			ClientAuthType: tls.RequireAndVerifyClientCert,
+		},
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), ErrTLSConfig.Error()) {
+		t.Fatalf("Expected a TLS config err, got: %v", err)
+	}
+
+	// invalid CA certificate
+	_, err = grpcTLSConfig(&securityConfig{
+		encryptionEnabled: true,
+		certInBytes:       []byte("not a certificate"),
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), ErrTLSConfig.Error()) {
+		t.Fatalf("Expected a TLS config err, got: %v", err)
+	}
+}
+
+func TestGrpcErrDesc(t *testing.T) {
+	tests := []struct {
+		err error
+		tls bool
+	}{
+		{err: nil},
+		{err: fmt.Errorf("connection refused")},
+		{err: status.Error(codes.Unavailable, "connection error: desc ="+
+			" \"transport: authentication handshake failed: x509: certificate"+
+			" signed by unknown authority\""), tls: true},
+		{err: fmt.Errorf("remote error: tls: bad certificate"), tls: true},
+	}
+
+	for _, test := range tests {
+		desc := grpcErrDesc(test.err, "search failed")
+		if test.tls != (desc != "search failed") {
+			t.Fatalf("[err: %v] Unexpected desc: %s", test.err, desc)
+		}
+	}
+}
+
+func TestGrpcErrDescMessageTooLarge(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	defer server.Stop()
+
+	// the health check response is over the (tiny) max receive size.
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure(),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx,
+		&grpc_health_v1.HealthCheckRequest{}, grpc.WaitForReady(true))
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected the message to be too large, got: %v", err)
+	}
+
+	desc := grpcErrDesc(err, "search failed")
+	if !strings.Contains(desc, "DefaultGrpcMaxRecvMsgSize") {
+		t.Fatalf("Expected a suggestion to raise the limit, got: %s", desc)
+	}
+}
+
+func TestClientWarmup(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a server without any services registered, to which the health
+	// check is unimplemented
+	server := grpc.NewServer()
+	go server.Serve(listener)
+	defer server.Stop()
+
+	setup := func(hostPort string) *ftsClient {
+		conn, err := grpc.Dial(hostPort, grpc.WithInsecure())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pool := newConnPool(hostPort, func() (*grpc.ClientConn, error) {
+			return conn, nil
+		}, nil)
+		if err = pool.init(); err != nil {
+			t.Fatal(err)
+		}
+
+		return &ftsClient{
+			pools:   map[string]*connPool{hostPort: pool},
+			servers: []string{hostPort},
+		}
+	}
+
+	client := setup(listener.Addr().String())
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// warmup concurrently, as well as over live connections
+	errCh := make(chan error, 3)
+	for k := 0; k < 3; k++ {
+		go func() {
+			errCh <- client.warmup(ctx)
+		}()
+	}
+	for k := 0; k < 3; k++ {
+		if err = <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = client.warmup(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// an unreachable host
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPort := listener.Addr().String()
+	listener.Close()
+
+	client = setup(hostPort)
+	defer client.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err = client.warmup(ctx); err == nil {
+		t.Fatalf("Expected warmup to fail for an unreachable host")
+	}
+}
+
+func TestClientStickyRouting(t *testing.T) {
+	defer SetSearchRoutingPolicy(GetSearchRoutingPolicy())
+
+	// the connections aren't established until used, so the nodes
+	// needn't be reachable
+	client := &ftsClient{pools: map[string]*connPool{}}
+	for k := 0; k < 4; k++ {
+		hostPort := fmt.Sprintf("127.0.0.1:%d", 10000+k)
+		pool := newConnPool(hostPort, func() (*grpc.ClientConn, error) {
+			return grpc.Dial(hostPort, grpc.WithInsecure())
+		}, nil)
+		if err := pool.init(); err != nil {
+			t.Fatal(err)
+		}
+		client.pools[hostPort] = pool
+		client.servers = append(client.servers, hostPort)
+	}
+	defer client.Close()
+
+	SetSearchRoutingPolicy(RoutingSticky)
+
+	// the searches over an index stick to a node
+	sticky := client.pickServer("uuid1")
+	for k := 0; k < 10; k++ {
+		if server := client.pickServer("uuid1"); server != sticky {
+			t.Fatalf("Expected the sticky node: %s, got: %s", sticky, server)
+		}
+	}
+
+	// regardless of the order the nodes are known in
+	client.servers[0], client.servers[3] = client.servers[3], client.servers[0]
+	if server := client.pickServer("uuid1"); server != sticky {
+		t.Fatalf("Expected the sticky node: %s, got: %s", sticky, server)
+	}
+
+	// the searches over the indexes are spread across the nodes
+	picked := map[string]bool{}
+	for k := 0; k < 32; k++ {
+		picked[client.pickServer(fmt.Sprintf("uuid%d", k))] = true
+	}
+	if len(picked) < 2 {
+		t.Fatalf("Expected the indexes to be spread across nodes, got: %v",
+			picked)
+	}
+
+	// with the sticky node down, the searches fail over to another node,
+	// consistently
+	for _, conn := range client.pools[sticky].connections() {
+		conn.Close()
+	}
+	failover := client.pickServer("uuid1")
+	if failover == sticky {
+		t.Fatalf("Expected a fail over from the sticky node: %s", sticky)
+	}
+	for k := 0; k < 10; k++ {
+		if server := client.pickServer("uuid1"); server != failover {
+			t.Fatalf("Expected the fail over node: %s, got: %s",
+				failover, server)
+		}
+	}
+}
+
+// fakeClientSource provides the search client given, for any index.
+type fakeClientSource struct {
+	client pb.SearchServiceClient
+}
+
+func (s *fakeClientSource) getGrpcClient(
+	routingKey string) pb.SearchServiceClient {
+	return s.client
+}
+
+func TestFetchHitsWithFakeClient(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	// without a client, nor a source of them.
+	if _, _, err = index.fetchHits(context.Background(),
+		&pb.SearchRequest{}); err == nil {
+		t.Fatalf("Expected an error without a client")
+	}
+
+	result := func(status string) *pb.StreamSearchResults {
+		return &pb.StreamSearchResults{
+			Contents: &pb.StreamSearchResults_SearchResult{
+				SearchResult: []byte(`{"status":` + status +
+					`,"hits":[{"id":"doc-2"}]}`),
+			},
+		}
+	}
+
+	batch := &pb.StreamSearchResults{
+		Contents: &pb.StreamSearchResults_Hits{
+			Hits: &pb.StreamSearchResults_Batch{
+				Bytes: []byte(`[{"id":"doc-1"}]`), Total: 1},
+		},
+	}
+
+	tests := []struct {
+		client  *fakeSearchClient
+		hits    int
+		partial bool
+		err     bool
+	}{
+		{
+			client: &fakeSearchClient{stream: &fakeStream{msgs: []*pb.StreamSearchResults{
+				batch, result(`{"total":2,"failed":0,"successful":2}`)}}},
+			hits: 2,
+		},
+		{
+			client: &fakeSearchClient{stream: &fakeStream{msgs: []*pb.StreamSearchResults{
+				batch, result(`{"total":2,"failed":1,"successful":1}`)}}},
+			hits:    2,
+			partial: true,
+		},
+		{
+			client: &fakeSearchClient{stream: &fakeStream{
+				msgs: []*pb.StreamSearchResults{batch},
+				err:  status.Error(codes.Unavailable, "node down")}},
+			err: true,
+		},
+		{
+			client: &fakeSearchClient{
+				err: status.Error(codes.InvalidArgument, "bad request")},
+			err: true,
+		},
+		{
+			// the stream ending without the search result.
+			client: &fakeSearchClient{stream: &fakeStream{
+				msgs: []*pb.StreamSearchResults{batch}}},
+			err: true,
+		},
+	}
+
+	for testi, test := range tests {
+		index.indexer.clientSource = &fakeClientSource{client: test.client}
+
+		hits, searchStatus, err := index.fetchHits(context.Background(),
+			&pb.SearchRequest{})
+		if test.err != (err != nil) {
+			t.Fatalf("[%d] Expected err: %t, got: %v", testi, test.err, err)
+		}
+		if test.err {
+			continue
+		}
+
+		if len(hits) != test.hits {
+			t.Fatalf("[%d] Expected %d arrays of hits, got: %d", testi,
+				test.hits, len(hits))
+		}
+
+		if partial := partialResultsErr(searchStatus) != nil; partial != test.partial {
+			t.Fatalf("[%d] Expected partial: %t, got status: %s", testi,
+				test.partial, searchStatus)
+		}
+	}
+}
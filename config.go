@@ -31,6 +31,75 @@ import (
 const backfillSpaceDir = "query_tmpspace_dir"
 const backfillSpaceLimit = "query_tmpspace_limit"
 const searchTimeoutMS = "searchTimeoutMS"
+const maxConcurrentSearchesKey = "maxConcurrentSearches"
+const searchRoutingPolicyKey = "searchRoutingPolicy"
+const searchRetryJitterKey = "searchRetryJitter"
+
+// flagConfigs are the config keys of the bool knobs, with their setters.
+var flagConfigs = map[string]func(bool){
+	"failFastOnMaxConcurrentSearches": SetFailFastOnMaxConcurrentSearches,
+	"backfillFallbackToBlocking":      SetBackfillFallbackToBlocking,
+	"strictQueryTypes":                SetStrictQueryTypes,
+	"statsByKeyspace":                 SetStatsByKeyspace,
+	"strictHitDecoding":               SetStrictHitDecoding,
+	"indexHintCaseInsensitive":        util.SetIndexHintCaseInsensitive,
+	"allowInsecureGrpcFallback":       SetAllowInsecureGrpcFallback,
+	"distinctFailOnLimit":             SetDistinctFailOnLimit,
+}
+
+// intConfig is the least value of an int knob, with its setter.
+type intConfig struct {
+	min int64
+	set func(int64)
+}
+
+// intConfigs are the config keys of the int knobs.
+var intConfigs = map[string]intConfig{
+	"breakerFailureThreshold":    {0, SetBreakerFailureThreshold},
+	"grpcMaxStreamsPerConn":      {1, SetGrpcMaxStreamsPerConn},
+	"deepPagingMaxPages":         {0, SetDeepPagingMaxPages},
+	"deepPagingMaxHeldBytes":     {0, SetDeepPagingMaxHeldBytes},
+	"distinctMemoryLimit":        {0, SetDistinctMemoryLimit},
+	"collapseMemoryLimit":        {0, SetCollapseMemoryLimit},
+	"estimateCacheSize":          {0, SetEstimateCacheSize},
+	"dynamicMappingIndexedCount": {0, SetDynamicMappingIndexedCount},
+	"defaultMappingCacheSize":    {0, SetDefaultMappingCacheSize},
+	"rawResultMemoryLimit":       {0, SetRawResultMemoryLimit},
+	"streamDrainMaxMessages":     {0, SetStreamDrainMaxMessages},
+	"backfillResumeBatches":      {0, SetBackfillResumeBatches},
+	"explainBufferedHits":        {0, SetExplainBufferedHits},
+	"searchRetryMaxAttempts":     {0, SetSearchRetryMaxAttempts},
+	"visitBufferSize":            {1, SetVisitBufferSize},
+	"parsedRequestCacheBytes":    {0, util.SetParsedRequestCacheBytes},
+	"maxQueryDepth":              {1, util.SetMaxQueryDepth},
+}
+
+// durationConfigs are the config keys of the duration knobs, in ms (as
+// with searchTimeoutMS), with their setters.
+var durationConfigs = map[string]func(time.Duration){
+	"breakerFailureWindowMS":        SetBreakerFailureWindow,
+	"breakerCooldownMS":             SetBreakerCooldown,
+	"estimateCacheTTLMS":            SetEstimateCacheTTL,
+	"estimateTimeoutMS":             SetEstimateTimeout,
+	"searchTimeoutGraceMS":          SetSearchTimeoutGrace,
+	"closeDrainTimeoutMS":           SetCloseDrainTimeout,
+	"streamDrainTimeoutMS":          SetStreamDrainTimeout,
+	"backfillPollIntervalMS":        SetBackfillPollInterval,
+	"entrySendTimeoutMS":            SetEntrySendTimeout,
+	"searchRetryBackoffMS":          SetSearchRetryBackoff,
+	"searchRetryMaxBackoffMS":       SetSearchRetryMaxBackoff,
+	"searchRetryMaxTimeMS":          SetSearchRetryMaxTime,
+	"slowQueryFirstByteThresholdMS": SetSlowQueryFirstByteThreshold,
+	"slowQueryDurationThresholdMS":  SetSlowQueryDurationThreshold,
+}
+
+// stringConfigs are the config keys of the string knobs, with their
+// setters.
+var stringConfigs = map[string]func(string){
+	"grpcTLSServerName":    SetGrpcTLSServerName,
+	searchRoutingPolicyKey: SetSearchRoutingPolicy,
+	"casStoredField":       SetCASStoredField,
+}
 
 const metakvMetaDir = "/fts/cbgt/cfg/"
 
@@ -215,6 +284,69 @@ func (c *n1ftyConfig) validateConfig(conf map[string]interface{}) errors.Error {
 		}
 	}
 
+	if v, ok := conf[maxConcurrentSearchesKey]; ok {
+		if max, ok1 := v.(int64); !ok1 || max < 0 {
+			err := fmt.Errorf("n1fty Invalid Config.. key: %v, val: %v",
+				maxConcurrentSearchesKey, v)
+			return util.N1QLError(err, err.Error())
+		}
+	}
+
+	if v, ok := conf[searchRoutingPolicyKey]; ok &&
+		v != RoutingRandom && v != RoutingSticky {
+		err := fmt.Errorf("n1fty Invalid Config.. key: %v, val: %v",
+			searchRoutingPolicyKey, v)
+		return util.N1QLError(err, err.Error())
+	}
+
+	if v, ok := conf[searchRetryJitterKey]; ok {
+		if jitter, ok1 := v.(float64); !ok1 || jitter < 0 || jitter > 1 {
+			err := fmt.Errorf("n1fty Invalid Config.. key: %v, val: %v",
+				searchRetryJitterKey, v)
+			return util.N1QLError(err, err.Error())
+		}
+	}
+
+	for key := range flagConfigs {
+		if v, ok := conf[key]; ok {
+			if _, ok1 := v.(bool); !ok1 {
+				err := fmt.Errorf("n1fty Invalid Config.. key: %v, val: %v",
+					key, v)
+				return util.N1QLError(err, err.Error())
+			}
+		}
+	}
+
+	for key, ic := range intConfigs {
+		if v, ok := conf[key]; ok {
+			if n, ok1 := v.(int64); !ok1 || n < ic.min {
+				err := fmt.Errorf("n1fty Invalid Config.. key: %v, val: %v",
+					key, v)
+				return util.N1QLError(err, err.Error())
+			}
+		}
+	}
+
+	for key := range durationConfigs {
+		if v, ok := conf[key]; ok {
+			if ms, ok1 := v.(int64); !ok1 || ms < 0 {
+				err := fmt.Errorf("n1fty Invalid Config.. key: %v, val: %v",
+					key, v)
+				return util.N1QLError(err, err.Error())
+			}
+		}
+	}
+
+	for key := range stringConfigs {
+		if v, ok := conf[key]; ok {
+			if _, ok1 := v.(string); !ok1 {
+				err := fmt.Errorf("n1fty Invalid Config.. key: %v, val: %v",
+					key, v)
+				return util.N1QLError(err, err.Error())
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -224,6 +356,38 @@ func (c *n1ftyConfig) processConfig(conf map[string]interface{}) {
 
 	if conf != nil {
 		newdir, _ = conf[backfillSpaceDir]
+
+		if v, ok := conf[maxConcurrentSearchesKey]; ok {
+			SetMaxConcurrentSearches(v.(int64))
+		}
+
+		if v, ok := conf[searchRetryJitterKey]; ok {
+			SetSearchRetryJitter(v.(float64))
+		}
+
+		for key, set := range flagConfigs {
+			if v, ok := conf[key]; ok {
+				set(v.(bool))
+			}
+		}
+
+		for key, ic := range intConfigs {
+			if v, ok := conf[key]; ok {
+				ic.set(v.(int64))
+			}
+		}
+
+		for key, set := range durationConfigs {
+			if v, ok := conf[key]; ok {
+				set(time.Duration(v.(int64)) * time.Millisecond)
+			}
+		}
+
+		for key, set := range stringConfigs {
+			if v, ok := conf[key]; ok {
+				set(v.(string))
+			}
+		}
 	}
 
 	prevconf := clientConfig.GetConfig()
@@ -281,6 +445,20 @@ func (c *n1ftyConfig) GetConfig() map[string]interface{} {
 	return nil
 }
 
+// loadFlag and storeFlag read and set a bool knob (held as an int32)
+// atomically, as the config may change it while searches read it.
+func loadFlag(flag *int32) bool {
+	return atomic.LoadInt32(flag) != 0
+}
+
+func storeFlag(flag *int32, v bool) {
+	var rv int32
+	if v {
+		rv = 1
+	}
+	atomic.StoreInt32(flag, rv)
+}
+
 func getDefaultTmpDir() string {
 	file, err := ioutil.TempFile("", backfillPrefix)
 	if err != nil {
@@ -13,8 +13,10 @@ package n1fty
 
 import (
 	"github.com/couchbase/cbgt"
+	"github.com/couchbase/n1fty/util"
 	"github.com/couchbase/query/errors"
 	"testing"
+	"time"
 )
 
 var tconfig *ftsConfig
@@ -340,3 +342,59 @@ func TestRemoveNodeDefs(t *testing.T) {
 	}
 	cleanConfig()
 }
+
+func TestConfigKnobs(t *testing.T) {
+	defer SetMaxConcurrentSearches(GetMaxConcurrentSearches())
+	defer SetStrictHitDecoding(GetStrictHitDecoding())
+	defer util.SetIndexHintCaseInsensitive(util.GetIndexHintCaseInsensitive())
+	defer SetDeepPagingMaxPages(GetDeepPagingMaxPages())
+	defer SetEntrySendTimeout(GetEntrySendTimeout())
+	defer SetSearchRoutingPolicy(GetSearchRoutingPolicy())
+	defer SetSearchRetryJitter(GetSearchRetryJitter())
+	defer util.SetMaxQueryDepth(util.GetMaxQueryDepth())
+
+	conf := &n1ftyConfig{}
+	err := conf.SetConfig(map[string]interface{}{
+		"maxConcurrentSearches":    int64(8),
+		"strictHitDecoding":        false,
+		"indexHintCaseInsensitive": true,
+		"deepPagingMaxPages":       int64(10),
+		"entrySendTimeoutMS":       int64(250),
+		"searchRoutingPolicy":      RoutingSticky,
+		"searchRetryJitter":        0.25,
+		"maxQueryDepth":            int64(20),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if GetMaxConcurrentSearches() != 8 || GetStrictHitDecoding() ||
+		!util.GetIndexHintCaseInsensitive() ||
+		GetDeepPagingMaxPages() != 10 ||
+		GetEntrySendTimeout() != 250*time.Millisecond ||
+		GetSearchRoutingPolicy() != RoutingSticky ||
+		GetSearchRetryJitter() != 0.25 || util.GetMaxQueryDepth() != 20 {
+		t.Fatalf("Expected the knobs set by the config")
+	}
+
+	if err = conf.SetParam("strictHitDecoding", true); err != nil ||
+		!GetStrictHitDecoding() {
+		t.Fatalf("Expected the knob set by the param, err: %v", err)
+	}
+
+	for key, v := range map[string]interface{}{
+		"maxConcurrentSearches": int64(-1),
+		"strictQueryTypes":      "true",
+		"statsByKeyspace":       int64(1),
+		"deepPagingMaxPages":    int64(-1),
+		"maxQueryDepth":         int64(0),
+		"entrySendTimeoutMS":    "1s",
+		"searchRoutingPolicy":   "closest",
+		"grpcTLSServerName":     int64(1),
+		"searchRetryJitter":     1.5,
+	} {
+		if err = conf.SetParam(key, v); err == nil {
+			t.Fatalf("Expected an error for key: %s, val: %v", key, v)
+		}
+	}
+}
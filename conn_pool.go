@@ -0,0 +1,313 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	pb "github.com/couchbase/cbft/protobuf"
+	"github.com/couchbase/query/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+// grpcMaxStreamsPerConn is the number of concurrent searches (gRPC streams)
+// a connection to an FTS node carries, past which another connection is
+// set up (up to DefaultConnPoolSize per node), or else the search waits for
+// a stream to be freed; it's to be within the FTS nodes' HTTP/2 max
+// concurrent streams; as set by the "grpcMaxStreamsPerConn" config
+var grpcMaxStreamsPerConn = int64(100)
+
+func GetGrpcMaxStreamsPerConn() int64 {
+	return atomic.LoadInt64(&grpcMaxStreamsPerConn)
+}
+
+func SetGrpcMaxStreamsPerConn(v int64) {
+	atomic.StoreInt64(&grpcMaxStreamsPerConn, v)
+}
+
+// newSearchServiceClient returns the client the searches are sent with
+// over the connection, substituted in tests.
+var newSearchServiceClient = pb.NewSearchServiceClient
+
+// connPool is the pool of the gRPC connections to an FTS node, set up
+// lazily (as the concurrent searches need them) up to DefaultConnPoolSize,
+// with the searches assigned to the connections round-robin, each carrying
+// up to grpcMaxStreamsPerConn of them. A connection that's shut down, or
+// failed while carrying no searches, is recycled, i.e. closed and replaced
+// by the next search needing one.
+type connPool struct {
+	hostPort string
+	dial     func() (*grpc.ClientConn, error)
+	recycled *int64 // the stat of the connections recycled, if any
+
+	m      sync.Mutex
+	conns  []*pooledConn
+	next   int           // the connection the next search is tried on
+	freed  chan struct{} // closed (and replaced) as a stream is freed
+	closed bool
+}
+
+type pooledConn struct {
+	conn    *grpc.ClientConn
+	streams int
+}
+
+func newConnPool(hostPort string, dial func() (*grpc.ClientConn, error),
+	recycled *int64) *connPool {
+	return &connPool{
+		hostPort: hostPort,
+		dial:     dial,
+		recycled: recycled,
+		freed:    make(chan struct{}),
+	}
+}
+
+// init sets up the first connection, for the node's reachability to be
+// known (see up()) ahead of the searches.
+func (p *connPool) init() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	conn, err := p.dial()
+	if err != nil {
+		return err
+	}
+	logging.Infof("client: grpc client connection #%d created for host: %v",
+		len(p.conns), p.hostPort)
+	p.conns = append(p.conns, &pooledConn{conn: conn})
+
+	return nil
+}
+
+// acquire returns the connection the search is to be carried over, with
+// a stream of it taken, waiting for one to be freed should all of them be
+// taken, until the context's done.
+func (p *connPool) acquire(ctx context.Context) (*pooledConn, error) {
+	for {
+		p.m.Lock()
+		pc, err := p.pickLOCKED()
+		freed := p.freed
+		p.m.Unlock()
+
+		if pc != nil || err != nil {
+			return pc, err
+		}
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (p *connPool) pickLOCKED() (*pooledConn, error) {
+	if p.closed {
+		return nil, fmt.Errorf("client: connection pool closed, host: %s",
+			p.hostPort)
+	}
+
+	p.recycleLOCKED()
+
+	maxStreams := int(GetGrpcMaxStreamsPerConn())
+	if maxStreams <= 0 {
+		maxStreams = 1
+	}
+
+	for k := 0; k < len(p.conns); k++ {
+		x := (p.next + k) % len(p.conns)
+		if pc := p.conns[x]; pc.streams < maxStreams {
+			p.next = x + 1
+			pc.streams++
+			return pc, nil
+		}
+	}
+
+	if len(p.conns) >= DefaultConnPoolSize && len(p.conns) > 0 {
+		return nil, nil // all of the streams are taken
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		return nil, fmt.Errorf("client: grpc.Dial for host: %s, err: %v",
+			p.hostPort, err)
+	}
+	logging.Infof("client: grpc client connection #%d created for host: %v",
+		len(p.conns), p.hostPort)
+
+	pc := &pooledConn{conn: conn, streams: 1}
+	p.conns = append(p.conns, pc)
+	p.next = len(p.conns)
+
+	return pc, nil
+}
+
+// recycleLOCKED closes and drops the connections that are shut down, or
+// have failed while carrying no searches, for others to be set up in their
+// place; the searches over a connection dropped free their streams still.
+func (p *connPool) recycleLOCKED() {
+	conns := p.conns[:0]
+	for _, pc := range p.conns {
+		state := pc.conn.GetState()
+		if state == connectivity.Shutdown ||
+			(state == connectivity.TransientFailure && pc.streams == 0) {
+			pc.conn.Close()
+			if p.recycled != nil {
+				atomic.AddInt64(p.recycled, 1)
+			}
+			logging.Infof("client: grpc client connection recycled for"+
+				" host: %v, state: %v", p.hostPort, state)
+			continue
+		}
+		conns = append(conns, pc)
+	}
+
+	for x := len(conns); x < len(p.conns); x++ {
+		p.conns[x] = nil
+	}
+	p.conns = conns
+}
+
+// release frees the stream of the connection taken by acquire(..).
+func (p *connPool) release(pc *pooledConn) {
+	p.m.Lock()
+	pc.streams--
+	close(p.freed)
+	p.freed = make(chan struct{})
+	p.m.Unlock()
+}
+
+// up returns true unless all the connections have failed or are shut down,
+// those yet to be set up not known to fail.
+func (p *connPool) up() bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if len(p.conns) == 0 {
+		return true
+	}
+
+	for _, pc := range p.conns {
+		state := pc.conn.GetState()
+		if state != connectivity.TransientFailure &&
+			state != connectivity.Shutdown {
+			return true
+		}
+	}
+
+	return false
+}
+
+// connections returns the connections set up so far.
+func (p *connPool) connections() []*grpc.ClientConn {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	rv := make([]*grpc.ClientConn, 0, len(p.conns))
+	for _, pc := range p.conns {
+		rv = append(rv, pc.conn)
+	}
+
+	return rv
+}
+
+// utilization returns the number of connections set up, and that of the
+// streams taken (the searches in flight) over them.
+func (p *connPool) utilization() (conns, streams int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	for _, pc := range p.conns {
+		streams += pc.streams
+	}
+
+	return len(p.conns), streams
+}
+
+func (p *connPool) Close() {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	for _, pc := range p.conns {
+		pc.conn.Close()
+	}
+	p.conns = nil
+	p.closed = true
+}
+
+// -----------------------------------------------------------------------------
+
+// pooledClient is the client to an FTS node, whose searches are each
+// carried by a stream over a connection of the node's pool, freed once
+// the search ends (or its context's done).
+type pooledClient struct {
+	pool *connPool
+}
+
+func (c *pooledClient) Search(ctx context.Context, in *pb.SearchRequest,
+	opts ...grpc.CallOption) (pb.SearchService_SearchClient, error) {
+	pc, err := c.pool.acquire(ctx)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, status.Error(codes.DeadlineExceeded, err.Error())
+		} else if ctx.Err() != nil {
+			return nil, status.Error(codes.Canceled, err.Error())
+		}
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			c.pool.release(pc)
+		})
+	}
+
+	stream, err := newSearchServiceClient(pc.conn).Search(ctx, in, opts...)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	// a search abandoned (with its stream yet to end) frees its stream
+	// once canceled.
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+			release()
+		}()
+	}
+
+	return &pooledStream{SearchService_SearchClient: stream,
+		release: release}, nil
+}
+
+// pooledStream frees the stream of its connection once the search ends.
+type pooledStream struct {
+	pb.SearchService_SearchClient
+	release func()
+}
+
+func (s *pooledStream) Recv() (*pb.StreamSearchResults, error) {
+	results, err := s.SearchService_SearchClient.Recv()
+	if err != nil {
+		s.release()
+	}
+
+	return results, err
+}
@@ -0,0 +1,182 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/couchbase/cbft/protobuf"
+	"google.golang.org/grpc"
+)
+
+// streamCounter tracks the searches in flight over each connection, along
+// with the most there were at once.
+type streamCounter struct {
+	m         sync.Mutex
+	active    map[*grpc.ClientConn]int
+	maxActive int
+}
+
+func TestConnPoolConcurrentSearches(t *testing.T) {
+	defer SetGrpcMaxStreamsPerConn(GetGrpcMaxStreamsPerConn())
+	defer func(poolSize int) {
+		DefaultConnPoolSize = poolSize
+		newSearchServiceClient = pb.NewSearchServiceClient
+	}(DefaultConnPoolSize)
+
+	SetGrpcMaxStreamsPerConn(2)
+	DefaultConnPoolSize = 3
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	go server.Serve(listener)
+	defer server.Stop()
+
+	counter := &streamCounter{active: map[*grpc.ClientConn]int{}}
+	newSearchServiceClient = func(
+		conn *grpc.ClientConn) pb.SearchServiceClient {
+		return &fakeSearchClient{newStream: func(
+			ctx context.Context) pb.SearchService_SearchClient {
+			counter.m.Lock()
+			counter.active[conn]++
+			if n := counter.active[conn]; n > counter.maxActive {
+				counter.maxActive = n
+			}
+			counter.m.Unlock()
+
+			// ends (after a while) with the search no longer counted.
+			return &fakeStream{delay: 5 * time.Millisecond, onEnd: func() {
+				counter.m.Lock()
+				counter.active[conn]--
+				counter.m.Unlock()
+			}}
+		}}
+	}
+
+	var recycled int64
+	hostPort := listener.Addr().String()
+	pool := newConnPool(hostPort, func() (*grpc.ClientConn, error) {
+		return grpc.Dial(hostPort, grpc.WithInsecure())
+	}, &recycled)
+	defer pool.Close()
+
+	if err = pool.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &pooledClient{pool: pool}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 50)
+	for k := 0; k < 50; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(),
+				5*time.Second)
+			defer cancel()
+
+			stream, err := client.Search(ctx, &pb.SearchRequest{})
+			if err != nil {
+				errCh <- err
+				return
+			}
+			for {
+				if _, err = stream.Recv(); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	// the pool grew to its size, with no connection carrying more than
+	// its streams.
+	conns, streams := pool.utilization()
+	if conns != 3 || streams != 0 {
+		t.Fatalf("Expected 3 connections with no streams taken, got: %d,"+
+			" streams: %d", conns, streams)
+	}
+
+	if len(counter.active) != 3 ||
+		int64(counter.maxActive) > GetGrpcMaxStreamsPerConn() {
+		t.Fatalf("Expected the searches over 3 connections, at most %d at"+
+			" once over each, got: %d, %d", GetGrpcMaxStreamsPerConn(),
+			len(counter.active), counter.maxActive)
+	}
+
+	// a search abandoned frees its stream once canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err = client.Search(ctx, &pb.SearchRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	for k := 0; k < 100; k++ {
+		if _, streams = pool.utilization(); streams == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if streams != 0 {
+		t.Fatalf("Expected the abandoned search's stream freed, got: %d",
+			streams)
+	}
+
+	// with all of the streams taken, a search waits until its deadline.
+	var held []*pooledConn
+	for k := 0; k < 6; k++ {
+		pc, err := pool.acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, pc)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(),
+		20*time.Millisecond)
+	defer cancel()
+	if _, err = client.Search(ctx, &pb.SearchRequest{}); err == nil {
+		t.Fatalf("Expected the search to time out waiting for a stream")
+	}
+
+	for _, pc := range held {
+		pool.release(pc)
+	}
+
+	// a connection that's shut down is recycled, and replaced.
+	pool.connections()[0].Close()
+	pc, err := pool.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.release(pc)
+
+	if conns, _ = pool.utilization(); conns != 2 || recycled != 1 {
+		t.Fatalf("Expected a connection recycled, got: %d, recycled: %d",
+			conns, recycled)
+	}
+}
@@ -0,0 +1,260 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/buger/jsonparser"
+	"github.com/couchbase/cbft"
+	pb "github.com/couchbase/cbft/protobuf"
+	"github.com/couchbase/n1fty/util"
+	"github.com/couchbase/query/datastore"
+	"github.com/couchbase/query/errors"
+	"github.com/couchbase/query/timestamp"
+)
+
+// deepPagingMaxPages bounds the searches made paging through the hits
+// (see FTSIndex.pageThrough(..)), the search failing past those, so that
+// one without a limit doesn't page through the entire result set; 0
+// leaves them unbounded; as set by the "deepPagingMaxPages" config
+var deepPagingMaxPages = int64(100)
+
+func GetDeepPagingMaxPages() int64 {
+	return atomic.LoadInt64(&deepPagingMaxPages)
+}
+
+func SetDeepPagingMaxPages(v int64) {
+	atomic.StoreInt64(&deepPagingMaxPages, v)
+}
+
+// deepPagingMaxHeldBytes bounds the bytes of the hits held paging before a
+// cursor (until the last search, to be sent in order), the search failing
+// past those; 0 leaves them unbounded; as set by the
+// "deepPagingMaxHeldBytes" config
+var deepPagingMaxHeldBytes = int64(16 * 1024 * 1024) // 16 MB
+
+func GetDeepPagingMaxHeldBytes() int64 {
+	return atomic.LoadInt64(&deepPagingMaxHeldBytes)
+}
+
+func SetDeepPagingMaxHeldBytes(v int64) {
+	atomic.StoreInt64(&deepPagingMaxHeldBytes, v)
+}
+
+// fetchFunc issues the search request to FTS, returning the hits (the JSON
+// arrays of them, as received) along with the status of the search, see
+// FTSIndex.fetchHits(..).
+type fetchFunc func(ctx context.Context,
+	searchReq *pb.SearchRequest) ([][]byte, []byte, error)
+
+// pageThrough performs a search whose offset+limit exceeds the max result
+// window, or that pages from a cursor (see SearchOptions.SearchAfter), as
+// successive searches of up to a window of hits each, every one resuming
+// after the last hit of the previous (with search_after). The sort is made
+// deterministic with the document ID as the tie breaker, so the hits keep
+// to the global order; a hit repeated at the boundary of two pages is
+// skipped. The first offset hits are skipped over, and those that follow
+// sent (in order) up to the limit. Paging before a cursor, the searches
+// resume before the first hit of the previous (with search_before), with
+// the offset skipping over the hits nearest the cursor, and the hits held
+// until the last search, to be sent in order. The searches made, and the
+// bytes of the hits held, are bounded by deepPagingMaxPages and
+// deepPagingMaxHeldBytes.
+func (i *FTSIndex) pageThrough(ctx context.Context, fetch fetchFunc,
+	sr *cbft.SearchRequest, searchInfo *datastore.FTSSearchInfo,
+	vector timestamp.Vector, cons datastore.ScanConsistency, timeoutMS int64,
+	rh *responseHandler, conn searchConn) errors.Error {
+	if len(sr.Facets) > 0 {
+		return util.N1QLError(nil, "paging: facets unsupported")
+	}
+
+	base := util.CopySearchRequest(sr)
+	base.From, base.Size, base.Offset, base.Limit = nil, nil, nil, nil
+	base.SearchAfter, base.SearchBefore = nil, nil
+
+	var err error
+	if len(base.Sort) == 0 && len(searchInfo.Order) > 0 {
+		base.Sort, err = util.SortFromOrder(searchInfo.Order)
+		if err != nil {
+			return util.N1QLError(err, "paging: sort err")
+		}
+	}
+
+	var appended bool
+	base.Sort, appended, err = util.DeterministicSort(base.Sort)
+	if err != nil {
+		return util.N1QLError(err, fmt.Sprintf("paging: %v", err))
+	}
+	if appended {
+		// the tie breaker's value isn't carried within the hits' metadata.
+		rh.trimSortValues = 1
+	}
+
+	cursor, backward := sr.SearchAfter, false
+	if sr.SearchBefore != nil {
+		cursor, backward = sr.SearchBefore, true
+	}
+	if cursor != nil && len(cursor) != len(base.Sort) {
+		return util.N1QLError(nil, fmt.Sprintf("paging: cursor of %d sort"+
+			" values, for a sort by %d", len(cursor), len(base.Sort)))
+	}
+
+	window := util.GetBleveMaxResultWindow()
+	skip, remaining := searchInfo.Offset, searchInfo.Limit
+	if skip < 0 {
+		skip = 0
+	}
+
+	pageInfo := &datastore.FTSSearchInfo{Query: searchInfo.Query}
+	maxPages := GetDeepPagingMaxPages()
+	maxHeldBytes := GetDeepPagingMaxHeldBytes()
+
+	var held [][]byte // paging backward, the hits to send (in reverse)
+	var heldBytes int64
+	var lastID string
+	for pages := int64(0); remaining > 0; pages++ {
+		if maxPages > 0 && pages >= maxPages {
+			return util.N1QLError(nil, fmt.Sprintf("paging: exceeds %d"+
+				" pages of %d hits, the search needs a lower offset+limit",
+				maxPages, window))
+		}
+
+		size := window
+		if remaining < size && skip < size-remaining {
+			size = skip + remaining
+		}
+
+		page := util.CopySearchRequest(base)
+		from, n := 0, int(size)
+		page.From, page.Size = &from, &n
+		if backward {
+			page.SearchBefore = cursor
+		} else {
+			page.SearchAfter = cursor
+		}
+		pageInfo.Limit = size
+
+		searchReq, err := util.BuildProtoSearchRequest(page, pageInfo, vector,
+			cons, i.identity())
+		if err != nil {
+			return util.N1QLError(err, "search request parse err")
+		}
+		searchReq.Stream = false
+
+		if err = util.SetQueryCtlTimeout(searchReq, timeoutMS); err != nil {
+			return util.N1QLError(err, "search request ctl params err")
+		}
+
+		hits, searchStatus, err := fetch(ctx, searchReq)
+		if err != nil {
+			return util.GrpcN1QLError(err, grpcErrDesc(err,
+				"paging: search failed"))
+		}
+
+		// the pages that follow resume after the last hit, so a partial
+		// page would have hits go missing.
+		if err = partialResultsErr(searchStatus); err != nil {
+			return util.N1QLError(err, "paging: err")
+		}
+
+		var pageHits [][]byte
+		for _, arr := range hits {
+			_, err = jsonparser.ArrayEach(arr, func(hit []byte,
+				dataType jsonparser.ValueType, offset int, err error) {
+				pageHits = append(pageHits, hit)
+			})
+			if err != nil {
+				return util.N1QLError(err, "paging: hits err")
+			}
+		}
+
+		// paging backward, the hits (in order) nearest the cursor are last.
+		if backward {
+			for x, y := 0, len(pageHits)-1; x < y; x, y = x+1, y-1 {
+				pageHits[x], pageHits[y] = pageHits[y], pageHits[x]
+			}
+		}
+
+		var send bytes.Buffer
+		for _, hit := range pageHits {
+			id, _ := jsonparser.GetString(hit, "id")
+			if id == lastID && cursor != nil {
+				continue // the boundary hit, already seen
+			}
+
+			cursor, lastID = hitSortValues(hit), id
+
+			if skip > 0 {
+				skip--
+				continue
+			}
+
+			if remaining > 0 {
+				if backward {
+					heldBytes += int64(len(hit))
+					if maxHeldBytes > 0 && heldBytes > maxHeldBytes {
+						return util.N1QLError(nil, fmt.Sprintf("paging: the"+
+							" hits before the cursor exceed %d bytes, the"+
+							" search needs a lower limit", maxHeldBytes))
+					}
+					held = append(held, hit)
+				} else {
+					if send.Len() > 0 {
+						send.WriteByte(',')
+					}
+					send.Write(hit)
+				}
+				remaining--
+			}
+		}
+
+		if send.Len() > 0 {
+			if !rh.sendEntries([]byte("["+send.String()+"]"), conn) {
+				return nil // reported by the response handler, if at all
+			}
+		}
+
+		if int64(len(pageHits)) < size || len(cursor) == 0 {
+			break // no more hits
+		}
+	}
+
+	if len(held) > 0 {
+		var send bytes.Buffer
+		for x := len(held) - 1; x >= 0; x-- {
+			if send.Len() > 0 {
+				send.WriteByte(',')
+			}
+			send.Write(held[x])
+		}
+		rh.sendEntries([]byte("["+send.String()+"]"), conn)
+	}
+
+	return nil
+}
+
+// hitSortValues returns the values the hit is sorted by, as reported.
+func hitSortValues(hit []byte) []string {
+	var rv []string
+	jsonparser.ArrayEach(hit, func(v []byte, dataType jsonparser.ValueType,
+		offset int, err error) {
+		if s, err := jsonparser.ParseString(v); err == nil {
+			rv = append(rv, s)
+		}
+	}, "sort")
+
+	return rv
+}
@@ -0,0 +1,558 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/couchbase/cbft"
+	pb "github.com/couchbase/cbft/protobuf"
+	"github.com/couchbase/n1fty/util"
+	"github.com/couchbase/query/datastore"
+	"github.com/couchbase/query/errors"
+	"github.com/couchbase/query/expression"
+	"github.com/couchbase/query/value"
+)
+
+// bleveFetch serves the search requests off the bleve index, counting them.
+func bleveFetch(idx bleve.Index, searches *int) fetchFunc {
+	return func(ctx context.Context,
+		searchReq *pb.SearchRequest) ([][]byte, []byte, error) {
+		*searches++
+
+		var sr *cbft.SearchRequest
+		if err := json.Unmarshal(searchReq.Contents, &sr); err != nil {
+			return nil, nil, err
+		}
+
+		bsr, err := sr.ConvertToBleveSearchRequest()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		res, err := idx.Search(bsr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		hits, err := json.Marshal(res.Hits)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return [][]byte{hits}, []byte(`{"total":1,"failed":0,"successful":1}`),
+			nil
+	}
+}
+
+// newShirtsIndex returns a bleve index of 10 shirts of 3 colors, along
+// with a func returning the IDs of those sorted by color (descending) and
+// ID, within the offset and limit.
+func newShirtsIndex(t *testing.T) (bleve.Index,
+	func(offset, limit int) []string) {
+	idx, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the colors tie, for the document ID to break.
+	colors := []string{"red", "green", "blue"}
+	for k := 0; k < 10; k++ {
+		err = idx.Index(fmt.Sprintf("doc-%02d", k), map[string]interface{}{
+			"color": colors[k%len(colors)],
+			"kind":  "shirt",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sortedIDs := func(offset, limit int) []string {
+		bsr := bleve.NewSearchRequestOptions(bleve.NewMatchQuery("shirt"),
+			limit, offset, false)
+		bsr.SortBy([]string{"-color", "_id"})
+		res, err := idx.Search(bsr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var rv []string
+		for _, hit := range res.Hits {
+			rv = append(rv, hit.ID)
+		}
+		return rv
+	}
+
+	return idx, sortedIDs
+}
+
+func TestPageThrough(t *testing.T) {
+	defer util.SetBleveMaxResultWindow(util.GetBleveMaxResultWindow())
+	util.SetBleveMaxResultWindow(3)
+
+	idx, sortedIDs := newShirtsIndex(t)
+	defer idx.Close()
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	tests := []struct {
+		offset, limit int64
+		searches      int
+	}{
+		{offset: 2, limit: 7, searches: 3},
+		{offset: 0, limit: 10, searches: 4},
+		{offset: 4, limit: 20, searches: 4}, // past the hits available
+		{offset: 9, limit: 5, searches: 4},
+	}
+
+	for _, test := range tests {
+		sr, _, err := util.BuildSearchRequest("", value.NewValue(
+			map[string]interface{}{
+				"query": map[string]interface{}{"match": "shirt", "field": "kind"},
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		searchInfo := &datastore.FTSSearchInfo{
+			Query:  value.NewValue(map[string]interface{}{}),
+			Order:  []string{"color DESC"},
+			Offset: test.offset,
+			Limit:  test.limit,
+		}
+
+		rh := newResponseHandler(index, "req", sr, nil)
+		sender := &chanSender{ch: make(chan *datastore.IndexEntry, 20)}
+		conn := &testConn{sender: sender}
+
+		var searches int
+		n1qlErr := index.pageThrough(context.Background(),
+			bleveFetch(idx, &searches), sr, searchInfo, nil,
+			datastore.UNBOUNDED, 1000, rh, conn)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+		sender.Close()
+
+		var got []string
+		for entry := range sender.ch {
+			got = append(got, entry.PrimaryKey)
+		}
+
+		expect := sortedIDs(int(test.offset), int(test.limit))
+		if !reflect.DeepEqual(expect, got) {
+			t.Fatalf("[%d, %d] Expected the hits in order: %v, got: %v",
+				test.offset, test.limit, expect, got)
+		}
+
+		if searches != test.searches {
+			t.Fatalf("[%d, %d] Expected %d searches, got: %d", test.offset,
+				test.limit, test.searches, searches)
+		}
+	}
+
+	// a sort by score can't be resumed after a hit.
+	sr, _, err := util.BuildSearchRequest("", value.NewValue(
+		map[string]interface{}{
+			"query": map[string]interface{}{"match": "shirt", "field": "kind"},
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var searches int
+	n1qlErr := index.pageThrough(context.Background(),
+		bleveFetch(idx, &searches), sr, &datastore.FTSSearchInfo{
+			Order: []string{"score DESC"}, Limit: 5},
+		nil, datastore.UNBOUNDED, 1000, newResponseHandler(index, "req", sr, nil),
+		&testConn{sender: &chanSender{ch: make(chan *datastore.IndexEntry, 5)}})
+	if n1qlErr == nil || searches != 0 {
+		t.Fatalf("Expected an error for a sort by score, got: %v", n1qlErr)
+	}
+}
+
+func TestPageThroughCursor(t *testing.T) {
+	defer util.SetBleveMaxResultWindow(util.GetBleveMaxResultWindow())
+	util.SetBleveMaxResultWindow(3)
+
+	idx, sortedIDs := newShirtsIndex(t)
+	defer idx.Close()
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	// page returns the IDs of the hits paged from the cursor, along with
+	// their cursors.
+	page := func(options map[string]interface{}, offset,
+		limit int64) ([]string, [][]string) {
+		opts, err := util.ParseSearchOptions(value.NewValue(options))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sr, _, err := util.BuildSearchRequest("", value.NewValue(
+			map[string]interface{}{
+				"query": map[string]interface{}{"match": "shirt", "field": "kind"},
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sr = util.CursorInSearchRequest(sr, opts.SearchAfter,
+			opts.SearchBefore)
+
+		searchInfo := &datastore.FTSSearchInfo{
+			Query:  value.NewValue(map[string]interface{}{}),
+			Order:  []string{"color DESC"},
+			Offset: offset,
+			Limit:  limit,
+		}
+
+		rh := newResponseHandler(index, "req", sr, opts)
+		sender := &chanSender{ch: make(chan *datastore.IndexEntry, 20)}
+
+		var searches int
+		n1qlErr := index.pageThrough(context.Background(),
+			bleveFetch(idx, &searches), sr, searchInfo, nil,
+			datastore.UNBOUNDED, 1000, rh, &testConn{sender: sender})
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+		sender.Close()
+
+		var ids []string
+		var cursors [][]string
+		for entry := range sender.ch {
+			ids = append(ids, entry.PrimaryKey)
+
+			cursor, ok := entry.MetaData.Field("cursor")
+			if !ok {
+				t.Fatalf("Expected the cursor of hit: %s, got: %v",
+					entry.PrimaryKey, entry.MetaData)
+			}
+
+			var vals []string
+			for _, v := range cursor.Actual().([]interface{}) {
+				vals = append(vals, v.(string))
+			}
+			cursors = append(cursors, vals)
+		}
+
+		return ids, cursors
+	}
+
+	cursorOpts := func(option string, cursor []string) map[string]interface{} {
+		vals := make([]interface{}, len(cursor))
+		for x, v := range cursor {
+			vals[x] = v
+		}
+		return map[string]interface{}{option: vals}
+	}
+
+	// forward, from the first page through to the last.
+	var got []string
+	cursor := []string{}
+	for pages := 0; ; pages++ {
+		ids, cursors := page(cursorOpts("search_after", cursor), 0, 4)
+		if len(ids) == 0 {
+			if pages != 3 {
+				t.Fatalf("Expected 3 pages, got: %d", pages)
+			}
+			break
+		}
+
+		got = append(got, ids...)
+		cursor = cursors[len(cursors)-1]
+	}
+
+	if expect := sortedIDs(0, 10); !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Expected the hits in order: %v, got: %v", expect, got)
+	}
+
+	// the cursor carries the tie breaker (the document ID).
+	if len(cursor) != 2 || cursor[1] != got[len(got)-1] {
+		t.Fatalf("Expected the cursor of the last hit, got: %v", cursor)
+	}
+
+	// backward, from the page before the last.
+	_, cursors := page(cursorOpts("search_after", []string{}), 0, 8)
+	ids, _ := page(cursorOpts("search_before", cursors[7]), 0, 4)
+	if expect := sortedIDs(3, 4); !reflect.DeepEqual(expect, ids) {
+		t.Fatalf("Expected the hits before the cursor: %v, got: %v",
+			expect, ids)
+	}
+
+	// the offset skips over the hits nearest the cursor, either way.
+	ids, _ = page(cursorOpts("search_before", cursors[7]), 2, 4)
+	if expect := sortedIDs(1, 4); !reflect.DeepEqual(expect, ids) {
+		t.Fatalf("Expected the hits before the cursor: %v, got: %v",
+			expect, ids)
+	}
+
+	ids, _ = page(cursorOpts("search_after", cursors[1]), 2, 4)
+	if expect := sortedIDs(4, 4); !reflect.DeepEqual(expect, ids) {
+		t.Fatalf("Expected the hits after the cursor: %v, got: %v",
+			expect, ids)
+	}
+
+	// past the first hit, there are none before.
+	ids, _ = page(cursorOpts("search_before", cursors[0]), 0, 4)
+	if len(ids) != 0 {
+		t.Fatalf("Expected no hits before the first, got: %v", ids)
+	}
+}
+
+func TestPageThroughBounds(t *testing.T) {
+	defer util.SetBleveMaxResultWindow(util.GetBleveMaxResultWindow())
+	util.SetBleveMaxResultWindow(3)
+
+	defer SetDeepPagingMaxPages(GetDeepPagingMaxPages())
+	defer SetDeepPagingMaxHeldBytes(GetDeepPagingMaxHeldBytes())
+
+	idx, _ := newShirtsIndex(t)
+	defer idx.Close()
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	// page pages through the hits after the first (or before the cursor,
+	// if any), returning those sent along with the searches made.
+	page := func(before []interface{}, limit int64) ([]*datastore.IndexEntry,
+		int, errors.Error) {
+		options := map[string]interface{}{"search_after": []interface{}{}}
+		if before != nil {
+			options = map[string]interface{}{"search_before": before}
+		}
+		opts, err := util.ParseSearchOptions(value.NewValue(options))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sr, _, err := util.BuildSearchRequest("", value.NewValue(
+			map[string]interface{}{
+				"query": map[string]interface{}{"match": "shirt", "field": "kind"},
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sr = util.CursorInSearchRequest(sr, opts.SearchAfter,
+			opts.SearchBefore)
+
+		searchInfo := &datastore.FTSSearchInfo{
+			Query: value.NewValue(map[string]interface{}{}),
+			Order: []string{"color DESC"},
+			Limit: limit,
+		}
+
+		sender := &chanSender{ch: make(chan *datastore.IndexEntry, 20)}
+
+		var searches int
+		n1qlErr := index.pageThrough(context.Background(),
+			bleveFetch(idx, &searches), sr, searchInfo, nil,
+			datastore.UNBOUNDED, 1000, newResponseHandler(index, "req", sr, opts),
+			&testConn{sender: sender})
+		sender.Close()
+
+		var entries []*datastore.IndexEntry
+		for entry := range sender.ch {
+			entries = append(entries, entry)
+		}
+
+		return entries, searches, n1qlErr
+	}
+
+	// without a limit, the searches stop at the max pages.
+	SetDeepPagingMaxPages(2)
+	_, searches, n1qlErr := page(nil, math.MaxInt64)
+	if n1qlErr == nil || searches != 2 {
+		t.Fatalf("Expected an error after 2 searches, got: %v, %d searches",
+			n1qlErr, searches)
+	}
+
+	SetDeepPagingMaxPages(0)
+	entries, _, n1qlErr := page(nil, math.MaxInt64)
+	if n1qlErr != nil || len(entries) != 10 {
+		t.Fatalf("Expected the 10 hits, got: %v, %d hits", n1qlErr,
+			len(entries))
+	}
+
+	cursor, ok := entries[len(entries)-1].MetaData.Field("cursor")
+	if !ok {
+		t.Fatalf("Expected the cursor of the last hit, got: %v",
+			entries[len(entries)-1].MetaData)
+	}
+	before := cursor.Actual().([]interface{})
+
+	// paging backward, the hits held stop at the max bytes.
+	SetDeepPagingMaxHeldBytes(64)
+	entries, _, n1qlErr = page(before, 9)
+	if n1qlErr == nil || len(entries) != 0 {
+		t.Fatalf("Expected an error holding the hits, got: %v, %d hits",
+			n1qlErr, len(entries))
+	}
+
+	SetDeepPagingMaxHeldBytes(0)
+	entries, _, n1qlErr = page(before, 9)
+	if n1qlErr != nil || len(entries) != 9 {
+		t.Fatalf("Expected the 9 hits before the cursor, got: %v, %d hits",
+			n1qlErr, len(entries))
+	}
+}
+
+func TestPageableWithDeepPaging(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := expression.NewConstant(map[string]interface{}{
+		"match": "paris", "field": "city"})
+	deepPaging := expression.NewConstant(map[string]interface{}{
+		"deep_paging": true})
+
+	offset := util.GetBleveMaxResultWindow()
+	if index.Pageable([]string{"city"}, offset, 10, query, nil) {
+		t.Fatalf("Expected not pageable past the window")
+	}
+
+	if !index.Pageable([]string{"city"}, offset, 10, query, deepPaging) {
+		t.Fatalf("Expected pageable past the window, with deep paging")
+	}
+
+	// the hits are paged through in the order given, so one's required.
+	if index.Pageable(nil, offset, 10, query, deepPaging) {
+		t.Fatalf("Expected not pageable without an order")
+	}
+
+	// paging from a cursor, there's no window to the offset+limit.
+	cursor := expression.NewConstant(map[string]interface{}{
+		"search_after": []interface{}{"paris", "doc-1"}})
+	if !index.Pageable([]string{"city"}, offset, 10, query, cursor) {
+		t.Fatalf("Expected pageable past the window, from a cursor")
+	}
+}
+
+// TestPageThroughKeyOrder pages through the hits of an index of several
+// pindexes, sorted by key (see SearchOptions.Sort), the pages each merging
+// the hits of all of the pindexes.
+func TestPageThroughKeyOrder(t *testing.T) {
+	defer util.SetBleveMaxResultWindow(util.GetBleveMaxResultWindow())
+	util.SetBleveMaxResultWindow(4)
+
+	// the documents are spread across the pindexes, out of key order.
+	alias := bleve.NewIndexAlias()
+	for p := 0; p < 3; p++ {
+		pindex, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pindex.Close()
+		alias.Add(pindex)
+
+		for k := p; k < 15; k += 3 {
+			err = pindex.Index(fmt.Sprintf("doc-%02d", (k*7)%15),
+				map[string]interface{}{"kind": "shirt"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	for _, keyOrder := range util.KeyOrders {
+		sr, _, err := util.BuildSearchRequest("", value.NewValue(
+			map[string]interface{}{
+				"query": map[string]interface{}{"match": "shirt", "field": "kind"},
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sr, err = util.SortInSearchRequest(sr, []string{keyOrder})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rh := newResponseHandler(index, "req", sr, nil)
+		sender := &chanSender{ch: make(chan *datastore.IndexEntry, 20)}
+		conn := &testConn{sender: sender}
+
+		var searches int
+		n1qlErr := index.pageThrough(context.Background(),
+			bleveFetch(alias, &searches), sr, &datastore.FTSSearchInfo{
+				Query: value.NewValue(map[string]interface{}{}),
+				Limit: 15,
+			}, nil, datastore.UNBOUNDED, 1000, rh, conn)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+		sender.Close()
+
+		var got []string
+		for entry := range sender.ch {
+			got = append(got, entry.PrimaryKey)
+		}
+
+		var expect []string
+		for k := 0; k < 15; k++ {
+			expect = append(expect, fmt.Sprintf("doc-%02d", k))
+		}
+		if keyOrder == "-_id" {
+			for x, y := 0, len(expect)-1; x < y; x, y = x+1, y-1 {
+				expect[x], expect[y] = expect[y], expect[x]
+			}
+		}
+
+		if !reflect.DeepEqual(expect, got) {
+			t.Fatalf("[%s] Expected the hits in key order: %v, got: %v",
+				keyOrder, expect, got)
+		}
+
+		if searches != 4 {
+			t.Fatalf("[%s] Expected 4 searches, got: %d", keyOrder, searches)
+		}
+	}
+
+	// the order pushed down must be that of the keys sorted by.
+	query := expression.NewConstant(map[string]interface{}{
+		"match": "shirt", "field": "kind"})
+	sortByID := expression.NewConstant(map[string]interface{}{
+		"deep_paging": true, "sort": []interface{}{"_id"}})
+	offset := util.GetBleveMaxResultWindow()
+	if !index.Pageable([]string{"id ASC"}, offset, 10, query, sortByID) {
+		t.Fatalf("Expected pageable in key order")
+	}
+
+	if index.Pageable([]string{"id DESC"}, offset, 10, query, sortByID) {
+		t.Fatalf("Expected not pageable in another order than the keys'")
+	}
+}
@@ -0,0 +1,262 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/couchbase/query/logging"
+)
+
+// distinctMemoryLimit is the memory (in bytes) a search request with the
+// "distinct" option may use towards tracking the primary keys it has
+// already sent, past which the keys are spilled to disk; as set by the
+// "distinctMemoryLimit" config
+var distinctMemoryLimit = int64(16 * 1024 * 1024) // 16 MB
+
+func GetDistinctMemoryLimit() int64 {
+	return atomic.LoadInt64(&distinctMemoryLimit)
+}
+
+func SetDistinctMemoryLimit(v int64) {
+	atomic.StoreInt64(&distinctMemoryLimit, v)
+}
+
+// collapseMemoryLimit is the memory (in bytes) a search request with the
+// "collapse" option may use towards tracking the groups of the hits it has
+// already sent, past which the groups are spilled to disk, as with the
+// distinctMemoryLimit (and distinctFailOnLimit); as set by the
+// "collapseMemoryLimit" config
+var collapseMemoryLimit = int64(16 * 1024 * 1024) // 16 MB
+
+func GetCollapseMemoryLimit() int64 {
+	return atomic.LoadInt64(&collapseMemoryLimit)
+}
+
+func SetCollapseMemoryLimit(v int64) {
+	atomic.StoreInt64(&collapseMemoryLimit, v)
+}
+
+// distinctFailOnLimit decides whether a search request fails once even the
+// spilled keys' digests exhaust the distinctMemoryLimit, or whether it
+// carries on (with a logged warning) without tracking further keys,
+// allowing for duplicates thereafter; as set by the "distinctFailOnLimit"
+// config
+var distinctFailOnLimit = int32(0)
+
+func GetDistinctFailOnLimit() bool {
+	return loadFlag(&distinctFailOnLimit)
+}
+
+func SetDistinctFailOnLimit(v bool) {
+	storeFlag(&distinctFailOnLimit, v)
+}
+
+// approximate memory held per tracked key and per spilled key digest
+// (along with the offset of the key within the spill file)
+const distinctKeyOverhead = 48
+const distinctDigestSize = 16
+
+// distinctKeys is the bounded set of primary keys sent so far by a
+// search request, used to suppress duplicates. The keys are held in
+// memory until the limit is reached, after which they're moved to a
+// file under the spill (backfill space) directory, with only their
+// digests retained in memory, each with the offset of the key spilled
+// under it (and of any others whose digests collide with it); a matching
+// digest is confirmed by reading just those keys back from the file.
+type distinctKeys struct {
+	m sync.Mutex
+
+	logPrefix string
+	spillDir  string
+	memLimit  int64
+	memUsed   int64
+	keys      map[string]struct{}
+
+	digests    map[uint64]int64   // digest -> offset of the spilled key
+	collisions map[uint64][]int64 // digest -> offsets of the keys after
+	spillFile  *os.File
+	spillSize  int64 // the offset the next key's spilled at
+
+	degraded bool
+}
+
+func newDistinctKeys(logPrefix, spillDir string,
+	memLimit int64) *distinctKeys {
+	return &distinctKeys{
+		logPrefix: logPrefix,
+		spillDir:  spillDir,
+		memLimit:  memLimit,
+		keys:      make(map[string]struct{}),
+	}
+}
+
+// seen returns true if the key was seen before, recording it otherwise.
+func (d *distinctKeys) seen(key string) (bool, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.spillFile == nil {
+		if _, exists := d.keys[key]; exists {
+			return true, nil
+		}
+
+		if d.memUsed+int64(len(key)+distinctKeyOverhead) <= d.memLimit {
+			d.keys[key] = struct{}{}
+			d.memUsed += int64(len(key) + distinctKeyOverhead)
+			return false, nil
+		}
+
+		if err := d.spill(); err != nil {
+			return false, err
+		}
+	}
+
+	digest := distinctDigest(key)
+	if offset, exists := d.digests[digest]; exists {
+		found, err := d.spilled(key,
+			append([]int64{offset}, d.collisions[digest]...))
+		if err != nil || found {
+			return found, err
+		}
+	} else if d.memUsed+distinctDigestSize > d.memLimit {
+		return false, d.exceeded()
+	}
+
+	return false, d.spillKey(digest, key)
+}
+
+// spill moves the keys held in memory over to the spill file.
+func (d *distinctKeys) spill() error {
+	prefix := backfillPrefix + "-distinct" + strconv.Itoa(os.Getpid())
+	f, err := ioutil.TempFile(d.spillDir, prefix)
+	if err != nil {
+		return fmt.Errorf("%v creating distinct keys file, err: %v",
+			d.logPrefix, err)
+	}
+
+	d.spillFile = f
+	d.spillSize = 0
+	d.digests = make(map[uint64]int64, len(d.keys))
+	d.memUsed = 0
+
+	for key := range d.keys {
+		if err = d.spillKey(distinctDigest(key), key); err != nil {
+			return err
+		}
+	}
+
+	logging.Infof("distinct: %v spilled %d keys to %v",
+		d.logPrefix, len(d.keys), f.Name())
+
+	d.keys = nil
+
+	return nil
+}
+
+// spillKey appends the key (length prefixed) to the spill file, recording
+// its offset under the digest.
+func (d *distinctKeys) spillKey(digest uint64, key string) error {
+	buf := make([]byte, 4+len(key))
+	binary.BigEndian.PutUint32(buf, uint32(len(key)))
+	copy(buf[4:], key)
+
+	if _, err := d.spillFile.Write(buf); err != nil {
+		return err
+	}
+
+	if _, exists := d.digests[digest]; exists {
+		if d.collisions == nil {
+			d.collisions = map[uint64][]int64{}
+		}
+		d.collisions[digest] = append(d.collisions[digest], d.spillSize)
+		d.memUsed += 8 // the offset
+	} else {
+		d.digests[digest] = d.spillSize
+		d.memUsed += distinctDigestSize
+	}
+	d.spillSize += int64(len(buf))
+
+	return nil
+}
+
+// spilled looks up the key within the spill file, amongst the keys at the
+// offsets (those spilled under its digest).
+func (d *distinctKeys) spilled(key string, offsets []int64) (bool, error) {
+	var lenBuf [4]byte
+	for _, offset := range offsets {
+		if _, err := d.spillFile.ReadAt(lenBuf[:], offset); err != nil {
+			return false, err
+		}
+
+		n := binary.BigEndian.Uint32(lenBuf[:])
+		if int(n) != len(key) {
+			continue
+		}
+
+		k := make([]byte, n)
+		if _, err := d.spillFile.ReadAt(k, offset+4); err != nil {
+			return false, err
+		}
+		if string(k) == key {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (d *distinctKeys) exceeded() error {
+	if GetDistinctFailOnLimit() {
+		return fmt.Errorf("%v distinct keys exceeded memory limit: %v",
+			d.logPrefix, d.memLimit)
+	}
+
+	if !d.degraded {
+		d.degraded = true
+		logging.Warnf("distinct: %v keys exceeded memory limit: %v,"+
+			" results may carry duplicates hereafter", d.logPrefix, d.memLimit)
+	}
+
+	return nil
+}
+
+func (d *distinctKeys) cleanup() {
+	if d == nil {
+		return
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.spillFile != nil {
+		d.spillFile.Close()
+		if err := os.Remove(d.spillFile.Name()); err != nil {
+			logging.Errorf("distinct: %v remove distinct keys file %v,"+
+				" err: %v", d.logPrefix, d.spillFile.Name(), err)
+		}
+		d.spillFile = nil
+	}
+}
+
+func distinctDigest(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
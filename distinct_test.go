@@ -0,0 +1,130 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestDistinctKeys(t *testing.T) {
+	for _, memLimit := range []int64{
+		1024 * 1024, // all keys held in memory
+		2048,        // keys spilled to disk
+	} {
+		d := newDistinctKeys("test", os.TempDir(), memLimit)
+
+		for i := 0; i < 100; i++ {
+			dup, err := d.seen(fmt.Sprintf("key-%d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dup {
+				t.Fatalf("[%d] Expected key-%d to not be a duplicate",
+					memLimit, i)
+			}
+		}
+
+		for i := 0; i < 100; i++ {
+			dup, err := d.seen(fmt.Sprintf("key-%d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !dup {
+				t.Fatalf("[%d] Expected key-%d to be a duplicate", memLimit, i)
+			}
+		}
+
+		spillFile := d.spillFile
+		if (memLimit < 1024*1024) != (spillFile != nil) {
+			t.Fatalf("[%d] Unexpected spill file: %v", memLimit, spillFile)
+		}
+
+		d.cleanup()
+
+		if spillFile != nil {
+			if _, err := os.Stat(spillFile.Name()); !os.IsNotExist(err) {
+				t.Fatalf("Expected spill file to be removed, err: %v", err)
+			}
+		}
+	}
+}
+
+func TestDistinctKeysExceedingLimit(t *testing.T) {
+	defer SetDistinctFailOnLimit(GetDistinctFailOnLimit())
+
+	for _, failOnLimit := range []bool{false, true} {
+		SetDistinctFailOnLimit(failOnLimit)
+
+		d := newDistinctKeys("test", os.TempDir(), distinctKeyOverhead+4*distinctDigestSize)
+
+		var err error
+		for i := 0; i < 10 && err == nil; i++ {
+			_, err = d.seen(fmt.Sprintf("key-%d", i))
+		}
+
+		if failOnLimit != (err != nil) {
+			t.Fatalf("[failOnLimit: %t] Unexpected err: %v", failOnLimit, err)
+		}
+
+		if !failOnLimit {
+			if !d.degraded {
+				t.Fatalf("Expected distinct keys to have degraded")
+			}
+
+			// keys tracked before the limit was reached are still
+			// recognized as duplicates
+			if dup, err := d.seen("key-0"); err != nil || !dup {
+				t.Fatalf("Expected key-0 to be a duplicate, err: %v", err)
+			}
+		}
+
+		d.cleanup()
+	}
+}
+
+func TestDistinctKeysSpilledDigestCollision(t *testing.T) {
+	// the keys are spilled once the second arrives.
+	d := newDistinctKeys("test", os.TempDir(),
+		distinctKeyOverhead+3*distinctDigestSize)
+	defer d.cleanup()
+
+	for _, key := range []string{"key-0", "key-1", "key-2"} {
+		if dup, err := d.seen(key); err != nil || dup {
+			t.Fatalf("Expected %s to not be a duplicate, err: %v", key, err)
+		}
+	}
+
+	if d.spillFile == nil {
+		t.Fatalf("Expected the keys spilled")
+	}
+
+	// a key whose digest collides with that of a spilled key is told
+	// apart from it, by the keys read back from their offsets.
+	digest := distinctDigest("other")
+	d.digests[digest] = d.digests[distinctDigest("key-1")]
+
+	if dup, err := d.seen("other"); err != nil || dup {
+		t.Fatalf("Expected other to not be a duplicate, err: %v", err)
+	}
+	if len(d.collisions[digest]) != 1 {
+		t.Fatalf("Expected a key spilled under the colliding digest, got: %v",
+			d.collisions[digest])
+	}
+
+	for _, key := range []string{"other", "key-1"} {
+		if dup, err := d.seen(key); err != nil || !dup {
+			t.Fatalf("Expected %s to be a duplicate, err: %v", key, err)
+		}
+	}
+}
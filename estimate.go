@@ -0,0 +1,256 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/jsonparser"
+	pb "github.com/couchbase/cbft/protobuf"
+	"github.com/couchbase/n1fty/util"
+	"github.com/couchbase/query/errors"
+	"github.com/couchbase/query/expression"
+	"github.com/couchbase/query/logging"
+	"github.com/couchbase/query/value"
+)
+
+// estimateCacheTTL is the duration the estimate of the number of documents
+// matched by a query is reused for, over the same index; as set by the
+// "estimateCacheTTLMS" config (in ms)
+var estimateCacheTTL = int64(5 * time.Second)
+
+func GetEstimateCacheTTL() time.Duration {
+	return time.Duration(atomic.LoadInt64(&estimateCacheTTL))
+}
+
+func SetEstimateCacheTTL(v time.Duration) {
+	atomic.StoreInt64(&estimateCacheTTL, int64(v))
+}
+
+// estimateCacheSize bounds the number of estimates cached per index; as
+// set by the "estimateCacheSize" config
+var estimateCacheSize = int64(256)
+
+func GetEstimateCacheSize() int64 {
+	return atomic.LoadInt64(&estimateCacheSize)
+}
+
+func SetEstimateCacheSize(v int64) {
+	atomic.StoreInt64(&estimateCacheSize, v)
+}
+
+// estimateTimeout bounds the count request issued to FTS for an estimate;
+// as set by the "estimateTimeoutMS" config (in ms)
+var estimateTimeout = int64(2 * time.Second)
+
+func GetEstimateTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&estimateTimeout))
+}
+
+func SetEstimateTimeout(v time.Duration) {
+	atomic.StoreInt64(&estimateTimeout, int64(v))
+}
+
+// EstimateCount returns an estimate of the number of documents the query
+// matches, for the planner to cost the index against other access paths.
+// The estimate is the total of a count request (fetching none of the
+// hits) issued to FTS, reused for estimateCacheTTL; if the count request
+// fails, the index's indexed count (as reported by Sargable(..)) is
+// returned instead.
+func (i *FTSIndex) EstimateCount(requestID string, field string, query,
+	options expression.Expression) (int64, errors.Error) {
+	var queryVal, optionsVal value.Value
+	if query != nil {
+		queryVal = query.Value()
+	}
+	if options != nil {
+		optionsVal = options.Value()
+	}
+
+	if queryVal == nil {
+		return 0, util.N1QLError(nil, "query unavailable for an estimate")
+	}
+
+	sargRV := i.buildQueryAndCheckIfSargable(field, queryVal, optionsVal, nil)
+	if sargRV.err != nil {
+		return 0, sargRV.err
+	}
+	if sargRV.count == 0 {
+		return 0, util.N1QLError(nil, "not sargable")
+	}
+
+	searchRequest := sargRV.searchRequest
+	if i.indexer != nil && i.indexer.collectionAware {
+		searchRequest = util.DecorateSearchRequest(searchRequest,
+			i.indexer.collection)
+	}
+
+	countReq, err := util.BuildProtoCountRequest(searchRequest,
+		i.identity())
+	if err != nil {
+		return 0, util.N1QLError(err, "count request parse err")
+	}
+
+	key := string(countReq.Contents)
+	if count, exists := i.estimates.get(key); exists {
+		return count, nil
+	}
+
+	count, err := i.countMatches(countReq, GetEstimateTimeout())
+	if err != nil {
+		logging.Infof("n1fty: EstimateCount, index: %s, requestID: %s,"+
+			" falling back to the indexed count, err: %v",
+			i.indexDef.Name, requestID, err)
+		return sargRV.indexedCount, nil
+	}
+
+	i.estimates.put(key, count)
+
+	return count, nil
+}
+
+// countMatches issues the count request to FTS, bounded by the timeout,
+// returning the total number of documents matched.
+func (i *FTSIndex) countMatches(countReq *pb.SearchRequest,
+	timeout time.Duration) (int64, error) {
+	if i.indexer == nil {
+		return 0, fmt.Errorf("indexer unavailable")
+	}
+
+	err := util.SetQueryCtlTimeout(countReq, int64(timeout/time.Millisecond))
+	if err != nil {
+		return 0, err
+	}
+
+	client, err := i.indexer.searchClient(i.indexDef.UUID)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err = i.indexer.acquireSearch(ctx); err != nil {
+		return 0, err
+	}
+	defer i.indexer.releaseSearch()
+
+	stream, err := searchWithRetry(ctx, client, countReq)
+	if err != nil || stream == nil {
+		return 0, fmt.Errorf("count request failed, err: %v", err)
+	}
+
+	for {
+		results, err := stream.Recv()
+		if err == io.EOF {
+			return 0, fmt.Errorf("count request ended without a result")
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if r, ok := results.Contents.(*pb.StreamSearchResults_SearchResult); ok &&
+			r.SearchResult != nil {
+			return countFromSearchResult(r.SearchResult)
+		}
+	}
+}
+
+// countFromSearchResult returns the total number of documents matched,
+// as reported within the search result, provided the search succeeded
+// over all of the partitions.
+func countFromSearchResult(searchResult []byte) (int64, error) {
+	searchStatus, _, _, err := jsonparser.Get(searchResult, "status")
+	if err != nil {
+		return 0, fmt.Errorf("error in retrieving status, err: %v", err)
+	}
+
+	if err = partialResultsErr(searchStatus); err != nil {
+		return 0, err
+	}
+
+	return jsonparser.GetInt(searchResult, "total_hits")
+}
+
+// -----------------------------------------------------------------------------
+
+type estimateEntry struct {
+	count   int64
+	expires time.Time
+}
+
+// estimateCache holds the estimates made over an index for a while, so
+// the repeat estimates made while planning don't each hit FTS.
+type estimateCache struct {
+	m        sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  map[string]estimateEntry
+}
+
+func newEstimateCache(capacity int, ttl time.Duration) *estimateCache {
+	return &estimateCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]estimateEntry),
+	}
+}
+
+func (c *estimateCache) get(key string) (int64, bool) {
+	if c == nil {
+		return 0, false
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	e, exists := c.entries[key]
+	if !exists {
+		return 0, false
+	}
+
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return 0, false
+	}
+
+	return e.count, true
+}
+
+func (c *estimateCache) put(key string, count int64) {
+	if c == nil || c.capacity <= 0 || c.ttl <= 0 {
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= c.capacity {
+		// make room by evicting the expired estimates, else all of them.
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.capacity {
+			c.entries = make(map[string]estimateEntry)
+		}
+	}
+
+	c.entries[key] = estimateEntry{count: count, expires: now.Add(c.ttl)}
+}
@@ -0,0 +1,122 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/n1fty/util"
+	"github.com/couchbase/query/expression"
+)
+
+func TestEstimateCache(t *testing.T) {
+	c := newEstimateCache(2, 20*time.Millisecond)
+
+	c.put("a", 10)
+	if count, exists := c.get("a"); !exists || count != 10 {
+		t.Fatalf("Expected the estimate to be cached, got: %v, %v",
+			count, exists)
+	}
+
+	// the estimates expire after the TTL
+	time.Sleep(30 * time.Millisecond)
+	if _, exists := c.get("a"); exists {
+		t.Fatalf("Expected the estimate to have expired")
+	}
+
+	// room is made for the estimates past the capacity
+	for i, key := range []string{"a", "b", "c"} {
+		c.put(key, int64(i))
+	}
+	if len(c.entries) > 2 {
+		t.Fatalf("Expected at most 2 estimates, got: %v", c.entries)
+	}
+	if count, exists := c.get("c"); !exists || count != 2 {
+		t.Fatalf("Expected the latest estimate to be cached, got: %v, %v",
+			count, exists)
+	}
+
+	// caching disabled
+	c = newEstimateCache(0, time.Second)
+	c.put("a", 10)
+	if _, exists := c.get("a"); exists {
+		t.Fatalf("Expected the estimate not to be cached")
+	}
+}
+
+func TestEstimateCount(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithCustomDefaultMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := expression.NewConstant(map[string]interface{}{
+		"match": "london",
+		"field": "city",
+	})
+
+	_, indexedCount, _, _, n1qlErr := index.Sargable("", query, nil, nil)
+	if n1qlErr != nil {
+		t.Fatal(n1qlErr)
+	}
+
+	// without FTS to count the matches, the indexed count is returned
+	count, n1qlErr := index.EstimateCount("req", "", query, nil)
+	if n1qlErr != nil {
+		t.Fatal(n1qlErr)
+	}
+	if count != indexedCount {
+		t.Fatalf("Expected the indexed count: %v, got: %v", indexedCount, count)
+	}
+
+	// which isn't cached, unlike the count of the matches
+	if len(index.estimates.entries) != 0 {
+		t.Fatalf("Unexpected estimates cached: %v", index.estimates.entries)
+	}
+
+	sargRV := index.buildQueryAndCheckIfSargable("", query.Value(), nil, nil)
+	countReq, err := util.BuildProtoCountRequest(sargRV.searchRequest,
+		index.identity())
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.estimates.put(string(countReq.Contents), 42)
+
+	count, n1qlErr = index.EstimateCount("req", "", query, nil)
+	if n1qlErr != nil || count != 42 {
+		t.Fatalf("Expected the cached estimate, got: %v, err: %v",
+			count, n1qlErr)
+	}
+
+	// queries that aren't sargable aren't estimated
+	_, n1qlErr = index.EstimateCount("req", "", expression.NewConstant(
+		map[string]interface{}{"match": "london", "field": "cityX"}), nil)
+	if n1qlErr == nil {
+		t.Fatalf("Expected an error for a query that isn't sargable")
+	}
+}
+
+func TestCountFromSearchResult(t *testing.T) {
+	count, err := countFromSearchResult([]byte(`{"status":{"total":2,` +
+		`"failed":0,"successful":2},"hits":[],"total_hits":120}`))
+	if err != nil || count != 120 {
+		t.Fatalf("Expected a count of 120, got: %v, err: %v", count, err)
+	}
+
+	_, err = countFromSearchResult([]byte(`{"status":{"total":2,` +
+		`"failed":1,"successful":1,"errors":{"pindex_1":"timeout"}},` +
+		`"hits":[],"total_hits":60}`))
+	if err == nil {
+		t.Fatalf("Expected an error over a partial count")
+	}
+}
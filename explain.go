@@ -0,0 +1,233 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/couchbase/n1fty/util"
+	"github.com/couchbase/query/expression"
+	"github.com/couchbase/query/value"
+)
+
+// SargExplanation is the breakdown of the sargability decision made by an
+// FTSIndex for a SEARCH() function, see ExplainSargable(..).
+type SargExplanation struct {
+	Index        string                  `json:"index"`
+	QueryFields  []*SargFieldExplanation `json:"queryFields"`
+	Sargable     bool                    `json:"sargable"`
+	Exact        bool                    `json:"exact"`
+	Count        int                     `json:"sargableCount"`
+	IndexedCount int64                   `json:"indexedCount"`
+	Reason       string                  `json:"reason"`
+}
+
+// SargFieldExplanation describes a field extracted from the query, with
+// the type, analyzer and date format it was checked against the index
+// with, and the outcome of that check.
+type SargFieldExplanation struct {
+	Name       string `json:"name"`
+	Type       string `json:"type,omitempty"`
+	Analyzer   string `json:"analyzer,omitempty"`
+	DateFormat string `json:"dateFormat,omitempty"`
+	Checked    bool   `json:"checked"`
+	Matched    bool   `json:"matched"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// ExplainSargable is a dry run of Sargable(..), that rather than just the
+// counts, returns the query fields extracted, the index fields they were
+// matched against (or not) and the decision reached, for tooling.
+func (i *FTSIndex) ExplainSargable(field string, query,
+	options expression.Expression) (*SargExplanation, error) {
+	var queryVal, optionsVal value.Value
+	if query != nil {
+		queryVal = query.Value()
+	}
+	if options != nil {
+		optionsVal = options.Value()
+	}
+
+	if queryVal == nil {
+		return nil, fmt.Errorf("explain sargable: query isn't available,"+
+			" query: %v", query)
+	}
+
+	explain := &SargExplanation{Index: i.Name()}
+
+	rv := i.buildQueryAndCheckIfSargable(field, queryVal, optionsVal,
+		map[string]interface{}{"explain": explain})
+	if rv.err != nil {
+		return nil, rv.err
+	}
+
+	explain.Count = rv.count
+	explain.IndexedCount = rv.indexedCount
+	explain.Sargable = rv.count > 0
+	explain.Exact = explain.Sargable && rv.exact
+	if explain.Sargable && explain.Reason == "" {
+		explain.Reason = "sargable"
+	}
+
+	return explain, nil
+}
+
+// IndexCoverage describes what an FTSIndex covers, as considered for
+// sargability, for tooling to show why an index was (or wasn't) selected,
+// see Coverage().
+type IndexCoverage struct {
+	Index                 string            `json:"index"`
+	Fields                []*CoveredField   `json:"fields"`
+	IndexedCount          int64             `json:"indexedCount"`
+	Dynamic               bool              `json:"dynamic"`
+	DynamicMappings       map[string]string `json:"dynamicMappings,omitempty"`
+	AllFieldSearchable    bool              `json:"allFieldSearchable"`
+	DefaultAnalyzer       string            `json:"defaultAnalyzer"`
+	DefaultDateTimeParser string            `json:"defaultDateTimeParser"`
+
+	// StoredFields lists the fields retrievable with the hits (see the
+	// include_fields option), that aren't necessarily searchable.
+	StoredFields []string `json:"storedFields,omitempty"`
+}
+
+// CoveredField is a searchable field of an index, a dynamic one covering
+// the fields nested under it.
+type CoveredField struct {
+	Name       string `json:"name"`
+	Type       string `json:"type,omitempty"`
+	Analyzer   string `json:"analyzer,omitempty"`
+	DateFormat string `json:"dateFormat,omitempty"`
+	Dynamic    bool   `json:"dynamic"`
+}
+
+// Coverage returns the searchable fields of the index along with the
+// defaults they're checked against, as a copy the caller may hold on to
+// (or modify) without affecting the index.
+func (i *FTSIndex) Coverage() *IndexCoverage {
+	rv := &IndexCoverage{
+		Index:                 i.Name(),
+		Fields:                make([]*CoveredField, 0, len(i.searchableFields)),
+		IndexedCount:          i.indexedCount,
+		AllFieldSearchable:    i.allFieldSearchable,
+		DefaultAnalyzer:       i.defaultAnalyzer,
+		DefaultDateTimeParser: i.defaultDateTimeParser,
+	}
+
+	if len(i.dynamicMappings) > 0 {
+		rv.DynamicMappings = make(map[string]string, len(i.dynamicMappings))
+		for k, v := range i.dynamicMappings {
+			rv.DynamicMappings[k] = v
+		}
+	}
+
+	for f, dynamic := range i.searchableFields {
+		rv.Fields = append(rv.Fields, &CoveredField{
+			Name:       f.Name,
+			Type:       f.Type,
+			Analyzer:   f.Analyzer,
+			DateFormat: f.DateFormat,
+			Dynamic:    dynamic,
+		})
+	}
+
+	if i.mappingInfo != nil {
+		for name := range i.mappingInfo.StoredFields {
+			rv.StoredFields = append(rv.StoredFields, name)
+		}
+		sort.Strings(rv.StoredFields)
+	}
+
+	// the index is dynamic if any of its mappings (nested or not) are.
+	rv.Dynamic = len(i.dynamicMappings) > 0
+	for _, f := range rv.Fields {
+		rv.Dynamic = rv.Dynamic || f.Dynamic
+	}
+
+	sort.Slice(rv.Fields, func(x, y int) bool {
+		a, b := rv.Fields[x], rv.Fields[y]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Analyzer != b.Analyzer {
+			return a.Analyzer < b.Analyzer
+		}
+		return a.DateFormat < b.DateFormat
+	})
+
+	return rv
+}
+
+// -----------------------------------------------------------------------------
+
+// The recording methods below are nil safe, as sargability is checked
+// without an explanation outside of ExplainSargable(..).
+
+func (e *SargExplanation) setQueryFields(
+	queryFields map[util.SearchField]struct{}) {
+	if e == nil {
+		return
+	}
+
+	e.QueryFields = make([]*SargFieldExplanation, 0, len(queryFields))
+	for f := range queryFields {
+		e.QueryFields = append(e.QueryFields, &SargFieldExplanation{
+			Name:       f.Name,
+			Type:       f.Type,
+			Analyzer:   f.Analyzer,
+			DateFormat: f.DateFormat,
+		})
+	}
+
+	sort.Slice(e.QueryFields, func(x, y int) bool {
+		a, b := e.QueryFields[x], e.QueryFields[y]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Analyzer < b.Analyzer
+	})
+}
+
+// check records the outcome for the query field qf, as checked against
+// the index in its resolved form f.
+func (e *SargExplanation) check(qf, f util.SearchField,
+	matched bool, reason string) {
+	if e == nil {
+		return
+	}
+
+	for _, fe := range e.QueryFields {
+		if fe.Name == qf.Name && fe.Type == qf.Type &&
+			fe.Analyzer == qf.Analyzer && fe.DateFormat == qf.DateFormat &&
+			!fe.Checked {
+			fe.Type, fe.Analyzer, fe.DateFormat = f.Type, f.Analyzer, f.DateFormat
+			fe.Checked = true
+			fe.Matched = matched
+			fe.Reason = reason
+			return
+		}
+	}
+}
+
+func (e *SargExplanation) decide(reason string) {
+	if e == nil {
+		return
+	}
+
+	e.Reason = reason
+}
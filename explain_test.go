@@ -0,0 +1,150 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"testing"
+
+	"github.com/couchbase/n1fty/util"
+	"github.com/couchbase/query/expression"
+)
+
+func TestExplainSargable(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithCustomDefaultMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    map[string]interface{}
+		sargable bool
+		matched  map[string]bool
+	}{
+		{
+			query: map[string]interface{}{
+				"conjuncts": []interface{}{
+					map[string]interface{}{"match": "london", "field": "city"},
+					map[string]interface{}{"match": "uk", "field": "country",
+						"analyzer": "keyword"},
+				},
+			},
+			sargable: true,
+			matched:  map[string]bool{"city": true, "country": true},
+		},
+		{
+			query: map[string]interface{}{
+				"match": "london", "field": "city", "analyzer": "keyword",
+			},
+			sargable: false,
+			matched:  map[string]bool{"city": false},
+		},
+		{
+			query: map[string]interface{}{
+				"match": "london", "field": "town",
+			},
+			sargable: false,
+			matched:  map[string]bool{"town": false},
+		},
+	}
+
+	for testi, test := range tests {
+		explain, err := index.ExplainSargable("",
+			expression.NewConstant(test.query), nil)
+		if err != nil {
+			t.Fatalf("[%d] err: %v", testi, err)
+		}
+
+		if explain.Sargable != test.sargable {
+			t.Fatalf("[%d] Expected sargable: %t, got explanation: %+v",
+				testi, test.sargable, explain)
+		}
+
+		if explain.Sargable && explain.Count != len(test.matched) {
+			t.Fatalf("[%d] Expected count: %d, got: %d",
+				testi, len(test.matched), explain.Count)
+		}
+
+		if explain.Reason == "" {
+			t.Fatalf("[%d] Expected a reason for the decision", testi)
+		}
+
+		if len(explain.QueryFields) != len(test.matched) {
+			t.Fatalf("[%d] Expected query fields: %v, got: %+v",
+				testi, test.matched, explain.QueryFields)
+		}
+
+		for _, f := range explain.QueryFields {
+			if !f.Checked || f.Matched != test.matched[f.Name] {
+				t.Fatalf("[%d] Unexpected outcome for field: %+v", testi, f)
+			}
+			if f.Type != "text" || f.Analyzer == "" {
+				t.Fatalf("[%d] Expected resolved type and analyzer: %+v",
+					testi, f)
+			}
+		}
+	}
+}
+
+func TestIndexCoverage(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithNestedAnalyzers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coverage := index.Coverage()
+	if coverage.Index != index.Name() ||
+		coverage.IndexedCount != index.indexedCount ||
+		coverage.DefaultAnalyzer != "standard" ||
+		coverage.DefaultDateTimeParser != "dateTimeOptional" ||
+		!coverage.AllFieldSearchable || !coverage.Dynamic {
+		t.Fatalf("Unexpected coverage: %+v", coverage)
+	}
+
+	if len(coverage.Fields) != len(index.searchableFields) {
+		t.Fatalf("Expected %d fields, got: %d",
+			len(index.searchableFields), len(coverage.Fields))
+	}
+
+	var content, notes bool
+	for _, f := range coverage.Fields {
+		switch {
+		case f.Name == "reviews.content" && f.Analyzer == "en":
+			content = !f.Dynamic && f.Type == "text"
+		case f.Name == "reviews.notes":
+			notes = f.Dynamic && f.Analyzer == "keyword"
+		}
+	}
+
+	if !content || !notes {
+		t.Fatalf("Expected the static and dynamic fields, got: %+v",
+			coverage.Fields)
+	}
+
+	// the coverage returned is a copy, so modifying it leaves the index
+	// unaffected.
+	coverage.Fields[0].Name = "modified"
+	for k := range coverage.DynamicMappings {
+		coverage.DynamicMappings[k] = "modified"
+	}
+
+	for f := range index.searchableFields {
+		if f.Name == "modified" {
+			t.Fatalf("Expected the index's fields to be unaffected")
+		}
+	}
+
+	for k, v := range index.dynamicMappings {
+		if v == "modified" {
+			t.Fatalf("Expected the index's dynamic mapping: %s unaffected", k)
+		}
+	}
+}
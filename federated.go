@@ -0,0 +1,411 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blevesearch/bleve/v2/search"
+	"github.com/buger/jsonparser"
+	"github.com/couchbase/cbft"
+	pb "github.com/couchbase/cbft/protobuf"
+	"github.com/couchbase/n1fty/util"
+	"github.com/couchbase/query/datastore"
+	"github.com/couchbase/query/timestamp"
+)
+
+// FederatedSearch performs the search over each of the indexes (for ex.
+// those over the time partitions of a dataset), merging their hits as per
+// the requested sort (else by score), with the offset and limit applied
+// over the merged hits. As the hits are fetched up to offset+limit from
+// each index, the offset+limit is bounded by the max result window, and
+// the merged hits are held in memory (rather than backfilled); the facets
+// (if requested) aren't merged, nor can the hits be paged from a cursor
+// or filtered by score.
+func FederatedSearch(requestID string, indexes []*FTSIndex,
+	searchInfo *datastore.FTSSearchInfo, cons datastore.ScanConsistency,
+	vector timestamp.Vector, conn *datastore.IndexConnection) {
+	if conn == nil {
+		return
+	}
+
+	sender := conn.Sender()
+	if sender == nil {
+		conn.Error(util.N1QLError(nil, "conn's Sender not defined"))
+		return
+	}
+	defer sender.Close()
+
+	if len(indexes) == 0 {
+		conn.Error(util.N1QLError(nil, "no indexes to search over"))
+		return
+	}
+
+	if searchInfo == nil || searchInfo.Query == nil {
+		conn.Error(util.N1QLError(nil, "no search parameters provided"))
+		return
+	}
+
+	if cons == datastore.SCAN_PLUS {
+		conn.Error(util.N1QLError(nil, "scan_plus consistency not supported"))
+		return
+	}
+
+	window := searchInfo.Offset + searchInfo.Limit
+	if searchInfo.Limit == math.MaxInt64 || window < 0 ||
+		window > util.GetBleveMaxResultWindow() {
+		conn.Error(util.N1QLError(nil, fmt.Sprintf("federated search:"+
+			" offset+limit must be within the max result window: %d",
+			util.GetBleveMaxResultWindow())))
+		return
+	}
+
+	field := ""
+	if searchInfo.Field != nil {
+		fieldStr, ok := searchInfo.Field.Actual().(string)
+		if !ok {
+			conn.Error(util.N1QLError(nil, "field provided must be of type:string"))
+			return
+		}
+		field = fieldStr
+	}
+
+	searchOpts, err := util.ParseSearchOptions(searchInfo.Options)
+	if err != nil {
+		conn.Error(util.N1QLError(err, "search options err"))
+		return
+	}
+
+	if searchOpts.SearchAfter != nil || searchOpts.SearchBefore != nil {
+		conn.Error(util.N1QLError(nil, "federated search:"+
+			" search_after/search_before unsupported"))
+		return
+	}
+
+	// the offset and limit are applied over the merged hits, so ahead of
+	// any filtering by score, or collapsing.
+	if searchOpts.MinScore != nil {
+		conn.Error(util.N1QLError(nil, "federated search:"+
+			" min_score unsupported"))
+		return
+	}
+
+	if searchOpts.Collapse != nil {
+		conn.Error(util.N1QLError(nil, "federated search:"+
+			" collapse unsupported"))
+		return
+	}
+
+	// the hits up to offset+limit are fetched from each index.
+	indexSearchInfo := *searchInfo
+	indexSearchInfo.Offset, indexSearchInfo.Limit = 0, window
+
+	var sr *cbft.SearchRequest
+	searchReqs := make([]*pb.SearchRequest, len(indexes))
+	for x, i := range indexes {
+		sargRV := i.buildQueryAndCheckIfSargable(
+			field, searchInfo.Query, searchInfo.Options, nil)
+		if sargRV.err != nil || sargRV.count == 0 {
+			conn.Error(util.N1QLError(nil,
+				fmt.Sprintf("not sargable over index: %s", i.Name())))
+			return
+		}
+
+		searchRequest := sargRV.searchRequest
+		if i.indexer != nil && i.indexer.collectionAware {
+			searchRequest = util.DecorateSearchRequest(searchRequest,
+				i.indexer.collection)
+		}
+		searchRequest = util.IncludeFieldsInSearchRequest(searchRequest,
+			searchOpts.IncludeFields)
+		searchRequest = util.IncludeFieldsInSearchRequest(searchRequest,
+			casFields())
+		searchRequest = util.ExcludeFieldsFromSearchRequest(searchRequest,
+			searchOpts.ExcludeFields)
+		searchRequest = util.IncludeLocationsInSearchRequest(searchRequest,
+			searchOpts.IncludeLocations)
+		searchRequest = util.ExplainInSearchRequest(searchRequest,
+			searchOpts.Explain)
+		searchRequest = util.HighlightInSearchRequest(searchRequest,
+			searchOpts.Highlight)
+		searchRequest, err = util.SortInSearchRequest(searchRequest,
+			searchOpts.Sort)
+		if err != nil {
+			conn.Error(util.N1QLError(err, "sort option err"))
+			return
+		}
+		searchRequest = util.KeysOnlyInSearchRequest(searchRequest,
+			searchInfo.Order, searchOpts.KeysOnly)
+
+		indexCons := cons
+		if c := searchOpts.Consistency; c != nil {
+			if c.Level == util.ConsistencyBounded {
+				if n1qlErr := i.checkStaleness(searchRequest, vector,
+					c.StalenessMS); n1qlErr != nil {
+					conn.Error(n1qlErr)
+					return
+				}
+			}
+			indexCons = datastore.UNBOUNDED
+		}
+
+		searchReqs[x], err = util.BuildProtoSearchRequest(searchRequest,
+			&indexSearchInfo, vector, indexCons, i.identity())
+		if err != nil {
+			conn.Error(util.N1QLError(err, "search request parse err"))
+			return
+		}
+		// the top hits (as per the sort) are fetched, rather than streamed.
+		searchReqs[x].Stream = false
+
+		err = util.SetQueryCtlTimeout(searchReqs[x],
+			util.SearchTimeoutMS(sargRV.timeoutMS, searchOpts))
+		if err != nil {
+			conn.Error(util.N1QLError(err, "search request ctl params err"))
+			return
+		}
+
+		if sr == nil {
+			sr = searchRequest
+		}
+	}
+
+	sortOrder := search.SortOrder{&search.SortScore{Desc: true}}
+	if len(sr.Sort) > 0 {
+		sortOrder, err = search.ParseSortOrderJSON(sr.Sort)
+		if err != nil {
+			conn.Error(util.N1QLError(err, "search request sort err"))
+			return
+		}
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	deadline := conn.GetReqDeadline()
+	if searchOpts.Timeout > 0 {
+		// canceled only past the timeout of FTS, see searchTimeoutGrace.
+		serverDeadline := time.Now().Add(time.Duration(searchOpts.Timeout)*
+			time.Millisecond + GetSearchTimeoutGrace())
+		if deadline.IsZero() || serverDeadline.Before(deadline) {
+			deadline = serverDeadline
+		}
+	}
+	if !deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	// the indexes are searched concurrently.
+	hits := make([][][]byte, len(indexes))
+	statuses := make([][]byte, len(indexes))
+	errs := make([]error, len(indexes))
+
+	var wg sync.WaitGroup
+	for x := range indexes {
+		wg.Add(1)
+		go func(x int) {
+			defer wg.Done()
+			hits[x], statuses[x], errs[x] = indexes[x].fetchHits(ctx, searchReqs[x])
+		}(x)
+	}
+	wg.Wait()
+
+	for x, err := range errs {
+		if err != nil {
+			conn.Error(util.GrpcN1QLError(err, grpcErrDesc(err,
+				fmt.Sprintf("federated search failed over index: %s",
+					indexes[x].Name()))))
+			return
+		}
+	}
+
+	for x, searchStatus := range statuses {
+		if err := partialResultsErr(searchStatus); err != nil {
+			if !searchOpts.AllowPartialResults && (searchOpts.Timeout <= 0 ||
+				!partialResultsTimedOut(searchStatus)) {
+				conn.Error(util.N1QLError(err, fmt.Sprintf("federated search"+
+					" over index: %s, err", indexes[x].Name())))
+				return
+			}
+			conn.Warning(util.N1QLError(err, fmt.Sprintf("federated search"+
+				" over index: %s, partial results", indexes[x].Name())))
+		}
+	}
+
+	merged, err := mergeHits(hits, sortOrder, searchInfo.Offset,
+		searchInfo.Limit)
+	if err != nil {
+		conn.Error(util.N1QLError(err, "federated search merge err"))
+		return
+	}
+
+	rh := newResponseHandler(indexes[0], requestID, sr, searchOpts)
+	rh.reqDeadline = conn.GetReqDeadline()
+	defer rh.cleanupDistinct()
+	defer rh.stopSends()
+
+	if rh.sendEntries(merged, conn) {
+		rh.flushLastHit(sender)
+	}
+}
+
+// fetchHits issues the search request to FTS, returning the hits (the
+// JSON arrays of them, as received) along with the status of the search.
+func (i *FTSIndex) fetchHits(ctx context.Context,
+	searchReq *pb.SearchRequest) ([][]byte, []byte, error) {
+	if i.indexer == nil {
+		return nil, nil, fmt.Errorf("indexer unavailable")
+	}
+
+	client, err := i.indexer.searchClient(i.indexDef.UUID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the search is canceled should the indexer be closed meanwhile.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	untrack, err := i.indexer.trackSearch(cancel)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer untrack()
+
+	if err := i.indexer.acquireSearch(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer i.indexer.releaseSearch()
+
+	starttm := time.Now()
+	defer func() {
+		i.indexer.countSearch(time.Since(starttm))
+	}()
+
+	stream, err := searchWithRetry(ctx, client, searchReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	if stream == nil {
+		return nil, nil, fmt.Errorf("search stream unavailable")
+	}
+
+	var rv [][]byte
+	for {
+		results, err := stream.Recv()
+		if err == io.EOF {
+			return nil, nil, fmt.Errorf("search ended without a result")
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch r := results.Contents.(type) {
+		case *pb.StreamSearchResults_Hits:
+			rv = append(rv, r.Hits.Bytes)
+
+		case *pb.StreamSearchResults_SearchResult:
+			if r.SearchResult == nil {
+				break
+			}
+
+			searchStatus, _, _, err := jsonparser.Get(r.SearchResult, "status")
+			if err != nil || len(searchStatus) == 0 {
+				return nil, nil, fmt.Errorf("error in retrieving status")
+			}
+
+			if took := searchResultTook(r.SearchResult); took > 0 {
+				atomic.AddInt64(&i.indexer.stats.TotalFTSServerDuration, took)
+			}
+
+			hits, dataType, _, err := jsonparser.Get(r.SearchResult, "hits")
+			if err == nil && dataType == jsonparser.Array {
+				rv = append(rv, hits)
+			}
+
+			return rv, searchStatus, nil
+		}
+	}
+}
+
+// mergedHit is a hit of one of the indexes, with what it's sorted by.
+type mergedHit struct {
+	dm  search.DocumentMatch
+	raw json.RawMessage
+}
+
+// mergeHits merges the hits of the indexes as per the sort order, with
+// the offset and limit applied over the merged hits, returning them as
+// a JSON array; the hits that sort the same are kept in the order of
+// the indexes.
+func mergeHits(sources [][][]byte, sortOrder search.SortOrder,
+	offset, limit int64) ([]byte, error) {
+	var hits []*mergedHit
+	for _, source := range sources {
+		for _, arr := range source {
+			var raws []json.RawMessage
+			if err := json.Unmarshal(arr, &raws); err != nil {
+				return nil, err
+			}
+
+			for _, raw := range raws {
+				h := &mergedHit{raw: raw}
+				if err := json.Unmarshal(raw, &h.dm); err != nil {
+					return nil, err
+				}
+				for len(h.dm.Sort) < len(sortOrder) {
+					h.dm.Sort = append(h.dm.Sort, "")
+				}
+				h.dm.HitNumber = uint64(len(hits))
+				hits = append(hits, h)
+			}
+		}
+	}
+
+	cachedScoring := sortOrder.CacheIsScore()
+	cachedDesc := sortOrder.CacheDescending()
+	sort.Slice(hits, func(x, y int) bool {
+		return sortOrder.Compare(cachedScoring, cachedDesc,
+			&hits[x].dm, &hits[y].dm) < 0
+	})
+
+	if offset > int64(len(hits)) {
+		offset = int64(len(hits))
+	}
+	hits = hits[offset:]
+	if limit >= 0 && limit < int64(len(hits)) {
+		hits = hits[:limit]
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for x, h := range hits {
+		if x > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(h.raw)
+	}
+	buf.WriteByte(']')
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,95 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2/search"
+)
+
+func TestMergeHits(t *testing.T) {
+	// the hits of two indexes (over two time partitions), each sorted
+	sources := [][][]byte{
+		{
+			[]byte(`[{"id":"a1","score":0.9,"sort":["2021-01-03"]},` +
+				`{"id":"a2","score":0.5,"sort":["2021-01-01"]}]`),
+		},
+		{
+			[]byte(`[{"id":"b1","score":0.7,"sort":["2021-02-02"]}]`),
+			[]byte(`[{"id":"b2","score":0.8,"sort":["2021-01-01"]}]`),
+		},
+	}
+
+	ids := func(hits []byte) []string {
+		var arr []struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(hits, &arr); err != nil {
+			t.Fatal(err)
+		}
+		rv := []string{}
+		for _, h := range arr {
+			rv = append(rv, h.ID)
+		}
+		return rv
+	}
+
+	tests := []struct {
+		sortOrder search.SortOrder
+		offset    int64
+		limit     int64
+		expect    []string
+	}{
+		{
+			sortOrder: search.SortOrder{&search.SortScore{Desc: true}},
+			limit:     10,
+			expect:    []string{"a1", "b2", "b1", "a2"},
+		},
+		{
+			// the hits that sort the same keep the order of the indexes
+			sortOrder: search.SortOrder{&search.SortField{Field: "date"}},
+			limit:     10,
+			expect:    []string{"a2", "b2", "a1", "b1"},
+		},
+		{
+			sortOrder: search.SortOrder{&search.SortField{Field: "date", Desc: true}},
+			offset:    1,
+			limit:     2,
+			expect:    []string{"a1", "a2"},
+		},
+		{
+			sortOrder: search.SortOrder{&search.SortScore{Desc: true}},
+			offset:    5,
+			limit:     2,
+			expect:    []string{},
+		},
+	}
+
+	for testi, test := range tests {
+		merged, err := mergeHits(sources, test.sortOrder, test.offset, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := ids(merged); !reflect.DeepEqual(test.expect, got) {
+			t.Fatalf("[%d] Expected hits: %v, got: %v", testi, test.expect, got)
+		}
+	}
+
+	if _, err := mergeHits([][][]byte{{[]byte(`{}`)}},
+		search.SortOrder{&search.SortScore{Desc: true}}, 0, 10); err == nil {
+		t.Fatalf("Expected an error for malformed hits")
+	}
+}
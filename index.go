@@ -14,15 +14,15 @@ package n1fty
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"math"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/blevesearch/bleve/v2/mapping"
 	"github.com/couchbase/cbft"
-	pb "github.com/couchbase/cbft/protobuf"
 	"github.com/couchbase/cbgt"
 	"github.com/couchbase/n1fty/flex"
 	"github.com/couchbase/n1fty/util"
@@ -37,6 +37,80 @@ import (
 
 const doneRequest = int64(1)
 
+// preferExactCount is the sargable_count reported for a query that's
+// sargable over a dynamic mapping, when the "prefer_exact" option is set.
+// As the planner ranks the indexes by sargable_count (higher the better)
+// ahead of indexed_count (lower the better, with a dynamic mapping's the
+// highest, see dynamicMappingIndexedCount), an index whose fields are
+// mapped explicitly (and so checked precisely, by type and analyzer) is
+// then picked over a dynamic one whenever it's sargable, the dynamic one
+// left as the fallback.
+const preferExactCount = 1
+
+// dynamicMappingIndexedCount is the indexed_count reported for a query
+// that's sargable over a dynamic mapping (under which any field's
+// indexed), rather than a count of the index's fields; as the planner
+// favors the lower indexed_count, the default (math.MaxInt64) has an index
+// mapping the fields explicitly picked ahead of a dynamic one; as set by
+// the "dynamicMappingIndexedCount" config
+var dynamicMappingIndexedCount = int64(math.MaxInt64)
+
+func GetDynamicMappingIndexedCount() int64 {
+	return atomic.LoadInt64(&dynamicMappingIndexedCount)
+}
+
+func SetDynamicMappingIndexedCount(v int64) {
+	atomic.StoreInt64(&dynamicMappingIndexedCount, v)
+}
+
+// strictQueryTypes fails the queries of a type whose fields aren't known to
+// be extracted (for ex. those of a newer bleve), rather than have them
+// deemed not sargable, as counted by the unsupported queries stat; as set
+// by the "strictQueryTypes" config
+var strictQueryTypes = int32(0)
+
+func GetStrictQueryTypes() bool {
+	return loadFlag(&strictQueryTypes)
+}
+
+func SetStrictQueryTypes(v bool) {
+	storeFlag(&strictQueryTypes, v)
+}
+
+// searchTimeoutGrace is the time past the timeout of FTS (as per the
+// timeout option, see util.SearchOptions.Timeout) that a search waits for
+// the partial results FTS then returns, before it's canceled; as set by
+// the "searchTimeoutGraceMS" config (in ms)
+var searchTimeoutGrace = int64(500 * time.Millisecond)
+
+func GetSearchTimeoutGrace() time.Duration {
+	return time.Duration(atomic.LoadInt64(&searchTimeoutGrace))
+}
+
+func SetSearchTimeoutGrace(v time.Duration) {
+	atomic.StoreInt64(&searchTimeoutGrace, int64(v))
+}
+
+var fieldlessQueriesM sync.RWMutex
+
+// fieldlessQueries overrides, by index name, whether the queries without
+// fields are sargable, see SetFieldlessQueriesAllowed(..)
+var fieldlessQueries = map[string]bool{}
+
+// SetFieldlessQueriesAllowed overrides whether the queries without fields
+// (over the _all field) are sargable for the index of the name, regardless
+// of its definition's params ("n1fty": {"disallow_fieldless_queries": ..});
+// a nil allowed clears the override.
+func SetFieldlessQueriesAllowed(indexName string, allowed *bool) {
+	fieldlessQueriesM.Lock()
+	if allowed == nil {
+		delete(fieldlessQueries, indexName)
+	} else {
+		fieldlessQueries[indexName] = *allowed
+	}
+	fieldlessQueriesM.Unlock()
+}
+
 // FTSIndex implements datastore.FTSIndex interface
 type FTSIndex struct {
 	indexer  *FTSIndexer
@@ -49,42 +123,66 @@ type FTSIndex struct {
 
 	condExpr expression.Expression
 
+	// the type field and the enabled type mappings the condition's
+	// synthesized from, in type_field modes
+	condTypeField string
+	condTypes     []string
+
 	// map of dynamic mappings to their default analyzers
 	dynamicMappings map[string]string
 
 	allFieldSearchable bool // true if _all field contains some content
 
+	// true if the queries without fields (over the _all field) are to be
+	// not sargable, as set by the index definition's params
+	fieldlessQueriesDisallowed bool
+
 	defaultAnalyzer       string
 	defaultDateTimeParser string
 	multipleTypeStrs      bool
 
+	// details of the index mapping such as field aliases
+	mappingInfo *util.MappingInfo
+
 	// flex indexes supported
 	condFlexIndexes flex.CondFlexIndexes
+
+	// estimates of the documents matched by queries, see EstimateCount
+	estimates *estimateCache
+
+	// invoked upon every sargability check made, if set (by tests)
+	onSargableCheck func()
 }
 
 // -----------------------------------------------------------------------------
 
 func newFTSIndex(indexer *FTSIndexer, indexDef *cbgt.IndexDef,
 	pip util.ProcessedIndexParams) (rv *FTSIndex, err error) {
-	var condExpr expression.Expression
-	if len(pip.CondExpr) > 0 {
-		condExpr, err = parser.Parse(pip.CondExpr)
-		if err != nil {
-			return nil, err
-		}
+	condExpr, err := pip.Cond()
+	if err != nil {
+		return nil, err
 	}
 
 	index := &FTSIndex{
-		indexer:               indexer,
-		indexDef:              indexDef,
-		searchableFields:      pip.SearchFields,
-		indexedCount:          pip.IndexedCount,
-		condExpr:              condExpr,
-		dynamicMappings:       pip.DynamicMappings,
-		allFieldSearchable:    pip.AllFieldSearchable,
-		defaultAnalyzer:       pip.DefaultAnalyzer,
-		defaultDateTimeParser: pip.DefaultDateTimeParser,
-		multipleTypeStrs:      pip.MultipleTypeStrs,
+		indexer:                    indexer,
+		indexDef:                   indexDef,
+		searchableFields:           pip.SearchFields,
+		indexedCount:               pip.IndexedCount,
+		condExpr:                   condExpr,
+		condTypes:                  pip.CondTypes,
+		dynamicMappings:            pip.DynamicMappings,
+		allFieldSearchable:         pip.AllFieldSearchable,
+		defaultAnalyzer:            pip.DefaultAnalyzer,
+		defaultDateTimeParser:      pip.DefaultDateTimeParser,
+		multipleTypeStrs:           pip.MultipleTypeStrs,
+		mappingInfo:                pip.MappingInfo,
+		fieldlessQueriesDisallowed: pip.FieldlessQueriesDisallowed,
+		estimates: newEstimateCache(
+			int(GetEstimateCacheSize()), GetEstimateCacheTTL()),
+	}
+
+	if pip.DocConfig != nil && len(pip.CondTypes) > 0 {
+		index.condTypeField = pip.DocConfig.TypeField
 	}
 
 	condFlexIndexes, err := flex.BleveToCondFlexIndexes(
@@ -119,6 +217,31 @@ func (i *FTSIndex) Name() string {
 	return i.indexDef.Name
 }
 
+// identity returns the identity of the index, qualified with the keyspace
+// it's defined within, that the requests to FTS are routed by.
+func (i *FTSIndex) identity() util.IndexIdentity {
+	rv := util.IndexIdentity{Name: i.indexDef.Name, UUID: i.indexDef.UUID}
+	if i.indexer != nil {
+		rv.Bucket, rv.Scope = i.indexer.bucket, i.indexer.scope
+	}
+
+	return rv
+}
+
+// fieldlessQueriesAllowed returns whether the queries without fields (over
+// the _all field) may be sargable for the index, as overridden by name (see
+// SetFieldlessQueriesAllowed(..)) or else set by the index's params.
+func (i *FTSIndex) fieldlessQueriesAllowed() bool {
+	fieldlessQueriesM.RLock()
+	allowed, exists := fieldlessQueries[i.indexDef.Name]
+	fieldlessQueriesM.RUnlock()
+	if exists {
+		return allowed
+	}
+
+	return !i.fieldlessQueriesDisallowed
+}
+
 func (i *FTSIndex) Type() datastore.IndexType {
 	return datastore.FTS
 }
@@ -138,7 +261,7 @@ func (i *FTSIndex) RangeKey() expression.Expressions {
 }
 
 func (i *FTSIndex) Condition() expression.Expression {
-	return i.condExpr // Non-nil, for example, when 'type IN ["beer"]'.
+	return i.condExpr // Non-nil, for example, when 'type = "beer"'.
 }
 
 func (i *FTSIndex) IsPrimary() bool {
@@ -192,12 +315,24 @@ func (i *FTSIndex) Search(requestID string, searchInfo *datastore.FTSSearchInfo,
 		return
 	}
 
+	trace := newSearchTrace(i, requestID)
+
 	if cons == datastore.SCAN_PLUS {
 		conn.Error(util.N1QLError(nil, "scan_plus consistency not supported"))
 		sender.Close()
 		return
 	}
 
+	// checked ahead of the search, for a clearer error than that from FTS,
+	// unless the hits past the window are to be paged through.
+	windowErr := util.CheckResultWindow(searchInfo.Offset, searchInfo.Limit)
+	if windowErr != nil && !util.DeepPagingRequested(searchInfo.Options) &&
+		!util.CursorRequested(searchInfo.Options) {
+		conn.Error(util.N1QLError(windowErr, windowErr.Error()))
+		sender.Close()
+		return
+	}
+
 	field := ""
 	if searchInfo.Field != nil {
 		if fieldStr, ok := searchInfo.Field.Actual().(string); ok {
@@ -214,6 +349,8 @@ func (i *FTSIndex) Search(requestID string, searchInfo *datastore.FTSSearchInfo,
 	// prepare time, the query/options may not have been available.
 	sargRV := i.buildQueryAndCheckIfSargable(
 		field, searchInfo.Query, searchInfo.Options, nil)
+	trace.stage(traceSargableCheck, "count", sargRV.count,
+		"exact", sargRV.exact)
 	if sargRV.err != nil || sargRV.count == 0 {
 		conn.Error(util.N1QLError(nil, "not sargable"))
 		sender.Close()
@@ -227,79 +364,248 @@ func (i *FTSIndex) Search(requestID string, searchInfo *datastore.FTSSearchInfo,
 		searchRequest = util.DecorateSearchRequest(searchRequest, i.indexer.collection)
 	}
 
+	searchOpts, err := util.ParseSearchOptions(searchInfo.Options)
+	if err != nil {
+		conn.Error(util.N1QLError(err, "search options err"))
+		sender.Close()
+		return
+	}
+
+	if searchOpts.Trailer {
+		// the trailer's handed over typed, which an IndexConnection can't
+		// take in, see SearchVisitTrailer(..).
+		conn.Error(util.N1QLError(nil, "trailer option: unsupported by"+
+			" N1QL searches"))
+		sender.Close()
+		return
+	}
+
+	// stored fields requested within the options are carried within
+	// the index entries' metadata, under "fields".
+	searchRequest = util.IncludeFieldsInSearchRequest(searchRequest,
+		searchOpts.IncludeFields)
+	searchRequest = util.IncludeFieldsInSearchRequest(searchRequest,
+		casFields())
+	searchRequest = util.ExcludeFieldsFromSearchRequest(searchRequest,
+		searchOpts.ExcludeFields)
+
+	// as are the term locations, under "locations", when requested.
+	searchRequest = util.IncludeLocationsInSearchRequest(searchRequest,
+		searchOpts.IncludeLocations)
+
+	// as are the breakdowns of the hits' scores, under "explanation".
+	searchRequest = util.ExplainInSearchRequest(searchRequest,
+		searchOpts.Explain)
+
+	// as are the highlighted fragments of the hits, under "fragments".
+	searchRequest = util.HighlightInSearchRequest(searchRequest,
+		searchOpts.Highlight)
+
+	// as is the value of the field the hits are collapsed by.
+	searchRequest = util.CollapseInSearchRequest(searchRequest,
+		searchOpts.Collapse)
+
+	// the hits are sorted by their keys, when requested.
+	searchRequest, err = util.SortInSearchRequest(searchRequest,
+		searchOpts.Sort)
+	if err != nil {
+		conn.Error(util.N1QLError(err, "sort option err"))
+		sender.Close()
+		return
+	}
+
+	// as is the cursor to page from, when provided.
+	searchRequest = util.CursorInSearchRequest(searchRequest,
+		searchOpts.SearchAfter, searchOpts.SearchBefore)
+
+	// only the keys of the hits are returned, when requested.
+	searchRequest = util.KeysOnlyInSearchRequest(searchRequest,
+		searchInfo.Order, searchOpts.KeysOnly)
+
+	// scoring is skipped when the hits aren't ordered by score, with FTS
+	// reporting a score of 0 for each, unless requested otherwise.
+	searchRequest = util.SkipScoring(searchRequest, searchInfo.Order,
+		searchOpts.Score)
+
+	// hits are filtered by score (see SearchOptions.MinScore) only if
+	// they're scored.
+	if searchOpts.MinScore != nil && searchRequest.Score == "none" {
+		conn.Error(util.N1QLError(nil, "min_score option: the search"+
+			" request skips scoring"))
+		sender.Close()
+		return
+	}
+
 	starttm := time.Now()
 
 	var waitGroup sync.WaitGroup
 	var backfillSync int64
 	var rh *responseHandler
-	var err error
+	var searchAcquired bool
 
 	var ctx context.Context
 	var cancel context.CancelFunc
 
-	timeoutMS := conn.GetReqDeadline().Sub(time.Now()) * time.Millisecond
-	if timeoutMS > 0 {
-		ctx, cancel = context.WithTimeout(context.Background(), timeoutMS)
+	timeout := searchTimeout(conn.GetReqDeadline(), searchOpts.Timeout)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
 	} else {
 		ctx, cancel = context.WithCancel(context.Background())
 	}
 
+	// the search is canceled should the indexer be closed meanwhile.
+	untrack, err := i.indexer.trackSearch(cancel)
+	if err != nil {
+		conn.Error(util.N1QLError(err, "search err"))
+		sender.Close()
+		cancel()
+		return
+	}
+
 	defer func() {
 		atomic.StoreInt64(&backfillSync, doneRequest)
 		waitGroup.Wait()
+		if rh != nil {
+			rh.flushLastHit(sender)
+			trace.stage(traceDone, "hits", atomic.LoadInt64(&rh.sent))
+		}
+		logSlowQuery(i, requestID, searchRequest, traceDone,
+			time.Since(starttm), GetSlowQueryDurationThreshold(),
+			conn.GetReqDeadline())
 		sender.Close()
 		cancel()
-		// cleanup the backfill file
+		if searchAcquired {
+			i.indexer.releaseSearch()
+		}
+		// cleanup the backfill, distinct keys and raw result files
 		if rh != nil {
+			rh.stopSends()
+			rh.drainAbandoned()
 			rh.cleanupBackfill()
+			rh.cleanupDistinct()
+			rh.cleanupRawResult()
 		}
+		untrack()
 	}()
 
+	// the staleness bound (if any) is checked for ahead of the search,
+	// which then doesn't wait on the index.
+	if c := searchOpts.Consistency; c != nil {
+		if c.Level == util.ConsistencyBounded {
+			if n1qlErr := i.checkStaleness(searchRequest, vector,
+				c.StalenessMS); n1qlErr != nil {
+				conn.Error(n1qlErr)
+				return
+			}
+		}
+		cons = datastore.UNBOUNDED
+	}
+
+	// If timeout specified in the options or else the SearchRequest, apply
+	// it to the gRPC search request, otherwise default to 2 minutes
+	sargRV.timeoutMS = util.SearchTimeoutMS(sargRV.timeoutMS, searchOpts)
+
+	if windowErr != nil || searchOpts.SearchAfter != nil ||
+		searchOpts.SearchBefore != nil {
+		// the hits are paged through, a window at a time, see
+		// SearchOptions.DeepPaging and SearchOptions.SearchAfter.
+		rh = newResponseHandler(i, requestID, searchRequest, searchOpts)
+		rh.reqDeadline = conn.GetReqDeadline()
+		rh.trace = trace
+
+		if n1qlErr := i.pageThrough(ctx, i.fetchHits, searchRequest,
+			searchInfo, vector, cons, sargRV.timeoutMS, rh, conn); n1qlErr != nil {
+			conn.Error(n1qlErr)
+		}
+		return
+	}
+
 	searchReq, err := util.BuildProtoSearchRequest(searchRequest, searchInfo,
-		vector, cons, i.indexDef.Name)
+		vector, cons, i.identity())
 	if err != nil {
 		conn.Error(util.N1QLError(err, "search request parse err"))
 		return
 	}
 
-	if sargRV.timeoutMS <= 0 {
-		// If timeout specified in SearchRequest, apply it to the
-		// gRPC search request, otherwise default to 2 minutes
-		sargRV.timeoutMS = 120000 // defaults to 2min
-	}
-
-	queryCtlParams := &pb.QueryCtlParams{
-		Ctl: &pb.QueryCtl{
-			Timeout: sargRV.timeoutMS,
-		},
+	err = util.SetQueryCtlTimeout(searchReq, sargRV.timeoutMS)
+	if err != nil {
+		conn.Error(util.N1QLError(err, "search request ctl params err"))
+		return
 	}
 
-	searchReq.QueryCtlParams, _ = json.Marshal(queryCtlParams)
+	trace.stage(traceBuildRequest, "stream", searchReq.Stream,
+		"timeoutMS", sargRV.timeoutMS)
 
-	ftsClient := i.indexer.getClient()
-	if ftsClient == nil {
-		conn.Error(util.N1QLError(nil, "client unavailable, try refreshing"))
+	client, err := i.indexer.searchClient(i.indexDef.UUID)
+	if err != nil {
+		conn.Error(util.N1QLError(nil, err.Error()))
 		return
 	}
 
-	client := ftsClient.getGrpcClient()
-	if client == nil {
-		conn.Error(util.N1QLError(nil, "gRPC client unavailable, try refreshing"))
+	if err = i.indexer.acquireSearch(ctx); err != nil {
+		conn.Error(util.N1QLError(err, "search throttled"))
 		return
 	}
+	searchAcquired = true
 
-	stream, err := client.Search(ctx, searchReq)
+	stream, err := searchWithRetry(ctx, client, searchReq)
 	if err != nil || stream == nil {
-		conn.Error(util.N1QLError(err, "search failed"))
+		conn.Error(util.GrpcN1QLError(err, grpcErrDesc(err, "search failed")))
 		return
 	}
 
-	rh = newResponseHandler(i, requestID, sargRV.searchRequest)
+	trace.stage(traceStreamStart)
+
+	rh = newResponseHandler(i, requestID, searchRequest, searchOpts)
+	rh.reqDeadline = conn.GetReqDeadline()
+	rh.trace = trace
 
 	rh.handleResponse(conn, &waitGroup, &backfillSync, stream)
 
-	atomic.AddInt64(&i.indexer.stats.TotalSearch, 1)
-	atomic.AddInt64(&i.indexer.stats.TotalSearchDuration, int64(time.Since(starttm)))
+	i.indexer.countSearch(time.Since(starttm))
+}
+
+// searchTimeout returns the time the search is bounded by: that left
+// until the request's deadline (if any), or when the timeout option (in
+// milliseconds) is set and sooner, the timeout of FTS along with a grace
+// period past it; none (<= 0) leaves the search unbounded.
+func searchTimeout(deadline time.Time, timeoutOptMS int64) time.Duration {
+	var timeoutMS int64
+	if !deadline.IsZero() {
+		timeoutMS = int64(time.Until(deadline) / time.Millisecond)
+	}
+
+	if timeoutOptMS > 0 {
+		// FTS returns the partial results once its timeout elapses, so
+		// the search's canceled only past it.
+		serverTimeoutMS := timeoutOptMS +
+			int64(GetSearchTimeoutGrace()/time.Millisecond)
+		if timeoutMS <= 0 || serverTimeoutMS < timeoutMS {
+			timeoutMS = serverTimeoutMS
+		}
+	}
+
+	return time.Duration(timeoutMS) * time.Millisecond
+}
+
+// checkStaleness returns an error unless the index catches up with the
+// scan vector within the staleness bound (in milliseconds).
+func (i *FTSIndex) checkStaleness(sr *cbft.SearchRequest,
+	vector timestamp.Vector, stalenessMS int64) errors.Error {
+	freshnessReq, err := util.BuildProtoFreshnessRequest(sr, vector,
+		i.identity(), stalenessMS)
+	if err != nil {
+		return util.N1QLError(err, "search request parse err")
+	}
+
+	_, err = i.countMatches(freshnessReq,
+		time.Duration(stalenessMS)*time.Millisecond)
+	if err != nil {
+		return util.N1QLError(err, fmt.Sprintf("index: %s, stale beyond"+
+			" the bound of %dms", i.Name(), stalenessMS))
+	}
+
+	return nil
 }
 
 // -----------------------------------------------------------------------------
@@ -310,20 +616,27 @@ type sargableRV struct {
 	opaque        map[string]interface{}
 	searchRequest *cbft.SearchRequest
 	timeoutMS     int64
+	exact         bool
 	err           errors.Error
 }
 
 // Sargable checks if the provided request is applicable for the index.
 //
 // Return parameters:
-// - sargable_count: This is the number of fields whose names along with
-//                   analyzers from the built query matched with that of
-//                   the index definition, for now all of query fields or 0.
+// - sargable_count: This is the number of distinct fields whose names along
+//                   with analyzers from the built query matched with that
+//                   of the index definition (with the _all field counting
+//                   as one), all of the query fields, those of the
+//                   covered clauses of a conjunction, or 0; over a
+//                   dynamic mapping with the "prefer_exact" option, it's
+//                   preferExactCount, for the planner to rank the indexes
+//                   mapping the fields explicitly ahead.
 // - indexed_count:  This is the total number of indexed fields within the
-//                   the FTS index.
+//                   the FTS index, or dynamicMappingIndexedCount if the
+//                   query's sargable over a dynamic mapping.
 // - exact:          True if the query would produce no false positives
-//                   using this FTS index.
-//                   (place holder for when partial sargability is supported)
+//                   using this FTS index, false if only some clauses of a
+//                   conjunction are covered (and searched for).
 // - opaque:         The map of certain contextual data that can be re-used
 //                   as query iterates through several FTSIndexes.
 //                   (in-out parameter)
@@ -332,6 +645,8 @@ type sargableRV struct {
 //     - an entry for query field-type-analyzers
 //     - an entry for searchable fields obtained from index option
 //     - an entry for the search request generated from the query & field.
+//     - an entry for the verdicts of the indexes checked, by field & options.
+//     - an entry for the fields' types inferred, by index, see inferredFields.
 //
 // The caller will have to make the decision on which index to choose based
 // on the sargable_count (higher the better), indexed_count (lower the better),
@@ -347,18 +662,8 @@ func (i *FTSIndex) Sargable(field string, query,
 		optionsVal = options.Value()
 	}
 
-	if i.multipleTypeStrs {
-		// As this index includes multiple type mappings, this index will
-		// not be supported for n1ql's SEARCH(..) functions to avoid the
-		// possibility of false positives
-		return 0, 0, false, nil, nil
-	}
-
-	// For now, Exact will always be true (to prevent n1ql from doing
-	// unnecessary KV fetches);
-	// This is more of a place holder for until partial sargability is
-	// supported where n1fty can determine whether a particular index
-	// would generate false positives or not for a given query.
+	// exact unless the query is found to be partially sargable, see
+	// checkConjunctsSargable(..).
 	exact := true
 
 	var queryFields map[util.SearchField]struct{}
@@ -371,8 +676,14 @@ func (i *FTSIndex) Sargable(field string, query,
 	if queryVal == nil && len(queryFields) == 0 {
 		// this index will be sargable for the unavailable query if
 		// it has a default dynamic mapping with the _all field searchable.
-		if len(i.dynamicMappings) > 0 && i.allFieldSearchable {
-			return int(math.MaxInt64), math.MaxInt64, exact, opaque, nil
+		if len(i.dynamicMappings) > 0 && i.allFieldSearchable &&
+			i.fieldlessQueriesAllowed() {
+			if util.PreferExactRequested(optionsVal) {
+				return preferExactCount, GetDynamicMappingIndexedCount(), exact,
+					opaque, nil
+			}
+			return int(math.MaxInt64), GetDynamicMappingIndexedCount(), exact,
+				opaque, nil
 		}
 
 		// if the index isn't default dynamic, check if the query expression
@@ -384,8 +695,21 @@ func (i *FTSIndex) Sargable(field string, query,
 		// query becomes available.
 		queryFields = map[util.SearchField]struct{}{}
 
-		var fetchFields func(expression.Expression)
-		fetchFields = func(arg expression.Expression) {
+		// the fields of a query nested past the max depth aren't fetched,
+		// the query then not sargable.
+		var tooDeep bool
+
+		maxDepth := int(util.GetMaxQueryDepth())
+		var fetchFields func(expression.Expression, int)
+		fetchFields = func(arg expression.Expression, depth int) {
+			switch arg.(type) {
+			case *expression.ObjectConstruct, *expression.ArrayConstruct:
+				if depth >= maxDepth {
+					tooDeep = true
+					return
+				}
+			}
+
 			if oc, ok := arg.(*expression.ObjectConstruct); ok {
 				for name, val := range oc.Mapping() {
 					n := name.Value()
@@ -397,17 +721,23 @@ func (i *FTSIndex) Sargable(field string, query,
 							}] = struct{}{}
 						}
 					} else {
-						fetchFields(val)
+						fetchFields(val, depth+1)
 					}
 				}
 			} else if ac, ok := arg.(*expression.ArrayConstruct); ok {
 				for _, entry := range ac.Operands() {
-					fetchFields(entry)
+					fetchFields(entry, depth+1)
 				}
 			}
 		}
 
-		fetchFields(query)
+		fetchFields(query, 0)
+
+		if tooDeep {
+			logging.Warnf("n1fty: index: %s, %v, not sargable", i.Name(),
+				&util.QueryTooDeepError{Max: maxDepth})
+			return 0, 0, exact, opaque, nil
+		}
 
 		if len(queryFields) > 0 {
 			opq, ok := opaque.(map[string]interface{})
@@ -419,7 +749,37 @@ func (i *FTSIndex) Sargable(field string, query,
 		}
 	}
 
+	// the verdict is looked up from (or else recorded within) the opaque,
+	// for repeat calls over the same index, field and options.
+	verdictKey, err := i.sargVerdictKey(field, queryVal != nil, optionsVal)
+	if err != nil {
+		return 0, 0, false, opaque, util.N1QLError(err, "options err")
+	}
+
+	if opq, ok := opaque.(map[string]interface{}); ok {
+		verdicts, _ := opq["sargable_verdicts"].(map[string]*sargVerdict)
+		if v, exists := verdicts[verdictKey]; exists {
+			return v.count, v.indexedCount, v.exact, opaque, nil
+		}
+	}
+
 	rv := i.buildQueryAndCheckIfSargable(field, queryVal, optionsVal, opaque)
+	if rv.count > 0 {
+		exact = rv.exact
+	}
+
+	if rv.err == nil {
+		verdicts, _ := rv.opaque["sargable_verdicts"].(map[string]*sargVerdict)
+		if verdicts == nil {
+			verdicts = map[string]*sargVerdict{}
+			rv.opaque["sargable_verdicts"] = verdicts
+		}
+		verdicts[verdictKey] = &sargVerdict{
+			count:        rv.count,
+			indexedCount: rv.indexedCount,
+			exact:        exact,
+		}
+	}
 
 	if util.Debug > 0 {
 		logging.Infof("n1fty: Sargable, index: %s, field: %s, query: %v,"+
@@ -430,24 +790,343 @@ func (i *FTSIndex) Sargable(field string, query,
 	return rv.count, rv.indexedCount, exact, rv.opaque, rv.err
 }
 
+// SargableResult is the verdict of an index checked by SargableBatch(..).
+type SargableResult struct {
+	Index        *FTSIndex
+	Count        int
+	IndexedCount int64
+	Exact        bool
+	Err          errors.Error
+}
+
+// SargableBatch checks the query for each of the indexes, with the opaque
+// shared across them so the query's parsed just once, returning the
+// verdicts (those of Sargable(..) over each index by itself) ranked as
+// the planner picks an index: by count (higher the better), indexed count
+// (lower the better) and exact ahead of not; the indexes that errored
+// are ranked last.
+func SargableBatch(indexes []*FTSIndex, field string, query,
+	options expression.Expression) []*SargableResult {
+	rv := make([]*SargableResult, 0, len(indexes))
+
+	var opaque interface{}
+	for _, i := range indexes {
+		r := &SargableResult{Index: i}
+		r.Count, r.IndexedCount, r.Exact, opaque, r.Err = i.Sargable(field,
+			query, options, opaque)
+		rv = append(rv, r)
+	}
+
+	sort.SliceStable(rv, func(x, y int) bool {
+		a, b := rv[x], rv[y]
+		if (a.Err == nil) != (b.Err == nil) {
+			return a.Err == nil
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.IndexedCount != b.IndexedCount {
+			return a.IndexedCount < b.IndexedCount
+		}
+		return a.Exact && !b.Exact
+	})
+
+	return rv
+}
+
+// sargVerdict is the outcome of a Sargable(..) check, as recorded within
+// the opaque.
+type sargVerdict struct {
+	count        int
+	indexedCount int64
+	exact        bool
+}
+
+// sargVerdictKey identifies the verdict of the index for the field and
+// options, within the opaque (that's shared by the indexes considered
+// for a query); a verdict reached before the query value was available
+// is told apart from one reached with it.
+func (i *FTSIndex) sargVerdictKey(field string, queryAvailable bool,
+	options value.Value) (string, error) {
+	var optionsBytes []byte
+	if options != nil {
+		var err error
+		optionsBytes, err = options.MarshalJSON()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%s/%s/%s/%t/%s", i.Id(), i.Name(), field,
+		queryAvailable, optionsBytes), nil
+}
+
+// buildQueryAndCheckIfSargable checks whether the query is sargable for
+// the index, building the search request to issue for it; a conjunction
+// that the index covers only some clauses of is partially sargable, see
+// checkConjunctsSargable(..).
 func (i *FTSIndex) buildQueryAndCheckIfSargable(field string,
 	query, options value.Value, opaque interface{}) *sargableRV {
-	rv := &sargableRV{}
+	if i.onSargableCheck != nil {
+		i.onSargableCheck()
+	}
+
+	rv := i.checkSargable(field, query, options, opaque)
+	if rv.err != nil || rv.count > 0 || query == nil {
+		return rv
+	}
+
+	rv = i.checkCondSubsumedSargable(field, options, rv)
+	if rv.err != nil || rv.count > 0 {
+		return rv
+	}
+
+	return i.checkConjunctsSargable(field, options, rv)
+}
+
+// checkCondSubsumedSargable checks the query (not sargable as a whole)
+// without its clauses that are subsumed by the index's condition, that
+// is, those matching the type field with the one type mapping enabled
+// (for ex. {"term": "beer", "field": "type"} when the condition's
+// `type` = "beer"), that hold for all the documents indexed, whether or
+// not the type field's indexed itself. If the rest of the query's
+// sargable, the search request carries just that, with the result exact.
+func (i *FTSIndex) checkCondSubsumedSargable(field string,
+	options value.Value, rv *sargableRV) *sargableRV {
+	if i.condTypeField == "" || len(i.condTypes) != 1 {
+		return rv
+	}
+
+	explain, _ := rv.opaque["explain"].(*SargExplanation)
+
+	sr, _ := rv.opaque["search_request"].(*cbft.SearchRequest)
+	if sr == nil || len(sr.Q) == 0 {
+		return rv
+	}
+
+	conjuncts, err := util.QueryConjuncts(sr)
+	if err != nil {
+		return rv
+	}
+	if conjuncts == nil {
+		// the query's a single clause.
+		conjuncts = []json.RawMessage{sr.Q}
+	}
+
+	var rest []json.RawMessage
+	for _, c := range conjuncts {
+		name, term, ok := util.QueryClauseTerm(c)
+		if !ok || name != i.condTypeField || term != i.condTypes[0] {
+			rest = append(rest, c)
+		}
+	}
+
+	if len(rest) == len(conjuncts) {
+		return rv
+	}
+
+	var q []byte
+	switch len(rest) {
+	case 0:
+		// all of the documents indexed are matched.
+		q = []byte(`{"match_all":{}}`)
+	case 1:
+		q = rest[0]
+	default:
+		q, err = json.Marshal(map[string]interface{}{"conjuncts": rest})
+		if err != nil {
+			return rv
+		}
+	}
+
+	crv := i.checkSargable(field, value.NewValue(q), options, nil)
+	if crv.err != nil || crv.count == 0 || crv.searchRequest == nil {
+		return rv
+	}
+
+	searchRequest := *sr
+	searchRequest.Q = crv.searchRequest.Q
+
+	explain.decide(fmt.Sprintf("sargable, %d of %d clauses subsumed by the"+
+		" index condition", len(conjuncts)-len(rest), len(conjuncts)))
+
+	rv.searchRequest = &searchRequest
+	rv.count = crv.count
+	rv.indexedCount = crv.indexedCount
+	rv.exact = crv.exact
+
+	return rv
+}
+
+// checkConjunctsSargable checks the clauses of a query that's a
+// conjunction (not sargable as a whole) individually, and if the index
+// covers some of them, has the search request carry just those, with
+// the sargable count that of the fields covered and the result inexact,
+// for the covered clauses to pre-filter the documents that N1QL re-checks
+// the query against. The search request otherwise remains the same, as
+// the planner doesn't push the pagination down to an inexact index.
+func (i *FTSIndex) checkConjunctsSargable(field string,
+	options value.Value, rv *sargableRV) *sargableRV {
+	explain, _ := rv.opaque["explain"].(*SargExplanation)
+
+	sr, _ := rv.opaque["search_request"].(*cbft.SearchRequest)
+	conjuncts, err := util.QueryConjuncts(sr)
+	if err != nil || len(conjuncts) < 2 {
+		return rv
+	}
+
+	var covered []json.RawMessage
+	names := map[string]struct{}{}
+	for _, c := range conjuncts {
+		crv := i.checkSargable(field, value.NewValue([]byte(c)), options, nil)
+		if crv.err != nil || crv.count == 0 || crv.searchRequest == nil {
+			continue
+		}
+
+		// the clause as rewritten for the index, for ex. with its fields
+		// aliased.
+		covered = append(covered, crv.searchRequest.Q)
+
+		queryFields, _ := crv.opaque["query_fields"].(map[util.SearchField]struct{})
+		for f := range queryFields {
+			// the _all field (a field without a name) counts as one.
+			names[f.Name] = struct{}{}
+		}
+	}
+
+	if len(covered) == 0 || len(covered) == len(conjuncts) {
+		return rv
+	}
+
+	searchRequest, err := util.ConjunctsSearchRequest(sr, covered)
+	if err != nil {
+		return rv
+	}
+
+	explain.decide(fmt.Sprintf("partially sargable, %d of %d conjuncts"+
+		" covered", len(covered), len(conjuncts)))
+
+	rv.searchRequest = searchRequest
+	rv.count = len(names)
+	rv.indexedCount = i.indexedCount
+	rv.exact = false
+
+	return rv
+}
+
+// collapsible returns true if the field by the name is indexed (other than
+// as a dynamic mapping) and stored, for the hits to be collapsed by it.
+func (i *FTSIndex) collapsible(name string) bool {
+	if !i.mappingInfo.IsStoredField(name) {
+		return false
+	}
+
+	for f, dynamic := range i.searchableFields {
+		if f.Name == name && !dynamic {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inferredFields returns the fields (with the types, analyzers and date
+// formats) inferred from the index for the query fields without a type,
+// as recorded within the opaque by index name, under "inferred_fields",
+// for the checks that follow over the same opaque (for ex. at search time)
+// to keep to, rather than infer them again.
+func (i *FTSIndex) inferredFields(
+	opaque map[string]interface{}) map[util.SearchField]util.SearchField {
+	all, _ := opaque["inferred_fields"].(map[string]map[util.SearchField]util.SearchField)
+	if all == nil {
+		all = map[string]map[util.SearchField]util.SearchField{}
+		opaque["inferred_fields"] = all
+	}
+
+	rv := all[i.Name()]
+	if rv == nil {
+		rv = map[util.SearchField]util.SearchField{}
+		all[i.Name()] = rv
+	}
+
+	return rv
+}
+
+// unsupportedQuery has a query of a type whose fields aren't known to be
+// extracted deemed not sargable (for the indexes checked after, too), and
+// counted, or else failed with strictQueryTypes.
+func (i *FTSIndex) unsupportedQuery(uerr *util.UnsupportedQueryTypeError,
+	rv *sargableRV, explain *SargExplanation) {
+	if i.indexer != nil {
+		atomic.AddInt64(&i.indexer.stats.TotalUnsupportedQueries, 1)
+	}
+
+	if GetStrictQueryTypes() {
+		rv.err = util.N1QLError(uerr, uerr.Error())
+		return
+	}
+
+	logging.Warnf("n1fty: index: %s, %v, not sargable", i.Name(), uerr)
+	rv.opaque["unsupported_query"] = uerr
+	explain.decide(uerr.Error())
+}
+
+// checkSargable checks whether the query is sargable for the index as a
+// whole.
+func (i *FTSIndex) checkSargable(field string,
+	query, options value.Value, opaque interface{}) *sargableRV {
+	rv := &sargableRV{exact: true}
 	var ok bool
 	rv.opaque, ok = opaque.(map[string]interface{})
 	if !ok {
 		rv.opaque = make(map[string]interface{})
 	}
 
+	// an explanation is recorded only when requested, see ExplainSargable
+	explain, _ := rv.opaque["explain"].(*SargExplanation)
+
 	var err error
 	var queryFields map[util.SearchField]struct{}
 	var sr *cbft.SearchRequest
 	var ctlTimeout int64
+	var dateRanges []*util.DateRange
+	var phraseFields map[string]bool
+
+	if uerr, ok := rv.opaque["unsupported_query"].(*util.UnsupportedQueryTypeError); ok {
+		// as found by the check for an index ahead, and counted then.
+		explain.decide(uerr.Error())
+		return rv
+	}
 
 	if queryFieldsInterface, exists := rv.opaque["query_fields"]; !exists {
 		// if opaque didn't carry a "query" entry, go ahead and
 		// process the field+query provided to retrieve queryFields.
 		queryFields, sr, ctlTimeout, err = util.ParseQueryToSearchRequest(field, query)
+		if err != nil {
+			if uerr, ok := err.(*util.UnsupportedQueryTypeError); ok {
+				i.unsupportedQuery(uerr, rv, explain)
+				return rv
+			}
+			if derr, ok := err.(*util.QueryTooDeepError); ok {
+				logging.Warnf("n1fty: index: %s, %v, not sargable", i.Name(), derr)
+				explain.decide(derr.Error())
+				return rv
+			}
+			rv.err = util.N1QLError(err, "failed to parse query to search request")
+			return rv
+		}
+
+		// the date ranges as given, whose time zones (if any) bleve's
+		// parsing doesn't retain.
+		dateRanges, err = util.FetchDateRanges(field, query)
+		if err != nil {
+			rv.err = util.N1QLError(err, "failed to parse query to search request")
+			return rv
+		}
+
+		// the fields phrases are matched over, that need the terms'
+		// positions indexed.
+		phraseFields, err = util.FetchPhraseFields(sr)
 		if err != nil {
 			rv.err = util.N1QLError(err, "failed to parse query to search request")
 			return rv
@@ -457,8 +1136,12 @@ func (i *FTSIndex) buildQueryAndCheckIfSargable(field string,
 		rv.opaque["query_fields"] = queryFields
 		rv.opaque["search_request"] = sr
 		rv.opaque["ctl_timeout"] = ctlTimeout
+		rv.opaque["date_ranges"] = dateRanges
+		rv.opaque["phrase_fields"] = phraseFields
 	} else {
 		queryFields, _ = queryFieldsInterface.(map[util.SearchField]struct{})
+		dateRanges, _ = rv.opaque["date_ranges"].([]*util.DateRange)
+		phraseFields, _ = rv.opaque["phrase_fields"].(map[string]bool)
 
 		// if an entry for "query" exists, we can assume that an entry for
 		// "search_request" also exists.
@@ -471,64 +1154,188 @@ func (i *FTSIndex) buildQueryAndCheckIfSargable(field string,
 	rv.searchRequest = sr
 	rv.timeoutMS = ctlTimeout
 
+	var preferExact bool
 	if options != nil {
 		// check if an "index" entry exists and if it matches
+		// the index may be selected by name and/or UUID, all of which need
+		// to match this index, so a query doesn't bind to an index that's
+		// been recreated under the same name.
+		var names, uuids []string
+
 		indexVal, exists := options.Field("index")
 		if exists {
-			if indexVal.Type() == value.OBJECT {
-				var im *mapping.IndexMappingImpl
-				// check if opaque carries an "index" entry
-				if imInterface, exists := rv.opaque["index_mapping"]; !exists {
-					// if in case this value were an object, it is expected to be
-					// a mapping, check if this mapping is compatible with the
-					// current index's mapping.
-					im, err = util.ConvertValObjectToIndexMapping(indexVal)
-					if err != nil {
-						rv.err = util.N1QLError(err, "index mapping option isn't valid")
+			if indexVal.Type() == value.OBJECT && util.IsIndexSelector(indexVal) {
+				// an object carrying just the "name" and/or "uuid" of the index.
+				for k, v := range indexVal.Fields() {
+					id, ok := v.(string)
+					if !ok || len(id) == 0 {
+						rv.err = util.N1QLError(fmt.Errorf("index option: %v,"+
+							" %s must be a non-empty string", indexVal, k),
+							"index option isn't valid")
 						return rv
 					}
 
-					// update opaqueMap
-					rv.opaque["index_mapping"] = im
-				} else {
-					im, _ = imInterface.(*mapping.IndexMappingImpl)
+					if k == "name" {
+						names = append(names, id)
+					} else {
+						uuids = append(uuids, id)
+					}
+				}
+			} else if indexVal.Type() == value.OBJECT {
+				// if in case this value were an object, it is expected to be
+				// a mapping, check if this mapping is compatible with the
+				// current index's mapping.
+				pm, err := i.processIndexMappingOption(indexVal, rv.opaque)
+				if err != nil {
+					rv.err = util.N1QLError(err, "index mapping option isn't valid")
+					return rv
 				}
 
-				searchableFields, _, _, dynamicMappings, _,
-					defaultAnalyzer, defaultDateTimeParser := util.ProcessIndexMapping(im)
-
-				if len(dynamicMappings) == 0 && len(i.dynamicMappings) == 0 {
+				if len(pm.dynamicMappings) == 0 && len(i.dynamicMappings) == 0 {
 					// no dynamic mappings
-					for k, expect := range searchableFields {
+					for k, expect := range pm.searchableFields {
 						if got, exists := i.searchableFields[k]; !exists || got != expect {
+							explain.decide("index mapping option incompatible, field: " +
+								k.Name)
 							return rv
 						}
 					}
 
-					if (defaultAnalyzer != "" && defaultAnalyzer != i.defaultAnalyzer) ||
-						(defaultDateTimeParser != "" &&
-							defaultDateTimeParser != i.defaultDateTimeParser) {
+					if (pm.defaultAnalyzer != "" &&
+						pm.defaultAnalyzer != i.defaultAnalyzer) ||
+						(pm.defaultDateTimeParser != "" &&
+							pm.defaultDateTimeParser != i.defaultDateTimeParser) {
+						explain.decide("index mapping option incompatible," +
+							" default analyzer or datetime parser")
 						return rv
 					}
 				}
 			} else if indexVal.Type() == value.STRING {
-				// if an index name has been provided, check if the current index
-				// shares the same name; if not this index is not sargable, also
-				// check for indexUUID if available.
-				if i.Name() != indexVal.Actual().(string) {
-					// not sargable
-					return rv
-				}
+				names = append(names, indexVal.Actual().(string))
 			}
 		}
 
-		// check if an "indexUUID" entry exists and if it matches
+		// check if an "indexUUID" entry exists
 		indexUUIDVal, indexUUIDAvailable := options.Field("indexUUID")
 		if indexUUIDAvailable && indexUUIDVal.Type() == value.STRING {
-			if i.Id() != indexUUIDVal.Actual().(string) {
+			uuids = append(uuids, indexUUIDVal.Actual().(string))
+		}
+
+		for _, name := range names {
+			if !util.IndexNameMatches(i.Name(), name) {
+				// not sargable
+				explain.decide("index option names another index")
+				return rv
+			}
+		}
+
+		for _, uuid := range uuids {
+			if i.Id() != uuid {
 				// not sargable
+				explain.decide("index option carries another index's UUID")
+				return rv
+			}
+		}
+
+		// the hits are collapsed by the value of a field, that's to be
+		// indexed and stored, for it to be returned with them.
+		if name := util.CollapseField(options); name != "" &&
+			!i.collapsible(name) {
+			explain.decide("collapse field not indexed and stored: " + name)
+			return rv
+		}
+
+		// check if a "prefer_exact" entry exists, see preferExactCount.
+		if v, exists := options.Field("prefer_exact"); exists {
+			if v.Type() != value.BOOLEAN {
+				rv.err = util.N1QLError(fmt.Errorf("prefer_exact option: %v,"+
+					" must be a boolean", v), "prefer_exact option isn't valid")
 				return rv
 			}
+			preferExact = v.Truth()
+		}
+	}
+
+	// query fields over the elements of arrays are checked (and searched)
+	// by the paths they're indexed under.
+	queryFields, elementPaths, positional := resolveArrayElementFields(
+		queryFields)
+	if positional != "" {
+		explain.decide("query field array position unsupported: " +
+			positional)
+		return rv
+	}
+
+	// query fields whose names are aliased within the index mapping, are
+	// checked (and searched) by the names they're indexed under.
+	queryFields, aliases, err := i.resolveFieldAliases(queryFields)
+	if err != nil {
+		rv.err = util.N1QLError(err, "field alias err")
+		return rv
+	}
+
+	for name, path := range elementPaths {
+		if aliases == nil {
+			aliases = map[string]string{}
+		}
+		if alias, ok := aliases[path]; ok {
+			path = alias
+		}
+		aliases[name] = path
+	}
+
+	if len(aliases) > 0 {
+		rv.searchRequest, err = util.RewriteQueryFields(sr, aliases)
+		if err != nil {
+			rv.err = util.N1QLError(err, "failed to rewrite aliased fields")
+			return rv
+		}
+	}
+
+	explain.setQueryFields(queryFields)
+
+	// the datetime fields queried with a time zone, by the names they're
+	// indexed under.
+	var zonedFields map[string]bool
+	for _, dr := range dateRanges {
+		if dr.HasTimeZone() {
+			if zonedFields == nil {
+				zonedFields = map[string]bool{}
+			}
+			name := dr.Field
+			if alias, ok := aliases[name]; ok {
+				name = alias
+			}
+			zonedFields[name] = true
+		}
+	}
+
+	// the fields phrases are matched over, by the names they're indexed
+	// under.
+	var positionalFields map[string]bool
+	for name := range phraseFields {
+		if positionalFields == nil {
+			positionalFields = map[string]bool{}
+		}
+		if alias, ok := aliases[name]; ok {
+			name = alias
+		}
+		positionalFields[name] = true
+	}
+
+	if !i.fieldlessQueriesAllowed() {
+		// the query (or some clause of it) searching without fields, over
+		// the _all field, isn't sargable when disallowed for the index.
+		fieldless := len(queryFields) == 0
+		for f := range queryFields {
+			if f.Name == "" {
+				explain.check(f, f, false, "fieldless queries disallowed")
+				fieldless = true
+			}
+		}
+		if fieldless {
+			explain.decide("fieldless queries disallowed for the index")
+			return rv
 		}
 	}
 
@@ -545,24 +1352,36 @@ func (i *FTSIndex) buildQueryAndCheckIfSargable(field string,
 			}
 		}
 		if compatibleWithDynamicMapping {
-			var count int
+			for qf := range queryFields {
+				explain.check(qf, qf, true,
+					"dynamic mapping, default analyzer: "+defaultAnalyzer)
+			}
+			explain.decide("query fields compatible with a dynamic mapping")
+
+			// a field queried with different types or analyzers counts once.
+			matched := map[string]struct{}{}
 			for qf, _ := range queryFields {
 				if len(qf.Name) == 0 {
 					// if even a single sub-query doesn't have it's field set,
 					// reset count to 0, and overwrite sargable count to the
 					// number of fields indexed.
-					count = 0
+					matched = nil
 					break
 				}
-				count++
+				matched[qf.Name] = struct{}{}
 			}
-			rv.count = count
+			rv.count = len(matched)
 			if rv.count == 0 {
 				// if field(s) not provided or unavailable within query,
 				// search is applicable on all indexed fields.
 				rv.count = int(i.indexedCount)
 			}
-			rv.indexedCount = i.indexedCount
+			if preferExact {
+				rv.count = preferExactCount
+				explain.decide("query fields compatible with a dynamic" +
+					" mapping, ranked below exact indexes (prefer_exact)")
+			}
+			rv.indexedCount = GetDynamicMappingIndexedCount()
 			return rv
 		}
 	}
@@ -581,46 +1400,81 @@ func (i *FTSIndex) buildQueryAndCheckIfSargable(field string,
 			return false
 		}
 
-		var matched bool
-		entry := fieldSplitAtDot[0]
-		for k := 1; k < len(fieldSplitAtDot); k++ {
-			searchField := util.SearchField{
-				Name:     entry,
-				Analyzer: field.Analyzer,
-			}
-			if dynamic, exists := i.searchableFields[searchField]; exists {
-				if dynamic {
-					matched = true
-					break
-				}
-			}
+		// the nearest dynamic mapping the field is under decides, a nested
+		// one overriding the default analyzer of those above it.
+		parent, analyzers := i.mappingInfo.DynamicParentOf(field.Name)
+		if parent == "" {
+			// not sargable
+			return false
+		}
 
-			entry += "." + fieldSplitAtDot[k]
+		// the numbers, booleans and dates (those parsed with the index's
+		// default parser) under a dynamic mapping are indexed regardless
+		// of its analyzer, as are those within arrays of objects.
+		if field.Type == "number" || field.Type == "boolean" ||
+			(field.Type == "datetime" &&
+				field.DateFormat == i.defaultDateTimeParser) {
+			return true
 		}
 
-		if !matched {
-			// not sargable
-			return false
+		for _, analyzer := range analyzers {
+			if analyzer == field.Analyzer {
+				return true
+			}
 		}
 
-		return true
+		// not sargable, the text under the dynamic parent being
+		// analyzed otherwise.
+		return false
 	}
 
-	var count int
+	// a field (whose type was inferred) is searchable if indexed as such,
+	// or under a dynamic parent.
+	inferredSearchable := func(f util.SearchField) bool {
+		dynamic, exists := i.searchableFields[f]
+		return (exists && !dynamic) || (!exists && isParentFieldSearchable(f))
+	}
+
+	inferred := i.inferredFields(rv.opaque)
+
+	// the (distinct) names of the query fields matched with the index's
+	// fields, directly or under a dynamic parent; query fields without a
+	// name are matched with the _all field.
+	matched := map[string]struct{}{}
+	var allFieldMatched bool
 	for f := range queryFields {
+		qf := f
 		if f.Name == "" {
 			// field name not provided/available
 			// check if index supports _all field, if not, this query is not sargable
 			if !i.allFieldSearchable {
+				explain.check(qf, f, false, "_all field isn't searchable")
+				explain.decide("query field without a name, over _all")
 				return rv
 			}
 
+			if f.Analyzer != "" && !i.mappingInfo.HasAllFieldAnalyzer(f.Analyzer) {
+				// the query's analyzer needs to be that of some content
+				// within the _all field.
+				explain.check(qf, f, false, "_all field not analyzed with the analyzer")
+				explain.decide("query field without a name, over _all")
+				return rv
+			}
+
+			explain.check(qf, f, true, "_all field")
+			allFieldMatched = true
+
 			// move on to next query field
 			continue
 		}
 
-		count++
-		if f.Type == "" {
+		if r, exists := inferred[qf]; f.Type == "" && exists &&
+			inferredSearchable(r) {
+			// the type inferred by an earlier check (over the same opaque),
+			// which is kept to, rather than inferred again.
+			f = r
+			explain.check(qf, f, true, "type inferred earlier")
+		} else if f.Type == "" {
 			// type isn't available, likely because query value wasn't available;
 			// check field name against all possible types
 			for _, typ := range []string{
@@ -630,6 +1484,10 @@ func (i *FTSIndex) buildQueryAndCheckIfSargable(field string,
 					f.Analyzer = i.defaultAnalyzer
 				} else if typ == "datetime" {
 					f.DateFormat = i.defaultDateTimeParser
+					if !i.mappingInfo.HasFieldDateFormat(f.Name, f.DateFormat) {
+						// the field's indexed with a date/time parser of its own.
+						f.DateFormat = i.mappingInfo.DateFormatsOf(f.Name)[0]
+					}
 				}
 
 				dynamic, exists := i.searchableFields[f]
@@ -650,10 +1508,15 @@ func (i *FTSIndex) buildQueryAndCheckIfSargable(field string,
 
 			if f.Type == "" {
 				// not sargable
+				explain.check(qf, f, false, "not indexed under any type")
+				explain.decide("query field not indexed: " + f.Name)
 				return rv
 			}
 
+			inferred[qf] = f
+			explain.check(qf, f, true, "type inferred from the index")
 		} else {
+			explicitAnalyzer := f.Type == "text" && f.Analyzer != ""
 			if f.Type == "text" && f.Analyzer == "" {
 				// set analyzer to defaultAnalyzer for those query fields of type:text,
 				// that don't have an explicit analyzer set already.
@@ -664,27 +1527,133 @@ func (i *FTSIndex) buildQueryAndCheckIfSargable(field string,
 				f.DateFormat = i.defaultDateTimeParser
 			}
 
-			dynamic, exists := i.searchableFields[f]
-			if exists && dynamic {
-				// if searched field contains nested fields, then this field is not
-				// searchable, and the query not sargable.
+			checkField := func(f util.SearchField) (ok bool, reason, decision string) {
+				dynamic, exists := i.searchableFields[f]
+				if exists && dynamic {
+					// if searched field contains nested fields, then this field is not
+					// searchable, and the query not sargable.
+					return false, "field is a dynamic (object) mapping",
+						"query field not searchable: " + f.Name
+				}
+
+				if !exists {
+					if !isParentFieldSearchable(f) {
+						if explicitAnalyzer &&
+							len(i.mappingInfo.AnalyzersOf(f.Name)) > 0 {
+							// indexed, though with analyzers other than that
+							// set, rather than the default being assumed.
+							return false, "not indexed with the analyzer",
+								"query field analyzer mismatch: " + f.Name
+						}
+						// not sargable
+						return false, "not indexed", "query field not indexed: " + f.Name
+					}
+					return true, "parent mapping is dynamic", ""
+				}
+
+				if f.Type == "datetime" && zonedFields[f.Name] &&
+					!i.mappingInfo.DateFormatHasTimeZone(f.DateFormat) {
+					// the field's dates are parsed without time zones, which
+					// those of the query carry.
+					return false, "date/time parser without time zones",
+						"query field time zone unsupported: " + f.Name
+				}
+
+				if f.Type == "text" && positionalFields[f.Name] &&
+					!i.mappingInfo.HasTermVectors(f.Name) {
+					// the phrases are matched by the terms' positions, that
+					// aren't indexed without the term vectors.
+					return false, "indexed without term vectors",
+						"query field phrase unsupported: " + f.Name
+				}
+
+				if explicitAnalyzer &&
+					!i.mappingInfo.HasFieldAnalyzer(f.Name, f.Analyzer) {
+					// the field is also registered under the index's default
+					// analyzer (MB-33821), for queries that don't set one; an
+					// analyzer set explicitly (for ex. over a phrase) needs to
+					// be the one the field is indexed with.
+					return false, "not indexed with the analyzer",
+						"query field analyzer mismatch: " + f.Name
+				}
+
+				return true, "indexed", ""
+			}
+
+			ok, reason, decision := checkField(f)
+			if !ok && f.Type == "datetime" {
+				// the field may be indexed with a date/time parser of its own
+				// rather than the index's default; the query's dates are
+				// parsed independently of the field's (as per bleve's
+				// QueryDateTimeParser), so any of the parsers the field is
+				// indexed with will do, as long as it parses the time zones
+				// the query carries.
+				for _, dateFormat := range i.mappingInfo.DateFormatsOf(f.Name) {
+					fv := f
+					fv.DateFormat = dateFormat
+					okv, reasonv, decisionv := checkField(fv)
+					f, ok, reason, decision = fv, okv, reasonv, decisionv
+					if ok {
+						break
+					}
+				}
+			}
+
+			if !ok && f.Type == "text" && !explicitAnalyzer {
+				// without an analyzer set, the query is analyzed (by FTS)
+				// with that of the field or its dynamic parent, so any of
+				// the analyzer variants it's indexed under will do.
+				for _, analyzer := range i.analyzerVariants(f.Name) {
+					fv := f
+					fv.Analyzer = analyzer
+					if okv, reasonv, _ := checkField(fv); okv {
+						f, ok, reason = fv, okv, reasonv
+						break
+					}
+				}
+			}
+
+			if !ok {
+				explain.check(qf, f, false, reason)
+				explain.decide(decision)
 				return rv
 			}
 
-			if !exists {
-				if !isParentFieldSearchable(f) {
-					// not sargable
-					return rv
+			if i.multipleTypeStrs {
+				// the field is searchable if under any of the type mappings,
+				// the documents of which are those of the index's condition.
+				reason += ", types: " + strings.Join(
+					i.mappingInfo.TypesOf(f.Name), ", ")
+			}
+
+			if f.Type == "text" && !explicitAnalyzer {
+				// report the analyzer the field is indexed with, rather than
+				// the default it's also registered under.
+				fe := f
+				if analyzers := i.mappingInfo.AnalyzersOf(f.Name); len(analyzers) > 0 &&
+					!i.mappingInfo.HasFieldAnalyzer(f.Name, f.Analyzer) {
+					fe.Analyzer = analyzers[0]
 				}
+				explain.check(qf, fe, true, reason+", analyzer: "+fe.Analyzer)
+			} else {
+				explain.check(qf, f, true, reason)
 			}
 		}
+
+		matched[f.Name] = struct{}{}
+	}
+
+	rv.count = len(matched)
+	if rv.count > 0 && allFieldMatched {
+		// the _all field counts as one more field covered.
+		rv.count++
 	}
 
-	rv.count = count
 	if rv.count == 0 {
 		// if field(s) not provided or unavailable within query,
 		// index is not sargable if it does not support _all field
 		if !i.allFieldSearchable {
+			explain.decide("no query fields and _all field isn't searchable")
 			return rv
 		}
 
@@ -697,6 +1666,156 @@ func (i *FTSIndex) buildQueryAndCheckIfSargable(field string,
 	return rv
 }
 
+// analyzerVariants returns the (sorted) analyzers other than the default
+// that the text field is indexed with, directly or under a dynamic parent.
+func (i *FTSIndex) analyzerVariants(name string) []string {
+	variants := map[string]struct{}{}
+	for f, dynamic := range i.searchableFields {
+		if f.Analyzer == "" || f.Analyzer == i.defaultAnalyzer {
+			continue
+		}
+
+		if (f.Name == name && f.Type == "text" && !dynamic) ||
+			(dynamic && strings.HasPrefix(name, f.Name+".")) {
+			variants[f.Analyzer] = struct{}{}
+		}
+	}
+
+	rv := make([]string, 0, len(variants))
+	for analyzer := range variants {
+		rv = append(rv, analyzer)
+	}
+	sort.Strings(rv)
+
+	return rv
+}
+
+// dynamicAnalyzers returns the (default) analyzers of the index's dynamic
+// mappings, nested or not.
+func (i *FTSIndex) dynamicAnalyzers() []string {
+	analyzers := map[string]struct{}{}
+	for f, dynamic := range i.searchableFields {
+		if dynamic {
+			analyzers[f.Analyzer] = struct{}{}
+		}
+	}
+
+	rv := make([]string, 0, len(analyzers))
+	for analyzer := range analyzers {
+		rv = append(rv, analyzer)
+	}
+	sort.Strings(rv)
+
+	return rv
+}
+
+// resolveArrayElementFields returns the query fields with the array
+// element selectors dropped from their names, along with the paths of the
+// names that had them; a field selecting an element by its position is
+// returned as positional, as it can't be searched for.
+func resolveArrayElementFields(queryFields map[util.SearchField]struct{}) (
+	map[util.SearchField]struct{}, map[string]string, string) {
+	var paths map[string]string
+	var rv map[util.SearchField]struct{}
+	for f := range queryFields {
+		path, positional := util.ArrayElementPath(f.Name)
+		if positional {
+			return nil, nil, f.Name
+		}
+
+		if path != f.Name {
+			if paths == nil {
+				paths = map[string]string{}
+			}
+			paths[f.Name] = path
+		}
+	}
+
+	if len(paths) == 0 {
+		return queryFields, nil, ""
+	}
+
+	rv = make(map[util.SearchField]struct{}, len(queryFields))
+	for f := range queryFields {
+		if path, ok := paths[f.Name]; ok {
+			f.Name = path
+		}
+		rv[f] = struct{}{}
+	}
+
+	return rv, paths, ""
+}
+
+// resolveFieldAliases returns the query fields with any aliased field
+// names replaced by the names they're indexed under, along with the
+// aliases applied.
+func (i *FTSIndex) resolveFieldAliases(
+	queryFields map[util.SearchField]struct{}) (
+	map[util.SearchField]struct{}, map[string]string, error) {
+	if i.mappingInfo == nil || len(i.mappingInfo.FieldAliases) == 0 {
+		return queryFields, nil, nil
+	}
+
+	var aliases map[string]string
+	rv := make(map[util.SearchField]struct{}, len(queryFields))
+	for f := range queryFields {
+		name, err := i.mappingInfo.ResolveFieldAlias(f.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if name != "" {
+			if aliases == nil {
+				aliases = map[string]string{}
+			}
+			aliases[f.Name] = name
+			f.Name = name
+		}
+
+		rv[f] = struct{}{}
+	}
+
+	return rv, aliases, nil
+}
+
+// processIndexMappingOption returns the processed form of the index mapping
+// provided within the options, looking it up from the opaque first and
+// then from the indexer's mapping cache before processing it afresh.
+func (i *FTSIndex) processIndexMappingOption(indexVal value.Value,
+	opaque map[string]interface{}) (*processedMapping, error) {
+	// check if opaque carries an "index_mapping" entry
+	if pm, ok := opaque["index_mapping"].(*processedMapping); ok {
+		return pm, nil
+	}
+
+	var cache *mappingCache
+	if i.indexer != nil {
+		cache = i.indexer.mappingCache
+	}
+
+	mappingBytes, err := indexVal.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	key := mappingCacheKeyFor(mappingBytes)
+	pm := cache.get(key)
+	if pm == nil {
+		im, err := util.ConvertValObjectToIndexMapping(indexVal)
+		if err != nil {
+			return nil, err
+		}
+
+		pm = newProcessedMapping(im)
+		cache.add(key, pm)
+	}
+
+	// update opaqueMap
+	opaque["index_mapping"] = pm
+
+	return pm, nil
+}
+
 // -----------------------------------------------------------------------------
 
 // Pageable returns `true` when it can deliver sorted paged results
@@ -726,15 +1845,82 @@ func (i *FTSIndex) pageable(order []string, offset, limit int64, query,
 	// info(From, Size or Sort details) then returns false.
 	if queryVal != nil {
 		if qf, ok := queryVal.Field("query"); ok && qf.Type() == value.OBJECT {
-			if util.CheckForPagination(queryVal) {
-				// User provided pagination details that could possibly
-				// conflict with higher offset/limit settings
-				return false
+			// a sort by descending score, the native order of FTS, is
+			// that of the results when the order given (if any) is too.
+			if util.CheckForPagination(queryVal) &&
+				!util.ScoreOrderedOnly(queryVal, order) {
+				// a sort by geo distance (over the index's geopoint fields)
+				// is the order of the results, that the offset/limit are
+				// applied over.
+				if len(order) > 0 || !i.geoDistanceSortable(queryVal) {
+					// User provided pagination details that could possibly
+					// conflict with higher offset/limit settings
+					return false
+				}
 			}
 		}
 	}
 
-	return offset+limit <= util.GetBleveMaxResultWindow()
+	var optionsVal value.Value
+	if options != nil {
+		optionsVal = options.Value()
+	}
+
+	// the hits scoring below the threshold are filtered out after those
+	// up to offset+limit are fetched, so fewer would be returned, as are
+	// the hits collapsed.
+	if util.MinScoreRequested(optionsVal) ||
+		util.CollapseField(optionsVal) != "" {
+		return false
+	}
+
+	// the hits sorted by their keys (see SearchOptions.Sort) are in the
+	// order given, only if that's the same.
+	if keyOrder := util.SortOption(optionsVal); len(keyOrder) > 0 &&
+		len(order) > 0 && !util.SortMatchesOrder(keyOrder, order) {
+		return false
+	}
+
+	// paging from a cursor, there's no window to the offset+limit.
+	if util.CursorRequested(optionsVal) {
+		return true
+	}
+
+	if offset+limit <= util.GetBleveMaxResultWindow() {
+		return true
+	}
+
+	// the hits past the window may be paged through, in the order given.
+	return len(order) > 0 && util.DeepPagingRequested(optionsVal)
+}
+
+// geoDistanceSortable returns true if the search request in the query value
+// sorts by distance over geopoint fields indexed by this index, and carries
+// no other pagination details.
+func (i *FTSIndex) geoDistanceSortable(queryVal value.Value) bool {
+	fields, ok := util.GeoDistanceSortFields(queryVal)
+	if !ok {
+		return false
+	}
+
+	for _, field := range fields {
+		name, err := i.mappingInfo.ResolveFieldAlias(field)
+		if err != nil {
+			return false
+		}
+		if name == "" {
+			name = field
+		}
+
+		if _, exists := i.searchableFields[util.SearchField{
+			Name: name,
+			Type: "geopoint",
+		}]; !exists {
+			return false
+		}
+	}
+
+	return true
 }
 
 // -----------------------------------------------------------------------------
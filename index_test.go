@@ -16,14 +16,19 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/blevesearch/bleve/v2/search/query"
 	"github.com/couchbase/cbgt"
 	"github.com/couchbase/n1fty/util"
 	"github.com/couchbase/query/datastore"
 	"github.com/couchbase/query/expression"
 	"github.com/couchbase/query/expression/parser"
 	"github.com/couchbase/query/expression/search"
+	"github.com/couchbase/query/value"
 )
 
 func setupSampleIndex(idef []byte) (*FTSIndex, error) {
@@ -223,6 +228,59 @@ func TestDynamicDefaultIndexSargabilityNoFieldsQuery(t *testing.T) {
 	}
 }
 
+func TestIndexSargabilityIndexedCountOfDynamicMappings(t *testing.T) {
+	defer SetDynamicMappingIndexedCount(GetDynamicMappingIndexedCount())
+
+	dynamic, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	explicit, err := setupSampleIndex(util.SampleIndexDefWithCustomDefaultMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := expression.NewConstant(map[string]interface{}{
+		"match": "san francisco", "field": "city"})
+
+	for _, dynamicIndexedCount := range []int64{math.MaxInt64, 100} {
+		SetDynamicMappingIndexedCount(dynamicIndexedCount)
+
+		tests := []struct {
+			index        *FTSIndex
+			query        expression.Expression
+			indexedCount int64
+		}{
+			{index: dynamic, query: query, indexedCount: dynamicIndexedCount},
+			// the query isn't available, sargable over the _all field.
+			{index: dynamic, indexedCount: dynamicIndexedCount},
+			{index: explicit, query: query, indexedCount: 3},
+		}
+
+		for testi, test := range tests {
+			count, indexedCount, _, _, n1qlErr := test.index.Sargable("",
+				test.query, nil, nil)
+			if n1qlErr != nil {
+				t.Fatal(n1qlErr)
+			}
+
+			if count == 0 || indexedCount != test.indexedCount {
+				t.Fatalf("[%d, %d] Expected indexed count: %d, got count: %d,"+
+					" indexed count: %d", dynamicIndexedCount, testi,
+					test.indexedCount, count, indexedCount)
+			}
+		}
+
+		// the index mapping the field explicitly is ranked first.
+		results := SargableBatch([]*FTSIndex{dynamic, explicit}, "", query, nil)
+		if results[0].Index != explicit {
+			t.Fatalf("[%d] Expected the explicit index ranked first, got: %+v",
+				dynamicIndexedCount, results[0])
+		}
+	}
+}
+
 func TestCustomIndexSargabilityNoFieldsQuery(t *testing.T) {
 	index, err := setupSampleIndex(util.SampleIndexDefWithCustomDefaultMapping)
 	if err != nil {
@@ -244,6 +302,266 @@ func TestCustomIndexSargabilityNoFieldsQuery(t *testing.T) {
 	}
 }
 
+func TestIndexSargabilityOfFieldlessQueriesDisallowed(t *testing.T) {
+	var def map[string]interface{}
+	if err := json.Unmarshal(util.SampleIndexDefDynamicDefault, &def); err != nil {
+		t.Fatal(err)
+	}
+	def["name"] = "SampleIndexDefFieldlessDisallowed"
+	def["params"].(map[string]interface{})["n1fty"] = map[string]interface{}{
+		"disallow_fieldless_queries": true,
+	}
+	idef, err := json.Marshal(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disallowed, err := setupSampleIndex(idef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fieldless := expression.NewConstant(map[string]interface{}{
+		"match": "san francisco"})
+	fielded := expression.NewConstant(map[string]interface{}{
+		"match": "san francisco", "field": "city"})
+
+	check := func(index *FTSIndex, query expression.Expression,
+		expectSargable bool) {
+		count, _, _, _, n1qlErr := index.Sargable("", query, nil, nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+
+		if (count > 0) != expectSargable {
+			t.Fatalf("[%s, %v] Expected sargable: %v, got count: %d",
+				index.Name(), query, expectSargable, count)
+		}
+	}
+
+	// the fieldless queries, and those unavailable (over the _all field),
+	// aren't sargable for the index disallowing them; those with fields are.
+	check(allowed, fieldless, true)
+	check(allowed, nil, true)
+	check(disallowed, fieldless, false)
+	check(disallowed, nil, false)
+	check(disallowed, fielded, true)
+
+	// the override by name takes precedence over the params, either way.
+	yes, no := true, false
+	SetFieldlessQueriesAllowed(disallowed.Name(), &yes)
+	SetFieldlessQueriesAllowed(allowed.Name(), &no)
+	defer SetFieldlessQueriesAllowed(disallowed.Name(), nil)
+	defer SetFieldlessQueriesAllowed(allowed.Name(), nil)
+
+	check(disallowed, fieldless, true)
+	check(disallowed, nil, true)
+	check(allowed, fieldless, false)
+	check(allowed, nil, false)
+	check(allowed, fielded, true)
+
+	// cleared, the params apply again.
+	SetFieldlessQueriesAllowed(disallowed.Name(), nil)
+	check(disallowed, fieldless, false)
+}
+
+func TestIndexSargabilityInferredTypesStable(t *testing.T) {
+	index, err := setupSampleIndex([]byte(`{
+		"name": "rated",
+		"type": "fulltext-index",
+		"params": {
+			"doc_config": {"mode": "type_field", "type_field": "type"},
+			"mapping": {
+				"default_analyzer": "standard",
+				"default_datetime_parser": "dateTimeOptional",
+				"default_mapping": {
+					"enabled": true,
+					"dynamic": false,
+					"properties": {
+						"rating": {
+							"enabled": true,
+							"dynamic": false,
+							"fields": [
+								{"name": "rating", "type": "number", "index": true},
+								{"name": "rating", "type": "text", "index": true}
+							]
+						}
+					}
+				}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the query isn't available at prepare time, leaving the field's type
+	// to be inferred from the index.
+	opaque := map[string]interface{}{}
+	count, _, _, _, n1qlErr := index.Sargable("rating", nil, nil, opaque)
+	if n1qlErr != nil || count != 1 {
+		t.Fatalf("Expected sargable, got count: %d, err: %v", count, n1qlErr)
+	}
+
+	qf := util.SearchField{Name: "rating"}
+	inferred, _ := opaque["inferred_fields"].(map[string]map[util.SearchField]util.SearchField)
+	if got := inferred["rated"][qf]; got.Type != "number" {
+		t.Fatalf("Expected the type inferred as number, got: %+v", inferred)
+	}
+
+	// the type recorded is kept to by the (search time) check that follows
+	// over the same opaque, even were it to be inferred differently.
+	inferred["rated"][qf] = util.SearchField{Name: "rating", Type: "text",
+		Analyzer: "standard"}
+
+	explain := &SargExplanation{}
+	opaque["explain"] = explain
+	rv := index.buildQueryAndCheckIfSargable("rating", nil, nil, opaque)
+	if rv.err != nil || rv.count != 1 {
+		t.Fatalf("Expected sargable, got count: %d, err: %v", rv.count, rv.err)
+	}
+
+	if len(explain.QueryFields) != 1 || explain.QueryFields[0].Type != "text" ||
+		explain.QueryFields[0].Reason != "type inferred earlier" {
+		t.Fatalf("Expected the type inferred earlier, got: %+v",
+			explain.QueryFields)
+	}
+
+	// a type no longer searchable is inferred again.
+	inferred["rated"][qf] = util.SearchField{Name: "rating", Type: "boolean"}
+	rv = index.buildQueryAndCheckIfSargable("rating", nil, nil, opaque)
+	if rv.err != nil || rv.count != 1 ||
+		inferred["rated"][qf].Type != "number" {
+		t.Fatalf("Expected the type inferred again, got count: %d, fields: %+v",
+			rv.count, inferred)
+	}
+}
+
+func TestIndexSargabilityWithCollapse(t *testing.T) {
+	index, err := setupSampleIndex([]byte(`{
+		"name": "products",
+		"type": "fulltext-index",
+		"params": {
+			"doc_config": {"mode": "type_field", "type_field": "type"},
+			"mapping": {
+				"default_analyzer": "standard",
+				"default_datetime_parser": "dateTimeOptional",
+				"default_mapping": {
+					"enabled": true,
+					"dynamic": false,
+					"properties": {
+						"name": {
+							"enabled": true,
+							"dynamic": false,
+							"fields": [{"name": "name", "type": "text", "index": true}]
+						},
+						"product_id": {
+							"enabled": true,
+							"dynamic": false,
+							"fields": [{"name": "product_id", "type": "text",
+								"analyzer": "keyword", "index": true, "store": true}]
+						}
+					}
+				}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := expression.NewConstant(map[string]interface{}{
+		"match": "shirt", "field": "name"})
+
+	tests := []struct {
+		field    string
+		sargable bool
+	}{
+		{field: "product_id", sargable: true},
+		{field: "name", sargable: false},  // not stored
+		{field: "color", sargable: false}, // not indexed
+	}
+
+	for _, test := range tests {
+		options := expression.NewConstant(map[string]interface{}{
+			"collapse": map[string]interface{}{"field": test.field}})
+
+		count, _, _, _, n1qlErr := index.Sargable("", query, options, nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+
+		if (count > 0) != test.sargable {
+			t.Fatalf("[%s] Expected sargable: %v, got count: %d", test.field,
+				test.sargable, count)
+		}
+
+		// the hits collapsed, the offset and limit can't be pushed down.
+		if index.Pageable([]string{"score DESC"}, 0, 10, query, options) {
+			t.Fatalf("[%s] Expected not pageable", test.field)
+		}
+	}
+}
+
+func TestIndexSargabilityWithQueryString(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithCustomDefaultMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		queryStr      string
+		expectedCount int
+	}{
+		{
+			queryStr:      "city:paris",
+			expectedCount: 1,
+		},
+		{
+			// "age" isn't indexed
+			queryStr:      "city:paris age:>30",
+			expectedCount: 0,
+		},
+		{
+			// "city" is indexed as text, not as a number
+			queryStr:      "city:>30",
+			expectedCount: 0,
+		},
+	}
+
+	for _, test := range tests {
+		query := expression.NewConstant(map[string]interface{}{
+			"query": test.queryStr,
+		})
+
+		count, _, _, _, n1qlErr := index.Sargable("", query,
+			expression.NewConstant(``), nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+
+		if count != test.expectedCount {
+			t.Fatalf("[%s] Expected sargable count of %v, but got: %v",
+				test.queryStr, test.expectedCount, count)
+		}
+	}
+
+	query := expression.NewConstant(map[string]interface{}{
+		"query": "city:paris age:>",
+	})
+
+	_, _, _, _, n1qlErr := index.Sargable("", query,
+		expression.NewConstant(``), nil)
+	if n1qlErr == nil {
+		t.Fatal("Expected an error for a malformed query string")
+	}
+}
+
 func TestIncompatibleIndexSargability(t *testing.T) {
 	index, err := setupSampleIndex(util.SampleLandmarkIndexDef)
 	if err != nil {
@@ -446,1224 +764,3357 @@ func TestIndexSargabilityCompatibleCustomDefaultMapping(t *testing.T) {
 	}
 }
 
-func TestIndexPageable(t *testing.T) {
+func TestIndexSargableVerdictCachedWithinOpaque(t *testing.T) {
 	index, err := setupSampleIndex(util.SampleLandmarkIndexDef)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// missing pagination info (size) in search request
-	query := expression.NewConstant(map[string]interface{}{
-		"query": map[string]interface{}{
-			"match": "united",
-			"field": "countryX",
-		},
-		"from":    0,
-		"explain": false,
-		"sort":    []interface{}{"-_score"},
-	})
-
-	pageable := index.Pageable([]string{"score DESC"}, 0, 10, query,
-		expression.NewConstant(``))
-
-	if pageable {
-		t.Fatalf("Expected to be non pageable, but got: %v", pageable)
+	otherIndex, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	// missing pagination info (from) in search request
-	query = expression.NewConstant(map[string]interface{}{
-		"query": map[string]interface{}{
-			"match": "united",
-			"field": "countryX",
-		},
-		"size":    10,
-		"explain": false,
-		"sort":    []interface{}{"country", "city", "-_score"},
-	})
+	checks := map[*FTSIndex]int{}
+	index.onSargableCheck = func() { checks[index]++ }
+	otherIndex.onSargableCheck = func() { checks[otherIndex]++ }
 
-	expOrder := []string{"country", "city", "-_score"}
-	order := []string{"country", "city", "-_score"}
+	query := expression.NewConstant(map[string]interface{}{
+		"match": "united", "field": "countryX",
+	})
+	options := expression.NewConstant(map[string]interface{}{
+		"index": index.Name(),
+	})
 
-	pageable = index.Pageable(order, 0,
-		10, query, expression.NewConstant(``))
+	count, indexedCount, _, opaque, n1qlErr := index.Sargable("", query,
+		options, nil)
+	if n1qlErr != nil || count != 1 {
+		t.Fatalf("Expected sargable count: 1, got: %v, err: %v", count, n1qlErr)
+	}
 
-	if pageable {
-		t.Fatalf("Expected to be non pageable, but got: %v", pageable)
+	count2, indexedCount2, _, opaque, n1qlErr := index.Sargable("", query,
+		options, opaque)
+	if n1qlErr != nil || count2 != count || indexedCount2 != indexedCount {
+		t.Fatalf("Expected the same verdict, got: %v, %v, err: %v",
+			count2, indexedCount2, n1qlErr)
 	}
 
-	if !reflect.DeepEqual(order, expOrder) {
-		t.Fatalf("order got changed, expected: %v, but got: %v", expOrder, order)
+	if checks[index] != 1 {
+		t.Fatalf("Expected a single sargability check, got: %v", checks[index])
 	}
 
-	// pagination given correctly in search request
-	query = expression.NewConstant(map[string]interface{}{
-		"query": map[string]interface{}{
-			"match": "united",
-			"field": "countryX",
-		},
-		"size":    100,
-		"from":    10,
-		"explain": false,
-	})
+	// differing options aren't served the cached verdict
+	count, _, _, opaque, _ = index.Sargable("", query,
+		expression.NewConstant(map[string]interface{}{"index": "other"}), opaque)
+	if count != 0 || checks[index] != 2 {
+		t.Fatalf("Expected the verdict to be rechecked, count: %v, checks: %v",
+			count, checks[index])
+	}
 
-	pageable = index.Pageable(nil, 0,
-		10, query, expression.NewConstant(``))
+	// nor are the other indexes sharing the opaque
+	otherIndex.Sargable("", query, nil, opaque)
+	if checks[otherIndex] != 1 {
+		t.Fatalf("Expected the other index to be checked, got: %v",
+			checks[otherIndex])
+	}
+}
 
-	if pageable {
-		t.Fatalf("Expected to be non pageable, but got: %v", pageable)
+func TestIndexSargabilityOfWildcardAndPrefixQueries(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithCustomDefaultMapping)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	// pagination given with Sort in the search request
-	query = expression.NewConstant(map[string]interface{}{
-		"query": map[string]interface{}{
-			"match": "united",
-			"field": "countryX",
+	tests := []struct {
+		query    map[string]interface{}
+		sargable bool
+	}{
+		// country is indexed with the keyword analyzer
+		{
+			query:    map[string]interface{}{"wildcard": "u*", "field": "country"},
+			sargable: true,
 		},
-		"size":    100,
-		"from":    10,
-		"explain": false,
-		"sort":    []interface{}{"country", "city", "-_score"},
-	})
+		{
+			query:    map[string]interface{}{"prefix": "u", "field": "country"},
+			sargable: true,
+		},
+		// city is indexed with the standard analyzer
+		{
+			query:    map[string]interface{}{"wildcard": "lon*", "field": "city"},
+			sargable: false,
+		},
+		{
+			query:    map[string]interface{}{"prefix": "lon", "field": "city"},
+			sargable: false,
+		},
+	}
 
-	pageable = index.Pageable([]string{"country", "city", "-_score"}, 0,
-		10, query, expression.NewConstant(``))
+	for testi, test := range tests {
+		count, _, _, _, n1qlErr := index.Sargable("",
+			expression.NewConstant(test.query), nil, nil)
+		if n1qlErr != nil {
+			t.Fatalf("[%d] err: %v", testi, n1qlErr)
+		}
 
-	if pageable {
-		t.Fatalf("Expected to be non pageable, but got: %v", pageable)
+		if (count > 0) != test.sargable {
+			t.Fatalf("[%d] Expected sargable: %v, for query: %v, got count: %v",
+				testi, test.sargable, test.query, count)
+		}
 	}
-
 }
 
-func TestIndexSargabilityOverDateTimeFields(t *testing.T) {
+func TestIndexSargabilityOfTermQueries(t *testing.T) {
 	index, err := setupSampleIndex(util.SampleIndexDefWithCustomDefaultMapping)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	query := expression.NewConstant(map[string]interface{}{
-		"start":           "2019-03-25 12:00:00",
-		"inclusive_start": true,
-		"field":           "currentTime",
-		"end":             "2019-03-25 12:00:00",
-		"inclusive_end":   true,
-	})
+	tests := []struct {
+		field    string
+		sargable bool
+		reason   string
+	}{
+		// country is indexed with the keyword analyzer
+		{field: "country", sargable: true, reason: "sargable"},
+		// city is indexed with the standard analyzer, whose tokens (rather
+		// than the field's value) the term would be matched against.
+		{field: "city", sargable: false,
+			reason: "query field analyzer mismatch: city"},
+	}
 
-	count, indexedCount, exact, _, n1qlErr := index.Sargable("", query,
-		expression.NewConstant(``), nil)
-	if n1qlErr != nil {
-		t.Fatal(n1qlErr)
-	}
+	for testi, test := range tests {
+		query := expression.NewConstant(map[string]interface{}{
+			"term": "United Kingdom", "field": test.field,
+		})
 
-	if count != 1 || indexedCount != 3 || !exact {
-		t.Fatal("Unexpected results from Index.Sargable(...) for query")
+		count, _, _, _, n1qlErr := index.Sargable("", query, nil, nil)
+		if n1qlErr != nil {
+			t.Fatalf("[%d] err: %v", testi, n1qlErr)
+		}
+		if (count > 0) != test.sargable {
+			t.Fatalf("[%d] Expected sargable: %v, for field: %s, got count: %v",
+				testi, test.sargable, test.field, count)
+		}
+
+		explanation, err := index.ExplainSargable("", query, nil)
+		if err != nil {
+			t.Fatalf("[%d] err: %v", testi, err)
+		}
+		if explanation.Sargable != test.sargable ||
+			explanation.Reason != test.reason {
+			t.Fatalf("[%d] Expected sargable: %v, reason: %q, got: %+v", testi,
+				test.sargable, test.reason, explanation)
+		}
 	}
 }
 
-func TestIndexSargabilityInvalidIndexName(t *testing.T) {
-	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+func TestIndexSargabilityOfRegexpQueries(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithCustomDefaultMapping)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	query := expression.NewConstant(map[string]interface{}{
-		"match": "california",
-	})
+	tests := []struct {
+		query    map[string]interface{}
+		sargable bool
+	}{
+		// country is indexed with the keyword analyzer
+		{
+			query:    map[string]interface{}{"regexp": "u[ks]+", "field": "country"},
+			sargable: true,
+		},
+		// city is indexed with the standard analyzer, whose tokens (rather
+		// than the field's value) the pattern would be matched against.
+		{
+			query:    map[string]interface{}{"regexp": "lon.*", "field": "city"},
+			sargable: false,
+		},
+	}
 
-	options := expression.NewConstant(map[string]interface{}{
-		"index": "wrong_name",
-	})
+	for testi, test := range tests {
+		count, _, _, _, n1qlErr := index.Sargable("",
+			expression.NewConstant(test.query), nil, nil)
+		if n1qlErr != nil {
+			t.Fatalf("[%d] err: %v", testi, n1qlErr)
+		}
 
-	count, indexedCount, _, _, n1qlErr := index.Sargable("", query,
-		options, nil)
-	if n1qlErr != nil {
-		t.Fatal(n1qlErr)
+		if (count > 0) != test.sargable {
+			t.Fatalf("[%d] Expected sargable: %v, for query: %v, got count: %v",
+				testi, test.sargable, test.query, count)
+		}
 	}
 
-	if count != 0 || indexedCount != 0 {
-		t.Fatal("Unexpected results from Index.Sargable(...) for query")
+	// an invalid pattern is reported ahead of the search.
+	_, _, _, _, n1qlErr := index.Sargable("", expression.NewConstant(
+		map[string]interface{}{"regexp": "u[ks", "field": "country"}), nil, nil)
+	if n1qlErr == nil || !strings.Contains(n1qlErr.Error(), "invalid pattern") {
+		t.Fatalf("Expected an invalid pattern err, got: %v", n1qlErr)
 	}
 }
 
-func TestIndexSargabilityForQueryWithMissingAnalyzer(t *testing.T) {
+func TestIndexSargabilityWithIndexSelection(t *testing.T) {
 	index, err := setupSampleIndex(util.SampleIndexDefWithCustomDefaultMapping)
 	if err != nil {
 		t.Fatal(err)
 	}
+	index.indexDef.UUID = "uuid-current"
 
-	// Note that the index has the field "country" indexed under the
-	// "keyword" analyzer.
 	query := expression.NewConstant(map[string]interface{}{
-		"prefix": "blah",
-		"field":  "country",
+		"match": "london", "field": "city",
 	})
 
-	count, indexedCount, _, _, n1qlErr := index.Sargable("", query,
-		expression.NewConstant(``), nil)
-	if n1qlErr != nil {
-		t.Fatal(n1qlErr)
+	name := "SampleIndexDefWithCustomDefaultMapping"
+
+	tests := []struct {
+		options  map[string]interface{}
+		sargable bool
+		err      bool
+	}{
+		{options: map[string]interface{}{"index": name}, sargable: true},
+		{options: map[string]interface{}{"index": "other"}, sargable: false},
+		{options: map[string]interface{}{"indexUUID": "uuid-current"}, sargable: true},
+		{options: map[string]interface{}{"index": name, "indexUUID": "uuid-current"},
+			sargable: true},
+		// the name's been reused by a recreated index
+		{options: map[string]interface{}{"index": name, "indexUUID": "uuid-dropped"},
+			sargable: false},
+		{options: map[string]interface{}{"index": map[string]interface{}{
+			"name": name, "uuid": "uuid-current"}}, sargable: true},
+		{options: map[string]interface{}{"index": map[string]interface{}{
+			"name": name, "uuid": "uuid-dropped"}}, sargable: false},
+		{options: map[string]interface{}{"index": map[string]interface{}{
+			"uuid": "uuid-current"}}, sargable: true},
+		{options: map[string]interface{}{"index": map[string]interface{}{
+			"name": "other"}}, sargable: false},
+		{options: map[string]interface{}{"index": map[string]interface{}{
+			"name": name}, "indexUUID": "uuid-dropped"}, sargable: false},
+		{options: map[string]interface{}{"index": map[string]interface{}{
+			"name": 10}}, err: true},
 	}
 
-	if indexedCount != 3 {
-		t.Fatalf("Expected indexedCount of 3 but got: %v", indexedCount)
+	for testi, test := range tests {
+		count, _, _, _, n1qlErr := index.Sargable("", query,
+			expression.NewConstant(test.options), nil)
+		if test.err != (n1qlErr != nil) {
+			t.Fatalf("[%d] Unexpected err: %v", testi, n1qlErr)
+		}
+
+		if test.sargable != (count > 0) {
+			t.Fatalf("[%d] Expected sargable: %t, got count: %d",
+				testi, test.sargable, count)
+		}
 	}
+}
 
-	if count != 1 {
-		t.Fatalf("Expected count of 1, as query is not sargable for index,"+
-			" but got: %v", count)
+func TestIndexPageableWithMinScore(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleLandmarkIndexDef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := expression.NewConstant(map[string]interface{}{
+		"match": "united", "field": "country"})
+
+	if !index.Pageable([]string{"score DESC"}, 0, 10, query, nil) {
+		t.Fatalf("Expected pageable")
+	}
+
+	// the hits counted by the limit would be filtered out after.
+	minScore := expression.NewConstant(map[string]interface{}{
+		"min_score": 0.5})
+	if index.Pageable([]string{"score DESC"}, 0, 10, query, minScore) {
+		t.Fatalf("Expected not pageable, with a min score")
 	}
 }
 
-func TestIndexSargabilityNoAllField(t *testing.T) {
-	index, err := setupSampleIndex(util.SampleIndexDefWithNoAllField)
+func TestIndexPageable(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleLandmarkIndexDef)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	// missing pagination info (size) in search request, sorted by
+	// descending score, the native order of FTS, as is the order given
 	query := expression.NewConstant(map[string]interface{}{
-		"match": "san francisco",
+		"query": map[string]interface{}{
+			"match": "united",
+			"field": "countryX",
+		},
+		"from":    0,
+		"explain": false,
+		"sort":    []interface{}{"-_score"},
 	})
 
-	count, _, _, _, n1qlErr := index.Sargable("", query,
-		expression.NewConstant(``), nil)
-	if n1qlErr != nil {
-		t.Fatal(n1qlErr)
+	pageable := index.Pageable([]string{"score DESC"}, 0, 10, query,
+		expression.NewConstant(``))
+
+	if !pageable {
+		t.Fatalf("Expected to be pageable, but got: %v", pageable)
 	}
 
-	if count != 0 {
-		t.Fatal("Expect index to NOT be sargable")
+	// missing pagination info (from) in search request
+	query = expression.NewConstant(map[string]interface{}{
+		"query": map[string]interface{}{
+			"match": "united",
+			"field": "countryX",
+		},
+		"size":    10,
+		"explain": false,
+		"sort":    []interface{}{"country", "city", "-_score"},
+	})
+
+	expOrder := []string{"country", "city", "-_score"}
+	order := []string{"country", "city", "-_score"}
+
+	pageable = index.Pageable(order, 0,
+		10, query, expression.NewConstant(``))
+
+	if pageable {
+		t.Fatalf("Expected to be non pageable, but got: %v", pageable)
 	}
-}
 
-// =============================================================================
+	if !reflect.DeepEqual(order, expOrder) {
+		t.Fatalf("order got changed, expected: %v, but got: %v", expOrder, order)
+	}
 
-func TestNotSargableFlexIndex(t *testing.T) {
-	index, err := setupSampleIndex(
-		util.SampleIndexDefWithKeywordAnalyzerOverDefaultMapping)
+	// pagination given correctly in search request
+	query = expression.NewConstant(map[string]interface{}{
+		"query": map[string]interface{}{
+			"match": "united",
+			"field": "countryX",
+		},
+		"size":    100,
+		"from":    10,
+		"explain": false,
+	})
+
+	pageable = index.Pageable(nil, 0,
+		10, query, expression.NewConstant(``))
+
+	if pageable {
+		t.Fatalf("Expected to be non pageable, but got: %v", pageable)
+	}
+
+	// pagination given with Sort in the search request
+	query = expression.NewConstant(map[string]interface{}{
+		"query": map[string]interface{}{
+			"match": "united",
+			"field": "countryX",
+		},
+		"size":    100,
+		"from":    10,
+		"explain": false,
+		"sort":    []interface{}{"country", "city", "-_score"},
+	})
+
+	pageable = index.Pageable([]string{"country", "city", "-_score"}, 0,
+		10, query, expression.NewConstant(``))
+
+	if pageable {
+		t.Fatalf("Expected to be non pageable, but got: %v", pageable)
+	}
+
+}
+
+func TestIndexPageableWithGeoDistanceSort(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithGeoPointField)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	for _, queryStr := range []string{
-		`t.country = 'United States'`,
-		`t.type <= hotel`,
-		`t.type > hotel`,
-		`t.id >= 10`,
-		`t.id < 10`,
-		`t.isOpen > true`,
-		`t.isOpen < false`,
-		`t.createdOn > '1985-04-12T23:20:50.52Z'`,
-		`t.createdOn <= '2020-01-30T12:00:00.00Z'`,
-		`t.id < 10 AND t.id > 0`,                              // min expression to be specified first
-		`t.type < "hotel" AND t.type > "hot"`,                 // min expression to specified first
-		`t.createdOn >= 'asdasd' AND t.createdOn <= "dsadsa"`, // createdOn: incorrect datatype
-		`t.id = 10 OR t.createdOn = 'asdasd'`,                 // createdOn: incorrect datatype
-	} {
-		queryExp, err := parser.Parse(queryStr)
-		if err != nil {
-			t.Fatal(err)
+	geoSort := func(field string) map[string]interface{} {
+		return map[string]interface{}{
+			"by":    "geo_distance",
+			"field": field,
+			"unit":  "mi",
+			"location": map[string]interface{}{
+				"lon": -2.235143,
+				"lat": 53.482358,
+			},
 		}
+	}
 
-		flexRequest := &datastore.FTSFlexRequest{
-			Keyspace: "t",
-			Pred:     queryExp,
-		}
+	tests := []struct {
+		order    []string
+		sort     []interface{}
+		size     interface{}
+		pageable bool
+	}{
+		// sorted by distance over the geopoint field
+		{sort: []interface{}{geoSort("geo")}, pageable: true},
+		// geo is not an indexed field
+		{sort: []interface{}{geoSort("name")}, pageable: false},
+		{sort: []interface{}{geoSort("location")}, pageable: false},
+		// sorted by distance, and by score
+		{sort: []interface{}{geoSort("geo"), "-_score"}, pageable: false},
+		// sorted by distance, with a conflicting order
+		{order: []string{"score DESC"}, sort: []interface{}{geoSort("geo")},
+			pageable: false},
+		// sorted by distance, with a size
+		{sort: []interface{}{geoSort("geo")}, size: 10, pageable: false},
+	}
 
-		resp, err := index.SargableFlex("0", flexRequest)
-		if err != nil {
-			t.Fatal(err)
+	for testi, test := range tests {
+		sr := map[string]interface{}{
+			"query": map[string]interface{}{
+				"match": "hotel",
+				"field": "name",
+			},
+			"sort": test.sort,
+		}
+		if test.size != nil {
+			sr["size"] = test.size
 		}
 
-		if resp != nil {
-			t.Fatalf("Expected query: `%s` to be NOT-SARGABLE, got resp: %#v",
-				queryStr, resp)
+		pageable := index.Pageable(test.order, 0, 10,
+			expression.NewConstant(sr), expression.NewConstant(``))
+		if pageable != test.pageable {
+			t.Fatalf("[%d] Expected pageable: %t, got: %t",
+				testi, test.pageable, pageable)
 		}
 	}
 }
 
-func testQueryOverFlexIndex(t *testing.T, index *FTSIndex,
-	queryStr, expectedQueryStr string, expectedSargKeys []string) {
-	queryExpression, err := parser.Parse(queryStr)
+func TestIndexPageableWithScoreSort(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	flexRequest := &datastore.FTSFlexRequest{
-		Keyspace: "t",
-		Pred:     queryExpression,
+	tests := []struct {
+		order    []string
+		sort     []interface{}
+		size     interface{}
+		pageable bool
+	}{
+		// sorted by descending score, the native order
+		{sort: []interface{}{"-_score"}, pageable: true},
+		{order: []string{"score DESC"}, sort: []interface{}{"-_score"},
+			pageable: true},
+		{order: []string{"score DESC"}, sort: []interface{}{
+			map[string]interface{}{"by": "score", "desc": true}},
+			pageable: true},
+		// sorted by ascending score
+		{sort: []interface{}{"_score"}, pageable: false},
+		{order: []string{"score ASC"}, sort: []interface{}{"_score"},
+			pageable: false},
+		// sorted by descending score, with a conflicting order
+		{order: []string{"score ASC"}, sort: []interface{}{"-_score"},
+			pageable: false},
+		{order: []string{"city"}, sort: []interface{}{"-_score"},
+			pageable: false},
+		// sorted by descending score, and by another field
+		{sort: []interface{}{"-_score", "city"}, pageable: false},
+		// sorted by descending score, with a size
+		{sort: []interface{}{"-_score"}, size: 10, pageable: false},
 	}
 
-	resp, err := index.SargableFlex("0", flexRequest)
+	for testi, test := range tests {
+		sr := map[string]interface{}{
+			"query": map[string]interface{}{
+				"match": "paris",
+				"field": "city",
+			},
+			"sort": test.sort,
+		}
+		if test.size != nil {
+			sr["size"] = test.size
+		}
+
+		pageable := index.Pageable(test.order, 0, 10,
+			expression.NewConstant(sr), expression.NewConstant(``))
+		if pageable != test.pageable {
+			t.Fatalf("[%d] Expected pageable: %t, got: %t",
+				testi, test.pageable, pageable)
+		}
+	}
+}
+
+func TestIndexSargabilityOverOpenEndedNumericRanges(t *testing.T) {
+	index, err := setupSampleIndex(
+		util.SampleIndexDefWithKeywordAnalyzerOverDefaultMapping)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if resp == nil || len(resp.StaticSargKeys) != len(expectedSargKeys) {
-		t.Fatalf("Query: %v, Resp: %#v", queryStr, resp)
-	}
+	for _, query := range []map[string]interface{}{
+		{"min": 5, "field": "id"},
+		{"max": 10, "field": "id"},
+		{"min": 5, "max": 10, "inclusive_min": false, "field": "id"},
+	} {
+		count, indexedCount, _, _, n1qlErr := index.Sargable("",
+			expression.NewConstant(query), expression.NewConstant(``), nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
 
-	for _, key := range expectedSargKeys {
-		if resp.StaticSargKeys[key] == nil {
-			t.Fatalf("ExpectedSargKeys: %v, Got StaticSargKeys: %v",
-				expectedSargKeys, resp.StaticSargKeys)
+		if count != 1 || indexedCount == 0 {
+			t.Fatalf("[%v] Expected sargable count: 1, got: %d, indexed count: %d",
+				query, count, indexedCount)
 		}
 	}
 
-	var gotQuery, expectedQuery map[string]interface{}
-	err = json.Unmarshal([]byte(resp.SearchQuery), &gotQuery)
-	if err != nil {
-		t.Fatalf("SearchQuery: %s, err: %v", resp.SearchQuery, err)
-	}
-	err = json.Unmarshal([]byte(expectedQueryStr), &expectedQuery)
-	if err != nil {
-		t.Fatalf("ExpectedQuery: %s, err: %v", expectedQueryStr, err)
+	// the type field isn't numeric
+	count, _, _, _, n1qlErr := index.Sargable("",
+		expression.NewConstant(map[string]interface{}{"min": 5, "field": "type"}),
+		expression.NewConstant(``), nil)
+	if n1qlErr != nil {
+		t.Fatal(n1qlErr)
 	}
 
-	if !reflect.DeepEqual(expectedQuery, gotQuery) {
-		t.Fatalf("ExpectedQuery: %s, GotQuery: %s", expectedQueryStr, resp.SearchQuery)
+	if count != 0 {
+		t.Fatalf("Expected query over type to be non sargable, got count: %d", count)
 	}
 }
 
-func TestSargableFlexIndex(t *testing.T) {
-	index, err := setupSampleIndex(
-		util.SampleIndexDefWithKeywordAnalyzerOverDefaultMapping)
+func TestIndexSargabilityOverDateTimeFields(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithCustomDefaultMapping)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	tests := []struct {
-		queryStr         string
-		expectedQueryStr string
-		expectedSargKeys []string
-	}{
-		{
-			queryStr:         "t.type = 'hotel' AND t.country = 'United States'",
-			expectedQueryStr: `{"query":{"field":"type","term":"hotel"},"score":"none"}`,
-			expectedSargKeys: []string{"type"},
-		},
-		{
-			queryStr: "t.type >= 'hot' AND t.type <= 'hotel'",
-			expectedQueryStr: `{"query": {"field":"type","min":"hot","inclusive_min":true,` +
+	query := expression.NewConstant(map[string]interface{}{
+		"start":           "2019-03-25 12:00:00",
+		"inclusive_start": true,
+		"field":           "currentTime",
+		"end":             "2019-03-25 12:00:00",
+		"inclusive_end":   true,
+	})
+
+	count, indexedCount, exact, _, n1qlErr := index.Sargable("", query,
+		expression.NewConstant(``), nil)
+	if n1qlErr != nil {
+		t.Fatal(n1qlErr)
+	}
+
+	if count != 1 || indexedCount != 3 || !exact {
+		t.Fatal("Unexpected results from Index.Sargable(...) for query")
+	}
+}
+
+func TestIndexSargabilityOverDateTimeFieldsWithParsers(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithDateTimeParsers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		field      string
+		sargable   bool
+		dateFormat string
+	}{
+		// indexed with the index's default parser
+		{field: "created", sargable: true, dateFormat: "dateTimeOptional"},
+		// indexed with a parser of its own
+		{field: "birthday", sargable: true, dateFormat: "dateOnly"},
+		{field: "anniversary", sargable: false},
+	}
+
+	for _, test := range tests {
+		q := expression.NewConstant(map[string]interface{}{
+			"start":           "2019-03-25",
+			"inclusive_start": true,
+			"field":           test.field,
+		})
+
+		count, _, _, _, n1qlErr := index.Sargable("", q, nil, nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+
+		if test.sargable != (count > 0) {
+			t.Fatalf("[%s] Expected sargable: %t, got count: %v",
+				test.field, test.sargable, count)
+		}
+
+		explain, err := index.ExplainSargable("", q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(explain.QueryFields) != 1 ||
+			explain.QueryFields[0].Matched != test.sargable {
+			t.Fatalf("[%s] Unexpected explanation: %+v", test.field, explain)
+		}
+
+		if test.sargable && explain.QueryFields[0].DateFormat != test.dateFormat {
+			t.Fatalf("[%s] Expected date format: %s, got: %+v", test.field,
+				test.dateFormat, explain.QueryFields[0])
+		}
+	}
+
+	// a query without the type (as the query value isn't available) over
+	// the field with a parser of its own.
+	count, _, _, _, n1qlErr := index.Sargable("birthday", nil, nil, nil)
+	if n1qlErr != nil {
+		t.Fatal(n1qlErr)
+	}
+
+	if count != 1 {
+		t.Fatalf("Expected query over birthday to be sargable, got count: %v",
+			count)
+	}
+}
+
+func TestIndexSargabilityOfDateRangesWithTimeZones(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithDateTimeParsers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		field    string
+		start    string
+		sargable bool
+		reason   string
+	}{
+		// the index's default parser (dateTimeOptional) parses time zones.
+		{field: "created", start: "2019-03-25T10:00:00+05:30", sargable: true},
+		{field: "created", start: "2019-03-25T10:00:00Z", sargable: true},
+		// a parser of its own with a time zone in its layout.
+		{field: "departure", start: "2019-03-25T10:00:00-07:00", sargable: true},
+		// a parser of its own without time zones.
+		{field: "birthday", start: "2019-03-25", sargable: true},
+		{field: "birthday", start: "2019-03-25T10:00:00+05:30",
+			reason: "query field time zone unsupported: birthday"},
+		{field: "birthday", start: "2019-03-25T10:00:00Z",
+			reason: "query field time zone unsupported: birthday"},
+	}
+
+	for _, test := range tests {
+		q := expression.NewConstant(map[string]interface{}{
+			"query": map[string]interface{}{
+				"start":           test.start,
+				"end":             "2030-01-01",
+				"inclusive_start": true,
+				"field":           test.field,
+			},
+		})
+
+		count, _, _, _, n1qlErr := index.Sargable("", q, nil, nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+
+		if test.sargable != (count > 0) {
+			t.Fatalf("[%s, %s] Expected sargable: %t, got count: %v",
+				test.field, test.start, test.sargable, count)
+		}
+
+		if test.sargable {
+			continue
+		}
+
+		explain, err := index.ExplainSargable("", q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if explain.Reason != test.reason {
+			t.Fatalf("[%s, %s] Expected reason: %q, got: %+v", test.field,
+				test.start, test.reason, explain)
+		}
+	}
+
+	// within a conjunction, only the clause over the field with a parser
+	// without time zones is not covered.
+	q := expression.NewConstant(map[string]interface{}{
+		"conjuncts": []interface{}{
+			map[string]interface{}{
+				"start": "2019-03-25T10:00:00+05:30", "field": "created"},
+			map[string]interface{}{
+				"end": "2019-03-25T10:00:00+05:30", "field": "birthday"},
+		},
+	})
+
+	count, _, exact, _, n1qlErr := index.Sargable("", q, nil, nil)
+	if n1qlErr != nil {
+		t.Fatal(n1qlErr)
+	}
+
+	if count != 1 || exact {
+		t.Fatalf("Expected the conjunction partially sargable, got count: %v,"+
+			" exact: %t", count, exact)
+	}
+}
+
+func TestIndexSargabilityOfPartiallyCoveredConjunction(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithCustomDefaultMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    map[string]interface{}
+		count    int
+		exact    bool
+		searched []string // fields of the query sent to FTS
+	}{
+		{
+			// all of the conjuncts covered
+			query: map[string]interface{}{
+				"conjuncts": []interface{}{
+					map[string]interface{}{"match": "london", "field": "city"},
+					map[string]interface{}{"match": "uk", "field": "country",
+						"analyzer": "keyword"},
+				},
+			},
+			count:    2,
+			exact:    true,
+			searched: []string{"city", "country"},
+		},
+		{
+			// 2 of the 3 conjuncts covered, town isn't indexed
+			query: map[string]interface{}{
+				"conjuncts": []interface{}{
+					map[string]interface{}{"match": "london", "field": "city"},
+					map[string]interface{}{"match": "uk", "field": "country",
+						"analyzer": "keyword"},
+					map[string]interface{}{"match": "soho", "field": "town"},
+				},
+			},
+			count:    2,
+			exact:    false,
+			searched: []string{"city", "country"},
+		},
+		{
+			// the city conjunct isn't covered with the keyword analyzer
+			query: map[string]interface{}{
+				"conjuncts": []interface{}{
+					map[string]interface{}{"match": "london", "field": "city",
+						"analyzer": "keyword"},
+					map[string]interface{}{"match": "uk", "field": "country",
+						"analyzer": "keyword"},
+				},
+			},
+			count:    1,
+			exact:    false,
+			searched: []string{"country"},
+		},
+		{
+			// none of the conjuncts covered
+			query: map[string]interface{}{
+				"conjuncts": []interface{}{
+					map[string]interface{}{"match": "soho", "field": "town"},
+					map[string]interface{}{"match": "uk", "field": "county"},
+				},
+			},
+			count: 0,
+		},
+		{
+			// a disjunction isn't covered in part
+			query: map[string]interface{}{
+				"disjuncts": []interface{}{
+					map[string]interface{}{"match": "london", "field": "city"},
+					map[string]interface{}{"match": "soho", "field": "town"},
+				},
+			},
+			count: 0,
+		},
+	}
+
+	for testi, test := range tests {
+		q := expression.NewConstant(test.query)
+
+		count, _, exact, _, n1qlErr := index.Sargable("", q, nil, nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+
+		if count != test.count || (count > 0 && exact != test.exact) {
+			t.Fatalf("[%d] Expected count: %d, exact: %t, got count: %d,"+
+				" exact: %t", testi, test.count, test.exact, count, exact)
+		}
+
+		if count == 0 {
+			continue
+		}
+
+		rv := index.buildQueryAndCheckIfSargable("", q.Value(), nil, nil)
+		if rv.searchRequest == nil {
+			t.Fatalf("[%d] Expected a search request", testi)
+		}
+
+		sq, err := query.ParseQuery(rv.searchRequest.Q)
+		if err != nil {
+			t.Fatalf("[%d] err: %v", testi, err)
+		}
+
+		fields, err := util.FetchFieldsToSearchFromQuery(sq)
+		if err != nil {
+			t.Fatalf("[%d] err: %v", testi, err)
+		}
+
+		var searched []string
+		for f := range fields {
+			searched = append(searched, f.Name)
+		}
+		sort.Strings(searched)
+
+		if !reflect.DeepEqual(searched, test.searched) {
+			t.Fatalf("[%d] Expected the fields searched: %v, got: %v",
+				testi, test.searched, searched)
+		}
+	}
+}
+
+func TestIndexSargabilityInvalidIndexName(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := expression.NewConstant(map[string]interface{}{
+		"match": "california",
+	})
+
+	options := expression.NewConstant(map[string]interface{}{
+		"index": "wrong_name",
+	})
+
+	count, indexedCount, _, _, n1qlErr := index.Sargable("", query,
+		options, nil)
+	if n1qlErr != nil {
+		t.Fatal(n1qlErr)
+	}
+
+	if count != 0 || indexedCount != 0 {
+		t.Fatal("Unexpected results from Index.Sargable(...) for query")
+	}
+}
+
+func TestIndexSargabilityIndexNameCase(t *testing.T) {
+	defer util.SetIndexHintCaseInsensitive(util.GetIndexHintCaseInsensitive())
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := expression.NewConstant(map[string]interface{}{
+		"match": "california",
+	})
+
+	tests := []struct {
+		index           interface{}
+		caseInsensitive bool
+		sargable        bool
+	}{
+		{index: "SampleIndexDefDynamicDefault", sargable: true},
+		{index: "sampleindexdefdynamicdefault", sargable: false},
+		{index: map[string]interface{}{"name": "SAMPLEINDEXDEFDYNAMICDEFAULT"},
+			sargable: false},
+		{index: "SampleIndexDefDynamicDefault", caseInsensitive: true,
+			sargable: true},
+		{index: "sampleindexdefdynamicdefault", caseInsensitive: true,
+			sargable: true},
+		{index: map[string]interface{}{"name": "SAMPLEINDEXDEFDYNAMICDEFAULT"},
+			caseInsensitive: true, sargable: true},
+		{index: "wrong_name", caseInsensitive: true, sargable: false},
+	}
+
+	for testi, test := range tests {
+		util.SetIndexHintCaseInsensitive(test.caseInsensitive)
+
+		options := expression.NewConstant(map[string]interface{}{
+			"index": test.index,
+		})
+
+		count, _, _, _, n1qlErr := index.Sargable("", query, options, nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+
+		if test.sargable != (count > 0) {
+			t.Fatalf("[%d] Expected sargable: %t, got count: %d", testi,
+				test.sargable, count)
+		}
+	}
+}
+
+func TestIndexSargabilityForQueryWithMissingAnalyzer(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithCustomDefaultMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Note that the index has the field "country" indexed under the
+	// "keyword" analyzer.
+	query := expression.NewConstant(map[string]interface{}{
+		"prefix": "blah",
+		"field":  "country",
+	})
+
+	count, indexedCount, _, _, n1qlErr := index.Sargable("", query,
+		expression.NewConstant(``), nil)
+	if n1qlErr != nil {
+		t.Fatal(n1qlErr)
+	}
+
+	if indexedCount != 3 {
+		t.Fatalf("Expected indexedCount of 3 but got: %v", indexedCount)
+	}
+
+	if count != 1 {
+		t.Fatalf("Expected count of 1, as query is not sargable for index,"+
+			" but got: %v", count)
+	}
+}
+
+func TestIndexSargabilityOverAliasedFields(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithAliasedFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query         map[string]interface{}
+		expectedCount int
+		expectErr     bool
+		expectField   string
+	}{
+		{
+			// "addr" is indexed as "address"
+			query:         map[string]interface{}{"match": "main st", "field": "addr"},
+			expectedCount: 1,
+			expectField:   "address",
+		},
+		{
+			query:         map[string]interface{}{"match": "main st", "field": "address"},
+			expectedCount: 1,
+			expectField:   "address",
+		},
+		{
+			// "country" is indexed under its own name as well
+			query:         map[string]interface{}{"match": "france", "field": "country"},
+			expectedCount: 1,
+			expectField:   "country",
+		},
+		{
+			// "city" is indexed as both "town" and "municipality"
+			query:     map[string]interface{}{"match": "paris", "field": "city"},
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		rv := index.buildQueryAndCheckIfSargable("",
+			value.NewValue(test.query), nil, nil)
+		if test.expectErr {
+			if rv.err == nil {
+				t.Fatalf("[%v] Expected an error", test.query)
+			}
+			continue
+		}
+
+		if rv.err != nil {
+			t.Fatalf("[%v] Unexpected err: %v", test.query, rv.err)
+		}
+
+		if rv.count != test.expectedCount {
+			t.Fatalf("[%v] Expected sargable count of %v, but got: %v",
+				test.query, test.expectedCount, rv.count)
+		}
+
+		var q map[string]interface{}
+		err = json.Unmarshal(rv.searchRequest.Q, &q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if q["field"] != test.expectField {
+			t.Fatalf("[%v] Expected query over field: %v, but got: %s",
+				test.query, test.expectField, rv.searchRequest.Q)
+		}
+	}
+}
+
+func TestIndexSargabilityOfArrayElementFields(t *testing.T) {
+	// "reviews" is an (array of) objects, with "reviews.review" mapped
+	// dynamically and "reviews.id" explicitly.
+	index, err := setupSampleIndex(util.SampleLandmarkIndexDef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query       map[string]interface{}
+		sargable    bool
+		expectField string
+		reason      string
+	}{
+		{
+			query:       map[string]interface{}{"match": "10", "field": "reviews.id"},
+			sargable:    true,
+			expectField: "reviews.id",
+		},
+		{
+			query:       map[string]interface{}{"match": "10", "field": "reviews[].id"},
+			sargable:    true,
+			expectField: "reviews.id",
+		},
+		{
+			// under the dynamic mapping, whatever the type.
+			query: map[string]interface{}{
+				"min": 3, "field": "reviews[].review.ratings.Overall"},
+			sargable:    true,
+			expectField: "reviews.review.ratings.Overall",
+		},
+		{
+			query: map[string]interface{}{
+				"bool": true, "field": "reviews.review.verified"},
+			sargable:    true,
+			expectField: "reviews.review.verified",
+		},
+		{
+			// the position of an element isn't retained within the index.
+			query:  map[string]interface{}{"match": "10", "field": "reviews[0].id"},
+			reason: "query field array position unsupported: reviews[0].id",
+		},
+		{
+			// the array itself, rather than the fields of its elements.
+			query:  map[string]interface{}{"match": "10", "field": "reviews"},
+			reason: "query field not indexed: reviews",
+		},
+		{
+			query:  map[string]interface{}{"match": "10", "field": "reviews[]"},
+			reason: "query field not indexed: reviews",
+		},
+	}
+
+	for _, test := range tests {
+		rv := index.buildQueryAndCheckIfSargable("",
+			value.NewValue(test.query), nil, nil)
+		if rv.err != nil {
+			t.Fatalf("[%v] Unexpected err: %v", test.query, rv.err)
+		}
+
+		if test.sargable != (rv.count > 0) {
+			t.Fatalf("[%v] Expected sargable: %t, got count: %d", test.query,
+				test.sargable, rv.count)
+		}
+
+		if !test.sargable {
+			explain, err := index.ExplainSargable("",
+				expression.NewConstant(test.query), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if explain.Reason != test.reason {
+				t.Fatalf("[%v] Expected reason: %q, got: %+v", test.query,
+					test.reason, explain)
+			}
+			continue
+		}
+
+		var q map[string]interface{}
+		err = json.Unmarshal(rv.searchRequest.Q, &q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if q["field"] != test.expectField {
+			t.Fatalf("[%v] Expected query over field: %v, but got: %s",
+				test.query, test.expectField, rv.searchRequest.Q)
+		}
+	}
+}
+
+func TestIndexSargabilityOfNestedPhrasesWithAnalyzers(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithNestedAnalyzers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		field    string
+		analyzer string
+		sargable bool
+	}{
+		{field: "reviews.content", analyzer: "en", sargable: true},
+		{field: "reviews.content", analyzer: "", sargable: true},
+		// reviews.content isn't indexed with the default analyzer
+		{field: "reviews.content", analyzer: "standard", sargable: false},
+		{field: "reviews.notes.text", analyzer: "keyword", sargable: true},
+		{field: "reviews.notes.text", analyzer: "standard", sargable: false},
+		// reviews.meta doesn't inherit its sibling's default analyzer
+		{field: "reviews.meta.text", analyzer: "standard", sargable: true},
+		{field: "reviews.meta.text", analyzer: "keyword", sargable: false},
+	}
+
+	for _, test := range tests {
+		q := map[string]interface{}{
+			"match_phrase": "great location",
+			"field":        test.field,
+		}
+		if test.analyzer != "" {
+			q["analyzer"] = test.analyzer
+		}
+
+		count, _, _, _, n1qlErr := index.Sargable("",
+			expression.NewConstant(q), expression.NewConstant(``), nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+
+		if test.sargable != (count > 0) {
+			t.Fatalf("[%s, analyzer: %q] Expected sargable: %t, got count: %v",
+				test.field, test.analyzer, test.sargable, count)
+		}
+	}
+}
+
+func TestIndexSargabilityAcrossAnalyzerVariants(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithNestedAnalyzers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		field    string
+		sargable bool
+		analyzer string
+	}{
+		// indexed with en (and registered under the default analyzer)
+		{field: "reviews.content", sargable: true, analyzer: "en"},
+		// under a dynamic parent with keyword as its default analyzer
+		{field: "reviews.notes.text", sargable: true, analyzer: "keyword"},
+		{field: "reviews.meta.text", sargable: true, analyzer: "standard"},
+		{field: "reviews.title", sargable: false},
+	}
+
+	for _, test := range tests {
+		q := expression.NewConstant(map[string]interface{}{
+			"match_phrase": "great location",
+			"field":        test.field,
+		})
+
+		count, _, _, _, n1qlErr := index.Sargable("", q, nil, nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+
+		if test.sargable != (count > 0) {
+			t.Fatalf("[%s] Expected sargable: %t, got count: %v",
+				test.field, test.sargable, count)
+		}
+
+		explain, err := index.ExplainSargable("", q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(explain.QueryFields) != 1 ||
+			explain.QueryFields[0].Matched != test.sargable {
+			t.Fatalf("[%s] Unexpected explanation: %+v", test.field, explain)
+		}
+
+		if test.sargable && explain.QueryFields[0].Analyzer != test.analyzer {
+			t.Fatalf("[%s] Expected analyzer: %s, got: %+v", test.field,
+				test.analyzer, explain.QueryFields[0])
+		}
+	}
+}
+
+func TestIndexSargabilityOverAllFieldWithAnalyzers(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithMixedAnalyzersInAllField)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		analyzer string
+		sargable bool
+	}{
+		{analyzer: "", sargable: true},
+		{analyzer: "standard", sargable: true},
+		{analyzer: "en", sargable: true},
+		// code, analyzed with keyword, isn't included in _all
+		{analyzer: "keyword", sargable: false},
+	}
+
+	for _, test := range tests {
+		q := map[string]interface{}{
+			"match": "brewing co",
+		}
+		if test.analyzer != "" {
+			q["analyzer"] = test.analyzer
+		}
+
+		count, _, _, _, n1qlErr := index.Sargable("",
+			expression.NewConstant(q), expression.NewConstant(``), nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+
+		if test.sargable != (count > 0) {
+			t.Fatalf("[analyzer: %q] Expected sargable: %t, got count: %v",
+				test.analyzer, test.sargable, count)
+		}
+	}
+}
+
+func TestIndexSargabilityOfQueryAnalyzerMismatch(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithCustomDefaultMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		field    string
+		analyzer string
+		sargable bool
+	}{
+		// country is indexed with keyword, city with the default (standard)
+		{field: "country", analyzer: "", sargable: true},
+		{field: "country", analyzer: "keyword", sargable: true},
+		{field: "country", analyzer: "standard", sargable: false},
+		{field: "country", analyzer: "en", sargable: false},
+		{field: "city", analyzer: "standard", sargable: true},
+		{field: "city", analyzer: "keyword", sargable: false},
+	}
+
+	for _, test := range tests {
+		for _, qtype := range []string{"match", "match_phrase"} {
+			q := map[string]interface{}{
+				qtype:   "united kingdom",
+				"field": test.field,
+			}
+			if test.analyzer != "" {
+				q["analyzer"] = test.analyzer
+			}
+
+			count, _, _, _, n1qlErr := index.Sargable("",
+				expression.NewConstant(q), expression.NewConstant(``), nil)
+			if n1qlErr != nil {
+				t.Fatal(n1qlErr)
+			}
+
+			if test.sargable != (count > 0) {
+				t.Fatalf("[%s %s, analyzer: %q] Expected sargable: %t, got"+
+					" count: %v", qtype, test.field, test.analyzer,
+					test.sargable, count)
+			}
+
+			if test.sargable {
+				continue
+			}
+
+			// reported as a mismatch, rather than the default assumed.
+			explain, err := index.ExplainSargable("",
+				expression.NewConstant(q), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if explain.Reason != "query field analyzer mismatch: "+test.field {
+				t.Fatalf("[%s %s, analyzer: %q] Unexpected reason: %q", qtype,
+					test.field, test.analyzer, explain.Reason)
+			}
+		}
+	}
+}
+
+func TestIndexSargableCountWithMixedAnalyzers(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithCustomDefaultMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		disjuncts []interface{}
+		count     int
+	}{
+		{
+			disjuncts: []interface{}{
+				map[string]interface{}{"match": "x", "field": "city"},
+				map[string]interface{}{"match": "x", "field": "country",
+					"analyzer": "keyword"},
+				map[string]interface{}{"field": "currentTime",
+					"start": "2020-01-01T00:00:00Z"},
+			},
+			count: 3,
+		},
+		{
+			// city queried over twice counts once
+			disjuncts: []interface{}{
+				map[string]interface{}{"match": "x", "field": "city"},
+				map[string]interface{}{"match": "x", "field": "city",
+					"analyzer": "standard"},
+				map[string]interface{}{"match": "x", "field": "country",
+					"analyzer": "keyword"},
+			},
+			count: 2,
+		},
+		{
+			// the _all field counts as one more field
+			disjuncts: []interface{}{
+				map[string]interface{}{"match": "x", "field": "city"},
+				map[string]interface{}{"match": "x", "field": "country",
+					"analyzer": "keyword"},
+				map[string]interface{}{"match": "x"},
+			},
+			count: 3,
+		},
+		{
+			// country isn't indexed with the standard analyzer
+			disjuncts: []interface{}{
+				map[string]interface{}{"match": "x", "field": "city"},
+				map[string]interface{}{"match": "x", "field": "country",
+					"analyzer": "standard"},
+				map[string]interface{}{"match": "x", "field": "currentTime"},
+			},
+			count: 0,
+		},
+	}
+
+	for testi, test := range tests {
+		query := expression.NewConstant(map[string]interface{}{
+			"disjuncts": test.disjuncts,
+		})
+
+		count, _, _, _, n1qlErr := index.Sargable("", query,
+			expression.NewConstant(``), nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+
+		if count != test.count {
+			t.Fatalf("[%d] Expected count: %d, got: %d", testi, test.count, count)
+		}
+	}
+}
+
+func TestIndexSargabilityNoAllField(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithNoAllField)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := expression.NewConstant(map[string]interface{}{
+		"match": "san francisco",
+	})
+
+	count, _, _, _, n1qlErr := index.Sargable("", query,
+		expression.NewConstant(``), nil)
+	if n1qlErr != nil {
+		t.Fatal(n1qlErr)
+	}
+
+	if count != 0 {
+		t.Fatal("Expect index to NOT be sargable")
+	}
+}
+
+// =============================================================================
+
+func TestNotSargableFlexIndex(t *testing.T) {
+	index, err := setupSampleIndex(
+		util.SampleIndexDefWithKeywordAnalyzerOverDefaultMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, queryStr := range []string{
+		`t.country = 'United States'`,
+		`t.type <= hotel`,
+		`t.type > hotel`,
+		`t.id >= 10`,
+		`t.id < 10`,
+		`t.isOpen > true`,
+		`t.isOpen < false`,
+		`t.createdOn > '1985-04-12T23:20:50.52Z'`,
+		`t.createdOn <= '2020-01-30T12:00:00.00Z'`,
+		`t.id < 10 AND t.id > 0`,                              // min expression to be specified first
+		`t.type < "hotel" AND t.type > "hot"`,                 // min expression to specified first
+		`t.createdOn >= 'asdasd' AND t.createdOn <= "dsadsa"`, // createdOn: incorrect datatype
+		`t.id = 10 OR t.createdOn = 'asdasd'`,                 // createdOn: incorrect datatype
+	} {
+		queryExp, err := parser.Parse(queryStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		flexRequest := &datastore.FTSFlexRequest{
+			Keyspace: "t",
+			Pred:     queryExp,
+		}
+
+		resp, err := index.SargableFlex("0", flexRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp != nil {
+			t.Fatalf("Expected query: `%s` to be NOT-SARGABLE, got resp: %#v",
+				queryStr, resp)
+		}
+	}
+}
+
+func testQueryOverFlexIndex(t *testing.T, index *FTSIndex,
+	queryStr, expectedQueryStr string, expectedSargKeys []string) {
+	queryExpression, err := parser.Parse(queryStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flexRequest := &datastore.FTSFlexRequest{
+		Keyspace: "t",
+		Pred:     queryExpression,
+	}
+
+	resp, err := index.SargableFlex("0", flexRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp == nil || len(resp.StaticSargKeys) != len(expectedSargKeys) {
+		t.Fatalf("Query: %v, Resp: %#v", queryStr, resp)
+	}
+
+	for _, key := range expectedSargKeys {
+		if resp.StaticSargKeys[key] == nil {
+			t.Fatalf("ExpectedSargKeys: %v, Got StaticSargKeys: %v",
+				expectedSargKeys, resp.StaticSargKeys)
+		}
+	}
+
+	var gotQuery, expectedQuery map[string]interface{}
+	err = json.Unmarshal([]byte(resp.SearchQuery), &gotQuery)
+	if err != nil {
+		t.Fatalf("SearchQuery: %s, err: %v", resp.SearchQuery, err)
+	}
+	err = json.Unmarshal([]byte(expectedQueryStr), &expectedQuery)
+	if err != nil {
+		t.Fatalf("ExpectedQuery: %s, err: %v", expectedQueryStr, err)
+	}
+
+	if !reflect.DeepEqual(expectedQuery, gotQuery) {
+		t.Fatalf("ExpectedQuery: %s, GotQuery: %s", expectedQueryStr, resp.SearchQuery)
+	}
+}
+
+func TestSargableFlexIndex(t *testing.T) {
+	index, err := setupSampleIndex(
+		util.SampleIndexDefWithKeywordAnalyzerOverDefaultMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		queryStr         string
+		expectedQueryStr string
+		expectedSargKeys []string
+	}{
+		{
+			queryStr:         "t.type = 'hotel' AND t.country = 'United States'",
+			expectedQueryStr: `{"query":{"field":"type","term":"hotel"},"score":"none"}`,
+			expectedSargKeys: []string{"type"},
+		},
+		{
+			queryStr: "t.type >= 'hot' AND t.type <= 'hotel'",
+			expectedQueryStr: `{"query": {"field":"type","min":"hot","inclusive_min":true,` +
+				`"max":"hotel","inclusive_max":true},"score":"none"}`,
+			expectedSargKeys: []string{"type"},
+		},
+		{
+			queryStr: "t.type = 'hotel' AND t.id = 10",
+			expectedQueryStr: `{"query":{"conjuncts":[{"field":"type","term":"hotel"},` +
+				`{"field":"id","inclusive_max":true,"inclusive_min":true,"max":10,` +
+				`"min":10}]},"score":"none"}`,
+			expectedSargKeys: []string{"type", "id"},
+		},
+		{
+			queryStr: "t.type = 'hotel' AND (t.id = 10 OR t.id = 20)",
+			expectedQueryStr: `{"query":{"conjuncts":[{"field":"type","term":"hotel"},` +
+				`{"disjuncts":[{"field":"id","inclusive_max":true,"inclusive_min":true,` +
+				`"max":10,"min":10},{"field":"id","inclusive_max":true,` +
+				`"inclusive_min":true,"max":20,"min":20}]}]},"score":"none"}`,
+			expectedSargKeys: []string{"type", "id"},
+		},
+		{
+			queryStr:         "t.type = 'hotel' AND t.id < 10",
+			expectedQueryStr: `{"query":{"field":"type","term":"hotel"},"score":"none"}`,
+			expectedSargKeys: []string{"type"},
+		},
+		{
+			queryStr:         "t.type = 'hotel' AND t.id <= 10",
+			expectedQueryStr: `{"query":{"field":"type","term":"hotel"},"score":"none"}`,
+			expectedSargKeys: []string{"type"},
+		},
+		{
+			queryStr:         "t.type = 'hotel' AND t.id > 10",
+			expectedQueryStr: `{"query":{"field":"type","term":"hotel"},"score":"none"}`,
+			expectedSargKeys: []string{"type"},
+		},
+		{
+			queryStr:         "t.type = 'hotel' AND t.id >= 10",
+			expectedQueryStr: `{"query":{"field":"type","term":"hotel"},"score":"none"}`,
+			expectedSargKeys: []string{"type"},
+		},
+		{
+			queryStr: "t.id >= 0 and t.id < 20",
+			expectedQueryStr: `{"query":{"field":"id","min":0,"inclusive_min":true,` +
+				`"max":20,"inclusive_max":false},"score":"none"}`,
+			expectedSargKeys: []string{"id"},
+		},
+		{
+			queryStr: "t.id >= -20 and t.id <= -5",
+			expectedQueryStr: `{"query":{"field":"id","min":-20,"inclusive_min":true,` +
+				`"max":-5,"inclusive_max":true},"score":"none"}`,
+			expectedSargKeys: []string{"id"},
+		},
+		{
+			queryStr: "t.type = 'hotel' AND t.id > 5 AND t.id < 10",
+			expectedQueryStr: `{"query":{"conjuncts":[{"field":"type","term":"hotel"},` +
+				`{"field":"id","min":5,"inclusive_min":false,"max":10,` +
+				`"inclusive_max":false}]},"score":"none"}`,
+			expectedSargKeys: []string{"type", "id"},
+		},
+		{
+			queryStr: "t.isOpen = true AND t.type = 'hotel'",
+			expectedQueryStr: `{"query":{"conjuncts":[{"field":"isOpen","bool":true},` +
+				`{"field":"type","term":"hotel"}]},"score":"none"}`,
+			expectedSargKeys: []string{"isOpen", "type"},
+		},
+		{
+			queryStr: "t.type = 'hotel' AND t.createdOn = '1985-04-12T23:20:50.52Z'",
+			expectedQueryStr: `{"query":{"conjuncts":[{"field":"type","term": "hotel"},` +
+				`{"field":"createdOn","start":"1985-04-12T23:20:50.52Z",` +
+				`"inclusive_start":true,"end":"1985-04-12T23:20:50.52Z",` +
+				`"inclusive_end":true}]},"score":"none"}`,
+			expectedSargKeys: []string{"type", "createdOn"},
+		},
+		{
+			queryStr: "t.createdOn > '1985-04-12T23:20:50.52Z'" +
+				"AND t.createdOn <= '2020-01-30T12:00:00.00Z'",
+			expectedQueryStr: `{"query":{"field":"createdOn",` +
+				`"start":"1985-04-12T23:20:50.52Z","inclusive_start":false,` +
+				`"end":"2020-01-30T12:00:00.00Z","inclusive_end":true},"score":"none"}`,
+			expectedSargKeys: []string{"createdOn"},
+		},
+		{
+			// this is a "datetime" search term over a "text" indexed field,
+			// query treated as sargable - although no results may be returned.
+			queryStr: "t.type = '1985-04-12T23:20:50.52Z'",
+			expectedQueryStr: `{"query":{"field":"type",` +
+				`"term":"1985-04-12T23:20:50.52Z"},"score":"none"}`,
+			expectedSargKeys: []string{"type"},
+		},
+		{
+			// createdOn is indexed as "datetime", so this query is partially sargable.
+			queryStr: "t.type = 'hotel' AND t.createdOn = 'crap'",
+			expectedQueryStr: `{"query":{"field":"type",` +
+				`"term":"hotel"},"score":"none"}`,
+			expectedSargKeys: []string{"type"},
+		},
+		{
+			queryStr: "t.type IN ['airline', 'airport'] AND t.createdOn = '2020-05-18'",
+			expectedQueryStr: `{"query":{"conjuncts":[{"disjuncts":[{"field":"type",` +
+				`"term":"airline"},{"field":"type","term":"airport"}]},` +
+				`{"field":"createdOn","start":"2020-05-18","end":"2020-05-18",` +
+				`"inclusive_start":true,"inclusive_end":true}]},"score":"none"}`,
+			expectedSargKeys: []string{"type", "createdOn"},
+		},
+	}
+
+	for i := range tests {
+		testQueryOverFlexIndex(t, index, tests[i].queryStr, tests[i].expectedQueryStr,
+			tests[i].expectedSargKeys)
+	}
+}
+
+func TestSargableDynamicFlexIndex(t *testing.T) {
+	// Only a default dynamic index with "default_analzyer" set to "keyword"
+	index, err := setupSampleIndex(
+		util.SampleIndexDefDynamicWithAnalyzerKeyword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		queryStr         string
+		expectedQueryStr string
+		expectedSargKeys []string
+	}{
+		{
+			queryStr:         "t.country = 'United States'",
+			expectedQueryStr: `{"query":{"field":"country","term":"United States"},"score":"none"}`,
+			expectedSargKeys: []string{"country"},
+		},
+		{
+			queryStr: "t.type >= 'hot' AND t.type <= 'hotel'",
+			expectedQueryStr: `{"query": {"field":"type","min":"hot","inclusive_min":true,` +
 				`"max":"hotel","inclusive_max":true},"score":"none"}`,
 			expectedSargKeys: []string{"type"},
 		},
 		{
-			queryStr: "t.type = 'hotel' AND t.id = 10",
-			expectedQueryStr: `{"query":{"conjuncts":[{"field":"type","term":"hotel"},` +
-				`{"field":"id","inclusive_max":true,"inclusive_min":true,"max":10,` +
-				`"min":10}]},"score":"none"}`,
-			expectedSargKeys: []string{"type", "id"},
+			queryStr: "t.id = 10",
+			expectedQueryStr: `{"query":{"field":"id","inclusive_max":true,"inclusive_min":true,` +
+				`"max":10,"min":10},"score":"none"}`,
+			expectedSargKeys: []string{"id"},
+		},
+		{
+			queryStr: "t.id >= 0 AND t.id < 20",
+			expectedQueryStr: `{"query":{"field":"id","min":0,"inclusive_min":true,` +
+				`"max":20,"inclusive_max":false},"score":"none"}`,
+			expectedSargKeys: []string{"id"},
+		},
+		{
+			queryStr: "t.id > -25 AND t.id <= 10",
+			expectedQueryStr: `{"query":{"field":"id","min":-25,"inclusive_min":false,` +
+				`"max":10,"inclusive_max":true},"score":"none"}`,
+			expectedSargKeys: []string{"id"},
+		},
+		{
+			queryStr:         "t.isOpen = true",
+			expectedQueryStr: `{"query":{"field":"isOpen","bool":true},"score":"none"}`,
+			expectedSargKeys: []string{"isOpen"},
+		},
+		{
+			queryStr: "t.createdOn = '1985-04-12T23:20:50.52Z'",
+			expectedQueryStr: `{"query":{"field":"createdOn","start":"1985-04-12T23:20:50.52Z",` +
+				`"inclusive_start":true,"end":"1985-04-12T23:20:50.52Z","inclusive_end":true},` +
+				`"score":"none"}`,
+			expectedSargKeys: []string{"createdOn"},
+		},
+		{
+			queryStr: "t.createdOn > '1985-04-12T23:20:50.52Z'" +
+				"AND t.createdOn <= '2020-01-30T12:00:00.00Z'",
+			expectedQueryStr: `{"query":{"field":"createdOn",` +
+				`"start":"1985-04-12T23:20:50.52Z","inclusive_start":false,` +
+				`"end":"2020-01-30T12:00:00.00Z","inclusive_end":true},"score":"none"}`,
+			expectedSargKeys: []string{"createdOn"},
+		},
+		{
+			queryStr: "t.createdOn IN ['2020-05-18', '2020-05-19']",
+			expectedQueryStr: `{"query":{"disjuncts":[{"field":"createdOn","start":"2020-05-18",` +
+				`"end":"2020-05-18","inclusive_start":true,"inclusive_end":true},` +
+				`{"field":"createdOn","start":"2020-05-19","end":"2020-05-19",` +
+				`"inclusive_start":true,"inclusive_end":true}]},"score":"none"}`,
+			expectedSargKeys: []string{"createdOn"},
+		},
+		{
+			queryStr: "t.id IN [10] AND t.type = 'hotel'",
+			expectedQueryStr: `{"query":{"conjuncts":[{"field":"id","min":10,"max":10,` +
+				`"inclusive_min":true,"inclusive_max":true},{"field":"type","term":"hotel"}]}` +
+				`,"score":"none"}`,
+			expectedSargKeys: []string{"id", "type"},
+		},
+	}
+
+	for i := range tests {
+		testQueryOverFlexIndex(t, index, tests[i].queryStr, tests[i].expectedQueryStr,
+			tests[i].expectedSargKeys)
+	}
+}
+
+func TestComplexQuerySargabilityOverFlexIndexes(t *testing.T) {
+	indexes := [][]byte{
+		util.SampleIndexDefWithSeveralNestedFieldsUnderDefaultMapping,
+		util.SampleIndexDefDynamicWithAnalyzerKeyword,
+		util.SampleIndexDefWithSeveralNestedFieldsUnderHotelMapping,
+	}
+
+	for i := range indexes {
+		index, err := setupSampleIndex(indexes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			queryStr                       string
+			expectedQueryStrDefaultMapping string
+			expectedQueryStrCustomMapping  string
+			expectedSargKeys               []string
+		}{
+			{
+				queryStr: `t.type = "hotel"` +
+					` AND ANY r in t.reviews SATISFIES r.author = "Shaniya Wisoky" END`,
+				expectedQueryStrDefaultMapping: `{"query":{"conjuncts":[{"field":"type","term":"hotel"},` +
+					`{"field":"reviews.author","term":"Shaniya Wisoky"}]},"score":"none"}`,
+				expectedQueryStrCustomMapping: `{"query":{"field":"reviews.author",` +
+					`"term":"Shaniya Wisoky"},"score":"none"}`,
+				expectedSargKeys: []string{"type", "reviews.author"},
+			},
+			{
+				queryStr: `t.type = "hotel"` +
+					` AND ANY r IN t.reviews SATISFIES r.ratings.Cleanliness = 5 OR r.ratings.Overall = 4 END` +
+					` AND ANY p IN t.public_likes SATISFIES p LIKE "Raymundo Quigley" END`,
+				expectedQueryStrDefaultMapping: `{"query":{"conjuncts":[{"field":"type","term":"hotel"},` +
+					`{"disjuncts":[{"field":"reviews.ratings.Cleanliness","inclusive_max":true,` +
+					`"inclusive_min":true,"max":5,"min":5},{"field":"reviews.ratings.Overall",` +
+					`"inclusive_max":true,"inclusive_min":true,"max":4,"min":4}]},` +
+					`{"field":"public_likes","wildcard":"Raymundo Quigley"}]},"score":"none"}`,
+				expectedQueryStrCustomMapping: `{"query":{"conjuncts":[{"disjuncts":[` +
+					`{"field":"reviews.ratings.Cleanliness",` +
+					`"inclusive_max":true,"inclusive_min":true,"max":5,"min":5},` +
+					`{"field":"reviews.ratings.Overall","inclusive_max":true,"inclusive_min":true,` +
+					`"max":4,"min":4}]},{"field":"public_likes","wildcard":"Raymundo Quigley"}]},"score":"none"}`,
+				expectedSargKeys: []string{
+					"type", "reviews.ratings.Cleanliness", "reviews.ratings.Overall", "public_likes",
+				},
+			},
+		}
+
+		for j := range tests {
+			queryExpression, err := parser.Parse(tests[j].queryStr)
+			if err != nil {
+				t.Fatal(tests[j].queryStr, err)
+			}
+
+			flexRequest := &datastore.FTSFlexRequest{
+				Keyspace: "t",
+				Pred:     queryExpression,
+			}
+
+			resp, err := index.SargableFlex("0", flexRequest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedQueryStr := ""
+
+			if index.condExpr == nil {
+				// default mapping in use
+				expectedQueryStr = tests[j].expectedQueryStrDefaultMapping
+			} else {
+				expectedQueryStr = tests[j].expectedQueryStrCustomMapping
+			}
+
+			if resp == nil || len(resp.StaticSargKeys) != len(tests[j].expectedSargKeys) {
+				t.Fatalf("[%s] Query: %v, Resp: %#v", index.Name(), tests[j].queryStr, resp)
+			}
+
+			for _, key := range tests[j].expectedSargKeys {
+				if resp.StaticSargKeys[key] == nil {
+					t.Fatalf("[%s] ExpectedSargKeys: %v, Got StaticSargKeys: %v",
+						index.Name(), tests[j].expectedSargKeys, resp.StaticSargKeys)
+				}
+			}
+
+			var gotQuery, expectedQuery map[string]interface{}
+			err = json.Unmarshal([]byte(resp.SearchQuery), &gotQuery)
+			if err != nil {
+				t.Fatalf("[%s] SearchQuery: %s, err: %v", index.Name(), resp.SearchQuery, err)
+			}
+			err = json.Unmarshal([]byte(expectedQueryStr), &expectedQuery)
+			if err != nil {
+				t.Fatalf("[%s] ExpectedQuery: %s, err: %v", index.Name(), expectedQueryStr, err)
+			}
+
+			if !reflect.DeepEqual(expectedQuery, gotQuery) {
+				t.Fatalf("[%s] ExpectedQuery: %s, GotQuery: %s", index.Name(), expectedQueryStr,
+					resp.SearchQuery)
+			}
+		}
+	}
+}
+
+// =============================================================================
+
+func TestIndexMultipleTypeMappings(t *testing.T) {
+	index, err := setupSampleIndex([]byte(`{
+		"name": "default",
+		"type": "fulltext-index",
+		"sourceName": "default",
+		"planParams": {
+			"indexPartitions": 6
+		},
+		"params": {
+			"doc_config": {
+				"mode": "type_field",
+				"type_field": "type"
+			},
+			"mapping": {
+				"default_mapping": {
+					"dynamic": true,
+					"enabled": false
+				},
+				"type_field": "_type",
+				"types": {
+					"type1": {
+						"dynamic": true,
+						"enabled": true
+					},
+					"type2": {
+						"dynamic": true,
+						"enabled": true
+					}
+				}
+			},
+			"store": {
+				"indexType": "scorch"
+			}
+		}
+	}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectCondExprStr := "`type` = \"type1\" OR `type` = \"type2\""
+	expectCondExpr, err := parser.Parse(expectCondExprStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectExprs := expectCondExpr.Children()
+	gotExprs := index.condExpr.Children()
+
+	if len(expectExprs) != len(gotExprs) {
+		t.Fatalf("Expected condExpr: %s, got: %s",
+			expectCondExpr.String(), index.condExpr.String())
+	}
+
+	for i := range expectExprs {
+		if len(expectExprs[i].Children()) != len(gotExprs[i].Children()) {
+			t.Fatalf("Expect expression: %s, got expression: %s",
+				expectExprs[i].String(), gotExprs[i].String())
+		}
+	}
+}
+
+func TestIndexSargabilityOverMultipleTypeMappings(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithMultipleTypeMappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the documents searched are those of the indexed types.
+	if cond := index.Condition(); cond == nil ||
+		!strings.Contains(cond.String(), `"airline"`) ||
+		!strings.Contains(cond.String(), `"airport"`) {
+		t.Fatalf("Expected the condition over both types, got: %v", cond)
+	}
+
+	tests := []struct {
+		field    string
+		sargable bool
+		types    string
+	}{
+		// city is under the airport type mapping only
+		{field: "city", sargable: true, types: "airport"},
+		{field: "country", sargable: true, types: "airline, airport"},
+		{field: "name", sargable: false},
+	}
+
+	for _, test := range tests {
+		q := expression.NewConstant(map[string]interface{}{
+			"term": "United States", "field": test.field,
+		})
+
+		count, _, _, _, n1qlErr := index.Sargable("", q, nil, nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+
+		if test.sargable != (count > 0) {
+			t.Fatalf("[%s] Expected sargable: %t, got count: %d", test.field,
+				test.sargable, count)
+		}
+
+		explain, err := index.ExplainSargable("", q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(explain.QueryFields) != 1 ||
+			explain.QueryFields[0].Matched != test.sargable {
+			t.Fatalf("[%s] Unexpected explanation: %+v", test.field, explain)
+		}
+
+		if test.sargable && !strings.HasSuffix(explain.QueryFields[0].Reason,
+			"types: "+test.types) {
+			t.Fatalf("[%s] Expected the types: %s, got: %+v", test.field,
+				test.types, explain.QueryFields[0])
+		}
+	}
+}
+
+func TestIndexConditionOverCustomTypeField(t *testing.T) {
+	index, err := setupSampleIndex([]byte(`{
+		"name": "default",
+		"type": "fulltext-index",
+		"sourceName": "default",
+		"params": {
+			"doc_config": {
+				"mode": "type_field",
+				"type_field": "meta.kind"
+			},
+			"mapping": {
+				"default_mapping": {
+					"enabled": false
+				},
+				"types": {
+					"beer": {
+						"dynamic": true,
+						"enabled": true
+					},
+					"brewery": {
+						"dynamic": true,
+						"enabled": false
+					}
+				}
+			},
+			"store": {
+				"indexType": "scorch"
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// expect: `meta`.`kind` = "beer"
+	eq, ok := index.Condition().(*expression.Eq)
+	if !ok {
+		t.Fatalf("Expected an equality condition, got: %v", index.Condition())
+	}
+
+	operands := eq.Children()
+	if len(operands) != 2 {
+		t.Fatalf("Unexpected condition: %s", eq.String())
+	}
+
+	typeField, ok := operands[0].(*expression.Field)
+	if !ok {
+		t.Fatalf("Expected a nested type field, got: %s", operands[0].String())
+	}
+
+	if ident, ok := typeField.Children()[0].(*expression.Identifier); !ok ||
+		ident.Identifier() != "meta" {
+		t.Fatalf("Unexpected type field: %s", typeField.String())
+	}
+
+	if operands[1].Value() == nil || operands[1].Value().Actual() != "beer" {
+		t.Fatalf("Unexpected type: %s", operands[1].String())
+	}
+}
+
+func TestIndexSargabilityOfConditionSubsumedClauses(t *testing.T) {
+	// the index's condition: `type` = "hotel", with the type field not
+	// indexed itself.
+	index, err := setupSampleIndex(
+		util.SampleIndexDefWithSeveralNestedFieldsUnderHotelMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    map[string]interface{}
+		count    int
+		exact    bool
+		searched []string // fields of the query sent to FTS
+	}{
+		{
+			// the type predicate is subsumed by the condition
+			query: map[string]interface{}{
+				"conjuncts": []interface{}{
+					map[string]interface{}{"term": "hotel", "field": "type"},
+					map[string]interface{}{"match": "xyz",
+						"field": "reviews.author"},
+				},
+			},
+			count:    1,
+			exact:    true,
+			searched: []string{"reviews.author"},
+		},
+		{
+			// as it is matched too
+			query: map[string]interface{}{
+				"conjuncts": []interface{}{
+					map[string]interface{}{"match": "hotel", "field": "type"},
+					map[string]interface{}{"match": "xyz",
+						"field": "reviews.author"},
+					map[string]interface{}{"match": "abc",
+						"field": "public_likes"},
+				},
+			},
+			count:    2,
+			exact:    true,
+			searched: []string{"public_likes", "reviews.author"},
 		},
 		{
-			queryStr: "t.type = 'hotel' AND (t.id = 10 OR t.id = 20)",
-			expectedQueryStr: `{"query":{"conjuncts":[{"field":"type","term":"hotel"},` +
-				`{"disjuncts":[{"field":"id","inclusive_max":true,"inclusive_min":true,` +
-				`"max":10,"min":10},{"field":"id","inclusive_max":true,` +
-				`"inclusive_min":true,"max":20,"min":20}]}]},"score":"none"}`,
-			expectedSargKeys: []string{"type", "id"},
+			// on its own, all of the documents indexed are matched
+			query: map[string]interface{}{
+				"term": "hotel", "field": "type",
+			},
+			count:    int(index.indexedCount),
+			exact:    true,
+			searched: nil,
 		},
 		{
-			queryStr:         "t.type = 'hotel' AND t.id < 10",
-			expectedQueryStr: `{"query":{"field":"type","term":"hotel"},"score":"none"}`,
-			expectedSargKeys: []string{"type"},
+			// another type isn't subsumed, the conjunction's partially
+			// sargable
+			query: map[string]interface{}{
+				"conjuncts": []interface{}{
+					map[string]interface{}{"term": "motel", "field": "type"},
+					map[string]interface{}{"match": "xyz",
+						"field": "reviews.author"},
+				},
+			},
+			count:    1,
+			exact:    false,
+			searched: []string{"reviews.author"},
 		},
 		{
-			queryStr:         "t.type = 'hotel' AND t.id <= 10",
-			expectedQueryStr: `{"query":{"field":"type","term":"hotel"},"score":"none"}`,
-			expectedSargKeys: []string{"type"},
+			// nor is a predicate within a disjunction
+			query: map[string]interface{}{
+				"disjuncts": []interface{}{
+					map[string]interface{}{"term": "hotel", "field": "type"},
+					map[string]interface{}{"match": "xyz",
+						"field": "reviews.author"},
+				},
+			},
+			count: 0,
+		},
+	}
+
+	for testi, test := range tests {
+		q := expression.NewConstant(test.query)
+
+		count, _, exact, _, n1qlErr := index.Sargable("", q, nil, nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+
+		if count != test.count || (count > 0 && exact != test.exact) {
+			t.Fatalf("[%d] Expected count: %d, exact: %t, got count: %d,"+
+				" exact: %t", testi, test.count, test.exact, count, exact)
+		}
+
+		if count == 0 {
+			continue
+		}
+
+		rv := index.buildQueryAndCheckIfSargable("", q.Value(), nil, nil)
+		if rv.searchRequest == nil {
+			t.Fatalf("[%d] Expected a search request", testi)
+		}
+
+		sq, err := query.ParseQuery(rv.searchRequest.Q)
+		if err != nil {
+			t.Fatalf("[%d] err: %v", testi, err)
+		}
+
+		fields, err := util.FetchFieldsToSearchFromQuery(sq)
+		if err != nil {
+			t.Fatalf("[%d] err: %v", testi, err)
+		}
+
+		var searched []string
+		for f := range fields {
+			if f.Name != "" {
+				searched = append(searched, f.Name)
+			}
+		}
+		sort.Strings(searched)
+
+		if !reflect.DeepEqual(searched, test.searched) {
+			t.Fatalf("[%d] Expected the fields searched: %v, got: %v",
+				testi, test.searched, searched)
+		}
+	}
+
+	// the explanation tells of the clauses subsumed.
+	explain, err := index.ExplainSargable("", expression.NewConstant(
+		tests[0].query), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if explain.Reason != "sargable, 1 of 2 clauses subsumed by the index"+
+		" condition" {
+		t.Fatalf("Unexpected explanation: %+v", explain)
+	}
+}
+
+func TestSargableFlexIndexWithMultipleTypeMappings(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithMultipleTypeMappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		queryStr         string
+		expectedQueryStr string
+	}{
+		{
+			queryStr:         `t.type = "airline" AND t.country = "US"`,
+			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
 		},
 		{
-			queryStr:         "t.type = 'hotel' AND t.id > 10",
-			expectedQueryStr: `{"query":{"field":"type","term":"hotel"},"score":"none"}`,
-			expectedSargKeys: []string{"type"},
+			queryStr:         `t.type = "airport" AND t.country = "US"`,
+			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
+		},
+		{
+			queryStr:         `(t.type = "airline" OR t.type = "airport") AND t.country = "US"`,
+			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
+		},
+		{
+			queryStr:         `t.type = "airline" OR t.type = "airport" AND t.country = "US"`,
+			expectedQueryStr: ``,
+		},
+		{
+			queryStr:         `t.type = "airline" OR (t.type = "airport" AND t.country = "US")`,
+			expectedQueryStr: ``,
+		},
+		{
+			queryStr:         `(t.type = "airport") OR (t.type = "airline" AND t.country = "US")`,
+			expectedQueryStr: ``,
+		},
+		{
+			// Expect this expression to be sargable, although filtering (non-covering index)
+			// will ensure that no results are returned.
+			queryStr:         `t.type = "airport" AND t.type = "airline" AND t.country = "US"`,
+			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
+		},
+		{
+			// No "type" expressions provided.
+			queryStr:         `(t.city = "airline" OR t.city = "airport") AND t.country = "US"`,
+			expectedQueryStr: ``,
+		},
+		{
+			queryStr:         `t.type IN ["airline"] AND t.country = "US"`,
+			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
+		},
+		{
+			queryStr:         `t.type IN ["airline", "airport"] AND t.country = "US"`,
+			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
+		},
+		{
+			queryStr:         `t.country = "US" AND t.type IN ["airline", "airport"]`,
+			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
+		},
+		{
+			// "type" expression(s) not searchable.
+			queryStr:         `t.type IN ["airline", "airport"]`,
+			expectedQueryStr: ``,
+		},
+		{
+			// No "type" expressions provided.
+			queryStr:         `t.city IN ["airline", "airport"] AND t.country = "US"`,
+			expectedQueryStr: ``,
+		},
+		{
+			// MB-39517: "city" not indexed within "airline" type mapping
+			queryStr:         `t.type = "airline" AND t.city = "SF"`,
+			expectedQueryStr: ``,
+		},
+		{
+			// MB-39517: "city" indexed within "airport" type mapping
+			queryStr:         `t.type = "airport" AND t.city = "SF"`,
+			expectedQueryStr: `{"query":{"field":"city","term":"SF"},"score":"none"}`,
+		},
+		{
+			// MB-39517: "city" only indexed within "airport" type mapping
+			queryStr:         `(t.type = "airline" OR t.type = "airport") AND t.city = "SF"`,
+			expectedQueryStr: ``,
+		},
+		{
+			// MB-39517: "city" only indexed within "airport" type mapping
+			queryStr:         `t.type IN ["airline", "airport"] AND t.city = "SF"`,
+			expectedQueryStr: ``,
+		},
+		{
+			// MB-39517: "city" not indexed within "airline", but country is within both, so partially sargable
+			queryStr:         `t.type IN ["airline", "airport"] AND t.country = "US" AND t.city = "SF"`,
+			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
+		},
+		{
+			// MB-39517: "city" not indexed within "airline", but country is within both, so partially sargable
+			queryStr:         `(t.type = "airline" OR t.type = "airport") AND t.country = "US" AND t.city = "SF"`,
+			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
+		},
+		{
+			// MB-39517: "city" not indexed within "airline", although country is within both, it's a disjunction
+			queryStr:         `t.type IN ["airline", "airport"] AND t.country = "US" OR t.city = "SF"`,
+			expectedQueryStr: ``,
+		},
+		{
+			// MB-39517: "city" not indexed within "airline", although country is within both, it's a disjunction
+			queryStr:         `(t.type = "airline" OR t.type = "airport") AND t.country = "US" OR t.city = "SF"`,
+			expectedQueryStr: ``,
 		},
+	}
+
+	for i := range tests {
+		queryExpression, err := parser.Parse(tests[i].queryStr)
+		if err != nil {
+			t.Fatal(tests[i].queryStr, err)
+		}
+
+		flexRequest := &datastore.FTSFlexRequest{
+			Keyspace: "t",
+			Pred:     queryExpression,
+		}
+
+		resp, err := index.SargableFlex("0", flexRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(tests[i].expectedQueryStr) == 0 {
+			if resp != nil {
+				t.Errorf("[%d] Expected `%s` to not be sargable for index",
+					i, tests[i].queryStr)
+			}
+			continue
+		}
+
+		if resp == nil {
+			t.Errorf("[%d] Expected `%s` to be sargable for index", i, tests[i].queryStr)
+			continue
+		}
+
+		var gotQuery, expectedQuery map[string]interface{}
+		err = json.Unmarshal([]byte(resp.SearchQuery), &gotQuery)
+		if err != nil {
+			t.Errorf("[%d] SearchQuery: %s, err: %v", i, resp.SearchQuery, err)
+		}
+		err = json.Unmarshal([]byte(tests[i].expectedQueryStr), &expectedQuery)
+		if err != nil {
+			t.Errorf("[%d] ExpectedQuery: %s, err: %v", i, tests[i].expectedQueryStr, err)
+		}
+
+		if !reflect.DeepEqual(expectedQuery, gotQuery) {
+			t.Errorf("[%d] ExpectedQuery: %s, GotQuery: %s",
+				i, tests[i].expectedQueryStr, resp.SearchQuery)
+		}
+	}
+}
+
+func TestSargableFlexIndexDocIDPrefixWithMultipleTypeMappings(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithDocIdPrefixMultipleTypeMappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		queryStr         string
+		expectedQueryStr string
+	}{
 		{
-			queryStr:         "t.type = 'hotel' AND t.id >= 10",
-			expectedQueryStr: `{"query":{"field":"type","term":"hotel"},"score":"none"}`,
-			expectedSargKeys: []string{"type"},
+			queryStr:         `meta().id LIKE "airline-%" AND t.country = "US"`,
+			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
 		},
 		{
-			queryStr: "t.id >= 0 and t.id < 20",
-			expectedQueryStr: `{"query":{"field":"id","min":0,"inclusive_min":true,` +
-				`"max":20,"inclusive_max":false},"score":"none"}`,
-			expectedSargKeys: []string{"id"},
+			queryStr:         `meta().id LIKE "airport-%" AND t.country = "US"`,
+			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
 		},
 		{
-			queryStr: "t.id >= -20 and t.id <= -5",
-			expectedQueryStr: `{"query":{"field":"id","min":-20,"inclusive_min":true,` +
-				`"max":-5,"inclusive_max":true},"score":"none"}`,
-			expectedSargKeys: []string{"id"},
+			queryStr:         `(meta().id LIKE "airline-%" OR meta().id LIKE "airport-%") AND t.country = "US"`,
+			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
 		},
 		{
-			queryStr: "t.type = 'hotel' AND t.id > 5 AND t.id < 10",
-			expectedQueryStr: `{"query":{"conjuncts":[{"field":"type","term":"hotel"},` +
-				`{"field":"id","min":5,"inclusive_min":false,"max":10,` +
-				`"inclusive_max":false}]},"score":"none"}`,
-			expectedSargKeys: []string{"type", "id"},
+			// MB-39517: "city" indexed within "airport" type mapping
+			queryStr:         `meta().id LIKE "airport-%" AND t.city = "SF"`,
+			expectedQueryStr: `{"query":{"field":"city","term":"SF"},"score":"none"}`,
 		},
 		{
-			queryStr: "t.isOpen = true AND t.type = 'hotel'",
-			expectedQueryStr: `{"query":{"conjuncts":[{"field":"isOpen","bool":true},` +
-				`{"field":"type","term":"hotel"}]},"score":"none"}`,
-			expectedSargKeys: []string{"isOpen", "type"},
+			// MB-39517: "city" only indexed within "airport" type mapping
+			queryStr:         `meta().id LIKE "airline-%" AND t.city = "SF"`,
+			expectedQueryStr: ``,
 		},
+	}
+
+	for i := range tests {
+		queryExpression, err := parser.Parse(tests[i].queryStr)
+		if err != nil {
+			t.Fatal(tests[i].queryStr, err)
+		}
+
+		flexRequest := &datastore.FTSFlexRequest{
+			Keyspace: "t",
+			Pred:     queryExpression,
+		}
+
+		resp, err := index.SargableFlex("0", flexRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(tests[i].expectedQueryStr) == 0 {
+			if resp != nil {
+				t.Errorf("[%d] Expected `%s` to not be sargable for index",
+					i, tests[i].queryStr)
+			}
+			continue
+		}
+
+		if resp == nil {
+			t.Errorf("[%d] Expected `%s` to be sargable for index", i, tests[i].queryStr)
+			continue
+		}
+
+		var gotQuery, expectedQuery map[string]interface{}
+		err = json.Unmarshal([]byte(resp.SearchQuery), &gotQuery)
+		if err != nil {
+			t.Errorf("[%d] SearchQuery: %s, err: %v", i, resp.SearchQuery, err)
+		}
+		err = json.Unmarshal([]byte(tests[i].expectedQueryStr), &expectedQuery)
+		if err != nil {
+			t.Errorf("[%d] ExpectedQuery: %s, err: %v", i, tests[i].expectedQueryStr, err)
+		}
+
+		if !reflect.DeepEqual(expectedQuery, gotQuery) {
+			t.Errorf("[%d] ExpectedQuery: %s, GotQuery: %s",
+				i, tests[i].expectedQueryStr, resp.SearchQuery)
+		}
+	}
+}
+
+func TestSargableFlexIndexWithLikeExpressions(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicWithAnalyzerKeyword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		queryStr         string
+		expectedQueryStr string
+	}{
 		{
-			queryStr: "t.type = 'hotel' AND t.createdOn = '1985-04-12T23:20:50.52Z'",
-			expectedQueryStr: `{"query":{"conjuncts":[{"field":"type","term": "hotel"},` +
-				`{"field":"createdOn","start":"1985-04-12T23:20:50.52Z",` +
-				`"inclusive_start":true,"end":"1985-04-12T23:20:50.52Z",` +
-				`"inclusive_end":true}]},"score":"none"}`,
-			expectedSargKeys: []string{"type", "createdOn"},
+			queryStr:         `t.type LIKE "ho%l"`,
+			expectedQueryStr: `{"query":{"field":"type","wildcard":"ho*l"},"score":"none"}`,
 		},
 		{
-			queryStr: "t.createdOn > '1985-04-12T23:20:50.52Z'" +
-				"AND t.createdOn <= '2020-01-30T12:00:00.00Z'",
-			expectedQueryStr: `{"query":{"field":"createdOn",` +
-				`"start":"1985-04-12T23:20:50.52Z","inclusive_start":false,` +
-				`"end":"2020-01-30T12:00:00.00Z","inclusive_end":true},"score":"none"}`,
-			expectedSargKeys: []string{"createdOn"},
+			queryStr:         `t.type LIKE "hot_l"`,
+			expectedQueryStr: `{"query":{"field":"type","wildcard":"hot?l"},"score":"none"}`,
 		},
 		{
-			// this is a "datetime" search term over a "text" indexed field,
-			// query treated as sargable - although no results may be returned.
-			queryStr: "t.type = '1985-04-12T23:20:50.52Z'",
-			expectedQueryStr: `{"query":{"field":"type",` +
-				`"term":"1985-04-12T23:20:50.52Z"},"score":"none"}`,
-			expectedSargKeys: []string{"type"},
+			queryStr:         `t.type LIKE "%t%"`,
+			expectedQueryStr: `{"query":{"field":"type","wildcard":"*t*"},"score":"none"}`,
 		},
 		{
-			// createdOn is indexed as "datetime", so this query is partially sargable.
-			queryStr: "t.type = 'hotel' AND t.createdOn = 'crap'",
-			expectedQueryStr: `{"query":{"field":"type",` +
-				`"term":"hotel"},"score":"none"}`,
-			expectedSargKeys: []string{"type"},
+			queryStr:         `t.type LIKE "\\%@hot_l%"`,
+			expectedQueryStr: `{"query":{"field":"type","wildcard":"\\%@hot?l*"},"score":"none"}`,
 		},
-		{
-			queryStr: "t.type IN ['airline', 'airport'] AND t.createdOn = '2020-05-18'",
-			expectedQueryStr: `{"query":{"conjuncts":[{"disjuncts":[{"field":"type",` +
-				`"term":"airline"},{"field":"type","term":"airport"}]},` +
-				`{"field":"createdOn","start":"2020-05-18","end":"2020-05-18",` +
-				`"inclusive_start":true,"inclusive_end":true}]},"score":"none"}`,
-			expectedSargKeys: []string{"type", "createdOn"},
+	}
+
+	for i := range tests {
+		queryExpression, err := parser.Parse(tests[i].queryStr)
+		if err != nil {
+			t.Fatal(tests[i].queryStr, err)
+		}
+
+		flexRequest := &datastore.FTSFlexRequest{
+			Keyspace: "t",
+			Pred:     queryExpression,
+		}
+
+		resp, err := index.SargableFlex("0", flexRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(tests[i].expectedQueryStr) == 0 {
+			if resp != nil {
+				t.Errorf("[%d] Expected `%s` to not be sargable for index, but got: %v",
+					i, tests[i].queryStr, resp)
+			}
+			continue
+		}
+
+		if resp == nil {
+			t.Errorf("[%d] Expected `%s` to be sargable for index", i, tests[i].queryStr)
+			continue
+		}
+
+		var gotQuery, expectedQuery map[string]interface{}
+		err = json.Unmarshal([]byte(resp.SearchQuery), &gotQuery)
+		if err != nil {
+			t.Errorf("[%d] SearchQuery: %s, err: %v", i, resp.SearchQuery, err)
+			continue
+		}
+		err = json.Unmarshal([]byte(tests[i].expectedQueryStr), &expectedQuery)
+		if err != nil {
+			t.Errorf("[%d] ExpectedQuery: %s, err: %v", i, tests[i].expectedQueryStr, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(expectedQuery, gotQuery) {
+			t.Errorf("[%d] ExpectedQuery: %s, GotQuery: %s",
+				i, tests[i].expectedQueryStr, resp.SearchQuery)
+		}
+	}
+}
+
+func TestFlexPushDownForLimitOffsetOrder(t *testing.T) {
+	index, err := setupSampleIndex(
+		util.SampleIndexDefWithKeywordAnalyzerOverDefaultMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryStr := `t.type = "hotel" AND t.id >= 10 AND t.id <= 20`
+	queryExpr, _ := parser.Parse(queryStr)
+	sortOnID, _ := parser.Parse("id")
+	flexRequest := &datastore.FTSFlexRequest{
+		Keyspace:      "t",
+		Pred:          queryExpr,
+		CheckPageable: true,
+		Order: []*datastore.SortTerm{
+			{
+				Expr:       sortOnID,
+				Descending: true,
+				NullsPos:   datastore.ORDER_NULLS_NONE,
+			},
 		},
+		Offset: 5,
+		Limit:  20,
+	}
+
+	resp, err := index.SargableFlex("0", flexRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp == nil {
+		t.Fatalf("Expected a response, but didn't get any")
 	}
 
-	for i := range tests {
-		testQueryOverFlexIndex(t, index, tests[i].queryStr, tests[i].expectedQueryStr,
-			tests[i].expectedSargKeys)
+	var expectQuery, gotQuery map[string]interface{}
+	_ = json.Unmarshal([]byte(`{"query":{"conjuncts":[{"field":"type","term":"hotel"},`+
+		`{"field":"id","inclusive_max":true,"inclusive_min":true,"max":20,`+
+		`"min":10}]},"score":"none", "size": 20, "from": 5, "sort": ["-id"]}`),
+		&expectQuery)
+	if err = json.Unmarshal([]byte(resp.SearchQuery), &gotQuery); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(expectQuery, gotQuery) {
+		t.Fatalf("Expected query: %v, Got Query: %v", expectQuery, gotQuery)
 	}
 }
 
-func TestSargableDynamicFlexIndex(t *testing.T) {
-	// Only a default dynamic index with "default_analzyer" set to "keyword"
+func TestFlexPushDownSearchFunc1(t *testing.T) {
 	index, err := setupSampleIndex(
 		util.SampleIndexDefDynamicWithAnalyzerKeyword)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	flexExpr, _ := parser.Parse(`t.country = "United States"`)
+
 	tests := []struct {
-		queryStr         string
-		expectedQueryStr string
-		expectedSargKeys []string
+		searchExpr expression.Expression
 	}{
 		{
-			queryStr:         "t.country = 'United States'",
-			expectedQueryStr: `{"query":{"field":"country","term":"United States"},"score":"none"}`,
-			expectedSargKeys: []string{"country"},
-		},
-		{
-			queryStr: "t.type >= 'hot' AND t.type <= 'hotel'",
-			expectedQueryStr: `{"query": {"field":"type","min":"hot","inclusive_min":true,` +
-				`"max":"hotel","inclusive_max":true},"score":"none"}`,
-			expectedSargKeys: []string{"type"},
-		},
-		{
-			queryStr: "t.id = 10",
-			expectedQueryStr: `{"query":{"field":"id","inclusive_max":true,"inclusive_min":true,` +
-				`"max":10,"min":10},"score":"none"}`,
-			expectedSargKeys: []string{"id"},
-		},
-		{
-			queryStr: "t.id >= 0 AND t.id < 20",
-			expectedQueryStr: `{"query":{"field":"id","min":0,"inclusive_min":true,` +
-				`"max":20,"inclusive_max":false},"score":"none"}`,
-			expectedSargKeys: []string{"id"},
-		},
-		{
-			queryStr: "t.id > -25 AND t.id <= 10",
-			expectedQueryStr: `{"query":{"field":"id","min":-25,"inclusive_min":false,` +
-				`"max":10,"inclusive_max":true},"score":"none"}`,
-			expectedSargKeys: []string{"id"},
-		},
-		{
-			queryStr:         "t.isOpen = true",
-			expectedQueryStr: `{"query":{"field":"isOpen","bool":true},"score":"none"}`,
-			expectedSargKeys: []string{"isOpen"},
-		},
-		{
-			queryStr: "t.createdOn = '1985-04-12T23:20:50.52Z'",
-			expectedQueryStr: `{"query":{"field":"createdOn","start":"1985-04-12T23:20:50.52Z",` +
-				`"inclusive_start":true,"end":"1985-04-12T23:20:50.52Z","inclusive_end":true},` +
-				`"score":"none"}`,
-			expectedSargKeys: []string{"createdOn"},
+			searchExpr: search.NewSearch(expression.NewConstant(``),
+				expression.NewConstant(map[string]interface{}{
+					"match": "Salt Lake City",
+					"field": "city",
+				})),
 		},
 		{
-			queryStr: "t.createdOn > '1985-04-12T23:20:50.52Z'" +
-				"AND t.createdOn <= '2020-01-30T12:00:00.00Z'",
-			expectedQueryStr: `{"query":{"field":"createdOn",` +
-				`"start":"1985-04-12T23:20:50.52Z","inclusive_start":false,` +
-				`"end":"2020-01-30T12:00:00.00Z","inclusive_end":true},"score":"none"}`,
-			expectedSargKeys: []string{"createdOn"},
+			searchExpr: search.NewSearch(expression.NewConstant(``),
+				expression.NewConstant(map[string]interface{}{
+					"query": map[string]interface{}{
+						"match": "Salt Lake City",
+						"field": "city",
+					},
+				})),
 		},
+	}
+
+	var expectQuery map[string]interface{}
+	_ = json.Unmarshal([]byte(`{"query":{"conjuncts":[{"field":"country",`+
+		`"term":"United States"},{"field":"city","match":"Salt Lake City",`+
+		`"fuzziness": 0,"prefix_length": 0}]},"score":"none"}`),
+		&expectQuery)
+
+	for testi, test := range tests {
+		finalExpr := expression.NewAnd(flexExpr, test.searchExpr)
+
+		flexRequest := &datastore.FTSFlexRequest{
+			Keyspace: "t",
+			Pred:     finalExpr,
+		}
+
+		resp, n1qlErr := index.SargableFlex("0", flexRequest)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+
+		expectedSargKeys := []string{test.searchExpr.String(), "country"}
+
+		if resp == nil || len(resp.StaticSargKeys) != len(expectedSargKeys) {
+			t.Fatalf("[%d] Resp: %#v", testi+1, resp)
+		}
+
+		for _, key := range expectedSargKeys {
+			if resp.StaticSargKeys[key] == nil {
+				t.Fatalf("[%d] ExpectedSargKeys: %v, Got StaticSargKeys: %v",
+					testi+1, expectedSargKeys, resp.StaticSargKeys)
+			}
+		}
+
+		var gotQuery map[string]interface{}
+		if err := json.Unmarshal([]byte(resp.SearchQuery), &gotQuery); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(expectQuery, gotQuery) {
+			t.Fatalf("[%d] Expected query: %v, Got query: %v",
+				testi+1, expectQuery, gotQuery)
+		}
+	}
+}
+
+func TestFlexPushDownSearchFunc2(t *testing.T) {
+	index, err := setupSampleIndex(
+		util.SampleIndexDefWithSeveralNestedFieldsUnderHotelMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	condExpr, _ := parser.Parse(`t.type = "hotel"`)
+	flexExpr, _ := parser.Parse(
+		`ANY p IN t.public_likes SATISFIES p LIKE "ABC" END`)
+
+	tests := []struct {
+		searchExpr       expression.Expression
+		expectQuery      string
+		expectedSargKeys []string
+		expectSearchExpr bool
+	}{
 		{
-			queryStr: "t.createdOn IN ['2020-05-18', '2020-05-19']",
-			expectedQueryStr: `{"query":{"disjuncts":[{"field":"createdOn","start":"2020-05-18",` +
-				`"end":"2020-05-18","inclusive_start":true,"inclusive_end":true},` +
-				`{"field":"createdOn","start":"2020-05-19","end":"2020-05-19",` +
-				`"inclusive_start":true,"inclusive_end":true}]},"score":"none"}`,
-			expectedSargKeys: []string{"createdOn"},
+			searchExpr: search.NewSearch(expression.NewConstant(``),
+				expression.NewConstant(`reviews.author:XYZ`),
+				expression.NewConstant(map[string]interface{}{
+					"index": "SampleIndexDefWithSeveralNestedFieldsUnderHotelMapping",
+				})),
+			expectQuery: `{"query":{"conjuncts":[{"field":"public_likes",` +
+				`"wildcard":"ABC"},{"must":{"conjuncts":[]},"must_not":{"disjuncts":[],` +
+				`"min": 0},"should":{"disjuncts":[{"field":"reviews.author","fuzziness":0,` +
+				`"match":"XYZ","prefix_length":0}],"min":0}}]},"score":"none"}`,
+			expectedSargKeys: []string{"type", "public_likes"},
+			expectSearchExpr: true,
 		},
 		{
-			queryStr: "t.id IN [10] AND t.type = 'hotel'",
-			expectedQueryStr: `{"query":{"conjuncts":[{"field":"id","min":10,"max":10,` +
-				`"inclusive_min":true,"inclusive_max":true},{"field":"type","term":"hotel"}]}` +
-				`,"score":"none"}`,
-			expectedSargKeys: []string{"id", "type"},
+			searchExpr: search.NewSearch(expression.NewConstant(``),
+				expression.NewConstant(`reviews.author:XYZ`),
+				expression.NewConstant(map[string]interface{}{
+					"index": "Incorrect Name",
+				})),
+			expectQuery: `{"query":{"field":"public_likes",` +
+				`"wildcard":"ABC"},"score":"none"}`,
+			expectedSargKeys: []string{"type", "public_likes"},
+			expectSearchExpr: false,
 		},
 	}
 
-	for i := range tests {
-		testQueryOverFlexIndex(t, index, tests[i].queryStr, tests[i].expectedQueryStr,
-			tests[i].expectedSargKeys)
-	}
-}
+	for testi, test := range tests {
+		expr := expression.NewAnd(condExpr, flexExpr, test.searchExpr)
 
-func TestComplexQuerySargabilityOverFlexIndexes(t *testing.T) {
-	indexes := [][]byte{
-		util.SampleIndexDefWithSeveralNestedFieldsUnderDefaultMapping,
-		util.SampleIndexDefDynamicWithAnalyzerKeyword,
-		util.SampleIndexDefWithSeveralNestedFieldsUnderHotelMapping,
-	}
+		flexRequest := &datastore.FTSFlexRequest{
+			Keyspace: "t",
+			Pred:     expr,
+		}
 
-	for i := range indexes {
-		index, err := setupSampleIndex(indexes[i])
-		if err != nil {
+		resp, n1qlErr := index.SargableFlex("0", flexRequest)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
+		}
+
+		if test.expectSearchExpr {
+			test.expectedSargKeys = append(test.expectedSargKeys,
+				test.searchExpr.String())
+		}
+
+		if resp == nil || len(resp.StaticSargKeys) != len(test.expectedSargKeys) {
+			t.Fatalf("[%d] Resp: %#v", testi+1, resp)
+		}
+
+		for _, key := range test.expectedSargKeys {
+			if resp.StaticSargKeys[key] == nil {
+				t.Fatalf("ExpectedSargKeys: %v, Got StaticSargKeys: %v",
+					test.expectedSargKeys, resp.StaticSargKeys)
+			}
+		}
+
+		var expectQuery, gotQuery map[string]interface{}
+		if err := json.Unmarshal([]byte(test.expectQuery), &expectQuery); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(resp.SearchQuery), &gotQuery); err != nil {
 			t.Fatal(err)
 		}
 
-		tests := []struct {
-			queryStr                       string
-			expectedQueryStrDefaultMapping string
-			expectedQueryStrCustomMapping  string
-			expectedSargKeys               []string
-		}{
-			{
-				queryStr: `t.type = "hotel"` +
-					` AND ANY r in t.reviews SATISFIES r.author = "Shaniya Wisoky" END`,
-				expectedQueryStrDefaultMapping: `{"query":{"conjuncts":[{"field":"type","term":"hotel"},` +
-					`{"field":"reviews.author","term":"Shaniya Wisoky"}]},"score":"none"}`,
-				expectedQueryStrCustomMapping: `{"query":{"field":"reviews.author",` +
-					`"term":"Shaniya Wisoky"},"score":"none"}`,
-				expectedSargKeys: []string{"type", "reviews.author"},
-			},
-			{
-				queryStr: `t.type = "hotel"` +
-					` AND ANY r IN t.reviews SATISFIES r.ratings.Cleanliness = 5 OR r.ratings.Overall = 4 END` +
-					` AND ANY p IN t.public_likes SATISFIES p LIKE "Raymundo Quigley" END`,
-				expectedQueryStrDefaultMapping: `{"query":{"conjuncts":[{"field":"type","term":"hotel"},` +
-					`{"disjuncts":[{"field":"reviews.ratings.Cleanliness","inclusive_max":true,` +
-					`"inclusive_min":true,"max":5,"min":5},{"field":"reviews.ratings.Overall",` +
-					`"inclusive_max":true,"inclusive_min":true,"max":4,"min":4}]},` +
-					`{"field":"public_likes","wildcard":"Raymundo Quigley"}]},"score":"none"}`,
-				expectedQueryStrCustomMapping: `{"query":{"conjuncts":[{"disjuncts":[` +
-					`{"field":"reviews.ratings.Cleanliness",` +
-					`"inclusive_max":true,"inclusive_min":true,"max":5,"min":5},` +
-					`{"field":"reviews.ratings.Overall","inclusive_max":true,"inclusive_min":true,` +
-					`"max":4,"min":4}]},{"field":"public_likes","wildcard":"Raymundo Quigley"}]},"score":"none"}`,
-				expectedSargKeys: []string{
-					"type", "reviews.ratings.Cleanliness", "reviews.ratings.Overall", "public_likes",
-				},
-			},
+		if !reflect.DeepEqual(expectQuery, gotQuery) {
+			t.Fatalf("[%d] Expected query: %v, Got query: %v", testi+1, expectQuery, gotQuery)
 		}
+	}
+}
 
-		for j := range tests {
-			queryExpression, err := parser.Parse(tests[j].queryStr)
-			if err != nil {
-				t.Fatal(tests[j].queryStr, err)
-			}
+func TestFlexPushDownSearchFunc3(t *testing.T) {
+	index, err := setupSampleIndex(
+		util.SampleIndexDefWithMultipleTypeMappings)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-			flexRequest := &datastore.FTSFlexRequest{
-				Keyspace: "t",
-				Pred:     queryExpression,
-			}
+	condExpr, _ := parser.Parse(`t.type = "airport"`)
+	flexExpr, _ := parser.Parse(`t.country = "United States"`)
+	searchExpr := search.NewSearch(expression.NewConstant(``),
+		expression.NewConstant(`city:"Salt Lake City"`))
 
-			resp, err := index.SargableFlex("0", flexRequest)
-			if err != nil {
-				t.Fatal(err)
-			}
+	finalExpr := expression.NewAnd(condExpr, flexExpr, searchExpr)
+	flexRequest := &datastore.FTSFlexRequest{
+		Keyspace: "t",
+		Pred:     finalExpr,
+	}
 
-			expectedQueryStr := ""
+	resp, n1qlErr := index.SargableFlex("0", flexRequest)
+	if n1qlErr != nil {
+		t.Fatal(n1qlErr)
+	}
 
-			if index.condExpr == nil {
-				// default mapping in use
-				expectedQueryStr = tests[j].expectedQueryStrDefaultMapping
-			} else {
-				expectedQueryStr = tests[j].expectedQueryStrCustomMapping
-			}
+	// searchExpr not supported because FTS index has multiple
+	// type mappings
+	expectedSargKeys := []string{"type", "country"}
 
-			if resp == nil || len(resp.StaticSargKeys) != len(tests[j].expectedSargKeys) {
-				t.Fatalf("[%s] Query: %v, Resp: %#v", index.Name(), tests[j].queryStr, resp)
-			}
+	if resp == nil || len(resp.StaticSargKeys) != len(expectedSargKeys) {
+		t.Fatalf("Resp: %#v", resp)
+	}
 
-			for _, key := range tests[j].expectedSargKeys {
-				if resp.StaticSargKeys[key] == nil {
-					t.Fatalf("[%s] ExpectedSargKeys: %v, Got StaticSargKeys: %v",
-						index.Name(), tests[j].expectedSargKeys, resp.StaticSargKeys)
-				}
-			}
+	var expectQuery, gotQuery map[string]interface{}
+	_ = json.Unmarshal([]byte(`{"query":{"field":"country","term":"United States"},`+
+		`"score":"none"}`),
+		&expectQuery)
 
-			var gotQuery, expectedQuery map[string]interface{}
-			err = json.Unmarshal([]byte(resp.SearchQuery), &gotQuery)
-			if err != nil {
-				t.Fatalf("[%s] SearchQuery: %s, err: %v", index.Name(), resp.SearchQuery, err)
-			}
-			err = json.Unmarshal([]byte(expectedQueryStr), &expectedQuery)
-			if err != nil {
-				t.Fatalf("[%s] ExpectedQuery: %s, err: %v", index.Name(), expectedQueryStr, err)
-			}
+	if err := json.Unmarshal([]byte(resp.SearchQuery), &gotQuery); err != nil {
+		t.Fatal(err)
+	}
 
-			if !reflect.DeepEqual(expectedQuery, gotQuery) {
-				t.Fatalf("[%s] ExpectedQuery: %s, GotQuery: %s", index.Name(), expectedQueryStr,
-					resp.SearchQuery)
-			}
-		}
+	if !reflect.DeepEqual(expectQuery, gotQuery) {
+		t.Fatalf("Expected query: %v, Got query: %v", expectQuery, gotQuery)
 	}
 }
 
 // =============================================================================
 
-func TestIndexMultipleTypeMappings(t *testing.T) {
-	index, err := setupSampleIndex([]byte(`{
-		"name": "default",
-		"type": "fulltext-index",
-		"sourceName": "default",
-		"planParams": {
-			"indexPartitions": 6
-		},
-		"params": {
-			"doc_config": {
-				"mode": "type_field",
-				"type_field": "type"
+func benchmarkSargableWithIndexMappingOption(b *testing.B, useCache bool) {
+	index, err := setupSampleIndex(util.SampleLandmarkIndexDef)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	if useCache {
+		index.indexer = &FTSIndexer{
+			mappingCache: newMappingCache(int(GetDefaultMappingCacheSize())),
+		}
+	}
+
+	query := expression.NewConstant(map[string]interface{}{
+		"match":    "United States",
+		"field":    "countryX",
+		"analyzer": "standard",
+	})
+
+	var opt map[string]interface{}
+	err = json.Unmarshal([]byte(`
+	{
+		"index": {
+			"default_analyzer": "standard",
+			"default_mapping": {
+				"dynamic": true,
+				"enabled": false
 			},
-			"mapping": {
-				"default_mapping": {
-					"dynamic": true,
-					"enabled": false
-				},
-				"type_field": "_type",
-				"types": {
-					"type1": {
-						"dynamic": true,
-						"enabled": true
-					},
-					"type2": {
-						"dynamic": true,
-						"enabled": true
+			"types": {
+				"landmark": {
+					"enabled": true,
+					"dynamic": false,
+					"properties": {
+						"country": {
+							"enabled": true,
+							"dynamic": false,
+							"fields": [{
+								"name": "countryX",
+								"type": "text",
+								"store": false,
+								"index": true
+							}]
+						}
 					}
 				}
-			},
-			"store": {
-				"indexType": "scorch"
 			}
 		}
-	}`))
-
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	expectCondExprStr := "`type` IN [\"type1\", \"type2\"]"
-	expectCondExpr, err := parser.Parse(expectCondExprStr)
+	}`), &opt)
 	if err != nil {
-		t.Fatal(err)
+		b.Fatal(err)
 	}
+	options := expression.NewConstant(opt)
 
-	expectExprs := expectCondExpr.Children()
-	gotExprs := index.condExpr.Children()
-
-	if len(expectExprs) != len(gotExprs) {
-		t.Fatalf("Expected condExpr: %s, got: %s",
-			expectCondExpr.String(), index.condExpr.String())
-	}
+	b.ResetTimer()
+	b.ReportAllocs()
 
-	for i := range expectExprs {
-		if len(expectExprs[i].Children()) != len(gotExprs[i].Children()) {
-			t.Fatalf("Expect expression: %s, got expression: %s",
-				expectExprs[i].String(), gotExprs[i].String())
+	for n := 0; n < b.N; n++ {
+		count, _, _, _, n1qlErr := index.Sargable("", query, options, nil)
+		if n1qlErr != nil || count != 1 {
+			b.Fatalf("Unexpected results, count: %v, err: %v", count, n1qlErr)
 		}
 	}
-}
-
-func TestSargableFlexIndexWithMultipleTypeMappings(t *testing.T) {
-	index, err := setupSampleIndex(util.SampleIndexDefWithMultipleTypeMappings)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	tests := []struct {
-		queryStr         string
-		expectedQueryStr string
-	}{
-		{
-			queryStr:         `t.type = "airline" AND t.country = "US"`,
-			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
-		},
-		{
-			queryStr:         `t.type = "airport" AND t.country = "US"`,
-			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
-		},
-		{
-			queryStr:         `(t.type = "airline" OR t.type = "airport") AND t.country = "US"`,
-			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
-		},
-		{
-			queryStr:         `t.type = "airline" OR t.type = "airport" AND t.country = "US"`,
-			expectedQueryStr: ``,
-		},
-		{
-			queryStr:         `t.type = "airline" OR (t.type = "airport" AND t.country = "US")`,
-			expectedQueryStr: ``,
-		},
-		{
-			queryStr:         `(t.type = "airport") OR (t.type = "airline" AND t.country = "US")`,
-			expectedQueryStr: ``,
-		},
-		{
-			// Expect this expression to be sargable, although filtering (non-covering index)
-			// will ensure that no results are returned.
-			queryStr:         `t.type = "airport" AND t.type = "airline" AND t.country = "US"`,
-			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
-		},
-		{
-			// No "type" expressions provided.
-			queryStr:         `(t.city = "airline" OR t.city = "airport") AND t.country = "US"`,
-			expectedQueryStr: ``,
-		},
-		{
-			queryStr:         `t.type IN ["airline"] AND t.country = "US"`,
-			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
-		},
-		{
-			queryStr:         `t.type IN ["airline", "airport"] AND t.country = "US"`,
-			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
-		},
-		{
-			queryStr:         `t.country = "US" AND t.type IN ["airline", "airport"]`,
-			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
-		},
-		{
-			// "type" expression(s) not searchable.
-			queryStr:         `t.type IN ["airline", "airport"]`,
-			expectedQueryStr: ``,
-		},
-		{
-			// No "type" expressions provided.
-			queryStr:         `t.city IN ["airline", "airport"] AND t.country = "US"`,
-			expectedQueryStr: ``,
-		},
-		{
-			// MB-39517: "city" not indexed within "airline" type mapping
-			queryStr:         `t.type = "airline" AND t.city = "SF"`,
-			expectedQueryStr: ``,
-		},
-		{
-			// MB-39517: "city" indexed within "airport" type mapping
-			queryStr:         `t.type = "airport" AND t.city = "SF"`,
-			expectedQueryStr: `{"query":{"field":"city","term":"SF"},"score":"none"}`,
-		},
-		{
-			// MB-39517: "city" only indexed within "airport" type mapping
-			queryStr:         `(t.type = "airline" OR t.type = "airport") AND t.city = "SF"`,
-			expectedQueryStr: ``,
-		},
-		{
-			// MB-39517: "city" only indexed within "airport" type mapping
-			queryStr:         `t.type IN ["airline", "airport"] AND t.city = "SF"`,
-			expectedQueryStr: ``,
-		},
-		{
-			// MB-39517: "city" not indexed within "airline", but country is within both, so partially sargable
-			queryStr:         `t.type IN ["airline", "airport"] AND t.country = "US" AND t.city = "SF"`,
-			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
+}
+
+func BenchmarkSargableWithIndexMappingOption(b *testing.B) {
+	benchmarkSargableWithIndexMappingOption(b, false)
+}
+
+func BenchmarkSargableWithCachedIndexMappingOption(b *testing.B) {
+	benchmarkSargableWithIndexMappingOption(b, true)
+}
+
+// sampleIndexes returns the indexes of the sample definitions.
+func TestSargableBatchPreferExact(t *testing.T) {
+	var indexes []*FTSIndex
+	for _, idef := range [][]byte{
+		util.SampleIndexDefDynamicDefault,
+		util.SampleIndexDefWithCustomDefaultMapping,
+	} {
+		index, err := setupSampleIndex(idef)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexes = append(indexes, index)
+	}
+
+	// the dynamic index covers both of the conjuncts, the other (mapping
+	// country explicitly) just one.
+	query := expression.NewConstant(map[string]interface{}{
+		"conjuncts": []interface{}{
+			map[string]interface{}{"match": "united states", "field": "country"},
+			map[string]interface{}{"match": "x", "field": "unmapped"},
 		},
+	})
+
+	tests := []struct {
+		options map[string]interface{}
+		picked  string
+		counts  map[string]int
+	}{
 		{
-			// MB-39517: "city" not indexed within "airline", but country is within both, so partially sargable
-			queryStr:         `(t.type = "airline" OR t.type = "airport") AND t.country = "US" AND t.city = "SF"`,
-			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
+			options: nil,
+			picked:  "SampleIndexDefDynamicDefault",
+			counts: map[string]int{"SampleIndexDefDynamicDefault": 2,
+				"SampleIndexDefWithCustomDefaultMapping": 1},
 		},
 		{
-			// MB-39517: "city" not indexed within "airline", although country is within both, it's a disjunction
-			queryStr:         `t.type IN ["airline", "airport"] AND t.country = "US" OR t.city = "SF"`,
-			expectedQueryStr: ``,
+			options: map[string]interface{}{"prefer_exact": false},
+			picked:  "SampleIndexDefDynamicDefault",
+			counts: map[string]int{"SampleIndexDefDynamicDefault": 2,
+				"SampleIndexDefWithCustomDefaultMapping": 1},
 		},
+		// the dynamic index is ranked below, by its count.
 		{
-			// MB-39517: "city" not indexed within "airline", although country is within both, it's a disjunction
-			queryStr:         `(t.type = "airline" OR t.type = "airport") AND t.country = "US" OR t.city = "SF"`,
-			expectedQueryStr: ``,
+			options: map[string]interface{}{"prefer_exact": true},
+			picked:  "SampleIndexDefWithCustomDefaultMapping",
+			counts: map[string]int{"SampleIndexDefDynamicDefault": 1,
+				"SampleIndexDefWithCustomDefaultMapping": 1},
 		},
 	}
 
-	for i := range tests {
-		queryExpression, err := parser.Parse(tests[i].queryStr)
-		if err != nil {
-			t.Fatal(tests[i].queryStr, err)
-		}
-
-		flexRequest := &datastore.FTSFlexRequest{
-			Keyspace: "t",
-			Pred:     queryExpression,
-		}
-
-		resp, err := index.SargableFlex("0", flexRequest)
-		if err != nil {
-			t.Fatal(err)
+	for testi, test := range tests {
+		var options expression.Expression
+		if test.options != nil {
+			options = expression.NewConstant(test.options)
 		}
 
-		if len(tests[i].expectedQueryStr) == 0 {
-			if resp != nil {
-				t.Errorf("[%d] Expected `%s` to not be sargable for index",
-					i, tests[i].queryStr)
+		results := SargableBatch(indexes, "", query, options)
+		for _, r := range results {
+			if r.Err != nil || r.Count != test.counts[r.Index.Name()] {
+				t.Fatalf("[%d] Expected count: %d, got: %+v", testi,
+					test.counts[r.Index.Name()], r)
 			}
-			continue
 		}
 
-		if resp == nil {
-			t.Errorf("[%d] Expected `%s` to be sargable for index", i, tests[i].queryStr)
-			continue
+		if results[0].Index.Name() != test.picked {
+			t.Fatalf("[%d] Expected index picked: %s, got: %s", testi,
+				test.picked, results[0].Index.Name())
 		}
+	}
 
-		var gotQuery, expectedQuery map[string]interface{}
-		err = json.Unmarshal([]byte(resp.SearchQuery), &gotQuery)
-		if err != nil {
-			t.Errorf("[%d] SearchQuery: %s, err: %v", i, resp.SearchQuery, err)
-		}
-		err = json.Unmarshal([]byte(tests[i].expectedQueryStr), &expectedQuery)
-		if err != nil {
-			t.Errorf("[%d] ExpectedQuery: %s, err: %v", i, tests[i].expectedQueryStr, err)
+	// with the query unavailable (at prepare time), as with it available.
+	for _, preferExact := range []bool{false, true} {
+		count, _, _, _, n1qlErr := indexes[0].Sargable("", nil,
+			expression.NewConstant(map[string]interface{}{
+				"prefer_exact": preferExact}), nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
 		}
 
-		if !reflect.DeepEqual(expectedQuery, gotQuery) {
-			t.Errorf("[%d] ExpectedQuery: %s, GotQuery: %s",
-				i, tests[i].expectedQueryStr, resp.SearchQuery)
+		if (count == preferExactCount) != preferExact {
+			t.Fatalf("[prefer_exact: %t] Unexpected count: %d", preferExact,
+				count)
 		}
 	}
+
+	// the option's to be a boolean.
+	_, _, _, _, n1qlErr := indexes[1].Sargable("", query,
+		expression.NewConstant(map[string]interface{}{"prefer_exact": "yes"}),
+		nil)
+	if n1qlErr == nil {
+		t.Fatalf("Expected an err for a prefer_exact option not a boolean")
+	}
 }
 
-func TestSargableFlexIndexDocIDPrefixWithMultipleTypeMappings(t *testing.T) {
-	index, err := setupSampleIndex(util.SampleIndexDefWithDocIdPrefixMultipleTypeMappings)
-	if err != nil {
-		t.Fatal(err)
+func sampleIndexes(tb testing.TB) []*FTSIndex {
+	var rv []*FTSIndex
+	for _, idef := range [][]byte{
+		util.SampleLandmarkIndexDef,
+		util.SampleIndexDefDynamicDefault,
+		util.SampleIndexDefDynamicWithAnalyzerKeyword,
+		util.SampleIndexDefWithCustomDefaultMapping,
+		util.SampleIndexDefWithNoAllField,
+		util.SampleIndexDefWithKeywordAnalyzerOverDefaultMapping,
+		util.SampleIndexDefWithMultipleTypeMappings,
+		util.SampleIndexDefWithAliasedFields,
+		util.SampleIndexDefWithDateTimeParsers,
+		util.SampleIndexDefWithStoredOnlyField,
+	} {
+		index, err := setupSampleIndex(idef)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		rv = append(rv, index)
 	}
 
-	tests := []struct {
-		queryStr         string
-		expectedQueryStr string
-	}{
-		{
-			queryStr:         `meta().id LIKE "airline-%" AND t.country = "US"`,
-			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
-		},
-		{
-			queryStr:         `meta().id LIKE "airport-%" AND t.country = "US"`,
-			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
-		},
-		{
-			queryStr:         `(meta().id LIKE "airline-%" OR meta().id LIKE "airport-%") AND t.country = "US"`,
-			expectedQueryStr: `{"query":{"field":"country","term":"US"},"score":"none"}`,
-		},
-		{
-			// MB-39517: "city" indexed within "airport" type mapping
-			queryStr:         `meta().id LIKE "airport-%" AND t.city = "SF"`,
-			expectedQueryStr: `{"query":{"field":"city","term":"SF"},"score":"none"}`,
-		},
-		{
-			// MB-39517: "city" only indexed within "airport" type mapping
-			queryStr:         `meta().id LIKE "airline-%" AND t.city = "SF"`,
-			expectedQueryStr: ``,
-		},
+	return rv
+}
+
+func TestSargableBatch(t *testing.T) {
+	indexes := sampleIndexes(t)
+
+	queries := []expression.Expression{
+		expression.NewConstant(map[string]interface{}{
+			"match": "United States", "field": "country"}),
+		expression.NewConstant(map[string]interface{}{
+			"match": "san francisco", "field": "city", "analyzer": "keyword"}),
+		expression.NewConstant(map[string]interface{}{
+			"conjuncts": []interface{}{
+				map[string]interface{}{"match": "paris", "field": "city"},
+				map[string]interface{}{"match": "x", "field": "unindexed"},
+			},
+		}),
+		expression.NewConstant(map[string]interface{}{
+			"start": "2019-03-25", "field": "created"}),
+		expression.NewConstant("blah"),
+		nil,
 	}
 
-	for i := range tests {
-		queryExpression, err := parser.Parse(tests[i].queryStr)
-		if err != nil {
-			t.Fatal(tests[i].queryStr, err)
+	for qi, q := range queries {
+		results := SargableBatch(indexes, "", q, nil)
+		if len(results) != len(indexes) {
+			t.Fatalf("[%d] Expected a verdict per index, got: %d", qi,
+				len(results))
 		}
 
-		flexRequest := &datastore.FTSFlexRequest{
-			Keyspace: "t",
-			Pred:     queryExpression,
-		}
+		var sargable int
+		for x, r := range results {
+			// the verdict of the index checked by itself.
+			count, indexedCount, exact, _, n1qlErr := r.Index.Sargable("", q,
+				nil, nil)
+			if count != r.Count || indexedCount != r.IndexedCount ||
+				exact != r.Exact || (n1qlErr == nil) != (r.Err == nil) {
+				t.Fatalf("[%d, %s] Expected count: %d, indexedCount: %d,"+
+					" exact: %t, err: %v, got: %+v", qi, r.Index.Name(), count,
+					indexedCount, exact, n1qlErr, r)
+			}
 
-		resp, err := index.SargableFlex("0", flexRequest)
-		if err != nil {
-			t.Fatal(err)
-		}
+			if count > 0 {
+				sargable++
+			}
 
-		if len(tests[i].expectedQueryStr) == 0 {
-			if resp != nil {
-				t.Errorf("[%d] Expected `%s` to not be sargable for index",
-					i, tests[i].queryStr)
+			if x == 0 {
+				continue
 			}
-			continue
-		}
 
-		if resp == nil {
-			t.Errorf("[%d] Expected `%s` to be sargable for index", i, tests[i].queryStr)
-			continue
+			// ranked by count, indexed count and then exact.
+			prev := results[x-1]
+			if prev.Count < r.Count || (prev.Count == r.Count &&
+				(prev.IndexedCount > r.IndexedCount ||
+					(prev.IndexedCount == r.IndexedCount &&
+						!prev.Exact && r.Exact))) {
+				t.Fatalf("[%d] Unexpected ranking, %+v ahead of %+v", qi,
+					prev, r)
+			}
 		}
 
-		var gotQuery, expectedQuery map[string]interface{}
-		err = json.Unmarshal([]byte(resp.SearchQuery), &gotQuery)
-		if err != nil {
-			t.Errorf("[%d] SearchQuery: %s, err: %v", i, resp.SearchQuery, err)
+		if q != nil && sargable == 0 {
+			t.Fatalf("[%d] Expected an index sargable for the query", qi)
 		}
-		err = json.Unmarshal([]byte(tests[i].expectedQueryStr), &expectedQuery)
-		if err != nil {
-			t.Errorf("[%d] ExpectedQuery: %s, err: %v", i, tests[i].expectedQueryStr, err)
+	}
+}
+
+// benchmarkSargableIndexes checks the query over the sample indexes, by
+// themselves or as a batch.
+func benchmarkSargableIndexes(b *testing.B, batch bool) {
+	indexes := sampleIndexes(b)
+
+	query := expression.NewConstant(map[string]interface{}{
+		"query": map[string]interface{}{
+			"conjuncts": []interface{}{
+				map[string]interface{}{"match": "United States", "field": "country"},
+				map[string]interface{}{"match": "paris", "field": "city"},
+			},
+		},
+		"sort": []interface{}{"-_score"},
+	})
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for n := 0; n < b.N; n++ {
+		if batch {
+			SargableBatch(indexes, "", query, nil)
+			continue
 		}
 
-		if !reflect.DeepEqual(expectedQuery, gotQuery) {
-			t.Errorf("[%d] ExpectedQuery: %s, GotQuery: %s",
-				i, tests[i].expectedQueryStr, resp.SearchQuery)
+		for _, index := range indexes {
+			index.Sargable("", query, nil, nil)
 		}
 	}
 }
 
-func TestSargableFlexIndexWithLikeExpressions(t *testing.T) {
-	index, err := setupSampleIndex(util.SampleIndexDefDynamicWithAnalyzerKeyword)
+func BenchmarkSargablePerIndex(b *testing.B) {
+	benchmarkSargableIndexes(b, false)
+}
+
+func BenchmarkSargableBatch(b *testing.B) {
+	benchmarkSargableIndexes(b, true)
+}
+
+func TestIndexSargabilityOfStoredOnlyField(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithStoredOnlyField)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	tests := []struct {
-		queryStr         string
-		expectedQueryStr string
-	}{
-		{
-			queryStr:         `t.type LIKE "ho%l"`,
-			expectedQueryStr: `{"query":{"field":"type","wildcard":"ho*l"},"score":"none"}`,
-		},
-		{
-			queryStr:         `t.type LIKE "hot_l"`,
-			expectedQueryStr: `{"query":{"field":"type","wildcard":"hot?l"},"score":"none"}`,
-		},
-		{
-			queryStr:         `t.type LIKE "%t%"`,
-			expectedQueryStr: `{"query":{"field":"type","wildcard":"*t*"},"score":"none"}`,
-		},
-		{
-			queryStr:         `t.type LIKE "\\%@hot_l%"`,
-			expectedQueryStr: `{"query":{"field":"type","wildcard":"\\%@hot?l*"},"score":"none"}`,
-		},
-	}
+	for field, sargable := range map[string]bool{
+		"name":  true,
+		"city":  true,
+		"notes": false, // stored, but not indexed for search
+	} {
+		q := expression.NewConstant(map[string]interface{}{
+			"match": "san francisco",
+			"field": field,
+		})
 
-	for i := range tests {
-		queryExpression, err := parser.Parse(tests[i].queryStr)
-		if err != nil {
-			t.Fatal(tests[i].queryStr, err)
+		count, _, _, _, n1qlErr := index.Sargable("", q, nil, nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
 		}
 
-		flexRequest := &datastore.FTSFlexRequest{
-			Keyspace: "t",
-			Pred:     queryExpression,
+		if sargable != (count > 0) {
+			t.Fatalf("[%s] Expected sargable: %t, got count: %v",
+				field, sargable, count)
 		}
+	}
 
-		resp, err := index.SargableFlex("0", flexRequest)
-		if err != nil {
-			t.Fatal(err)
-		}
+	// the stored-only field is still retrievable along with the hits.
+	coverage := index.Coverage()
+	if !reflect.DeepEqual(coverage.StoredFields, []string{"name", "notes"}) {
+		t.Fatalf("Expected the stored fields, got: %v", coverage.StoredFields)
+	}
+}
 
-		if len(tests[i].expectedQueryStr) == 0 {
-			if resp != nil {
-				t.Errorf("[%d] Expected `%s` to not be sargable for index, but got: %v",
-					i, tests[i].queryStr, resp)
-			}
-			continue
-		}
+func TestIndexSargabilityOfBooleanQueryMustNot(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithStoredOnlyField)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		if resp == nil {
-			t.Errorf("[%d] Expected `%s` to be sargable for index", i, tests[i].queryStr)
-			continue
+	for mustNotField, sargable := range map[string]bool{
+		"city":      true,
+		"notes":     false, // not indexed for search
+		"continent": false, // not within the index
+	} {
+		q := expression.NewConstant(map[string]interface{}{
+			"must": map[string]interface{}{
+				"conjuncts": []interface{}{
+					map[string]interface{}{"match": "joe", "field": "name"},
+				},
+			},
+			"must_not": map[string]interface{}{
+				"disjuncts": []interface{}{
+					map[string]interface{}{"match": "x", "field": mustNotField},
+				},
+			},
+		})
+
+		count, _, exact, _, n1qlErr := index.Sargable("", q, nil, nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
 		}
 
-		var gotQuery, expectedQuery map[string]interface{}
-		err = json.Unmarshal([]byte(resp.SearchQuery), &gotQuery)
-		if err != nil {
-			t.Errorf("[%d] SearchQuery: %s, err: %v", i, resp.SearchQuery, err)
-			continue
+		// a field of the must_not clause that the index lacks would have the
+		// clause match nothing, and so the search yield false positives.
+		if (sargable && (count != 2 || !exact)) || (!sargable && count != 0) {
+			t.Fatalf("[%s] Expected sargable: %t, got count: %v, exact: %t",
+				mustNotField, sargable, count, exact)
 		}
-		err = json.Unmarshal([]byte(tests[i].expectedQueryStr), &expectedQuery)
-		if err != nil {
-			t.Errorf("[%d] ExpectedQuery: %s, err: %v", i, tests[i].expectedQueryStr, err)
-			continue
+	}
+}
+
+func TestIndexSargabilityOfFuzzyQuery(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefWithStoredOnlyField)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fuzziness := range []int{1, 2} {
+		// over a field analyzed with the standard analyzer
+		q := expression.NewConstant(map[string]interface{}{
+			"term":      "jon",
+			"field":     "name",
+			"fuzziness": fuzziness,
+		})
+
+		count, _, exact, _, n1qlErr := index.Sargable("", q, nil, nil)
+		if n1qlErr != nil {
+			t.Fatal(n1qlErr)
 		}
 
-		if !reflect.DeepEqual(expectedQuery, gotQuery) {
-			t.Errorf("[%d] ExpectedQuery: %s, GotQuery: %s",
-				i, tests[i].expectedQueryStr, resp.SearchQuery)
+		if count != 1 || !exact {
+			t.Fatalf("[fuzziness: %d] Expected sargable, got count: %v,"+
+				" exact: %t", fuzziness, count, exact)
 		}
 	}
+
+	q := expression.NewConstant(map[string]interface{}{
+		"term":      "jon",
+		"field":     "name",
+		"fuzziness": 3,
+	})
+
+	_, _, _, _, n1qlErr := index.Sargable("", q, nil, nil)
+	if n1qlErr == nil || !strings.Contains(n1qlErr.Error(), "fuzziness") {
+		t.Fatalf("Expected a fuzziness error, got: %v", n1qlErr)
+	}
 }
 
-func TestFlexPushDownForLimitOffsetOrder(t *testing.T) {
-	index, err := setupSampleIndex(
-		util.SampleIndexDefWithKeywordAnalyzerOverDefaultMapping)
+func TestIndexSargabilityOfUnsupportedQueryTypes(t *testing.T) {
+	defer SetStrictQueryTypes(GetStrictQueryTypes())
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
 	if err != nil {
 		t.Fatal(err)
 	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	// a query of a type n1fty doesn't know of, as reported on extracting
+	// its fields (bleve itself parsing only the types known).
+	uerr := &util.UnsupportedQueryTypeError{Type: "*query.FutureQuery"}
+	query := expression.NewConstant(map[string]interface{}{
+		"match": "san francisco", "field": "city"})
+
+	SetStrictQueryTypes(false)
+	explain := &SargExplanation{}
+	rv := &sargableRV{opaque: map[string]interface{}{"explain": explain}}
+	index.unsupportedQuery(uerr, rv, explain)
+	if rv.err != nil || explain.Reason != "unsupported query type:"+
+		" *query.FutureQuery" {
+		t.Fatalf("Expected not sargable, got err: %v, reason: %q", rv.err,
+			explain.Reason)
+	}
+
+	// the verdict carries over to the indexes checked after, counted once,
+	// whatever the fields of the query.
+	for k := 0; k < 2; k++ {
+		count, _, _, _, n1qlErr := index.Sargable("", query, nil, rv.opaque)
+		if n1qlErr != nil || count != 0 {
+			t.Fatalf("Expected not sargable, got count: %d, err: %v", count,
+				n1qlErr)
+		}
+	}
+
+	if n := index.indexer.stats.TotalUnsupportedQueries; n != 1 {
+		t.Fatalf("Expected a single unsupported query, got: %d", n)
+	}
+
+	SetStrictQueryTypes(true)
+	rv = &sargableRV{opaque: map[string]interface{}{}}
+	index.unsupportedQuery(uerr, rv, nil)
+	if rv.err == nil || !strings.Contains(rv.err.Error(),
+		"unsupported query type: *query.FutureQuery") {
+		t.Fatalf("Expected the unsupported query type err, got: %v", rv.err)
+	}
+
+	if _, exists := rv.opaque["unsupported_query"]; exists {
+		t.Fatalf("Expected no verdict carried over, got: %v", rv.opaque)
+	}
 
-	queryStr := `t.type = "hotel" AND t.id >= 10 AND t.id <= 20`
-	queryExpr, _ := parser.Parse(queryStr)
-	sortOnID, _ := parser.Parse("id")
-	flexRequest := &datastore.FTSFlexRequest{
-		Keyspace:      "t",
-		Pred:          queryExpr,
-		CheckPageable: true,
-		Order: []*datastore.SortTerm{
-			{
-				Expr:       sortOnID,
-				Descending: true,
-				NullsPos:   datastore.ORDER_NULLS_NONE,
-			},
-		},
-		Offset: 5,
-		Limit:  20,
+	if n := index.indexer.stats.TotalUnsupportedQueries; n != 2 {
+		t.Fatalf("Expected 2 unsupported queries, got: %d", n)
 	}
+}
 
-	resp, err := index.SargableFlex("0", flexRequest)
+func TestIndexSargabilityOfDeeplyNestedQuery(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if resp == nil {
-		t.Fatalf("Expected a response, but didn't get any")
+	nested := func(depth int) expression.Expression {
+		var q interface{} = map[string]interface{}{
+			"match": "san francisco", "field": "city"}
+		for k := 0; k < depth; k++ {
+			q = map[string]interface{}{"conjuncts": []interface{}{q}}
+		}
+		return expression.NewConstant(q)
 	}
 
-	var expectQuery, gotQuery map[string]interface{}
-	_ = json.Unmarshal([]byte(`{"query":{"conjuncts":[{"field":"type","term":"hotel"},`+
-		`{"field":"id","inclusive_max":true,"inclusive_min":true,"max":20,`+
-		`"min":10}]},"score":"none", "size": 20, "from": 5, "sort": ["-id"]}`),
-		&expectQuery)
-	if err = json.Unmarshal([]byte(resp.SearchQuery), &gotQuery); err != nil {
-		t.Fatal(err)
+	// a pathologically deep query is not sargable, rather than have the
+	// extraction of its fields exhaust the stack.
+	count, _, _, _, n1qlErr := index.Sargable("", nested(100000), nil, nil)
+	if n1qlErr != nil || count != 0 {
+		t.Fatalf("Expected not sargable, got count: %d, err: %v", count,
+			n1qlErr)
 	}
 
-	if !reflect.DeepEqual(expectQuery, gotQuery) {
-		t.Fatalf("Expected query: %v, Got Query: %v", expectQuery, gotQuery)
+	defer util.SetMaxQueryDepth(util.GetMaxQueryDepth())
+	util.SetMaxQueryDepth(10)
+
+	explain, err := index.ExplainSargable("", nested(4), nil)
+	if err != nil || explain.Count == 0 {
+		t.Fatalf("Expected sargable within the max depth, got: %+v, err: %v",
+			explain, err)
+	}
+
+	explain, err = index.ExplainSargable("", nested(5), nil)
+	if err != nil || explain.Count != 0 ||
+		explain.Reason != "query nested too deep, past: 10 levels" {
+		t.Fatalf("Expected not sargable past the max depth, got: %+v, err: %v",
+			explain, err)
 	}
 }
 
-func TestFlexPushDownSearchFunc1(t *testing.T) {
-	index, err := setupSampleIndex(
-		util.SampleIndexDefDynamicWithAnalyzerKeyword)
+func TestIndexSargabilityOfPhrasesOverTermVectors(t *testing.T) {
+	index, err := setupSampleIndex([]byte(`{
+		"name": "phrases",
+		"type": "fulltext-index",
+		"params": {
+			"doc_config": {"mode": "type_field", "type_field": "type"},
+			"mapping": {
+				"default_analyzer": "standard",
+				"default_datetime_parser": "dateTimeOptional",
+				"default_mapping": {
+					"enabled": true,
+					"dynamic": false,
+					"properties": {
+						"title": {
+							"enabled": true,
+							"dynamic": false,
+							"fields": [{"name": "title", "type": "text",
+								"analyzer": "keyword", "index": true,
+								"include_term_vectors": true}]
+						},
+						"tag": {
+							"enabled": true,
+							"dynamic": false,
+							"fields": [{"name": "tag", "type": "text",
+								"analyzer": "keyword", "index": true}]
+						},
+						"body": {
+							"enabled": true,
+							"dynamic": false,
+							"fields": [{"name": "body", "type": "text",
+								"index": true}]
+						}
+					}
+				}
+			}
+		}
+	}`))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	flexExpr, _ := parser.Parse(`t.country = "United States"`)
-
 	tests := []struct {
-		searchExpr expression.Expression
+		query  map[string]interface{}
+		reason string
 	}{
 		{
-			searchExpr: search.NewSearch(expression.NewConstant(``),
-				expression.NewConstant(map[string]interface{}{
-					"match": "Salt Lake City",
-					"field": "city",
-				})),
+			query: map[string]interface{}{
+				"terms": []interface{}{"big", "blue"}, "field": "title"},
 		},
 		{
-			searchExpr: search.NewSearch(expression.NewConstant(``),
-				expression.NewConstant(map[string]interface{}{
-					"query": map[string]interface{}{
-						"match": "Salt Lake City",
-						"field": "city",
-					},
-				})),
+			query: map[string]interface{}{
+				"terms": []interface{}{"big", "blue"}, "field": "tag"},
+			reason: "query field phrase unsupported: tag",
+		},
+		{
+			query: map[string]interface{}{
+				"match_phrase": "big blue", "field": "body"},
+			reason: "query field phrase unsupported: body",
+		},
+		{
+			// the terms matched regardless of their positions
+			query: map[string]interface{}{"match": "big blue", "field": "body"},
+		},
+		{
+			query: map[string]interface{}{
+				"disjuncts": []interface{}{
+					map[string]interface{}{"match": "big", "field": "body"},
+					map[string]interface{}{
+						"terms": []interface{}{"big", "blue"}, "field": "tag"},
+				}},
+			reason: "query field phrase unsupported: tag",
 		},
 	}
 
-	var expectQuery map[string]interface{}
-	_ = json.Unmarshal([]byte(`{"query":{"conjuncts":[{"field":"country",`+
-		`"term":"United States"},{"field":"city","match":"Salt Lake City",`+
-		`"fuzziness": 0,"prefix_length": 0}]},"score":"none"}`),
-		&expectQuery)
-
 	for testi, test := range tests {
-		finalExpr := expression.NewAnd(flexExpr, test.searchExpr)
-
-		flexRequest := &datastore.FTSFlexRequest{
-			Keyspace: "t",
-			Pred:     finalExpr,
-		}
-
-		resp, n1qlErr := index.SargableFlex("0", flexRequest)
-		if n1qlErr != nil {
-			t.Fatal(n1qlErr)
-		}
-
-		expectedSargKeys := []string{test.searchExpr.String(), "country"}
-
-		if resp == nil || len(resp.StaticSargKeys) != len(expectedSargKeys) {
-			t.Fatalf("[%d] Resp: %#v", testi+1, resp)
-		}
-
-		for _, key := range expectedSargKeys {
-			if resp.StaticSargKeys[key] == nil {
-				t.Fatalf("[%d] ExpectedSargKeys: %v, Got StaticSargKeys: %v",
-					testi+1, expectedSargKeys, resp.StaticSargKeys)
-			}
+		explain, err := index.ExplainSargable("",
+			expression.NewConstant(test.query), nil)
+		if err != nil {
+			t.Fatal(err)
 		}
 
-		var gotQuery map[string]interface{}
-		if err := json.Unmarshal([]byte(resp.SearchQuery), &gotQuery); err != nil {
-			t.Fatal(err)
+		if (test.reason == "") != explain.Sargable {
+			t.Fatalf("[%d] Expected sargable: %t, got: %+v", testi,
+				test.reason == "", explain)
 		}
 
-		if !reflect.DeepEqual(expectQuery, gotQuery) {
-			t.Fatalf("[%d] Expected query: %v, Got query: %v",
-				testi+1, expectQuery, gotQuery)
+		if test.reason != "" && explain.Reason != test.reason {
+			t.Fatalf("[%d] Expected reason: %q, got: %q", testi, test.reason,
+				explain.Reason)
 		}
 	}
 }
 
-func TestFlexPushDownSearchFunc2(t *testing.T) {
-	index, err := setupSampleIndex(
-		util.SampleIndexDefWithSeveralNestedFieldsUnderHotelMapping)
+func TestIndexSargabilityUnderNestedDynamicAnalyzer(t *testing.T) {
+	index, err := setupSampleIndex([]byte(`{
+		"name": "reviewed",
+		"type": "fulltext-index",
+		"params": {
+			"doc_config": {"mode": "type_field", "type_field": "type"},
+			"mapping": {
+				"default_analyzer": "standard",
+				"default_datetime_parser": "dateTimeOptional",
+				"default_mapping": {
+					"enabled": true,
+					"dynamic": false,
+					"properties": {
+						"reviews": {
+							"enabled": true,
+							"dynamic": true,
+							"properties": {
+								"content": {
+									"enabled": true,
+									"dynamic": true,
+									"default_analyzer": "keyword"
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}`))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	condExpr, _ := parser.Parse(`t.type = "hotel"`)
-	flexExpr, _ := parser.Parse(
-		`ANY p IN t.public_likes SATISFIES p LIKE "ABC" END`)
-
 	tests := []struct {
-		searchExpr       expression.Expression
-		expectQuery      string
-		expectedSargKeys []string
-		expectSearchExpr bool
+		query    map[string]interface{}
+		sargable bool
 	}{
 		{
-			searchExpr: search.NewSearch(expression.NewConstant(``),
-				expression.NewConstant(`reviews.author:XYZ`),
-				expression.NewConstant(map[string]interface{}{
-					"index": "SampleIndexDefWithSeveralNestedFieldsUnderHotelMapping",
-				})),
-			expectQuery: `{"query":{"conjuncts":[{"field":"public_likes",` +
-				`"wildcard":"ABC"},{"must":{"conjuncts":[]},"must_not":{"disjuncts":[],` +
-				`"min": 0},"should":{"disjuncts":[{"field":"reviews.author","fuzziness":0,` +
-				`"match":"XYZ","prefix_length":0}],"min":0}}]},"score":"none"}`,
-			expectedSargKeys: []string{"type", "public_likes"},
-			expectSearchExpr: true,
+			query: map[string]interface{}{"match": "Jane Doe",
+				"field": "reviews.author", "analyzer": "standard"},
+			sargable: true,
 		},
 		{
-			searchExpr: search.NewSearch(expression.NewConstant(``),
-				expression.NewConstant(`reviews.author:XYZ`),
-				expression.NewConstant(map[string]interface{}{
-					"index": "Incorrect Name",
-				})),
-			expectQuery: `{"query":{"field":"public_likes",` +
-				`"wildcard":"ABC"},"score":"none"}`,
-			expectedSargKeys: []string{"type", "public_likes"},
-			expectSearchExpr: false,
+			query: map[string]interface{}{"match": "Jane Doe",
+				"field": "reviews.author", "analyzer": "keyword"},
+		},
+		{
+			// under the nested dynamic mapping, the text's analyzed with
+			// its own default analyzer, rather than that of its parent.
+			query: map[string]interface{}{"match": "Jane Doe",
+				"field": "reviews.content.author", "analyzer": "keyword"},
+			sargable: true,
+		},
+		{
+			query: map[string]interface{}{"match": "Jane Doe",
+				"field": "reviews.content.author", "analyzer": "standard"},
+		},
+		{
+			query: map[string]interface{}{"term": "Jane Doe",
+				"field": "reviews.content.author"},
+			sargable: true,
+		},
+		{
+			query: map[string]interface{}{"term": "jane",
+				"field": "reviews.author"},
+		},
+		{
+			query: map[string]interface{}{"min": 3,
+				"field": "reviews.content.rating"},
+			sargable: true,
 		},
 	}
 
 	for testi, test := range tests {
-		expr := expression.NewAnd(condExpr, flexExpr, test.searchExpr)
-
-		flexRequest := &datastore.FTSFlexRequest{
-			Keyspace: "t",
-			Pred:     expr,
-		}
-
-		resp, n1qlErr := index.SargableFlex("0", flexRequest)
+		count, _, _, _, n1qlErr := index.Sargable("",
+			expression.NewConstant(test.query), nil, nil)
 		if n1qlErr != nil {
 			t.Fatal(n1qlErr)
 		}
 
-		if test.expectSearchExpr {
-			test.expectedSargKeys = append(test.expectedSargKeys,
-				test.searchExpr.String())
-		}
-
-		if resp == nil || len(resp.StaticSargKeys) != len(test.expectedSargKeys) {
-			t.Fatalf("[%d] Resp: %#v", testi+1, resp)
-		}
-
-		for _, key := range test.expectedSargKeys {
-			if resp.StaticSargKeys[key] == nil {
-				t.Fatalf("ExpectedSargKeys: %v, Got StaticSargKeys: %v",
-					test.expectedSargKeys, resp.StaticSargKeys)
-			}
-		}
-
-		var expectQuery, gotQuery map[string]interface{}
-		if err := json.Unmarshal([]byte(test.expectQuery), &expectQuery); err != nil {
-			t.Fatal(err)
-		}
-		if err := json.Unmarshal([]byte(resp.SearchQuery), &gotQuery); err != nil {
-			t.Fatal(err)
-		}
-
-		if !reflect.DeepEqual(expectQuery, gotQuery) {
-			t.Fatalf("[%d] Expected query: %v, Got query: %v", testi+1, expectQuery, gotQuery)
+		if (count > 0) != test.sargable {
+			t.Fatalf("[%d] Expected sargable: %t, got count: %d", testi,
+				test.sargable, count)
 		}
 	}
 }
 
-func TestFlexPushDownSearchFunc3(t *testing.T) {
-	index, err := setupSampleIndex(
-		util.SampleIndexDefWithMultipleTypeMappings)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	condExpr, _ := parser.Parse(`t.type = "airport"`)
-	flexExpr, _ := parser.Parse(`t.country = "United States"`)
-	searchExpr := search.NewSearch(expression.NewConstant(``),
-		expression.NewConstant(`city:"Salt Lake City"`))
-
-	finalExpr := expression.NewAnd(condExpr, flexExpr, searchExpr)
-	flexRequest := &datastore.FTSFlexRequest{
-		Keyspace: "t",
-		Pred:     finalExpr,
-	}
-
-	resp, n1qlErr := index.SargableFlex("0", flexRequest)
-	if n1qlErr != nil {
-		t.Fatal(n1qlErr)
-	}
-
-	// searchExpr not supported because FTS index has multiple
-	// type mappings
-	expectedSargKeys := []string{"type", "country"}
-
-	if resp == nil || len(resp.StaticSargKeys) != len(expectedSargKeys) {
-		t.Fatalf("Resp: %#v", resp)
-	}
-
-	var expectQuery, gotQuery map[string]interface{}
-	_ = json.Unmarshal([]byte(`{"query":{"field":"country","term":"United States"},`+
-		`"score":"none"}`),
-		&expectQuery)
+func TestSearchTimeout(t *testing.T) {
+	grace := GetSearchTimeoutGrace()
 
-	if err := json.Unmarshal([]byte(resp.SearchQuery), &gotQuery); err != nil {
-		t.Fatal(err)
+	tests := []struct {
+		deadline     time.Time
+		timeoutOptMS int64
+		min, max     time.Duration
+	}{
+		// neither a deadline nor a timeout option, unbounded.
+		{min: 0, max: 0},
+		// bounded by the time left until the deadline.
+		{
+			deadline: time.Now().Add(10 * time.Second),
+			min:      9 * time.Second,
+			max:      10 * time.Second,
+		},
+		// by FTS's timeout (along with the grace) when sooner.
+		{
+			deadline:     time.Now().Add(10 * time.Second),
+			timeoutOptMS: 1000,
+			min:          time.Second + grace,
+			max:          time.Second + grace,
+		},
+		// and by the deadline when that's sooner.
+		{
+			deadline:     time.Now().Add(2 * time.Second),
+			timeoutOptMS: 60000,
+			min:          time.Second,
+			max:          2 * time.Second,
+		},
+		{
+			timeoutOptMS: 60000,
+			min:          time.Minute + grace,
+			max:          time.Minute + grace,
+		},
 	}
 
-	if !reflect.DeepEqual(expectQuery, gotQuery) {
-		t.Fatalf("Expected query: %v, Got query: %v", expectQuery, gotQuery)
+	for testi, test := range tests {
+		got := searchTimeout(test.deadline, test.timeoutOptMS)
+		if got < test.min || got > test.max {
+			t.Fatalf("[%d] Expected a timeout within [%v, %v], got: %v",
+				testi, test.min, test.max, got)
+		}
 	}
 }
@@ -12,6 +12,7 @@
 package n1fty
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -20,9 +21,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/couchbase/cbft"
+	pb "github.com/couchbase/cbft/protobuf"
 	"github.com/couchbase/cbgt"
 	"github.com/couchbase/gocbcore/v9"
 	"github.com/couchbase/n1fty/util"
@@ -35,6 +38,52 @@ import (
 
 const VERSION = 1
 
+// maxConcurrentSearches bounds the number of searches (gRPC search
+// streams) in flight per indexer, 0 implies no bound; as set by the
+// "maxConcurrentSearches" config, for the indexers created after
+var maxConcurrentSearches = int64(0)
+
+func GetMaxConcurrentSearches() int64 {
+	return atomic.LoadInt64(&maxConcurrentSearches)
+}
+
+func SetMaxConcurrentSearches(v int64) {
+	atomic.StoreInt64(&maxConcurrentSearches, v)
+}
+
+// failFastOnMaxConcurrentSearches decides whether a search over the
+// max concurrent searches fails right away, or waits (until the request's
+// deadline) for another search to complete; as set by the
+// "failFastOnMaxConcurrentSearches" config
+var failFastOnMaxConcurrentSearches = int32(0)
+
+func GetFailFastOnMaxConcurrentSearches() bool {
+	return loadFlag(&failFastOnMaxConcurrentSearches)
+}
+
+func SetFailFastOnMaxConcurrentSearches(v bool) {
+	storeFlag(&failFastOnMaxConcurrentSearches, v)
+}
+
+// ErrTooManyConcurrentSearches indicates that the bound on concurrent
+// searches was reached
+var ErrTooManyConcurrentSearches = fmt.Errorf("too many concurrent searches")
+
+// closeDrainTimeout bounds the time Close waits on the searches in flight
+// (canceled) to drain; as set by the "closeDrainTimeoutMS" config (in ms)
+var closeDrainTimeout = int64(5 * time.Second)
+
+func GetCloseDrainTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&closeDrainTimeout))
+}
+
+func SetCloseDrainTimeout(v time.Duration) {
+	atomic.StoreInt64(&closeDrainTimeout, int64(v))
+}
+
+// ErrIndexerClosed indicates a search over an indexer that's closed
+var ErrIndexerClosed = fmt.Errorf("indexer closed")
+
 // FTSIndexer implements datastore.Indexer interface
 type FTSIndexer struct {
 	serverURL  string
@@ -53,6 +102,20 @@ type FTSIndexer struct {
 	closeCh chan struct{}
 	init    sync.Once
 
+	// cache of index mappings provided within the SEARCH() options
+	mappingCache *mappingCache
+
+	// bounds the searches in flight, nil if unbounded
+	searchSem chan struct{}
+
+	// the cancels of the searches in flight, canceled on Close, which
+	// then waits on them to drain
+	searchesM      sync.Mutex
+	searches       map[uint64]context.CancelFunc
+	nextSearch     uint64
+	searchesWG     sync.WaitGroup
+	searchesClosed bool
+
 	// sync RWMutex protects following fields
 	m sync.RWMutex
 
@@ -61,6 +124,9 @@ type FTSIndexer struct {
 	client   *ftsClient
 	nodeDefs *cbgt.NodeDefs
 
+	// the source of the search clients in place of the client, if set
+	clientSource searchClientSource
+
 	indexIds   []string
 	indexNames []string
 	allIndexes []datastore.Index
@@ -75,10 +141,78 @@ type stats struct {
 	TotalSearch                int64
 	TotalSearchDuration        int64
 	TotalTTFBDuration          int64 // time to first response byte
+	TotalFTSServerDuration     int64 // time taken by FTS, as reported by it
 	TotalThrottledFtsDuration  int64
 	TotalThrottledN1QLDuration int64
 	TotalBackFills             int64
 	CurBackFillSize            int64
+	TotalResultsReturned       int64
+	TotalBackfillActivations   int64
+	TotalBackfillFallbacks     int64 // backfills that couldn't be set up
+	TotalBackfillResumes       int64 // backfills stopped, the consumer caught up
+
+	// The hits' bytes written to the backfills and read back from them,
+	// along with the entries (batches of hits) encoded and decoded, over
+	// all the searches since start; a backfill whose reads lag its writes
+	// is one with a slow consumer (N1QL) rather than producer (FTS).
+	TotalBackfillBytes          int64 // written
+	TotalBackfillBytesRead      int64
+	TotalBackfillEntriesWritten int64
+	TotalBackfillEntriesRead    int64
+
+	CurInFlightSearches    int64
+	TotalEntrySendTimeouts int64
+	TotalBreakerTrips      int64 // FTS nodes' circuit breakers tripped
+	TotalGrpcConnsRecycled int64 // broken connections to FTS nodes recycled
+
+	// The queries of a type whose fields aren't known to be extracted,
+	// deemed not sargable (or failed, see strictQueryTypes).
+	TotalUnsupportedQueries int64
+
+	// The hits dropped as they couldn't be decoded, see strictHitDecoding.
+	TotalHitsDropped int64
+
+	// The stats above broken down by the keyspace searched, as
+	// "bucket.scope.collection" to *KeyspaceStats, see statsByKeyspace.
+	byKeyspace sync.Map
+}
+
+// statsByKeyspace has (some of) the search stats broken down by the
+// keyspace searched, alongside their aggregate, to tell which of the
+// collections an index spans its searches dominate, see KeyspaceStats;
+// as set by the "statsByKeyspace" config
+var statsByKeyspace = int32(0)
+
+func GetStatsByKeyspace() bool {
+	return loadFlag(&statsByKeyspace)
+}
+
+func SetStatsByKeyspace(v bool) {
+	storeFlag(&statsByKeyspace, v)
+}
+
+// KeyspaceStats are the stats of the searches over a keyspace.
+type KeyspaceStats struct {
+	TotalSearch              int64
+	TotalSearchDuration      int64
+	TotalResultsReturned     int64
+	TotalBackFills           int64
+	TotalBackfillActivations int64
+	TotalBackfillBytes       int64 // written
+}
+
+// keyspace returns the stats of the searches over the keyspace, nil
+// unless broken down by keyspace, see statsByKeyspace.
+func (s *stats) keyspace(path string) *KeyspaceStats {
+	if s == nil || !GetStatsByKeyspace() {
+		return nil
+	}
+
+	if ks, ok := s.byKeyspace.Load(path); ok {
+		return ks.(*KeyspaceStats)
+	}
+	ks, _ := s.byKeyspace.LoadOrStore(path, &KeyspaceStats{})
+	return ks.(*KeyspaceStats)
 }
 
 // -----------------------------------------------------------------------------
@@ -131,6 +265,11 @@ func newFTSIndexer(serverIn, namespace, bucket, scope, collection, keyspace stri
 		cfg:             srvConfig,
 		stats:           &stats{},
 		closeCh:         make(chan struct{}),
+		mappingCache:    newMappingCache(int(GetDefaultMappingCacheSize())),
+	}
+
+	if max := GetMaxConcurrentSearches(); max > 0 {
+		indexer.searchSem = make(chan struct{}, max)
 	}
 
 	return indexer, nil
@@ -183,11 +322,76 @@ func (i *FTSIndexer) Close() error {
 	i.closed = true
 	i.m.Unlock()
 
+	err := i.cancelSearches(GetCloseDrainTimeout())
+
 	i.cfg.unSubscribe(i.namespace + "$" + i.bucket + "$" + i.scope + "$" + i.keyspace)
 	mr.unregisterIndexer(i)
 	close(i.closeCh)
 	agentMap.releaseAgent(i.bucket)
-	return nil
+
+	// a final sweep of the backfill files left behind (past their use).
+	cleanupTmpFiles(getBackfillSpaceDir())
+
+	return err
+}
+
+// trackSearch registers the cancel of a search in flight, returning the
+// func to deregister it once the search (and its cleanup) is done, or
+// ErrIndexerClosed if the indexer's closed.
+func (i *FTSIndexer) trackSearch(cancel context.CancelFunc) (func(), error) {
+	i.searchesM.Lock()
+	defer i.searchesM.Unlock()
+
+	if i.searchesClosed {
+		return nil, ErrIndexerClosed
+	}
+
+	if i.searches == nil {
+		i.searches = map[uint64]context.CancelFunc{}
+	}
+
+	i.nextSearch++
+	id := i.nextSearch
+	i.searches[id] = cancel
+	i.searchesWG.Add(1)
+
+	return func() {
+		i.searchesM.Lock()
+		delete(i.searches, id)
+		i.searchesM.Unlock()
+		i.searchesWG.Done()
+	}, nil
+}
+
+// cancelSearches cancels the searches in flight, disallowing any more,
+// and waits on them to drain up to the timeout.
+func (i *FTSIndexer) cancelSearches(timeout time.Duration) error {
+	i.searchesM.Lock()
+	i.searchesClosed = true
+	for _, cancel := range i.searches {
+		cancel()
+	}
+	i.searchesM.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		i.searchesWG.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-time.After(timeout):
+		i.searchesM.Lock()
+		n := len(i.searches)
+		i.searchesM.Unlock()
+
+		logging.Warnf("n1fty: Close, keyspace: %s, %d searches in flight"+
+			" after: %v", i.keyspace, n, timeout)
+		return fmt.Errorf("n1fty: Close, %d searches still in flight after:"+
+			" %v", n, timeout)
+	}
 }
 
 // SetCfg for better testing
@@ -371,6 +575,10 @@ func (i *FTSIndexer) refresh(configMutexAcquired bool) errors.Error {
 	i.cfgVersion = cfgVersion
 	i.m.Unlock()
 
+	// index definitions have changed, so invalidate the processed
+	// mappings that were cached against the older definitions.
+	i.mappingCache.reset()
+
 	// as it reaches here for the first time, all initialisations
 	// looks good for the given FTSIndexer and hence spin off the
 	// supporting go routines.
@@ -443,7 +651,7 @@ func (i *FTSIndexer) initClient(nodeDefs *cbgt.NodeDefs) error {
 	}
 
 	// setup new client
-	client, err := setupFTSClient(nodeDefs)
+	client, err := setupFTSClient(nodeDefs, i.stats)
 	if err != nil {
 		return err
 	}
@@ -458,6 +666,135 @@ func (i *FTSIndexer) initClient(nodeDefs *cbgt.NodeDefs) error {
 	return nil
 }
 
+// Warmup establishes the gRPC connections to the FTS nodes ahead of the
+// searches (sparing the first of them the connection setup), reporting
+// whether FTS is reachable. Connections that are live already are left
+// as is, and it's safe to invoke concurrently.
+func (i *FTSIndexer) Warmup(ctx context.Context) error {
+	client := i.getClient()
+	if client == nil {
+		if err := i.Refresh(); err != nil {
+			return err
+		}
+
+		client = i.getClient()
+		if client == nil {
+			return fmt.Errorf("n1fty: Warmup, client unavailable")
+		}
+	}
+
+	return client.warmup(ctx)
+}
+
+// acquireSearch reserves a slot for a search in flight, waiting on the
+// context if the bound on concurrent searches was reached, unless set to
+// fail fast.
+func (i *FTSIndexer) acquireSearch(ctx context.Context) error {
+	if i.searchSem != nil {
+		select {
+		case i.searchSem <- struct{}{}:
+		default:
+			if GetFailFastOnMaxConcurrentSearches() {
+				return ErrTooManyConcurrentSearches
+			}
+
+			select {
+			case i.searchSem <- struct{}{}:
+			case <-ctx.Done():
+				return fmt.Errorf("%v, waited until: %v", ErrTooManyConcurrentSearches,
+					ctx.Err())
+			}
+		}
+	}
+
+	atomic.AddInt64(&i.stats.CurInFlightSearches, 1)
+	return nil
+}
+
+func (i *FTSIndexer) releaseSearch() {
+	atomic.AddInt64(&i.stats.CurInFlightSearches, -1)
+	if i.searchSem != nil {
+		<-i.searchSem
+	}
+}
+
+// keyspacePath returns the keyspace searched, as "bucket.scope.collection",
+// or just the bucket for an indexer over a bucket.
+func (i *FTSIndexer) keyspacePath() string {
+	if i.scope == "" {
+		return i.bucket
+	}
+
+	return i.bucket + "." + i.scope + "." + i.keyspace
+}
+
+// KeyspaceStats returns the stats of the searches broken down by the
+// keyspace searched, when broken down by keyspace, see statsByKeyspace.
+func (i *FTSIndexer) KeyspaceStats() map[string]KeyspaceStats {
+	rv := map[string]KeyspaceStats{}
+	i.stats.byKeyspace.Range(func(k, v interface{}) bool {
+		ks := v.(*KeyspaceStats)
+		rv[k.(string)] = KeyspaceStats{
+			TotalSearch:              atomic.LoadInt64(&ks.TotalSearch),
+			TotalSearchDuration:      atomic.LoadInt64(&ks.TotalSearchDuration),
+			TotalResultsReturned:     atomic.LoadInt64(&ks.TotalResultsReturned),
+			TotalBackFills:           atomic.LoadInt64(&ks.TotalBackFills),
+			TotalBackfillActivations: atomic.LoadInt64(&ks.TotalBackfillActivations),
+			TotalBackfillBytes:       atomic.LoadInt64(&ks.TotalBackfillBytes),
+		}
+		return true
+	})
+
+	return rv
+}
+
+// Stats returns a snapshot of the search stats aggregated over the
+// keyspaces searched, keyed by their names as logged by the monitor.
+func (i *FTSIndexer) Stats() map[string]int64 {
+	client := i.getClient()
+	conns, streams := client.poolUtilization()
+
+	return map[string]int64{
+		"n1fty_search_count":             atomic.LoadInt64(&i.stats.TotalSearch),
+		"n1fty_search_duration":          atomic.LoadInt64(&i.stats.TotalSearchDuration),
+		"n1fty_fts_duration":             atomic.LoadInt64(&i.stats.TotalThrottledFtsDuration),
+		"n1fty_fts_server_duration":      atomic.LoadInt64(&i.stats.TotalFTSServerDuration),
+		"n1fty_ttfb_duration":            atomic.LoadInt64(&i.stats.TotalTTFBDuration),
+		"n1fty_n1ql_duration":            atomic.LoadInt64(&i.stats.TotalThrottledN1QLDuration),
+		"n1fty_totalbackfills":           atomic.LoadInt64(&i.stats.TotalBackFills),
+		"n1fty_backfill_size":            atomic.LoadInt64(&i.stats.CurBackFillSize),
+		"n1fty_results_returned":         atomic.LoadInt64(&i.stats.TotalResultsReturned),
+		"n1fty_backfill_activations":     atomic.LoadInt64(&i.stats.TotalBackfillActivations),
+		"n1fty_backfill_bytes":           atomic.LoadInt64(&i.stats.TotalBackfillBytes),
+		"n1fty_backfill_bytes_read":      atomic.LoadInt64(&i.stats.TotalBackfillBytesRead),
+		"n1fty_backfill_entries_written": atomic.LoadInt64(&i.stats.TotalBackfillEntriesWritten),
+		"n1fty_backfill_entries_read":    atomic.LoadInt64(&i.stats.TotalBackfillEntriesRead),
+		"n1fty_backfill_fallbacks":       atomic.LoadInt64(&i.stats.TotalBackfillFallbacks),
+		"n1fty_backfill_resumes":         atomic.LoadInt64(&i.stats.TotalBackfillResumes),
+		"n1fty_inflight_searches":        atomic.LoadInt64(&i.stats.CurInFlightSearches),
+		"n1fty_send_timeouts":            atomic.LoadInt64(&i.stats.TotalEntrySendTimeouts),
+		"n1fty_breaker_trips":            atomic.LoadInt64(&i.stats.TotalBreakerTrips),
+		"n1fty_open_breakers":            int64(client.openBreakers()),
+		"n1fty_unsupported_queries":      atomic.LoadInt64(&i.stats.TotalUnsupportedQueries),
+		"n1fty_grpc_conns":               int64(conns),
+		"n1fty_grpc_streams":             int64(streams),
+		"n1fty_grpc_conns_recycled":      atomic.LoadInt64(&i.stats.TotalGrpcConnsRecycled),
+		"n1fty_hits_dropped":             atomic.LoadInt64(&i.stats.TotalHitsDropped),
+	}
+}
+
+// countSearch accounts a search that took the duration given, in the
+// aggregate and the keyspace's stats.
+func (i *FTSIndexer) countSearch(dur time.Duration) {
+	atomic.AddInt64(&i.stats.TotalSearch, 1)
+	atomic.AddInt64(&i.stats.TotalSearchDuration, int64(dur))
+
+	if ks := i.stats.keyspace(i.keyspacePath()); ks != nil {
+		atomic.AddInt64(&ks.TotalSearch, 1)
+		atomic.AddInt64(&ks.TotalSearchDuration, int64(dur))
+	}
+}
+
 func (i *FTSIndexer) getClient() *ftsClient {
 	var client *ftsClient
 	i.m.RLock()
@@ -466,6 +803,30 @@ func (i *FTSIndexer) getClient() *ftsClient {
 	return client
 }
 
+// searchClient returns the gRPC client the searches over the index (with
+// the UUID) are sent with.
+func (i *FTSIndexer) searchClient(indexUUID string) (
+	pb.SearchServiceClient, error) {
+	i.m.RLock()
+	source := i.clientSource
+	i.m.RUnlock()
+
+	if source == nil {
+		client := i.getClient()
+		if client == nil {
+			return nil, fmt.Errorf("client unavailable, try refreshing")
+		}
+		source = client
+	}
+
+	client := source.getGrpcClient(indexUUID)
+	if client == nil {
+		return nil, fmt.Errorf("gRPC client unavailable, try refreshing")
+	}
+
+	return client, nil
+}
+
 func (i *FTSIndexer) fetchBleveMaxResultWindow() (int, error) {
 	ftsEndpoints := i.agent.FtsEps()
 	if len(ftsEndpoints) == 0 {
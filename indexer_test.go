@@ -0,0 +1,281 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbase/cbft"
+	pb "github.com/couchbase/cbft/protobuf"
+	"github.com/couchbase/n1fty/util"
+	"github.com/couchbase/query/datastore"
+)
+
+func TestIndexerConcurrentSearchesBound(t *testing.T) {
+	defer SetFailFastOnMaxConcurrentSearches(
+		GetFailFastOnMaxConcurrentSearches())
+
+	indexer := &FTSIndexer{
+		stats:     &stats{},
+		searchSem: make(chan struct{}, 2),
+	}
+
+	for k := 0; k < 2; k++ {
+		if err := indexer.acquireSearch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if atomic.LoadInt64(&indexer.stats.CurInFlightSearches) != 2 {
+		t.Fatalf("Expected 2 searches in flight, got: %d",
+			indexer.stats.CurInFlightSearches)
+	}
+
+	// fail fast
+	SetFailFastOnMaxConcurrentSearches(true)
+	if err := indexer.acquireSearch(context.Background()); err !=
+		ErrTooManyConcurrentSearches {
+		t.Fatalf("Expected err: %v, got: %v", ErrTooManyConcurrentSearches, err)
+	}
+
+	// wait until the deadline
+	SetFailFastOnMaxConcurrentSearches(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	err := indexer.acquireSearch(ctx)
+	cancel()
+	if err == nil ||
+		!strings.HasPrefix(err.Error(), ErrTooManyConcurrentSearches.Error()) {
+		t.Fatalf("Expected err: %v, got: %v", ErrTooManyConcurrentSearches, err)
+	}
+
+	// wait for a search to complete
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		indexer.releaseSearch()
+	}()
+
+	if err = indexer.acquireSearch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	indexer.releaseSearch()
+	indexer.releaseSearch()
+
+	if atomic.LoadInt64(&indexer.stats.CurInFlightSearches) != 0 {
+		t.Fatalf("Expected no searches in flight, got: %d",
+			indexer.stats.CurInFlightSearches)
+	}
+}
+
+func TestIndexerCancelSearchesOnClose(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the searches block until canceled.
+	client := &fakeSearchClient{started: make(chan struct{}, 1),
+		newStream: func(ctx context.Context) pb.SearchService_SearchClient {
+			return &fakeStream{ctx: ctx, block: true}
+		}}
+	index.indexer = &FTSIndexer{
+		stats:        &stats{},
+		clientSource: &fakeClientSource{client: client},
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := index.fetchHits(context.Background(), &pb.SearchRequest{})
+		errCh <- err
+	}()
+
+	select {
+	case <-client.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the search to start")
+	}
+
+	if err = index.indexer.cancelSearches(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-errCh:
+		if err == nil {
+			t.Fatalf("Expected the canceled search to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the search drained on close")
+	}
+
+	if n := len(index.indexer.searches); n != 0 {
+		t.Fatalf("Expected no searches in flight, got: %d", n)
+	}
+
+	// no searches are started past close.
+	if _, err = index.indexer.trackSearch(func() {}); err != ErrIndexerClosed {
+		t.Fatalf("Expected ErrIndexerClosed, got: %v", err)
+	}
+
+	if _, _, err = index.fetchHits(context.Background(),
+		&pb.SearchRequest{}); err != ErrIndexerClosed {
+		t.Fatalf("Expected ErrIndexerClosed, got: %v", err)
+	}
+}
+
+func TestIndexerCancelSearchesTimeout(t *testing.T) {
+	indexer := &FTSIndexer{stats: &stats{}}
+
+	// a search that ignores its cancel, outlasting the drain.
+	untrack, err := indexer.trackSearch(func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer untrack()
+
+	if err = indexer.cancelSearches(10 * time.Millisecond); err == nil {
+		t.Fatalf("Expected an error with a search still in flight")
+	}
+}
+
+func TestIndexerStatsByKeyspace(t *testing.T) {
+	defer SetStatsByKeyspace(GetStatsByKeyspace())
+
+	var sr *cbft.SearchRequest
+	err := json.Unmarshal([]byte(`{"query":{"match_all":{}}}`), &sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// search returns the hits of the batches given, over the collection.
+	search := func(indexer *FTSIndexer, batches int) {
+		index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index.indexer = indexer
+
+		msgs, _ := visitMsgs(batches)
+		rh := newResponseHandler(index, "", sr, &util.SearchOptions{})
+		conn := &testConn{sender: &chanSender{
+			ch: make(chan *datastore.IndexEntry, 16)}}
+
+		var waitGroup sync.WaitGroup
+		var backfillSync int64
+		rh.handleResponse(conn, &waitGroup, &backfillSync,
+			&fakeStream{msgs: msgs})
+		atomic.StoreInt64(&backfillSync, doneRequest)
+		waitGroup.Wait()
+
+		indexer.countSearch(time.Millisecond)
+	}
+
+	newIndexer := func(collection string) *FTSIndexer {
+		return &FTSIndexer{bucket: "travel", scope: "inventory",
+			keyspace: collection, collection: collection,
+			collectionAware: true, stats: &stats{}}
+	}
+
+	// not broken down unless requested.
+	hotels := newIndexer("hotel")
+	search(hotels, 1)
+	if ks := hotels.KeyspaceStats(); len(ks) != 0 {
+		t.Fatalf("Expected no stats by keyspace, got: %+v", ks)
+	}
+
+	SetStatsByKeyspace(true)
+
+	hotels, airlines := newIndexer("hotel"), newIndexer("airline")
+	search(hotels, 1)
+	search(hotels, 2)
+	search(airlines, 3)
+
+	for _, test := range []struct {
+		indexer *FTSIndexer
+		path    string
+		expect  KeyspaceStats
+	}{
+		{indexer: hotels, path: "travel.inventory.hotel",
+			expect: KeyspaceStats{TotalSearch: 2,
+				TotalSearchDuration:  int64(2 * time.Millisecond),
+				TotalResultsReturned: 6}},
+		{indexer: airlines, path: "travel.inventory.airline",
+			expect: KeyspaceStats{TotalSearch: 1,
+				TotalSearchDuration:  int64(time.Millisecond),
+				TotalResultsReturned: 6}},
+	} {
+		got := test.indexer.KeyspaceStats()
+		if len(got) != 1 || got[test.path] != test.expect {
+			t.Fatalf("Expected stats of %s: %+v, got: %+v", test.path,
+				test.expect, got)
+		}
+
+		// alongside the aggregate.
+		if n := atomic.LoadInt64(&test.indexer.stats.TotalSearch); n !=
+			test.expect.TotalSearch {
+			t.Fatalf("Expected the searches of %s aggregated: %d, got: %d",
+				test.path, test.expect.TotalSearch, n)
+		}
+	}
+}
+
+func TestIndexerStats(t *testing.T) {
+	var sr *cbft.SearchRequest
+	err := json.Unmarshal([]byte(`{"query":{"match_all":{}}}`), &sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexer := &FTSIndexer{stats: &stats{}}
+	index.indexer = indexer
+
+	msgs, _ := visitMsgs(2)
+	rh := newResponseHandler(index, "", sr, &util.SearchOptions{})
+	conn := &testConn{sender: &chanSender{
+		ch: make(chan *datastore.IndexEntry, 16)}}
+
+	var waitGroup sync.WaitGroup
+	var backfillSync int64
+	rh.handleResponse(conn, &waitGroup, &backfillSync,
+		&fakeStream{msgs: msgs})
+	atomic.StoreInt64(&backfillSync, doneRequest)
+	waitGroup.Wait()
+
+	indexer.countSearch(time.Millisecond)
+	atomic.AddInt64(&indexer.stats.TotalBackfillActivations, 1)
+	atomic.AddInt64(&indexer.stats.TotalBackfillBytes, 128)
+
+	got := indexer.Stats()
+	for name, expect := range map[string]int64{
+		"n1fty_search_count":         1,
+		"n1fty_search_duration":      int64(time.Millisecond),
+		"n1fty_results_returned":     4,
+		"n1fty_backfill_activations": 1,
+		"n1fty_backfill_bytes":       128,
+		"n1fty_backfill_bytes_read":  0,
+		"n1fty_open_breakers":        0,
+	} {
+		if n, ok := got[name]; !ok || n != expect {
+			t.Errorf("Expected %s: %d, got: %d (%t)", name, expect, n, ok)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"sync"
+	"sync/atomic"
+
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/couchbase/n1fty/util"
+)
+
+// defaultMappingCacheSize decides the number of processed index mappings
+// (provided within the SEARCH() function's options) cached per indexer; as
+// set by the "defaultMappingCacheSize" config
+var defaultMappingCacheSize = int64(64)
+
+func GetDefaultMappingCacheSize() int64 {
+	return atomic.LoadInt64(&defaultMappingCacheSize)
+}
+
+func SetDefaultMappingCacheSize(v int64) {
+	atomic.StoreInt64(&defaultMappingCacheSize, v)
+}
+
+// processedMapping holds the outcome of util.ProcessIndexMapping(..)
+// over an index mapping provided within the options.
+type processedMapping struct {
+	im                    *mapping.IndexMappingImpl
+	searchableFields      map[util.SearchField]bool
+	dynamicMappings       map[string]string
+	defaultAnalyzer       string
+	defaultDateTimeParser string
+}
+
+func newProcessedMapping(im *mapping.IndexMappingImpl) *processedMapping {
+	searchableFields, _, _, dynamicMappings, _,
+		defaultAnalyzer, defaultDateTimeParser, _ := util.ProcessIndexMapping(im)
+
+	return &processedMapping{
+		im:                    im,
+		searchableFields:      searchableFields,
+		dynamicMappings:       dynamicMappings,
+		defaultAnalyzer:       defaultAnalyzer,
+		defaultDateTimeParser: defaultDateTimeParser,
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+type mappingCacheKey [sha1.Size]byte
+
+type mappingCacheEntry struct {
+	key mappingCacheKey
+	pm  *processedMapping
+}
+
+// mappingCache is an LRU cache of processed index mappings, keyed by
+// the hash of the index mapping's JSON representation.
+type mappingCache struct {
+	m        sync.Mutex
+	capacity int
+	entries  map[mappingCacheKey]*list.Element
+	lru      *list.List
+}
+
+func newMappingCache(capacity int) *mappingCache {
+	return &mappingCache{
+		capacity: capacity,
+		entries:  make(map[mappingCacheKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func mappingCacheKeyFor(mappingBytes []byte) mappingCacheKey {
+	return mappingCacheKey(sha1.Sum(mappingBytes))
+}
+
+func (c *mappingCache) get(key mappingCacheKey) *processedMapping {
+	if c == nil {
+		return nil
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if elem, exists := c.entries[key]; exists {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*mappingCacheEntry).pm
+	}
+
+	return nil
+}
+
+func (c *mappingCache) add(key mappingCacheKey, pm *processedMapping) {
+	if c == nil || c.capacity <= 0 {
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if elem, exists := c.entries[key]; exists {
+		elem.Value.(*mappingCacheEntry).pm = pm
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&mappingCacheEntry{key: key, pm: pm})
+
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*mappingCacheEntry).key)
+	}
+}
+
+// reset invalidates all the cached entries, to be invoked whenever
+// the index definitions change.
+func (c *mappingCache) reset() {
+	if c == nil {
+		return
+	}
+
+	c.m.Lock()
+	c.entries = make(map[mappingCacheKey]*list.Element)
+	c.lru.Init()
+	c.m.Unlock()
+}
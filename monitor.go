@@ -12,6 +12,7 @@
 package n1fty
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"path"
 	"strings"
@@ -105,21 +106,24 @@ func (m *monitor) logStats() {
 
 		m.m.RLock()
 		for _, i := range m.indexers {
-			searchDur := atomic.LoadInt64(&i.stats.TotalSearchDuration)
-			n1qlDur := atomic.LoadInt64(&i.stats.TotalThrottledN1QLDuration)
-			ftsDur := atomic.LoadInt64(&i.stats.TotalThrottledFtsDuration)
-			ttfbDur := atomic.LoadInt64(&i.stats.TotalTTFBDuration)
-			totalSearch := atomic.LoadInt64(&i.stats.TotalSearch)
-			totalBackfills := atomic.LoadInt64(&i.stats.TotalBackFills)
-
-			fmsg := `n1fty bucket-scope-keyspace: %q.%q.%q {` +
-				`"n1fty_search_count":%v,"n1fty_search_duration":%v,` +
-				`"n1fty_fts_duration":%v,` +
-				`"n1fty_ttfb_duration":%v,"n1fty_n1ql_duration":%v,` +
-				`"n1fty_totalbackfills":%v}`
-			logging.Infof(fmsg,
-				i.BucketId(), i.ScopeId(), i.KeyspaceId(), totalSearch,
-				searchDur, ftsDur, ttfbDur, n1qlDur, totalBackfills)
+			buf, err := json.Marshal(i.Stats())
+			if err != nil {
+				continue
+			}
+
+			logging.Infof("n1fty bucket-scope-keyspace: %q.%q.%q %s",
+				i.BucketId(), i.ScopeId(), i.KeyspaceId(), buf)
+
+			// the breakdown by the keyspace searched, see statsByKeyspace.
+			for path, ks := range i.KeyspaceStats() {
+				logging.Infof(`n1fty keyspace: %q {"n1fty_search_count":%v,`+
+					`"n1fty_search_duration":%v,"n1fty_results_returned":%v,`+
+					`"n1fty_totalbackfills":%v,"n1fty_backfill_activations":%v,`+
+					`"n1fty_backfill_bytes":%v}`, path, ks.TotalSearch,
+					ks.TotalSearchDuration, ks.TotalResultsReturned,
+					ks.TotalBackFills, ks.TotalBackfillActivations,
+					ks.TotalBackfillBytes)
+			}
 		}
 		m.m.RUnlock()
 
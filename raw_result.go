@@ -0,0 +1,263 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/buger/jsonparser"
+	"github.com/couchbase/query/datastore"
+	"github.com/couchbase/query/logging"
+	"github.com/couchbase/query/value"
+)
+
+// rawResultMemoryLimit is the memory (in bytes) a search request with the
+// "raw_result" option may hold the streamed hits in, while the search
+// result is assembled, past which the hits are spilled to disk; as set by
+// the "rawResultMemoryLimit" config
+var rawResultMemoryLimit = int64(16 * 1024 * 1024) // 16 MB
+
+func GetRawResultMemoryLimit() int64 {
+	return atomic.LoadInt64(&rawResultMemoryLimit)
+}
+
+func SetRawResultMemoryLimit(v int64) {
+	atomic.StoreInt64(&rawResultMemoryLimit, v)
+}
+
+// rawResult assembles the complete search result of a request with the
+// "raw_result" option, out of the hits streamed and the final search
+// result (carrying the total, max score, took and status), for the
+// visitor of FTSIndex.SearchVisitRaw(..), or to be sent as a single index
+// entry by FTSIndex.Search(..). The hits are held in memory
+// until the limit is reached, after which they're moved to a file under
+// the spill (backfill space) directory, for up to the spill limit (in
+// MB), 0 disallowing spilling altogether.
+type rawResult struct {
+	logPrefix    string
+	spillDir     string
+	memLimit     int64
+	spillLimitMB int64
+
+	memUsed int64
+	hits    [][]byte
+
+	spillFile *os.File
+	enc       *gob.Encoder
+	spillUsed int64
+}
+
+func newRawResult(logPrefix, spillDir string, memLimit,
+	spillLimitMB int64) *rawResult {
+	return &rawResult{
+		logPrefix:    logPrefix,
+		spillDir:     spillDir,
+		memLimit:     memLimit,
+		spillLimitMB: spillLimitMB,
+	}
+}
+
+// add accumulates the hits (a JSON array) streamed.
+func (r *rawResult) add(hits []byte) error {
+	if len(hits) == 0 {
+		return nil
+	}
+
+	if r.spillFile == nil {
+		if r.memUsed+int64(len(hits)) <= r.memLimit {
+			r.hits = append(r.hits, append([]byte(nil), hits...))
+			r.memUsed += int64(len(hits))
+			return nil
+		}
+
+		if err := r.spill(); err != nil {
+			return err
+		}
+	}
+
+	r.spillUsed += int64(len(hits))
+	if float64(r.spillUsed)/1048576 > float64(r.spillLimitMB) {
+		return fmt.Errorf("%v raw result exceeded spill limit: %v MB",
+			r.logPrefix, r.spillLimitMB)
+	}
+
+	return r.enc.Encode(hits)
+}
+
+// spill moves the hits held in memory over to the spill file.
+func (r *rawResult) spill() error {
+	if r.spillLimitMB <= 0 {
+		return fmt.Errorf("%v raw result exceeded memory limit: %v,"+
+			" with backfill disabled", r.logPrefix, r.memLimit)
+	}
+
+	prefix := backfillPrefix + "-raw" + strconv.Itoa(os.Getpid())
+	f, err := ioutil.TempFile(r.spillDir, prefix)
+	if err != nil {
+		return fmt.Errorf("%v creating raw result file, err: %v",
+			r.logPrefix, err)
+	}
+
+	r.spillFile = f
+	r.enc = gob.NewEncoder(f)
+
+	for _, hits := range r.hits {
+		if err = r.enc.Encode(hits); err != nil {
+			return err
+		}
+		r.spillUsed += int64(len(hits))
+	}
+
+	logging.Infof("raw_result: %v spilled %d bytes of hits to %v",
+		r.logPrefix, r.memUsed, f.Name())
+
+	r.hits = nil
+	r.memUsed = 0
+
+	return nil
+}
+
+// RawResultVisitor takes in the complete search result of
+// FTSIndex.SearchVisitRaw(..): the final search result (the total hits,
+// max score, took and the status of the partitions) first, followed by
+// the hits, in the chunks (JSON arrays) they were streamed in. The search
+// stops early should the visitor return an error.
+type RawResultVisitor interface {
+	VisitResult(result map[string]interface{}) error
+	VisitHits(hits []byte) error
+}
+
+// visit hands the search result assembled over to the visitor, out of the
+// final search result received and the hits accumulated so far, with
+// those spilled read back off the spill file a chunk at a time.
+func (r *rawResult) visit(searchResult []byte,
+	visitor RawResultVisitor) error {
+	// the final search result carries the hits itself, unless streamed.
+	hits, dataType, _, err := jsonparser.Get(searchResult, "hits")
+	if err == nil && dataType == jsonparser.Array {
+		if err = r.add(hits); err != nil {
+			return err
+		}
+	}
+
+	var rv map[string]interface{}
+	err = json.Unmarshal(jsonparser.Delete(
+		append([]byte(nil), searchResult...), "hits"), &rv)
+	if err != nil {
+		return err
+	}
+
+	if err = visitor.VisitResult(rv); err != nil {
+		return err
+	}
+
+	if r.spillFile != nil {
+		f, err := os.Open(r.spillFile.Name())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		dec := gob.NewDecoder(f)
+		for {
+			var hits []byte
+			err = dec.Decode(&hits)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if err = visitor.VisitHits(hits); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, hits := range r.hits {
+		if err := visitor.VisitHits(hits); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rawResultEntry assembles the search result visited into the single
+// index entry sent for a N1QL search with the "raw_result" option, which
+// carries the search result (with the hits) as its metadata.
+type rawResultEntry struct {
+	result []byte
+	hits   bytes.Buffer // the hits visited, as the elements of an array
+}
+
+func (e *rawResultEntry) VisitResult(result map[string]interface{}) error {
+	var err error
+	e.result, err = json.Marshal(result)
+	return err
+}
+
+func (e *rawResultEntry) VisitHits(hits []byte) error {
+	hits = bytes.TrimSpace(hits)
+	if len(hits) < 2 || hits[0] != '[' || hits[len(hits)-1] != ']' {
+		return fmt.Errorf("raw_result: hits: %s, not an array", hits)
+	}
+
+	hits = bytes.TrimSpace(hits[1 : len(hits)-1])
+	if len(hits) == 0 {
+		return nil
+	}
+
+	if e.hits.Len() > 0 {
+		e.hits.WriteByte(',')
+	}
+	e.hits.Write(hits)
+
+	return nil
+}
+
+func (e *rawResultEntry) indexEntry() (*datastore.IndexEntry, error) {
+	hits := make([]byte, 0, e.hits.Len()+2)
+	hits = append(append(append(hits, '['), e.hits.Bytes()...), ']')
+
+	result, err := jsonparser.Set(e.result, hits, "hits")
+	if err != nil {
+		return nil, err
+	}
+
+	return &datastore.IndexEntry{MetaData: value.NewValue(result)}, nil
+}
+
+func (r *rawResult) cleanup() {
+	if r == nil {
+		return
+	}
+
+	r.hits = nil
+
+	if r.spillFile != nil {
+		r.spillFile.Close()
+		if err := os.Remove(r.spillFile.Name()); err != nil {
+			logging.Errorf("raw_result: %v remove raw result file %v,"+
+				" err: %v", r.logPrefix, r.spillFile.Name(), err)
+		}
+		r.spillFile = nil
+	}
+}
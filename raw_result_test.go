@@ -0,0 +1,302 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2/search"
+	pb "github.com/couchbase/cbft/protobuf"
+	"github.com/couchbase/n1fty/util"
+	"github.com/couchbase/query/datastore"
+	"github.com/couchbase/query/value"
+)
+
+// rawCollector collects the raw search result visited, failing once the
+// chunks of hits reach failAt (if set).
+type rawCollector struct {
+	result map[string]interface{}
+	chunks int
+	hits   []interface{}
+	failAt int
+}
+
+func (c *rawCollector) VisitResult(result map[string]interface{}) error {
+	c.result = result
+	return nil
+}
+
+func (c *rawCollector) VisitHits(hits []byte) error {
+	c.chunks++
+	if c.chunks == c.failAt {
+		return fmt.Errorf("visited enough")
+	}
+
+	var arr []interface{}
+	if err := json.Unmarshal(hits, &arr); err != nil {
+		return err
+	}
+	c.hits = append(c.hits, arr...)
+	return nil
+}
+
+func TestRawResult(t *testing.T) {
+	for _, memLimit := range []int64{
+		1024 * 1024, // all hits held in memory
+		64,          // hits spilled to disk
+	} {
+		r := newRawResult("test", os.TempDir(), memLimit, 1)
+
+		for i := 0; i < 10; i++ {
+			err := r.add([]byte(fmt.Sprintf(`[{"id":"doc-%d","score":1}]`, i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c := &rawCollector{}
+		err := r.visit([]byte(`{"status":{"total":2,"failed":1,`+
+			`"successful":1,"errors":{"pindex":"err"}},"hits":null,`+
+			`"total_hits":10,"max_score":1,"took":100}`), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the hits are visited a chunk at a time, as streamed.
+		if len(c.hits) != 10 || c.chunks != 10 {
+			t.Fatalf("[%d] Expected 10 hits in 10 chunks, got: %v in %d",
+				memLimit, c.hits, c.chunks)
+		}
+
+		for i, hit := range c.hits {
+			id := hit.(map[string]interface{})["id"]
+			if id != fmt.Sprintf("doc-%d", i) {
+				t.Fatalf("[%d] Unexpected hit at: %d, %v", memLimit, i, hit)
+			}
+		}
+
+		status, _ := c.result["status"].(map[string]interface{})
+		if status["failed"] != float64(1) ||
+			c.result["total_hits"] != float64(10) {
+			t.Fatalf("[%d] Unexpected result: %v", memLimit, c.result)
+		}
+
+		if _, exists := c.result["hits"]; exists {
+			t.Fatalf("[%d] Expected the hits visited apart from the result,"+
+				" got: %v", memLimit, c.result)
+		}
+
+		// the visitor failing stops the hits visited.
+		c = &rawCollector{failAt: 3}
+		if err = r.visit([]byte(`{"total_hits":10}`), c); err == nil ||
+			len(c.hits) != 2 {
+			t.Fatalf("[%d] Expected the visitor's error after 2 hits, got:"+
+				" %v, %v", memLimit, err, c.hits)
+		}
+
+		spillFile := r.spillFile
+		if (memLimit < 1024*1024) != (spillFile != nil) {
+			t.Fatalf("[%d] Unexpected spill file: %v", memLimit, spillFile)
+		}
+
+		r.cleanup()
+
+		if spillFile != nil {
+			if _, err := os.Stat(spillFile.Name()); !os.IsNotExist(err) {
+				t.Fatalf("Expected spill file to be removed, err: %v", err)
+			}
+		}
+	}
+}
+
+func TestRawResultLimits(t *testing.T) {
+	// spilling disallowed
+	r := newRawResult("test", os.TempDir(), 16, 0)
+	if err := r.add([]byte(`[{"id":"doc-1","score":1}]`)); err == nil {
+		t.Fatalf("Expected an error, with spilling disallowed")
+	}
+	r.cleanup()
+
+	// spill limit exceeded
+	r = newRawResult("test", os.TempDir(), 16, 1)
+	defer r.cleanup()
+
+	hits := []byte(fmt.Sprintf(`[{"id":"%0512d"}]`, 0))
+	var err error
+	for i := 0; i < 4096 && err == nil; i++ {
+		err = r.add(hits)
+	}
+	if err == nil {
+		t.Fatalf("Expected an error, with the spill limit exceeded")
+	}
+}
+
+func TestResponseHandlerRawResult(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	rh := newResponseHandler(index, "req", nil,
+		&util.SearchOptions{RawResult: true})
+	defer rh.cleanupRawResult()
+
+	c := &rawCollector{}
+	rh.rawVisitor = c
+
+	done, err := rh.handleRawResult(&pb.StreamSearchResults{
+		Contents: &pb.StreamSearchResults_Hits{
+			Hits: &pb.StreamSearchResults_Batch{
+				Bytes: []byte(`[{"id":"a"},{"id":"b"}]`),
+				Total: 2,
+			},
+		},
+	}, nil)
+	if err != nil || done || c.result != nil || c.chunks != 0 {
+		t.Fatalf("Expected the hits to be held back, done: %v, err: %v",
+			done, err)
+	}
+
+	done, err = rh.handleRawResult(&pb.StreamSearchResults{
+		Contents: &pb.StreamSearchResults_SearchResult{
+			SearchResult: []byte(`{"status":{"total":1,"failed":0,` +
+				`"successful":1},"total_hits":2,"max_score":1,"took":10}`),
+		},
+	}, nil)
+	if err != nil || !done {
+		t.Fatalf("Expected the raw result to be visited, done: %v, err: %v",
+			done, err)
+	}
+
+	if dur := index.indexer.stats.TotalFTSServerDuration; dur != 10 {
+		t.Fatalf("Expected the FTS server duration: 10, got: %v", dur)
+	}
+
+	if len(c.hits) != 2 {
+		t.Fatalf("Expected 2 hits within the raw result, got: %v", c.hits)
+	}
+
+	if _, ok := c.result["status"]; !ok {
+		t.Fatalf("Expected the status within the raw result, got: %v",
+			c.result)
+	}
+}
+
+func TestResponseHandlerRawResultEntry(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	rh := newResponseHandler(index, "req", nil,
+		&util.SearchOptions{RawResult: true})
+	defer rh.cleanupRawResult()
+
+	// the hits spilled to disk, past the first batch.
+	rh.raw = newRawResult("test", os.TempDir(), 32, 1)
+
+	sender := &chanSender{ch: make(chan *datastore.IndexEntry, 2)}
+	for _, hits := range []string{
+		`[{"id":"a"},{"id":"b"}]`, `[]`, ` [{"id":"c"}] `,
+	} {
+		done, err := rh.handleRawResult(&pb.StreamSearchResults{
+			Contents: &pb.StreamSearchResults_Hits{
+				Hits: &pb.StreamSearchResults_Batch{Bytes: []byte(hits)},
+			},
+		}, sender)
+		if err != nil || done {
+			t.Fatalf("Expected the hits to be held back, done: %v, err: %v",
+				done, err)
+		}
+	}
+
+	if rh.raw.spillFile == nil {
+		t.Fatalf("Expected the hits spilled to disk")
+	}
+
+	done, err := rh.handleRawResult(&pb.StreamSearchResults{
+		Contents: &pb.StreamSearchResults_SearchResult{
+			SearchResult: []byte(`{"status":{"total":2,"failed":1,` +
+				`"successful":1},"hits":[{"id":"d"}],"total_hits":4,` +
+				`"max_score":1,"took":10}`),
+		},
+	}, sender)
+	if err != nil || !done {
+		t.Fatalf("Expected the raw result to be sent, done: %v, err: %v",
+			done, err)
+	}
+
+	// the search result is sent as a single entry, hits included.
+	if len(sender.ch) != 1 {
+		t.Fatalf("Expected a single entry, got: %d", len(sender.ch))
+	}
+
+	entry := <-sender.ch
+	var result struct {
+		Status    map[string]interface{}   `json:"status"`
+		Hits      []map[string]interface{} `json:"hits"`
+		TotalHits int                      `json:"total_hits"`
+	}
+	b, _ := entry.MetaData.MarshalJSON()
+	if err = json.Unmarshal(b, &result); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, hit := range result.Hits {
+		ids = append(ids, hit["id"].(string))
+	}
+	if strings.Join(ids, ",") != "a,b,c,d" || result.TotalHits != 4 ||
+		result.Status["failed"] != float64(1) {
+		t.Fatalf("Unexpected raw result: %s", b)
+	}
+
+	if n := index.indexer.stats.TotalResultsReturned; n != 1 {
+		t.Fatalf("Expected 1 result returned, got: %v", n)
+	}
+}
+
+func TestSearchVisitRawResult(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	query := value.NewValue(map[string]interface{}{
+		"match": "shirt", "field": "kind",
+	})
+
+	// the raw search result is only for a raw result visitor.
+	err = index.SearchVisit(context.Background(), "", query,
+		value.NewValue(map[string]interface{}{"raw_result": true}),
+		func(*search.DocumentMatch) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "raw_result") {
+		t.Fatalf("Expected the raw_result option refused, got: %v", err)
+	}
+
+	// which implies the option, along with the checks of the others.
+	err = index.SearchVisitRaw(context.Background(), "", query,
+		value.NewValue(map[string]interface{}{
+			"search_after": []interface{}{},
+		}), &rawCollector{})
+	if err == nil || !strings.Contains(err.Error(), "raw_result") {
+		t.Fatalf("Expected the search_after option refused, got: %v", err)
+	}
+}
@@ -12,49 +12,399 @@
 package n1fty
 
 import (
+	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/buger/jsonparser"
 	"github.com/couchbase/cbft"
 	pb "github.com/couchbase/cbft/protobuf"
 	"github.com/couchbase/n1fty/util"
 	"github.com/couchbase/query/datastore"
+	"github.com/couchbase/query/errors"
 	"github.com/couchbase/query/logging"
 	"github.com/couchbase/query/value"
 )
 
+// streamDrainMaxMessages bounds the number of messages read off the gRPC
+// stream of a search request that's abandoned (for ex. when the query is
+// stopped), in the background once the search's canceled and its slot
+// released, see drainAbandoned; 0 disables draining.; as set by the
+// "streamDrainMaxMessages" config
+var streamDrainMaxMessages = int64(16)
+
+func GetStreamDrainMaxMessages() int64 {
+	return atomic.LoadInt64(&streamDrainMaxMessages)
+}
+
+func SetStreamDrainMaxMessages(v int64) {
+	atomic.StoreInt64(&streamDrainMaxMessages, v)
+}
+
+// streamDrainTimeout bounds the time spent draining an abandoned stream.;
+// as set by the "streamDrainTimeoutMS" config (in ms)
+var streamDrainTimeout = int64(500 * time.Millisecond)
+
+func GetStreamDrainTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&streamDrainTimeout))
+}
+
+func SetStreamDrainTimeout(v time.Duration) {
+	atomic.StoreInt64(&streamDrainTimeout, int64(v))
+}
+
+// backfillPollInterval is the interval at which an idle backfill checks
+// whether the search is done; hits written to the backfill are signalled,
+// and so drained without waiting out the interval; as set by the
+// "backfillPollIntervalMS" config (in ms)
+var backfillPollInterval = int64(10 * time.Millisecond)
+
+func GetBackfillPollInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&backfillPollInterval))
+}
+
+func SetBackfillPollInterval(v time.Duration) {
+	atomic.StoreInt64(&backfillPollInterval, int64(v))
+}
+
+// strictHitDecoding fails a search whose hits (as streamed by FTS) can't
+// be decoded; otherwise (by default) such hits are dropped, logged, counted
+// and warned of, with the search carrying on; as set by the
+// "strictHitDecoding" config
+var strictHitDecoding = int32(0)
+
+func GetStrictHitDecoding() bool {
+	return loadFlag(&strictHitDecoding)
+}
+
+func SetStrictHitDecoding(v bool) {
+	storeFlag(&strictHitDecoding, v)
+}
+
+// backfillFallbackToBlocking has a search whose backfill can't be set up
+// (for ex. with the backfill directory full or unwritable) carry on sending
+// the hits directly, blocking on a slow consumer, rather than fail; as set
+// by the "backfillFallbackToBlocking" config
+var backfillFallbackToBlocking = int32(1)
+
+func GetBackfillFallbackToBlocking() bool {
+	return loadFlag(&backfillFallbackToBlocking)
+}
+
+func SetBackfillFallbackToBlocking(v bool) {
+	storeFlag(&backfillFallbackToBlocking, v)
+}
+
+// backfillResumeBatches is the number of batches of hits in a row that,
+// received with the backfill drained and the consumer's buffer at most
+// half full (with room for them), have the backfill stopped and its file
+// removed, the hits that follow being sent directly again (until the
+// consumer falls behind once more); 0 keeps the backfill until the search
+// is done; as set by the "backfillResumeBatches" config
+var backfillResumeBatches = int64(3)
+
+func GetBackfillResumeBatches() int64 {
+	return atomic.LoadInt64(&backfillResumeBatches)
+}
+
+func SetBackfillResumeBatches(v int64) {
+	atomic.StoreInt64(&backfillResumeBatches, v)
+}
+
+// entrySendTimeout bounds the time an entry may wait on a consumer that
+// isn't reading (with its buffer full), past which the search is aborted;
+// 0 implies the request's deadline (if any); as set by the
+// "entrySendTimeoutMS" config (in ms)
+var entrySendTimeout = int64(0)
+
+func GetEntrySendTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&entrySendTimeout))
+}
+
+func SetEntrySendTimeout(v time.Duration) {
+	atomic.StoreInt64(&entrySendTimeout, int64(v))
+}
+
+// casStoredField names the stored field (of the index mappings) carrying
+// the documents' CAS, as a string (a number being indexed as a float, so
+// not exactly), that is requested along with the hits and forwarded in
+// the metadata of the index entries under "cas", for compare-and-swap
+// updates without a fetch; as is a CAS that FTS reports for a hit. Empty
+// disables requesting the stored field; as set by the "casStoredField" config
+var casStoredField atomic.Value
+
+func GetCASStoredField() string {
+	if v, ok := casStoredField.Load().(string); ok {
+		return v
+	}
+	return ""
+}
+
+func SetCASStoredField(v string) {
+	casStoredField.Store(v)
+}
+
+// backfillBufferedHits is the max number of hits that may be buffered in
+// memory, see SetBackfillBufferedHits(..)
+var backfillBufferedHits int64
+
+// SetBackfillBufferedHits sets the max number of hits that may be buffered
+// in memory (sent, but yet to be read by the consumer) before the hits that
+// follow are spilled over to the backfill, regardless of the capacity of
+// the consumer's buffer. The backfill starts as soon as either the buffer
+// lacks room for the hits received, or the hits buffered would exceed the
+// threshold, whichever's first; so a threshold past the buffer's capacity
+// has no effect, and 0 leaves it to the buffer's capacity alone.
+func SetBackfillBufferedHits(n int64) {
+	atomic.StoreInt64(&backfillBufferedHits, n)
+}
+
+func getBackfillBufferedHits() int64 {
+	return atomic.LoadInt64(&backfillBufferedHits)
+}
+
+// backfillBufferedBytes is the max number of bytes of hits that may be
+// buffered in memory, see SetBackfillBufferedBytes(..)
+var backfillBufferedBytes = int64(256 * 1024 * 1024)
+
+// SetBackfillBufferedBytes sets the max number of bytes of the hits that
+// may be buffered in memory (sent, but yet to be read by the consumer)
+// before the hits that follow are spilled over to the backfill, regardless
+// of their number, so that a consumer's buffer with room for many hits
+// doesn't hold too many wide ones; the bytes buffered are estimated at the
+// average size of the hits sent (as received from FTS). 0 disables it.
+func SetBackfillBufferedBytes(n int64) {
+	atomic.StoreInt64(&backfillBufferedBytes, n)
+}
+
+func getBackfillBufferedBytes() int64 {
+	return atomic.LoadInt64(&backfillBufferedBytes)
+}
+
+// explainBufferedHits is the max number of hits that may be buffered in
+// memory when they carry the breakdowns of their scores (which can be
+// large), before the hits that follow are spilled over to the backfill,
+// see SetBackfillBufferedHits(..); 0 leaves it to that of any hits; as set
+// by the "explainBufferedHits" config
+var explainBufferedHits = int64(100)
+
+func GetExplainBufferedHits() int64 {
+	return atomic.LoadInt64(&explainBufferedHits)
+}
+
+func SetExplainBufferedHits(v int64) {
+	atomic.StoreInt64(&explainBufferedHits, v)
+}
+
+// errEntrySendTimeout is reported when an entry couldn't be sent in time.
+var errEntrySendTimeout = fmt.Errorf("timed out sending to the consumer")
+
 type responseHandler struct {
 	i            *FTSIndex
 	requestID    string
 	backfillFile *os.File
 	sr           *cbft.SearchRequest
+	distinct     *distinctKeys // non-nil when duplicates are to be suppressed
+	collapse     *distinctKeys // non-nil when the hits are to be collapsed
+	raw          *rawResult    // non-nil when the raw search result is requested
+	rawVisitor   RawResultVisitor
+	opts         *util.SearchOptions
+	spillDir     string // the backfill directory, see backfillSpaceDir
+	spillDirErr  error  // non-nil when the spillDir's out of bounds
+
+	// When sorted by geo distance, the hits' sort values (the distances)
+	// are carried within their metadata, less the trailing trimSortValues
+	// added to the sort (for ex. the tie breaker of deep paging).
+	keepSortValues bool
+	trimSortValues int
+
+	// When paging from a cursor, the hits' sort values (untrimmed) are
+	// carried within their metadata under "cursor", that of the last hit
+	// (or the first, paging backward) being the cursor of the next page.
+	cursors bool
+
+	// When requested, the pindex that produced each hit (as reported) is
+	// carried within its metadata under "pindex".
+	includePindex bool
+
+	// The score below which hits are skipped, nil if none are.
+	minScore *float64
+
+	// When only the keys are requested, the index entries carry no
+	// metadata, with the hits not decoded beyond their IDs.
+	keysOnly bool
+
+	// The stored fields carried within the hits' metadata, those requested
+	// (any, when nil, as with "*" requested) less those excluded, with
+	// their values capped at maxFieldBytes (if non-zero) per hit.
+	fields        map[string]bool
+	excludeFields map[string]bool
+	maxFieldBytes int64
+
+	// When facets are requested, the last hit is held back until the
+	// facet results arrive (with the final search result), to carry
+	// them within its metadata.
+	holdLastHit bool
+	lastHit     map[string]interface{}
+	facets      []byte
+
+	// The deadline of the request, bounding the wait on a wedged consumer
+	// (unless entrySendTimeout is set), zero if there's none.
+	reqDeadline time.Time
+	sendErr     error
+	handoff     *sendHandoff // the sends handed off, see send(..)
+
+	sent      int64        // the number of hits sent, updated atomically
+	sentBytes int64        // the bytes of the hits sent, updated atomically
+	trace     *searchTrace // non-nil when the search is traced
+
+	ks *KeyspaceStats // the keyspace's stats, if tracked
+
+	droppedWarned int32 // set once the hits dropped are warned of
+
+	// the stream abandoned ahead of its end, drained once the search's
+	// done, see drainAbandoned.
+	abandoned pb.SearchService_SearchClient
+
+	// When requested, the totals of the search (from its final result)
+	// reported following the hits, see flushTrailer(..).
+	trailer *Trailer
+}
+
+// Trailer carries the totals of a search with the "trailer" option, as
+// FTS reports them (ahead of any hits skipped by n1fty), for clients
+// paginating over the hits to show the total along with a page of them.
+type Trailer struct {
+	TotalHits uint64
+	MaxScore  float64
+}
+
+// trailerConn is implemented by the searchConns that take in the trailer
+// of a search, following its hits.
+type trailerConn interface {
+	setTrailer(trailer *Trailer)
+}
+
+// bufferedSender is the subset of datastore.Sender that reports whether
+// its buffer is full.
+type bufferedSender interface {
+	Capacity() int
+	Length() int
+}
+
+// entrySender is the subset of datastore.Sender used to send the hits.
+type entrySender interface {
+	SendEntry(entry *datastore.IndexEntry) bool
+}
+
+// searchConn is the subset of datastore.IndexConnection the hits are sent
+// and the errors reported over.
+type searchConn interface {
+	Sender() datastore.Sender
+	Error(err errors.Error)
+	Warning(wrn errors.Error)
 }
 
 func newResponseHandler(i *FTSIndex, requestID string,
-	sr *cbft.SearchRequest) *responseHandler {
-	return &responseHandler{
+	sr *cbft.SearchRequest, opts *util.SearchOptions) *responseHandler {
+	rh := &responseHandler{
 		i:         i,
 		requestID: requestID,
 		sr:        sr,
+		opts:      opts,
+	}
+
+	rh.spillDir, rh.spillDirErr = rh.backfillSpaceDir()
+
+	if sr != nil && len(sr.Facets) > 0 {
+		rh.holdLastHit = true
+	}
+
+	if i != nil && i.indexer != nil {
+		rh.ks = i.indexer.stats.keyspace(i.indexer.keyspacePath())
 	}
+
+	if sr != nil {
+		_, rh.keepSortValues = util.GeoDistanceSorts(sr.Sort)
+		rh.fields = requestedFields(sr.Fields)
+	}
+
+	if opts != nil {
+		for _, field := range opts.ExcludeFields {
+			if rh.excludeFields == nil {
+				rh.excludeFields = map[string]bool{}
+			}
+			rh.excludeFields[field] = true
+		}
+		rh.maxFieldBytes = opts.MaxFieldBytes
+		rh.cursors = opts.SearchAfter != nil || opts.SearchBefore != nil
+		rh.minScore = opts.MinScore
+		rh.includePindex = opts.IncludePindex
+		rh.keysOnly = opts.KeysOnly
+	}
+
+	// with only the keys returned, there's no hit to carry the facets.
+	if rh.keysOnly {
+		rh.holdLastHit = false
+	}
+
+	if opts != nil && opts.Distinct {
+		rh.distinct = newDistinctKeys(
+			fmt.Sprintf("n1fty[%s] %q", i.Name(), requestID),
+			rh.spillDir, GetDistinctMemoryLimit())
+	}
+
+	if opts != nil && opts.Collapse != nil {
+		rh.collapse = newDistinctKeys(
+			fmt.Sprintf("n1fty[%s] %q collapse", i.Name(), requestID),
+			rh.spillDir, GetCollapseMemoryLimit())
+	}
+
+	if opts != nil && opts.RawResult {
+		rh.raw = newRawResult(
+			fmt.Sprintf("n1fty[%s] %q", i.Name(), requestID),
+			rh.spillDir, GetRawResultMemoryLimit(),
+			rh.backfillSpaceLimit())
+	}
+
+	return rh
 }
 
-func (r *responseHandler) handleResponse(conn *datastore.IndexConnection,
+// handleResponse sends the hits streamed over to the consumer, directly
+// while it keeps up, and through the backfill file once it falls behind.
+// Once the backfill has started, all of the hits that follow are routed
+// through the file, to be drained in the order streamed, which is the sort
+// order requested (if any), until the consumer catches up with it (see
+// backfillResumeBatches), when the backfill's stopped, once drained, ahead
+// of the hits being sent directly again. If the backfill can't be set up,
+// the hits carry on being sent directly, unless backfillFallbackToBlocking
+// is off.
+func (r *responseHandler) handleResponse(conn searchConn,
 	waitGroup *sync.WaitGroup,
 	backfillSync *int64,
 	stream pb.SearchService_SearchClient) {
 	sender := conn.Sender()
 
-	backfillLimit := getBackfillSpaceLimit()
+	if r.spillDirErr != nil {
+		conn.Error(util.N1QLError(r.spillDirErr, ""))
+		r.abandoned = stream
+		return
+	}
+
+	backfillLimit := r.backfillSpaceLimit()
 
 	firstResponseByte, starttm, ftsDur := false, time.Now(), time.Now()
 
@@ -66,12 +416,27 @@ func (r *responseHandler) handleResponse(conn *datastore.IndexConnection,
 
 	var tmpfile *os.File
 	var backfillFin, backfillEntries int64
+	var backfillResume int64 // set to have a drained backfill stop
+	var backfillStopped chan struct{}
+	var backfillWritten, backfillRead int64 // this search's, in bytes
+
+	// the batches received in a row with the consumer caught up
+	var headroom int64
+
+	backfillSignal := newBackfillSignal()
 	var hits []byte
 	var numHits uint64
 
-	backfill := func() {
+	holdLastHit := r.holdLastHit
+	var facets []byte
+
+	allowPartialResults := r.opts != nil && r.opts.AllowPartialResults
+	searchTimeout := r.opts != nil && r.opts.Timeout > 0
+
+	backfill := func(stopped chan struct{}) {
 		var entries []byte
 		name := tmpfile.Name()
+		backfillStart := time.Now()
 
 		defer func() {
 			if readfd != nil {
@@ -80,10 +445,17 @@ func (r *responseHandler) handleResponse(conn *datastore.IndexConnection,
 
 			waitGroup.Done()
 
-			atomic.AddInt64(&backfillFin, 1)
+			// a backfill stopped for the consumer having caught up isn't
+			// done, the hits that follow being sent directly.
+			if atomic.LoadInt64(&backfillResume) == 0 {
+				atomic.AddInt64(&backfillFin, 1)
+			}
+			close(stopped)
 
-			logging.Infof("response_handler: %v %q finished backfill for %v ",
-				logPrefix, r.requestID, name)
+			logging.Infof("response_handler: %v %q finished backfill for %v,"+
+				" bytes written: %d, read: %d, in: %v", logPrefix, r.requestID,
+				name, atomic.LoadInt64(&backfillWritten),
+				atomic.LoadInt64(&backfillRead), time.Since(backfillStart))
 
 			// TODO: revisit this for better pattern?
 			recover() // need this because entryChannel() would have closed
@@ -91,15 +463,23 @@ func (r *responseHandler) handleResponse(conn *datastore.IndexConnection,
 
 		logging.Infof("response_handler: %v %q started backfill for %v",
 			logPrefix, r.requestID, name)
+		r.trace.stage(traceBackfillStart, "file", name)
+
+		pollInterval := GetBackfillPollInterval()
+		poll := time.NewTimer(pollInterval)
+		defer poll.Stop()
 
 		for {
 			if pending := atomic.LoadInt64(&backfillEntries); pending > 0 {
 				atomic.AddInt64(&backfillEntries, -1)
 			} else if done := atomic.LoadInt64(backfillSync); done == doneRequest {
 				return
+			} else if atomic.LoadInt64(&backfillResume) > 0 {
+				return
 			} else {
-				// wait a bit
-				time.Sleep(1 * time.Millisecond)
+				// wait for more hits to be written, or a while to check
+				// whether the search is done
+				backfillSignal.wait(poll, pollInterval)
 				continue
 			}
 
@@ -119,6 +499,11 @@ func (r *responseHandler) handleResponse(conn *datastore.IndexConnection,
 				return
 			}
 
+			atomic.AddInt64(&backfillRead, int64(len(entries)))
+			atomic.AddInt64(&r.i.indexer.stats.TotalBackfillBytesRead,
+				int64(len(entries)))
+			atomic.AddInt64(&r.i.indexer.stats.TotalBackfillEntriesRead, 1)
+
 			atomic.AddInt64(&r.i.indexer.stats.TotalThrottledFtsDuration,
 				int64(time.Since(ftsDur)))
 
@@ -140,17 +525,37 @@ func (r *responseHandler) handleResponse(conn *datastore.IndexConnection,
 		}
 
 		if err != nil {
-			conn.Error(util.N1QLError(err, "response_handler: stream.Recv, err "))
+			conn.Error(util.GrpcN1QLError(err,
+				grpcErrDesc(err, "response_handler: stream.Recv, err")))
 			return
 		}
 
 		// account the time to first byte response from fts
 		if firstResponseByte == false {
-			atomic.AddInt64(&r.i.indexer.stats.TotalTTFBDuration,
-				int64(time.Since(starttm)))
+			ttfb := time.Since(starttm)
+			atomic.AddInt64(&r.i.indexer.stats.TotalTTFBDuration, int64(ttfb))
+			logSlowQuery(r.i, r.requestID, r.sr, traceFirstByte, ttfb,
+				GetSlowQueryFirstByteThreshold(), r.reqDeadline)
 			firstResponseByte = true
+			r.trace.stage(traceFirstByte)
+		}
+
+		if r.raw != nil {
+			// the search result is assembled, to be visited as a whole.
+			done, err := r.handleRawResult(results, sender)
+			if err != nil {
+				conn.Error(util.N1QLError(err, "response_handler: raw result err"))
+				return
+			}
+			if done {
+				return
+			}
+			continue
 		}
 
+		var took int64
+		var result []byte
+
 		switch r := results.Contents.(type) {
 		case *pb.StreamSearchResults_Hits:
 			hits = r.Hits.Bytes
@@ -167,23 +572,31 @@ func (r *responseHandler) handleResponse(conn *datastore.IndexConnection,
 				return
 			}
 
-			errorsBytes, _, _, _ := jsonparser.Get(searchStatus, "errors")
-			if len(errorsBytes) > 0 {
-				var errs []error
-				jsonparser.ObjectEach(errorsBytes,
-					func(partition []byte, er []byte, datatype jsonparser.ValueType,
-						offset int) error {
-						errs = append(errs,
-							fmt.Errorf("partition: %s, err: %s, ", string(partition), string(er)))
-						return nil
-					})
-				if len(errs) > 0 {
-					conn.Error(util.N1QLError(fmt.Errorf("search err summary: %v", errs),
-						"response_handler: err"))
-
-					// return here, as partial results are NOT supported
+			if err = partialResultsErr(searchStatus); err != nil {
+				// the partitions failing as the timeout (of FTS) elapsed
+				// return partial results, as requested by the timeout.
+				timedOut := searchTimeout && partialResultsTimedOut(searchStatus)
+				if !allowPartialResults && !timedOut {
+					conn.Error(util.N1QLError(err, "response_handler: err"))
+
+					// return here, as partial results aren't allowed
 					return
 				}
+
+				if timedOut {
+					conn.Warning(util.N1QLError(err, "response_handler:"+
+						" partial results, search timed out"))
+				} else {
+					conn.Warning(util.N1QLError(err,
+						"response_handler: partial results"))
+				}
+			}
+
+			took = searchResultTook(r.SearchResult)
+			result = r.SearchResult
+
+			if holdLastHit {
+				facets, _, _, _ = jsonparser.Get(r.SearchResult, "facets")
 			}
 
 			hits, _, _, err = jsonparser.Get(r.SearchResult, "hits")
@@ -195,23 +608,110 @@ func (r *responseHandler) handleResponse(conn *datastore.IndexConnection,
 			numHits = 0
 		}
 
+		if len(facets) > 0 {
+			r.facets = facets
+		}
+
+		if len(result) > 0 && r.opts != nil && r.opts.Trailer {
+			r.trailer = searchResultTrailer(result)
+		}
+
+		if took > 0 {
+			atomic.AddInt64(&r.i.indexer.stats.TotalFTSServerDuration, took)
+		}
+
 		ln := sender.Length()
 		cp := sender.Capacity()
+		maxBuffered := getBackfillBufferedHits()
+		if explainBuffered := GetExplainBufferedHits(); r.sr != nil &&
+			r.sr.Explain && explainBuffered > 0 &&
+			(maxBuffered <= 0 || explainBuffered < maxBuffered) {
+			maxBuffered = explainBuffered
+		}
+
+		maxBufferedBytes := getBackfillBufferedBytes()
+		var bufferedBytes int64
+		if maxBufferedBytes > 0 {
+			bufferedBytes = r.bufferedBytes(ln) + int64(len(hits))
+		}
+
+		overflow := uint64(cp-ln) < numHits ||
+			(maxBuffered > 0 && uint64(ln)+numHits > uint64(maxBuffered)) ||
+			(maxBufferedBytes > 0 && bufferedBytes > maxBufferedBytes)
+
+		// the consumer having caught up with the backfill, it's stopped
+		// (once done sending what it's read) and its file removed, for the
+		// hits that follow to be sent directly, in the order streamed.
+		resumeBatches := GetBackfillResumeBatches()
+		if tmpfile != nil && resumeBatches > 0 {
+			if !overflow && ln <= cp/2 &&
+				atomic.LoadInt64(&backfillEntries) == 0 &&
+				atomic.LoadInt64(&backfillFin) == 0 {
+				headroom++
+			} else {
+				headroom = 0
+			}
 
-		if backfillLimit > 0 && tmpfile == nil &&
-			(uint64(cp-ln) < numHits) {
-			logging.Infof("response_handler: buffer overflow [cap %d len %d],"+
-				" initiating backfill", cp, ln)
-			enc, dec, tmpfile, err = initBackFill(logPrefix, r.requestID, r)
+			if headroom >= resumeBatches {
+				atomic.StoreInt64(&backfillResume, 1)
+				backfillSignal.notify()
+				<-backfillStopped
+
+				if atomic.LoadInt64(&backfillFin) > 0 {
+					r.abandoned = stream
+					return
+				}
+
+				logging.Infof("response_handler: %v %q consumer caught up"+
+					" [cap %d len %d], resuming direct sends, backfill"+
+					" bytes written: %d, read: %d", logPrefix, r.requestID,
+					cp, ln, atomic.LoadInt64(&backfillWritten),
+					atomic.LoadInt64(&backfillRead))
+				r.trace.stage(traceBackfillStop, "file", tmpfile.Name())
+
+				r.cleanupBackfill()
+				r.backfillFile = nil
+				enc, dec, readfd, tmpfile = nil, nil, nil, nil
+				atomic.StoreInt64(&backfillResume, 0)
+				headroom = 0
+				atomic.AddInt64(&r.i.indexer.stats.TotalBackfillResumes, 1)
+			}
+		}
+
+		if backfillLimit > 0 && tmpfile == nil && overflow {
+			logging.Infof("response_handler: buffer overflow [cap %d len %d"+
+				" max buffered %d, bytes %d max buffered bytes %d], initiating"+
+				" backfill", cp, ln, maxBuffered, bufferedBytes, maxBufferedBytes)
+			enc, dec, readfd, tmpfile, err = initBackFill(logPrefix,
+				r.requestID, r)
 			if err != nil {
-				conn.Error(util.N1QLError(err, "initBackFill failed, err:"))
-				return
+				if !GetBackfillFallbackToBlocking() {
+					conn.Error(util.N1QLError(err, "initBackFill failed, err:"))
+					return
+				}
+
+				// carry on with the backfill disabled, the hits sent directly
+				// to the consumer (blocking while it catches up).
+				logging.Warnf("response_handler: %v %q backfill unavailable,"+
+					" falling back to blocking sends, err: %v",
+					logPrefix, r.requestID, err)
+				r.discardBackfill(logPrefix)
+				enc, dec, readfd, tmpfile = nil, nil, nil, nil
+				backfillLimit = 0
+				atomic.AddInt64(&r.i.indexer.stats.TotalBackfillFallbacks, 1)
+			} else {
+				atomic.AddInt64(&r.i.indexer.stats.TotalBackfillActivations, 1)
+				if r.ks != nil {
+					atomic.AddInt64(&r.ks.TotalBackfillActivations, 1)
+				}
+				backfillStopped = make(chan struct{})
+				waitGroup.Add(1)
+				go backfill(backfillStopped)
 			}
-			waitGroup.Add(1)
-			go backfill()
 		}
 
-		// slow reader found and hence start dumping the results to the backfill file
+		// slow reader found and hence start dumping the results to the backfill file,
+		// which the hits that follow go through too, so as to keep to their order
 		if tmpfile != nil {
 			// whether temp-file is exhausted the limit.
 			cummsizeInMB := float64(atomic.LoadInt64(
@@ -224,23 +724,43 @@ func (r *responseHandler) handleResponse(conn *datastore.IndexConnection,
 			}
 
 			if atomic.LoadInt64(&backfillFin) > 0 {
+				r.abandoned = stream
 				return
 			}
 
-			err := writeToBackfill(hits, enc)
+			// the hits scoring below the threshold aren't spilled.
+			if r.minScore != nil {
+				hits, err = filterHitsByScore(hits, *r.minScore)
+				if err != nil {
+					conn.Error(util.N1QLError(err, "response_handler: hits err"))
+					return
+				}
+				if hits == nil {
+					continue // none to spill
+				}
+			}
+
+			err := writeToBackfill(hits, enc, r.i.indexer.stats)
 			if err != nil {
 				conn.Error(util.N1QLError(err, "writeToBackfill err:"))
 				return
 			}
+			if r.ks != nil {
+				atomic.AddInt64(&r.ks.TotalBackfillBytes, int64(len(hits)))
+			}
 
+			atomic.AddInt64(&backfillWritten, int64(len(hits)))
 			atomic.AddInt64(&backfillEntries, 1)
 
+			backfillSignal.notify()
+
 		} else if hits != nil {
 			atomic.AddInt64(&r.i.indexer.stats.TotalThrottledFtsDuration,
 				int64(time.Since(ftsDur)))
 
 			connOk := r.sendEntries(hits, conn)
 			if !connOk {
+				r.abandoned = stream
 				return
 			}
 
@@ -250,6 +770,202 @@ func (r *responseHandler) handleResponse(conn *datastore.IndexConnection,
 	}
 }
 
+// partialResultsErr returns an error summarizing the partitions that
+// failed, as reported within the status of the search result, if any.
+func partialResultsErr(searchStatus []byte) error {
+	failed, _ := jsonparser.GetInt(searchStatus, "failed")
+
+	var errs []error
+	errorsBytes, _, _, _ := jsonparser.Get(searchStatus, "errors")
+	if len(errorsBytes) > 0 {
+		jsonparser.ObjectEach(errorsBytes,
+			func(partition []byte, er []byte, datatype jsonparser.ValueType,
+				offset int) error {
+				errs = append(errs,
+					fmt.Errorf("partition: %s, err: %s, ", string(partition), string(er)))
+				return nil
+			})
+	}
+
+	if failed <= 0 && len(errs) == 0 {
+		return nil
+	}
+
+	if failed <= 0 {
+		failed = int64(len(errs))
+	}
+
+	total, _ := jsonparser.GetInt(searchStatus, "total")
+
+	return fmt.Errorf("search failed on %d of %d partitions,"+
+		" search err summary: %v", failed, total, errs)
+}
+
+// partialResultsTimedOut returns true if the partitions that failed (as
+// reported within the status of the search result) all did so as the
+// timeout of FTS elapsed, i.e. with a deadline exceeded (or timeout) err.
+func partialResultsTimedOut(searchStatus []byte) bool {
+	var failures, timeouts int
+	errorsBytes, _, _, _ := jsonparser.Get(searchStatus, "errors")
+	if len(errorsBytes) > 0 {
+		jsonparser.ObjectEach(errorsBytes,
+			func(partition []byte, er []byte, datatype jsonparser.ValueType,
+				offset int) error {
+				failures++
+				if bytes.Contains(er, []byte(context.DeadlineExceeded.Error())) ||
+					bytes.Contains(er, []byte("timeout")) {
+					timeouts++
+				}
+				return nil
+			})
+	}
+
+	return failures > 0 && failures == timeouts
+}
+
+// searchResultTook returns the time (in nanoseconds) taken by FTS to
+// process the search, as reported within the search result, if any.
+func searchResultTook(searchResult []byte) int64 {
+	took, err := jsonparser.GetInt(searchResult, "took")
+	if err != nil || took < 0 {
+		return 0
+	}
+
+	return took
+}
+
+// searchResultTrailer returns the trailer of the search result, carrying
+// its total hits and max score, as reported by flushTrailer(..).
+func searchResultTrailer(searchResult []byte) *Trailer {
+	totalHits, _ := jsonparser.GetInt(searchResult, "total_hits")
+	maxScore, _ := jsonparser.GetFloat(searchResult, "max_score")
+
+	return &Trailer{
+		TotalHits: uint64(totalHits),
+		MaxScore:  maxScore,
+	}
+}
+
+// handleRawResult accumulates the streamed hits towards the raw search
+// result, handing it over to the raw result visitor (if any), else sending
+// it as a single index entry, once the final search result arrives;
+// returns true once done.
+func (r *responseHandler) handleRawResult(results *pb.StreamSearchResults,
+	sender entrySender) (bool, error) {
+	switch rs := results.Contents.(type) {
+	case *pb.StreamSearchResults_Hits:
+		return false, r.raw.add(rs.Hits.Bytes)
+
+	case *pb.StreamSearchResults_SearchResult:
+		if rs.SearchResult == nil {
+			return false, nil
+		}
+
+		if took := searchResultTook(rs.SearchResult); took > 0 {
+			atomic.AddInt64(&r.i.indexer.stats.TotalFTSServerDuration, took)
+		}
+
+		visitor := r.rawVisitor
+		var entry *rawResultEntry
+		if visitor == nil {
+			// that of a N1QL search, sent over as an index entry.
+			entry = &rawResultEntry{}
+			visitor = entry
+		}
+
+		// partial results are reported within the status of the search
+		// result handed over, rather than failing the request.
+		if err := r.raw.visit(rs.SearchResult, visitor); err != nil {
+			return true, err
+		}
+
+		if entry != nil {
+			ie, err := entry.indexEntry()
+			if err != nil {
+				return true, err
+			}
+			if !r.send(sender, ie) {
+				return true, nil
+			}
+		}
+
+		atomic.AddInt64(&r.i.indexer.stats.TotalResultsReturned, 1)
+		if r.ks != nil {
+			atomic.AddInt64(&r.ks.TotalResultsReturned, 1)
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// backfillSignal wakes up a backfill waiting on hits to be written.
+type backfillSignal chan struct{}
+
+func newBackfillSignal() backfillSignal {
+	return make(backfillSignal, 1)
+}
+
+// notify wakes up the backfill if waiting, or else has its next wait
+// return right away.
+func (s backfillSignal) notify() {
+	select {
+	case s <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until notified (returning true), or the timer (reset to d)
+// fires.
+func (s backfillSignal) wait(timer *time.Timer, d time.Duration) bool {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+
+	select {
+	case <-s:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// drainAbandoned drains the abandoned stream (if any) in the background,
+// to be called once the search's context is cancelled (so its Recv's
+// aren't left blocked) and its slot and sender released.
+func (r *responseHandler) drainAbandoned() {
+	stream := r.abandoned
+	if stream == nil || GetStreamDrainMaxMessages() <= 0 {
+		return
+	}
+	r.abandoned = nil
+
+	go r.drainStream(stream)
+}
+
+// drainStream reads off (and discards) what remains of the stream, for
+// up to streamDrainMaxMessages messages or streamDrainTimeout, whichever
+// comes first.
+func (r *responseHandler) drainStream(stream pb.SearchService_SearchClient) {
+	maxMessages, deadline := int(GetStreamDrainMaxMessages()),
+		time.Now().Add(GetStreamDrainTimeout())
+
+	var n int
+	for n < maxMessages && time.Now().Before(deadline) {
+		if _, err := stream.Recv(); err != nil {
+			break
+		}
+		n++
+	}
+
+	logging.Debugf("response_handler: %q drained %d messages",
+		r.requestID, n)
+}
+
 func (r *responseHandler) cleanupBackfill() {
 	if r.backfillFile != nil {
 		r.backfillFile.Close()
@@ -260,10 +976,37 @@ func (r *responseHandler) cleanupBackfill() {
 				fmt.Errorf(fmsg, fname, err))
 		}
 		atomic.AddInt64(&r.i.indexer.stats.TotalBackFills, 1)
+		if r.ks != nil {
+			atomic.AddInt64(&r.ks.TotalBackFills, 1)
+		}
 	}
 }
 
-func (r *responseHandler) sendEntries(hits []byte, conn *datastore.IndexConnection) bool {
+// discardBackfill removes the backfill file of a backfill that couldn't
+// be set up, if it got as far as creating one.
+func (r *responseHandler) discardBackfill(logPrefix string) {
+	if r.backfillFile == nil {
+		return
+	}
+
+	r.backfillFile.Close()
+	if err := os.Remove(r.backfillFile.Name()); err != nil {
+		logging.Errorf("response_handler: %v remove backfill file %v,"+
+			" err: %v", logPrefix, r.backfillFile.Name(), err)
+	}
+	r.backfillFile = nil
+}
+
+func (r *responseHandler) cleanupDistinct() {
+	r.distinct.cleanup()
+	r.collapse.cleanup()
+}
+
+func (r *responseHandler) cleanupRawResult() {
+	r.raw.cleanup()
+}
+
+func (r *responseHandler) sendEntries(hits []byte, conn searchConn) bool {
 	if len(hits) == 0 {
 		return true // so next set of hits can be processed
 	}
@@ -272,6 +1015,7 @@ func (r *responseHandler) sendEntries(hits []byte, conn *datastore.IndexConnecti
 	sender := conn.Sender()
 
 	var sendEntriesFailed bool
+	var sent, sentBytes int64
 	_, err := jsonparser.ArrayEach(hits,
 		func(hit []byte, dataType jsonparser.ValueType, offset int, err error) {
 			if sendEntriesFailed {
@@ -286,51 +1030,503 @@ func (r *responseHandler) sendEntries(hits []byte, conn *datastore.IndexConnecti
 			}
 
 			var hitMap map[string]interface{}
-			err = json.Unmarshal(hit, &hitMap)
-			if err != nil {
-				sendEntriesFailed = true
-				return
+			var id string
+			if r.keysOnly {
+				// only the key's sent, so the hit isn't decoded as a whole.
+				if id, err = jsonparser.GetString(hit, "id"); err != nil {
+					sendEntriesFailed = !r.dropHits(conn, err)
+					return
+				}
+			} else {
+				var keep bool
+				if hitMap, keep, err = r.hitMetadata(hit); err != nil {
+					sendEntriesFailed = !r.dropHits(conn, err)
+					return
+				}
+				if !keep {
+					return
+				}
+				var ok bool
+				if id, ok = hitMap["id"].(string); !ok {
+					sendEntriesFailed = !r.dropHits(conn,
+						fmt.Errorf("hit without an id"))
+					return
+				}
 			}
 
-			delete(hitMap, "index")
-			delete(hitMap, "sort")
+			if r.distinct != nil {
+				dup, err := r.distinct.seen(id)
+				if err != nil {
+					conn.Error(util.N1QLError(err, "response_handler: distinct err"))
+					sendEntriesFailed = true
+					return
+				}
 
-			if r.sr.Score == "none" {
-				delete(hitMap, "score")
+				if dup {
+					// skip the duplicate hit
+					return
+				}
 			}
 
-			id := hitMap["id"].(string)
+			if r.collapse != nil {
+				if group, ok := hitGroup(hit, r.opts.Collapse.Field); ok {
+					dup, err := r.collapse.seen(group)
+					if err != nil {
+						conn.Error(util.N1QLError(err, "response_handler: collapse err"))
+						sendEntriesFailed = true
+						return
+					}
+
+					if dup {
+						// skip the hit of a group already sent
+						return
+					}
+				}
+			}
 
-			if !sender.SendEntry(&datastore.IndexEntry{
-				PrimaryKey: id,
-				MetaData:   value.NewValue(hitMap),
-			}) {
+			var ok bool
+			if r.keysOnly {
+				ok = r.send(sender, &datastore.IndexEntry{PrimaryKey: id})
+			} else {
+				ok = r.sendEntry(sender, hitMap)
+			}
+			if !ok {
+				if r.sendErr != nil {
+					conn.Error(util.N1QLError(r.sendErr, "response_handler: send err"))
+				}
 				sendEntriesFailed = true
 				return
 			}
+			sent++
+			sentBytes += int64(len(hit))
 
 			if blocked {
 				blockedtm += int64(time.Since(start))
 				atomic.AddInt64(&r.i.indexer.stats.TotalThrottledN1QLDuration, blockedtm)
 			}
 		})
-	if err != nil || sendEntriesFailed {
+
+	atomic.AddInt64(&r.i.indexer.stats.TotalResultsReturned, sent)
+	if r.ks != nil {
+		atomic.AddInt64(&r.ks.TotalResultsReturned, sent)
+	}
+	atomic.AddInt64(&r.sent, sent)
+	atomic.AddInt64(&r.sentBytes, sentBytes)
+
+	if sendEntriesFailed {
+		return false
+	}
+
+	// the hits of a batch that's malformed, past those sent, are dropped.
+	if err != nil && !r.dropHits(conn, err) {
 		return false
 	}
 
 	return true
 }
 
+// dropHits handles the hits (streamed by FTS) that couldn't be decoded,
+// failing the search with strictHitDecoding, else returning true for the
+// hits to be dropped, logged, counted and warned of (once per search),
+// with the search carrying on.
+func (r *responseHandler) dropHits(conn searchConn, err error) bool {
+	if GetStrictHitDecoding() {
+		conn.Error(util.N1QLError(err, "response_handler: hits decode err"))
+		return false
+	}
+
+	logging.Warnf("response_handler: %q hits dropped, decode err: %v",
+		r.requestID, err)
+
+	if r.i != nil && r.i.indexer != nil {
+		atomic.AddInt64(&r.i.indexer.stats.TotalHitsDropped, 1)
+	}
+
+	if atomic.CompareAndSwapInt32(&r.droppedWarned, 0, 1) {
+		conn.Warning(util.N1QLError(err, "response_handler: hits dropped,"+
+			" couldn't be decoded"))
+	}
+
+	return true
+}
+
+// hitMetadata decodes the hit into the metadata of its index entry, as
+// requested, returning false for a hit that's to be skipped.
+func (r *responseHandler) hitMetadata(hit []byte) (
+	map[string]interface{}, bool, error) {
+	var hitMap map[string]interface{}
+	if err := json.Unmarshal(hit, &hitMap); err != nil {
+		return nil, false, err
+	}
+
+	if r.minScore != nil {
+		if score, _ := hitMap["score"].(float64); score < *r.minScore {
+			return nil, false, nil // skip the hit scoring below the threshold
+		}
+	}
+
+	// the CAS (if available) is forwarded exactly, rather than as
+	// the float decoded.
+	if cas, ok := hitCAS(hit); ok {
+		hitMap["cas"] = cas
+	}
+
+	if pindex, ok := hitMap["index"].(string); ok && pindex != "" &&
+		r.includePindex {
+		hitMap["pindex"] = pindex
+	}
+	delete(hitMap, "index")
+	if sortVals, ok := hitMap["sort"]; ok && r.cursors {
+		hitMap["cursor"] = sortVals
+	}
+	if !r.keepSortValues {
+		delete(hitMap, "sort")
+	} else if sortVals, ok := hitMap["sort"].([]interface{}); ok &&
+		r.trimSortValues > 0 && len(sortVals) >= r.trimSortValues {
+		hitMap["sort"] = sortVals[:len(sortVals)-r.trimSortValues]
+	}
+
+	if r.sr.Score == "none" {
+		delete(hitMap, "score")
+	}
+
+	// the term locations (if requested) are carried as reported.
+	if !r.sr.IncludeLocations {
+		delete(hitMap, "locations")
+	}
+
+	// as are the breakdowns of the scores.
+	if !r.sr.Explain {
+		delete(hitMap, "explanation")
+	}
+
+	r.trimFields(hitMap)
+
+	return hitMap, true, nil
+}
+
+// bufferedBytes estimates the bytes of the n hits buffered (sent, but yet
+// to be read by the consumer), at the average size of the hits sent.
+func (r *responseHandler) bufferedBytes(n int) int64 {
+	sent := atomic.LoadInt64(&r.sent)
+	if sent <= 0 || n <= 0 {
+		return 0
+	}
+
+	return atomic.LoadInt64(&r.sentBytes) / sent * int64(n)
+}
+
+// requestedFields returns the set of the stored fields requested, nil if
+// any of the fields are (with "*").
+func requestedFields(fields []string) map[string]bool {
+	rv := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		if field == "*" {
+			return nil
+		}
+		rv[field] = true
+	}
+
+	return rv
+}
+
+// trimFields drops the stored fields of the hit that weren't requested
+// (which FTS may still return) or were excluded, and caps the bytes of
+// the values of those kept at maxFieldBytes, visiting the fields by name;
+// a string value past the cap is truncated, any other is dropped, with
+// the names of the fields affected listed under "truncated_fields".
+func (r *responseHandler) trimFields(hitMap map[string]interface{}) {
+	fields, ok := hitMap["fields"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	for name := range fields {
+		if (r.fields != nil && !r.fields[name]) || r.excludeFields[name] {
+			delete(fields, name)
+		}
+	}
+
+	if r.maxFieldBytes > 0 {
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var truncated []interface{}
+		remaining := r.maxFieldBytes
+		for _, name := range names {
+			size := fieldValueSize(fields[name])
+			if size <= remaining {
+				remaining -= size
+				continue
+			}
+
+			if str, ok := fields[name].(string); ok && remaining > 0 {
+				fields[name] = truncateString(str, int(remaining))
+			} else {
+				delete(fields, name)
+			}
+			remaining = 0
+			truncated = append(truncated, name)
+		}
+
+		if len(truncated) > 0 {
+			hitMap["truncated_fields"] = truncated
+		}
+	}
+
+	if len(fields) == 0 {
+		delete(hitMap, "fields")
+	}
+}
+
+// fieldValueSize returns the bytes of a stored field's value, the length
+// of a string, else that of its JSON encoding.
+func fieldValueSize(v interface{}) int64 {
+	if str, ok := v.(string); ok {
+		return int64(len(str))
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+
+	return int64(len(b))
+}
+
+// truncateString truncates the string to at most n bytes, without
+// splitting a multi-byte character.
+func truncateString(str string, n int) string {
+	if len(str) <= n {
+		return str
+	}
+
+	for n > 0 && !utf8.RuneStart(str[n]) {
+		n--
+	}
+
+	return str[:n]
+}
+
+// casFields returns the stored fields to be requested along with the
+// hits for their CAS, if any.
+func casFields() []string {
+	field := GetCASStoredField()
+	if field == "" {
+		return nil
+	}
+
+	return []string{field}
+}
+
+// hitGroup returns the group of the hit, as the stored value of the field
+// it's collapsed by (tagged with its JSON type, for the number 1 and the
+// string "1" to differ), false if the hit lacks a value.
+func hitGroup(hit []byte, field string) (string, bool) {
+	v, dataType, _, err := jsonparser.Get(hit, "fields", field)
+	if err != nil || dataType == jsonparser.Null {
+		return "", false
+	}
+
+	return strconv.Itoa(int(dataType)) + ":" + string(v), true
+}
+
+// hitCAS returns the CAS of the hit's document, as reported by FTS or
+// else carried by the casStoredField, if either's available.
+func hitCAS(hit []byte) (uint64, bool) {
+	paths := [][]string{{"cas"}}
+	if field := GetCASStoredField(); field != "" {
+		paths = append(paths, []string{"fields", field})
+	}
+
+	for _, path := range paths {
+		v, dataType, _, err := jsonparser.Get(hit, path...)
+		if err != nil ||
+			(dataType != jsonparser.Number && dataType != jsonparser.String) {
+			continue
+		}
+
+		if cas, err := strconv.ParseUint(string(v), 10, 64); err == nil &&
+			cas > 0 {
+			return cas, true
+		}
+	}
+
+	return 0, false
+}
+
+// sendEntry sends the hit as an index entry, or holds it back (sending
+// the one held back earlier instead) when facets are awaited.
+func (r *responseHandler) sendEntry(sender entrySender,
+	hitMap map[string]interface{}) bool {
+	if r.holdLastHit {
+		hitMap, r.lastHit = r.lastHit, hitMap
+		if hitMap == nil {
+			return true
+		}
+	}
+
+	return r.send(sender, &datastore.IndexEntry{
+		PrimaryKey: hitMap["id"].(string),
+		MetaData:   value.NewValue(hitMap),
+	})
+}
+
+// send sends the entry, and when the consumer's buffer is full, waits for
+// it up to entrySendTimeout (or the request's deadline), past which the
+// entry is dropped with the sendErr set.
+func (r *responseHandler) send(sender entrySender,
+	entry *datastore.IndexEntry) bool {
+	if r.sendErr != nil {
+		return false // the consumer's wedged already
+	}
+
+	deadline := r.reqDeadline
+	if timeout := GetEntrySendTimeout(); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	bs, ok := sender.(bufferedSender)
+	if deadline.IsZero() || !ok || bs.Length() < bs.Capacity() {
+		return sender.SendEntry(entry)
+	}
+
+	// the send is handed off, so a consumer that's wedged (neither reading
+	// nor stopping) doesn't hold up the search beyond the deadline.
+	h := r.handoff
+	if h == nil {
+		h = newSendHandoff()
+		r.handoff = h
+	}
+
+	if !h.timer.Stop() {
+		select {
+		case <-h.timer.C:
+		default:
+		}
+	}
+	h.timer.Reset(time.Until(deadline))
+
+	select {
+	case h.sends <- pendingSend{sender: sender, entry: entry}:
+	case <-h.timer.C:
+		return r.sendTimedOut()
+	}
+
+	select {
+	case ok = <-h.sent:
+		return ok
+	case <-h.timer.C:
+		return r.sendTimedOut()
+	}
+}
+
+func (r *responseHandler) sendTimedOut() bool {
+	if r.i != nil && r.i.indexer != nil {
+		atomic.AddInt64(&r.i.indexer.stats.TotalEntrySendTimeouts, 1)
+	}
+	r.sendErr = errEntrySendTimeout
+	return false
+}
+
+// stopSends stops the goroutine the sends are handed off to, if any; one
+// still blocked on a wedged consumer is released once that's closed.
+func (r *responseHandler) stopSends() {
+	if r.handoff != nil {
+		r.handoff.timer.Stop()
+		close(r.handoff.sends)
+		r.handoff = nil
+	}
+}
+
+type pendingSend struct {
+	sender entrySender
+	entry  *datastore.IndexEntry
+}
+
+// sendHandoff is the goroutine (one per search) the sends to a consumer
+// whose buffer is full are handed off to, along with the timer bounding
+// the wait on each.
+type sendHandoff struct {
+	sends chan pendingSend
+	sent  chan bool
+	timer *time.Timer
+}
+
+func newSendHandoff() *sendHandoff {
+	h := &sendHandoff{
+		sends: make(chan pendingSend),
+		sent:  make(chan bool, 1),
+		timer: time.NewTimer(time.Hour),
+	}
+	h.timer.Stop()
+
+	go func() {
+		for s := range h.sends {
+			h.sent <- s.sender.SendEntry(s.entry)
+		}
+	}()
+
+	return h
+}
+
+// flushLastHit sends the hit held back, carrying the facet results (if
+// any) within its metadata under "facets"; to be invoked once all the
+// hits have been processed.
+func (r *responseHandler) flushLastHit(sender entrySender) {
+	if r.lastHit == nil {
+		return
+	}
+
+	hitMap := r.lastHit
+	r.lastHit = nil
+
+	if len(r.facets) > 0 {
+		var facets map[string]interface{}
+		if err := json.Unmarshal(r.facets, &facets); err != nil {
+			logging.Warnf("response_handler: %q unmarshal facets, err: %v",
+				r.requestID, err)
+		} else {
+			hitMap["facets"] = facets
+		}
+	}
+
+	r.send(sender, &datastore.IndexEntry{
+		PrimaryKey: hitMap["id"].(string),
+		MetaData:   value.NewValue(hitMap),
+	})
+}
+
+// flushTrailer hands the trailer of the search (if requested, and the
+// search's final result has arrived) over to the connection, should it
+// take one in; to be invoked once all the hits have been sent, after
+// flushLastHit(..).
+func (r *responseHandler) flushTrailer(conn searchConn) {
+	if r.trailer == nil {
+		return
+	}
+
+	trailer := r.trailer
+	r.trailer = nil
+
+	if tc, ok := conn.(trailerConn); ok {
+		tc.setTrailer(trailer)
+	}
+}
+
 // TODO: need to cleanup any orphaned backfill subdirs from last time
 // if there was a process crash and restart?
 func initBackFill(logPrefix, requestID string, rh *responseHandler) (*gob.Encoder,
-	*gob.Decoder, *os.File, error) {
+	*gob.Decoder, *os.File, *os.File, error) {
 	prefix := backfillPrefix + strconv.Itoa(os.Getpid())
 
-	tmpfile, err := ioutil.TempFile(getBackfillSpaceDir(), prefix)
+	tmpfile, err := ioutil.TempFile(rh.spillDir, prefix)
 	if err != nil {
 		fmsg := "%v %s creating backfill file, err: %v\n"
-		return nil, nil, nil, fmt.Errorf(fmsg, logPrefix, requestID, err)
+		return nil, nil, nil, nil, fmt.Errorf(fmsg, logPrefix, requestID, err)
 	}
 
 	name := ""
@@ -344,11 +1540,61 @@ func initBackFill(logPrefix, requestID string, rh *responseHandler) (*gob.Encode
 	readfd, err := os.OpenFile(name, os.O_RDONLY, 0666)
 	if err != nil {
 		fmsg := "%v %v reading backfill file %v, err: %v\n"
-		return nil, nil, tmpfile, fmt.Errorf(fmsg, logPrefix, requestID, name, err)
+		return nil, nil, nil, tmpfile, fmt.Errorf(fmsg, logPrefix, requestID,
+			name, err)
 	}
 
 	// decoder
-	return enc, gob.NewDecoder(readfd), tmpfile, nil
+	return enc, gob.NewDecoder(readfd), readfd, tmpfile, nil
+}
+
+// backfillSpaceDir returns the configured backfill directory, or its
+// subdirectory requested within the search options, if any; the latter's
+// resolved (following any symlinks), failing if it then lies outside of
+// the configured directory. A subdirectory that doesn't exist is returned
+// as is, for the backfill to fail being set up within it.
+func (r *responseHandler) backfillSpaceDir() (string, error) {
+	baseDir := getBackfillSpaceDir()
+	if r.opts == nil || r.opts.BackfillDir == "" {
+		return baseDir, nil
+	}
+
+	dir := filepath.Join(baseDir, r.opts.BackfillDir)
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return dir, nil
+	}
+
+	resolvedBase, err := filepath.EvalSymlinks(baseDir)
+	if err != nil {
+		return "", fmt.Errorf("backfill_dir option: %q, err: %v",
+			r.opts.BackfillDir, err)
+	}
+
+	rel, err := filepath.Rel(resolvedBase, resolved)
+	if err != nil || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("backfill_dir option: %q, resolved to: %s,"+
+			" must be a subdirectory of the configured backfill directory",
+			r.opts.BackfillDir, resolved)
+	}
+
+	return resolved, nil
+}
+
+// backfillSpaceLimit returns the backfill limit (in MB) requested within
+// the search options, if any, or the configured one otherwise; 0 with the
+// backfill disabled (see SearchOptions.NoBackfill).
+func (r *responseHandler) backfillSpaceLimit() int64 {
+	if r.opts != nil && r.opts.NoBackfill {
+		return 0
+	}
+
+	if r.opts != nil && r.opts.BackfillLimitMB != nil {
+		return *r.opts.BackfillLimitMB
+	}
+
+	return getBackfillSpaceLimit()
 }
 
 // -----------------------------------------------------------------------------
@@ -379,11 +1625,47 @@ func getBackfillSpaceLimit() int64 {
 	return defaultBackfillLimit
 }
 
-func writeToBackfill(hits []byte, enc *gob.Encoder) error {
+// filterHitsByScore returns the JSON array of the hits (as is) scoring at
+// least minScore, nil if none do.
+func filterHitsByScore(hits []byte, minScore float64) ([]byte, error) {
+	if hits == nil {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	_, err := jsonparser.ArrayEach(hits, func(hit []byte,
+		dataType jsonparser.ValueType, offset int, err error) {
+		if score, _ := jsonparser.GetFloat(hit, "score"); score < minScore {
+			return
+		}
+
+		if buf.Len() == 0 {
+			buf.WriteByte('[')
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.Write(hit)
+	})
+	if err != nil || buf.Len() == 0 {
+		return nil, err
+	}
+
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+// writeToBackfill encodes the hits to the backfill, accounting them within
+// the stats (if any).
+func writeToBackfill(hits []byte, enc *gob.Encoder, st *stats) error {
 	if hits != nil {
 		if err := enc.Encode(hits); err != nil {
 			return err
 		}
+
+		if st != nil {
+			atomic.AddInt64(&st.TotalBackfillBytes, int64(len(hits)))
+			atomic.AddInt64(&st.TotalBackfillEntriesWritten, 1)
+		}
 	}
 	return nil
 }
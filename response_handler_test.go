@@ -0,0 +1,2028 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search"
+	"github.com/couchbase/cbft"
+	pb "github.com/couchbase/cbft/protobuf"
+	"github.com/couchbase/n1fty/util"
+	"github.com/couchbase/query/datastore"
+	"github.com/couchbase/query/errors"
+	"github.com/couchbase/query/value"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type testSender struct {
+	entries []*datastore.IndexEntry
+}
+
+func (s *testSender) SendEntry(entry *datastore.IndexEntry) bool {
+	s.entries = append(s.entries, entry)
+	return true
+}
+
+func TestResponseHandlerFacets(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sr *cbft.SearchRequest
+	err = json.Unmarshal([]byte(`{"query":{"match_all":{}},`+
+		`"facets":{"types":{"field":"type","size":5}}}`), &sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rh := newResponseHandler(index, "req", sr, nil)
+	sender := &testSender{}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if !rh.sendEntry(sender, map[string]interface{}{"id": id}) {
+			t.Fatalf("Expected hit: %v to be sent", id)
+		}
+	}
+
+	// the last hit is held back, until the facets arrive
+	if len(sender.entries) != 2 {
+		t.Fatalf("Expected 2 entries to be sent, got: %v", len(sender.entries))
+	}
+
+	rh.facets = []byte(`{"types":{"field":"type","total":3,"missing":0,` +
+		`"other":0,"terms":[{"term":"hotel","count":3}]}}`)
+	rh.flushLastHit(sender)
+
+	if len(sender.entries) != 3 || sender.entries[2].PrimaryKey != "c" {
+		t.Fatalf("Expected the last hit to be sent, got: %v", sender.entries)
+	}
+
+	facets, ok := sender.entries[2].MetaData.Field("facets")
+	if !ok {
+		t.Fatalf("Expected facets within the last hit's metadata")
+	}
+
+	total, ok := facets.Field("types")
+	if !ok {
+		t.Fatalf("Unexpected facets: %v", facets)
+	}
+
+	if v, _ := total.Field("total"); v.String() != "3" {
+		t.Fatalf("Unexpected facet result: %v", total)
+	}
+
+	for _, entry := range sender.entries[:2] {
+		if _, ok := entry.MetaData.Field("facets"); ok {
+			t.Fatalf("Unexpected facets within entry: %v", entry.PrimaryKey)
+		}
+	}
+}
+
+func TestResponseHandlerWithoutFacets(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rh := newResponseHandler(index, "req", &cbft.SearchRequest{}, nil)
+	sender := &testSender{}
+
+	for _, id := range []string{"a", "b"} {
+		rh.sendEntry(sender, map[string]interface{}{"id": id})
+	}
+	rh.flushLastHit(sender)
+
+	if len(sender.entries) != 2 {
+		t.Fatalf("Expected 2 entries to be sent, got: %v", len(sender.entries))
+	}
+}
+
+func TestResponseHandlerDrainStream(t *testing.T) {
+	defer SetStreamDrainMaxMessages(GetStreamDrainMaxMessages())
+	defer SetStreamDrainTimeout(GetStreamDrainTimeout())
+
+	SetStreamDrainMaxMessages(4)
+	SetStreamDrainTimeout(50 * time.Millisecond)
+
+	rh := &responseHandler{requestID: "req"}
+
+	// drained until the end of the stream
+	stream := &fakeStream{msgs: make([]*pb.StreamSearchResults, 2)}
+	rh.drainStream(stream)
+	if stream.received != 2 {
+		t.Fatalf("Expected the stream to be drained, got: %+v", stream)
+	}
+
+	// drained up to the bound on messages
+	stream = &fakeStream{msgs: make([]*pb.StreamSearchResults, 10)}
+	rh.drainStream(stream)
+	if stream.received != 4 {
+		t.Fatalf("Expected 4 messages to be drained, got: %d", stream.received)
+	}
+
+	// drained up to the timeout, when the stream's slow
+	stream = &fakeStream{msgs: make([]*pb.StreamSearchResults, 10),
+		delay: 30 * time.Millisecond}
+	rh.drainStream(stream)
+	if stream.received == 0 || stream.received >= 4 {
+		t.Fatalf("Expected draining to time out, got: %d messages",
+			stream.received)
+	}
+
+	// the abandoned stream's drained in the background
+	stream = &fakeStream{msgs: make([]*pb.StreamSearchResults, 2)}
+	rh.abandoned = stream
+	rh.drainAbandoned()
+	if rh.abandoned != nil {
+		t.Fatalf("Expected the abandoned stream to be handed off")
+	}
+	for start := time.Now(); atomic.LoadInt32(&stream.received) != 2; {
+		if time.Since(start) > time.Second {
+			t.Fatalf("Expected the abandoned stream to be drained, got: %d",
+				atomic.LoadInt32(&stream.received))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// draining disabled
+	SetStreamDrainMaxMessages(0)
+	stream = &fakeStream{msgs: make([]*pb.StreamSearchResults, 2)}
+	rh.abandoned = stream
+	rh.drainAbandoned()
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&stream.received) != 0 {
+		t.Fatalf("Expected the stream to be left alone, got: %+v", stream)
+	}
+}
+
+func TestPartialResultsErr(t *testing.T) {
+	tests := []struct {
+		status string
+		expect string
+	}{
+		{
+			status: `{"total":6,"failed":0,"successful":6}`,
+		},
+		{
+			status: `{"total":6,"failed":2,"successful":4,` +
+				`"errors":{"pindex_1":"timeout","pindex_2":"timeout"}}`,
+			expect: "search failed on 2 of 6 partitions",
+		},
+		{
+			// failures reported without the errors
+			status: `{"total":6,"failed":1,"successful":5}`,
+			expect: "search failed on 1 of 6 partitions",
+		},
+		{
+			// errors reported without the count
+			status: `{"total":6,"errors":{"pindex_1":"timeout"}}`,
+			expect: "search failed on 1 of 6 partitions",
+		},
+	}
+
+	for testi, test := range tests {
+		err := partialResultsErr([]byte(test.status))
+		if test.expect == "" {
+			if err != nil {
+				t.Fatalf("[%d] Unexpected err: %v", testi, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), test.expect) {
+			t.Fatalf("[%d] Expected err: %q, got: %v", testi, test.expect, err)
+		}
+	}
+}
+
+func TestPartialResultsTimedOut(t *testing.T) {
+	tests := []struct {
+		status   string
+		timedOut bool
+	}{
+		{
+			status: `{"total":6,"failed":0,"successful":6}`,
+		},
+		{
+			status: `{"total":6,"failed":2,"successful":4,` +
+				`"errors":{"pindex_1":"context deadline exceeded",` +
+				`"pindex_2":"timeout"}}`,
+			timedOut: true,
+		},
+		{
+			// a partition failed otherwise
+			status: `{"total":6,"failed":2,"successful":4,` +
+				`"errors":{"pindex_1":"context deadline exceeded",` +
+				`"pindex_2":"index closed"}}`,
+		},
+		{
+			// failures reported without the errors
+			status: `{"total":6,"failed":1,"successful":5}`,
+		},
+	}
+
+	for testi, test := range tests {
+		if timedOut := partialResultsTimedOut(
+			[]byte(test.status)); timedOut != test.timedOut {
+			t.Fatalf("[%d] Expected timed out: %t, got: %t", testi,
+				test.timedOut, timedOut)
+		}
+	}
+}
+
+// blockedSender is a consumer with a full buffer, that doesn't read
+// until released.
+type blockedSender struct {
+	release chan struct{}
+}
+
+func (s *blockedSender) SendEntry(entry *datastore.IndexEntry) bool {
+	<-s.release
+	return false
+}
+
+func (s *blockedSender) Capacity() int { return 1 }
+func (s *blockedSender) Length() int   { return 1 }
+
+func TestResponseHandlerSendTimeout(t *testing.T) {
+	defer SetEntrySendTimeout(GetEntrySendTimeout())
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	sender := &blockedSender{release: make(chan struct{})}
+	defer close(sender.release)
+
+	// bounded by the request's deadline
+	SetEntrySendTimeout(0)
+	rh := newResponseHandler(index, "req", &cbft.SearchRequest{}, nil)
+	rh.reqDeadline = time.Now().Add(20 * time.Millisecond)
+	if rh.sendEntry(sender, map[string]interface{}{"id": "a"}) ||
+		rh.sendErr != errEntrySendTimeout {
+		t.Fatalf("Expected the send to time out, err: %v", rh.sendErr)
+	}
+
+	// bounded by the configured timeout, past the request's deadline
+	SetEntrySendTimeout(20 * time.Millisecond)
+	rh = newResponseHandler(index, "req", &cbft.SearchRequest{}, nil)
+	rh.reqDeadline = time.Now().Add(time.Hour)
+	starttm := time.Now()
+	if rh.sendEntry(sender, map[string]interface{}{"id": "b"}) ||
+		rh.sendErr != errEntrySendTimeout {
+		t.Fatalf("Expected the send to time out, err: %v", rh.sendErr)
+	}
+	if time.Since(starttm) > time.Second {
+		t.Fatalf("Expected the send to time out early, took: %v",
+			time.Since(starttm))
+	}
+
+	if n := index.indexer.stats.TotalEntrySendTimeouts; n != 2 {
+		t.Fatalf("Expected 2 send timeouts, got: %v", n)
+	}
+
+	// a consumer with room isn't waited on
+	rh = newResponseHandler(index, "req", &cbft.SearchRequest{}, nil)
+	ts := &testSender{}
+	if !rh.sendEntry(ts, map[string]interface{}{"id": "c"}) ||
+		len(ts.entries) != 1 {
+		t.Fatalf("Expected the entry to be sent")
+	}
+}
+
+// slowSender is a consumer with a full buffer, reading (and dropping) an
+// entry every so often.
+type slowSender struct {
+	delay time.Duration
+	sent  int
+}
+
+func (s *slowSender) SendEntry(entry *datastore.IndexEntry) bool {
+	time.Sleep(s.delay)
+	s.sent++
+	return true
+}
+
+func (s *slowSender) Capacity() int { return 1 }
+func (s *slowSender) Length() int   { return 1 }
+
+func TestResponseHandlerSendHandoff(t *testing.T) {
+	defer SetEntrySendTimeout(GetEntrySendTimeout())
+	SetEntrySendTimeout(time.Second)
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	// the sends to a slow consumer are handed off to the same goroutine.
+	rh := newResponseHandler(index, "req", &cbft.SearchRequest{}, nil)
+	sender := &slowSender{delay: time.Millisecond}
+	var handoff *sendHandoff
+	for k := 0; k < 10; k++ {
+		if !rh.sendEntry(sender, map[string]interface{}{"id": "a"}) {
+			t.Fatalf("Expected the entry to be sent, err: %v", rh.sendErr)
+		}
+		if handoff == nil {
+			handoff = rh.handoff
+		} else if rh.handoff != handoff {
+			t.Fatalf("Expected the sends handed off to the same goroutine")
+		}
+	}
+	if sender.sent != 10 {
+		t.Fatalf("Expected 10 entries sent, got: %d", sender.sent)
+	}
+	rh.stopSends()
+
+	// past a timeout, the sends fail outright, with the goroutine blocked
+	// on the wedged consumer stopping once that's released.
+	goroutines := runtime.NumGoroutine()
+	SetEntrySendTimeout(10 * time.Millisecond)
+	blocked := &blockedSender{release: make(chan struct{})}
+	rh = newResponseHandler(index, "req", &cbft.SearchRequest{}, nil)
+	if rh.sendEntry(blocked, map[string]interface{}{"id": "a"}) {
+		t.Fatalf("Expected the send to time out")
+	}
+	starttm := time.Now()
+	if rh.sendEntry(blocked, map[string]interface{}{"id": "b"}) ||
+		time.Since(starttm) >= GetEntrySendTimeout() {
+		t.Fatalf("Expected the send to fail outright, took: %v",
+			time.Since(starttm))
+	}
+
+	rh.stopSends()
+	close(blocked.release)
+	for starttm = time.Now(); runtime.NumGoroutine() > goroutines; {
+		if time.Since(starttm) > time.Second {
+			t.Fatalf("Expected the send goroutine to stop, goroutines: %d,"+
+				" was: %d", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBackfillSignal(t *testing.T) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	s := newBackfillSignal()
+
+	// a notification ahead of the wait isn't lost
+	s.notify()
+	s.notify()
+	if !s.wait(timer, time.Hour) {
+		t.Fatalf("Expected the wait to be notified")
+	}
+
+	// an idle wait gives up at the interval
+	starttm := time.Now()
+	if s.wait(timer, 20*time.Millisecond) {
+		t.Fatalf("Expected the wait to time out")
+	}
+	if time.Since(starttm) < 20*time.Millisecond {
+		t.Fatalf("Expected the wait to last the interval, took: %v",
+			time.Since(starttm))
+	}
+
+	// a notification wakes up the wait well ahead of the interval
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.notify()
+	}()
+	starttm = time.Now()
+	if !s.wait(timer, time.Hour) || time.Since(starttm) > time.Second {
+		t.Fatalf("Expected the wait to be notified, took: %v",
+			time.Since(starttm))
+	}
+}
+
+// chanSender is a consumer with a bounded buffer, read off by the test.
+type chanSender struct {
+	ch chan *datastore.IndexEntry
+}
+
+func (s *chanSender) SendEntry(entry *datastore.IndexEntry) bool {
+	s.ch <- entry
+	return true
+}
+
+func (s *chanSender) Close()        { close(s.ch) }
+func (s *chanSender) Capacity() int { return cap(s.ch) }
+func (s *chanSender) Length() int   { return len(s.ch) }
+
+type testConn struct {
+	sender datastore.Sender
+	errs   []errors.Error
+	wrns   []errors.Error
+}
+
+func (c *testConn) Sender() datastore.Sender { return c.sender }
+func (c *testConn) Error(err errors.Error)   { c.errs = append(c.errs, err) }
+func (c *testConn) Warning(wrn errors.Error) { c.wrns = append(c.wrns, wrn) }
+
+func TestResponseHandlerSortedHitsThroughBackfill(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	var sr *cbft.SearchRequest
+	err = json.Unmarshal([]byte(`{"query":{"match_all":{}},`+
+		`"sort":["-rating"]}`), &sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the hits, streamed in the order of their ratings (descending)
+	var expect []string
+	var msgs []*pb.StreamSearchResults
+	for batch := 0; batch < 4; batch++ {
+		var hits []string
+		for j := 0; j < 2; j++ {
+			id := fmt.Sprintf("hotel_%d", 10-(batch*2+j))
+			expect = append(expect, id)
+			hits = append(hits, fmt.Sprintf(`{"id":%q,"sort":["%d"]}`,
+				id, 10-(batch*2+j)))
+		}
+		msgs = append(msgs, &pb.StreamSearchResults{
+			Contents: &pb.StreamSearchResults_Hits{
+				Hits: &pb.StreamSearchResults_Batch{
+					Bytes: []byte("[" + strings.Join(hits, ",") + "]"),
+					Total: uint64(len(hits)),
+				},
+			},
+		})
+	}
+	expect = append(expect, "hotel_2")
+	msgs = append(msgs, &pb.StreamSearchResults{
+		Contents: &pb.StreamSearchResults_SearchResult{
+			SearchResult: []byte(`{"status":{"total":1,"failed":0,` +
+				`"successful":1},"hits":[{"id":"hotel_2","sort":["2"]}]}`),
+		},
+	})
+
+	limitMB := int64(1)
+	rh := newResponseHandler(index, "req", sr, &util.SearchOptions{
+		BackfillLimitMB: &limitMB,
+	})
+	defer rh.cleanupBackfill()
+
+	// the consumer doesn't read until the search is done streaming, so the
+	// first batch fills its buffer, and the ones that follow spill.
+	sender := &chanSender{ch: make(chan *datastore.IndexEntry, 2)}
+	conn := &testConn{sender: sender}
+
+	var waitGroup sync.WaitGroup
+	var backfillSync int64
+	rh.handleResponse(conn, &waitGroup, &backfillSync, &fakeStream{msgs: msgs})
+
+	if n := index.indexer.stats.TotalBackfillActivations; n != 1 {
+		t.Fatalf("Expected the backfill to be activated, got: %v", n)
+	}
+
+	var got []string
+	received := make(chan struct{})
+	go func() {
+		for entry := range sender.ch {
+			got = append(got, entry.PrimaryKey)
+		}
+		close(received)
+	}()
+
+	atomic.StoreInt64(&backfillSync, doneRequest)
+	waitGroup.Wait()
+	sender.Close()
+	<-received
+
+	if len(conn.errs) > 0 {
+		t.Fatalf("Unexpected errors: %v", conn.errs)
+	}
+
+	if !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Expected the hits in order: %v, got: %v", expect, got)
+	}
+}
+
+func TestResponseHandlerNoBackfill(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	// a subdirectory of the configured backfill directory.
+	dir, err := ioutil.TempDir(getBackfillSpaceDir(), "n1fty-backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var expect []string
+	var msgs []*pb.StreamSearchResults
+	for batch := 0; batch < 4; batch++ {
+		var hits []string
+		for j := 0; j < 2; j++ {
+			id := fmt.Sprintf("doc-%02d", batch*2+j)
+			expect = append(expect, id)
+			hits = append(hits, fmt.Sprintf(`{"id":%q}`, id))
+		}
+		msgs = append(msgs, &pb.StreamSearchResults{
+			Contents: &pb.StreamSearchResults_Hits{
+				Hits: &pb.StreamSearchResults_Batch{
+					Bytes: []byte("[" + strings.Join(hits, ",") + "]"),
+					Total: uint64(len(hits)),
+				},
+			},
+		})
+	}
+
+	// the backfill's disabled, whatever the limit configured.
+	limitMB := int64(1)
+	rh := newResponseHandler(index, "req", &cbft.SearchRequest{},
+		&util.SearchOptions{BackfillDir: filepath.Base(dir),
+			BackfillLimitMB: &limitMB,
+			NoBackfill:      true})
+	defer rh.cleanupBackfill()
+
+	// the consumer reads slowly, with the search blocking on it.
+	sender := &chanSender{ch: make(chan *datastore.IndexEntry, 2)}
+	conn := &testConn{sender: sender}
+
+	var got []string
+	received := make(chan struct{})
+	go func() {
+		for entry := range sender.ch {
+			time.Sleep(time.Millisecond)
+			got = append(got, entry.PrimaryKey)
+		}
+		close(received)
+	}()
+
+	var waitGroup sync.WaitGroup
+	var backfillSync int64
+	rh.handleResponse(conn, &waitGroup, &backfillSync, &fakeStream{msgs: msgs})
+
+	atomic.StoreInt64(&backfillSync, doneRequest)
+	waitGroup.Wait()
+	sender.Close()
+	<-received
+
+	if len(conn.errs) > 0 {
+		t.Fatalf("Unexpected errors: %v", conn.errs)
+	}
+
+	if !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Expected the hits in order: %v, got: %v", expect, got)
+	}
+
+	if n := index.indexer.stats.TotalBackfillActivations; n != 0 ||
+		rh.backfillFile != nil {
+		t.Fatalf("Expected no backfill, got activations: %d", n)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 0 {
+		t.Fatalf("Expected no backfill file, got: %v, err: %v", files, err)
+	}
+}
+
+func TestResponseHandlerBackfillDirSymlink(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	dir, err := ioutil.TempDir(getBackfillSpaceDir(), "n1fty-backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// symlinked subdirectories, one resolving within the configured
+	// backfill directory, the other outside of it.
+	inside := filepath.Join(dir, "inside")
+	if err = os.Mkdir(inside, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(inside, filepath.Join(dir, "within")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(string(filepath.Separator),
+		filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	rh := newResponseHandler(index, "req", &cbft.SearchRequest{},
+		&util.SearchOptions{
+			BackfillDir: filepath.Join(filepath.Base(dir), "within")})
+	expect, err := filepath.EvalSymlinks(inside)
+	if err != nil || rh.spillDirErr != nil || rh.spillDir != expect {
+		t.Fatalf("Expected the backfill dir: %s, got: %s, err: %v",
+			expect, rh.spillDir, rh.spillDirErr)
+	}
+
+	rh = newResponseHandler(index, "req", &cbft.SearchRequest{},
+		&util.SearchOptions{
+			BackfillDir: filepath.Join(filepath.Base(dir), "escape")})
+	if rh.spillDirErr == nil {
+		t.Fatalf("Expected an error for the backfill dir outside")
+	}
+
+	// the search fails, before any backfill's set up.
+	conn := &testConn{
+		sender: &chanSender{ch: make(chan *datastore.IndexEntry, 1)}}
+	var waitGroup sync.WaitGroup
+	var backfillSync int64
+	rh.handleResponse(conn, &waitGroup, &backfillSync, &fakeStream{})
+	if len(conn.errs) != 1 || rh.backfillFile != nil {
+		t.Fatalf("Expected the search to fail, got: %v", conn.errs)
+	}
+}
+
+func TestResponseHandlerBackfillResumesDirectSends(t *testing.T) {
+	defer SetBackfillResumeBatches(GetBackfillResumeBatches())
+	SetBackfillResumeBatches(1)
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	// a subdirectory of the configured backfill directory.
+	dir, err := ioutil.TempDir(getBackfillSpaceDir(), "n1fty-backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	limitMB := int64(1)
+	rh := newResponseHandler(index, "req", &cbft.SearchRequest{},
+		&util.SearchOptions{BackfillDir: filepath.Base(dir),
+			BackfillLimitMB: &limitMB})
+
+	sender := &chanSender{ch: make(chan *datastore.IndexEntry, 2)}
+	conn := &testConn{sender: sender}
+	stream := &fakeStream{gate: make(chan *pb.StreamSearchResults)}
+
+	var waitGroup sync.WaitGroup
+	var backfillSync int64
+	handled := make(chan struct{})
+	go func() {
+		rh.handleResponse(conn, &waitGroup, &backfillSync, stream)
+		close(handled)
+	}()
+
+	var expect, got []string
+	next := 0
+	batch := func(n int) {
+		var hits []string
+		for k := 0; k < n; k++ {
+			id := fmt.Sprintf("doc-%02d", next)
+			next++
+			expect = append(expect, id)
+			hits = append(hits, fmt.Sprintf(`{"id":%q}`, id))
+		}
+		stream.gate <- &pb.StreamSearchResults{
+			Contents: &pb.StreamSearchResults_Hits{
+				Hits: &pb.StreamSearchResults_Batch{
+					Bytes: []byte("[" + strings.Join(hits, ",") + "]"),
+					Total: uint64(n),
+				},
+			},
+		}
+	}
+	consume := func(n int) {
+		for k := 0; k < n; k++ {
+			got = append(got, (<-sender.ch).PrimaryKey)
+		}
+	}
+
+	// the consumer stalls, its buffer filled by the first batch, so the
+	// second spills over to the backfill.
+	batch(2)
+	batch(1)
+	batch(1)
+	if n := atomic.LoadInt64(
+		&index.indexer.stats.TotalBackfillActivations); n != 1 {
+		t.Fatalf("Expected the backfill to be activated, got: %v", n)
+	}
+
+	// the consumer catches up, draining the backfill, so the batch that
+	// follows has the backfill stopped, and is sent directly.
+	consume(4)
+	batch(1)
+	consume(1)
+	batch(2)
+
+	// the consumer stalls again, re-engaging the backfill.
+	batch(1)
+	close(stream.gate)
+	<-handled
+	consume(3)
+
+	atomic.StoreInt64(&backfillSync, doneRequest)
+	waitGroup.Wait()
+	sender.Close()
+	rh.cleanupBackfill()
+
+	if len(conn.errs) > 0 {
+		t.Fatalf("Unexpected errors: %v", conn.errs)
+	}
+
+	if !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Expected the hits in order: %v, got: %v", expect, got)
+	}
+
+	if n := index.indexer.stats.TotalBackfillResumes; n != 1 {
+		t.Fatalf("Expected a single resume of direct sends, got: %v", n)
+	}
+
+	if n := index.indexer.stats.TotalBackfillActivations; n != 2 {
+		t.Fatalf("Expected the backfill re-activated, got: %v", n)
+	}
+
+	if n := index.indexer.stats.TotalBackFills; n != 2 {
+		t.Fatalf("Expected both backfills cleaned up, got: %v", n)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("Expected the backfill files removed, got: %d", len(files))
+	}
+}
+
+func TestResponseHandlerFTSServerDuration(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	msgs := []*pb.StreamSearchResults{
+		{
+			Contents: &pb.StreamSearchResults_Hits{
+				Hits: &pb.StreamSearchResults_Batch{
+					Bytes: []byte(`[{"id":"a"}]`),
+					Total: 1,
+				},
+			},
+		},
+		{
+			Contents: &pb.StreamSearchResults_SearchResult{
+				SearchResult: []byte(`{"status":{"total":1,"failed":0,` +
+					`"successful":1},"hits":[],"took":1500000}`),
+			},
+		},
+	}
+
+	rh := newResponseHandler(index, "req", &cbft.SearchRequest{}, nil)
+	sender := &chanSender{ch: make(chan *datastore.IndexEntry, 4)}
+	conn := &testConn{sender: sender}
+
+	var waitGroup sync.WaitGroup
+	var backfillSync int64
+	rh.handleResponse(conn, &waitGroup, &backfillSync, &fakeStream{msgs: msgs})
+
+	if len(conn.errs) > 0 {
+		t.Fatalf("Unexpected errors: %v", conn.errs)
+	}
+
+	if len(sender.ch) != 1 {
+		t.Fatalf("Expected a single entry, got: %v", len(sender.ch))
+	}
+
+	if dur := index.indexer.stats.TotalFTSServerDuration; dur != 1500000 {
+		t.Fatalf("Expected the FTS server duration: 1500000, got: %v", dur)
+	}
+
+	if took := searchResultTook([]byte(`{"hits":[]}`)); took != 0 {
+		t.Fatalf("Expected no duration without took, got: %v", took)
+	}
+}
+
+func TestResponseHandlerBackfillUnavailable(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expect []string
+	var msgs []*pb.StreamSearchResults
+	for batch := 0; batch < 3; batch++ {
+		var hits []string
+		for j := 0; j < 2; j++ {
+			id := fmt.Sprintf("hotel_%d", batch*2+j)
+			expect = append(expect, id)
+			hits = append(hits, fmt.Sprintf(`{"id":%q}`, id))
+		}
+		msgs = append(msgs, &pb.StreamSearchResults{
+			Contents: &pb.StreamSearchResults_Hits{
+				Hits: &pb.StreamSearchResults_Batch{
+					Bytes: []byte("[" + strings.Join(hits, ",") + "]"),
+					Total: uint64(len(hits)),
+				},
+			},
+		})
+	}
+	msgs = append(msgs, &pb.StreamSearchResults{
+		Contents: &pb.StreamSearchResults_SearchResult{
+			SearchResult: []byte(`{"status":{"total":1,"failed":0,` +
+				`"successful":1},"hits":[]}`),
+		},
+	})
+
+	// the backfill can't be set up within a directory that doesn't exist.
+	limitMB := int64(1)
+	opts := &util.SearchOptions{
+		BackfillDir:     filepath.Join("n1fty-missing", "dir"),
+		BackfillLimitMB: &limitMB,
+	}
+
+	defer SetBackfillFallbackToBlocking(GetBackfillFallbackToBlocking())
+
+	for _, fallback := range []bool{true, false} {
+		SetBackfillFallbackToBlocking(fallback)
+		index.indexer = &FTSIndexer{stats: &stats{}}
+
+		rh := newResponseHandler(index, "req", &cbft.SearchRequest{}, opts)
+
+		// the consumer holds a single entry, and reads concurrently.
+		sender := &chanSender{ch: make(chan *datastore.IndexEntry, 1)}
+		conn := &testConn{sender: sender}
+
+		var got []string
+		received := make(chan struct{})
+		go func() {
+			for entry := range sender.ch {
+				got = append(got, entry.PrimaryKey)
+			}
+			close(received)
+		}()
+
+		var waitGroup sync.WaitGroup
+		var backfillSync int64
+		stream := &fakeStream{msgs: append([]*pb.StreamSearchResults(nil), msgs...)}
+		rh.handleResponse(conn, &waitGroup, &backfillSync, stream)
+		waitGroup.Wait()
+		sender.Close()
+		<-received
+		rh.cleanupBackfill()
+
+		if !fallback {
+			if len(conn.errs) != 1 || len(got) != 0 {
+				t.Fatalf("Expected the search to fail, got errors: %v, hits: %v",
+					conn.errs, got)
+			}
+			continue
+		}
+
+		if len(conn.errs) > 0 {
+			t.Fatalf("Unexpected errors: %v", conn.errs)
+		}
+
+		if !reflect.DeepEqual(expect, got) {
+			t.Fatalf("Expected the hits in order: %v, got: %v", expect, got)
+		}
+
+		if n := index.indexer.stats.TotalBackfillFallbacks; n != 1 {
+			t.Fatalf("Expected a single fallback, got: %v", n)
+		}
+
+		if n := index.indexer.stats.TotalBackfillActivations; n != 0 {
+			t.Fatalf("Expected no backfill activations, got: %v", n)
+		}
+	}
+}
+
+func TestResponseHandlerMessageTooLarge(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	// a batch of hits, followed by one over the max receive size.
+	stream := &fakeStream{
+		msgs: []*pb.StreamSearchResults{{
+			Contents: &pb.StreamSearchResults_Hits{
+				Hits: &pb.StreamSearchResults_Batch{
+					Bytes: []byte(`[{"id":"a"}]`),
+					Total: 1,
+				},
+			},
+		}},
+		err: status.Errorf(codes.ResourceExhausted,
+			"grpc: received message larger than max (%d vs. %d)",
+			DefaultGrpcMaxRecvMsgSize+1, DefaultGrpcMaxRecvMsgSize),
+	}
+
+	rh := newResponseHandler(index, "req", &cbft.SearchRequest{}, nil)
+	sender := &chanSender{ch: make(chan *datastore.IndexEntry, 4)}
+	conn := &testConn{sender: sender}
+
+	var waitGroup sync.WaitGroup
+	var backfillSync int64
+	rh.handleResponse(conn, &waitGroup, &backfillSync, stream)
+
+	if len(conn.errs) != 1 ||
+		!strings.Contains(conn.errs[0].Error(), "DefaultGrpcMaxRecvMsgSize") {
+		t.Fatalf("Expected an error suggesting to raise the limit, got: %v",
+			conn.errs)
+	}
+
+	if len(sender.ch) != 1 {
+		t.Fatalf("Expected the hits ahead of the error, got: %v", len(sender.ch))
+	}
+}
+
+func TestResponseHandlerForwardsCAS(t *testing.T) {
+	defer SetCASStoredField(GetCASStoredField())
+	SetCASStoredField("_cas")
+
+	tests := []struct {
+		hit string
+		cas uint64
+	}{
+		// as reported by FTS, past the precision of a float
+		{hit: `{"id":"a","cas":1617183772519456769}`, cas: 1617183772519456769},
+		// as carried by the stored field
+		{hit: `{"id":"b","fields":{"_cas":"1617183772519456770"}}`,
+			cas: 1617183772519456770},
+		// unavailable
+		{hit: `{"id":"c","fields":{"name":"x"}}`},
+		{hit: `{"id":"d","fields":{"_cas":"not a cas"}}`},
+	}
+
+	var hits []string
+	for _, test := range tests {
+		cas, ok := hitCAS([]byte(test.hit))
+		if ok != (test.cas > 0) || cas != test.cas {
+			t.Fatalf("[%s] Expected cas: %d, got: %d, %t",
+				test.hit, test.cas, cas, ok)
+		}
+		hits = append(hits, test.hit)
+	}
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	rh := newResponseHandler(index, "req", &cbft.SearchRequest{}, nil)
+	sender := &chanSender{ch: make(chan *datastore.IndexEntry, len(hits))}
+	conn := &testConn{sender: sender}
+
+	if !rh.sendEntries([]byte("["+strings.Join(hits, ",")+"]"), conn) {
+		t.Fatalf("Expected the hits sent, errs: %v", conn.errs)
+	}
+	sender.Close()
+
+	k := 0
+	for entry := range sender.ch {
+		_, exists := entry.MetaData.Field("cas")
+		if exists != (tests[k].cas > 0) {
+			t.Fatalf("[%s] Expected cas within the metadata: %t, got: %v",
+				entry.PrimaryKey, tests[k].cas > 0, entry.MetaData)
+		}
+		k++
+	}
+
+	if k != len(tests) {
+		t.Fatalf("Expected %d entries, got: %d", len(tests), k)
+	}
+
+	if fields := casFields(); len(fields) != 1 || fields[0] != "_cas" {
+		t.Fatalf("Expected the stored field requested, got: %v", fields)
+	}
+}
+
+func TestResponseHandlerReturnsRequestedFields(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	hits := `[{"id":"a","fields":{"name":"abcdef","city":"x","extra":"y"}},` +
+		`{"id":"b","fields":{"extra":"y"}},` +
+		`{"id":"c","fields":{"name":"abc","reviews":[1,2,3]}}]`
+
+	tests := []struct {
+		fields []string
+		opts   *util.SearchOptions
+		expect map[string]string // fields within the metadata, by id
+	}{
+		{
+			fields: []string{"name", "city", "reviews"},
+			expect: map[string]string{
+				"a": `{"city":"x","name":"abcdef"}`,
+				"b": ``,
+				"c": `{"name":"abc","reviews":[1,2,3]}`,
+			},
+		},
+		{
+			fields: []string{"*"},
+			opts:   &util.SearchOptions{ExcludeFields: []string{"extra"}},
+			expect: map[string]string{
+				"a": `{"city":"x","name":"abcdef"}`,
+				"b": ``,
+				"c": `{"name":"abc","reviews":[1,2,3]}`,
+			},
+		},
+		{
+			fields: []string{"name", "city", "reviews"},
+			opts:   &util.SearchOptions{MaxFieldBytes: 5},
+			expect: map[string]string{
+				"a": `{"city":"x","name":"abcd"}`,
+				"b": ``,
+				"c": `{"name":"abc"}`,
+			},
+		},
+	}
+
+	for x, test := range tests {
+		rh := newResponseHandler(index, "req",
+			&cbft.SearchRequest{Fields: test.fields}, test.opts)
+		sender := &chanSender{ch: make(chan *datastore.IndexEntry, 3)}
+		conn := &testConn{sender: sender}
+
+		if !rh.sendEntries([]byte(hits), conn) {
+			t.Fatalf("[%d] Expected the hits sent, errs: %v", x, conn.errs)
+		}
+		sender.Close()
+
+		for entry := range sender.ch {
+			got := ""
+			if fields, exists := entry.MetaData.Field("fields"); exists {
+				b, _ := fields.MarshalJSON()
+				got = string(b)
+			}
+			if got != test.expect[entry.PrimaryKey] {
+				t.Fatalf("[%d] Expected fields: %s for %s, got: %s", x,
+					test.expect[entry.PrimaryKey], entry.PrimaryKey, got)
+			}
+
+			_, truncated := entry.MetaData.Field("truncated_fields")
+			if truncated != (test.opts != nil && test.opts.MaxFieldBytes > 0 &&
+				entry.PrimaryKey != "b") {
+				t.Fatalf("[%d] Unexpected truncated fields for %s: %v", x,
+					entry.PrimaryKey, entry.MetaData)
+			}
+		}
+	}
+}
+
+func TestResponseHandlerForwardsLocations(t *testing.T) {
+	idx, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	docs := map[string]string{
+		"doc-a": "quick brown quick",
+		"doc-b": "the quick fox",
+		"doc-c": "slow brown dog",
+	}
+	for id, title := range docs {
+		if err = idx.Index(id, map[string]interface{}{"title": title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts, err := util.ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"include_locations": true,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr, _, err := util.BuildSearchRequest("", value.NewValue(
+		map[string]interface{}{
+			"query": map[string]interface{}{"match": "quick", "field": "title"},
+			"sort":  []interface{}{"_id"},
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr = util.IncludeLocationsInSearchRequest(sr, opts.IncludeLocations)
+
+	bsr, err := sr.ConvertToBleveSearchRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bsr.IncludeLocations {
+		t.Fatalf("Expected the locations requested")
+	}
+
+	res, err := idx.Search(bsr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a hit per message, so that with the consumer not reading the hits
+	// that follow the first spill over to the backfill.
+	var msgs []*pb.StreamSearchResults
+	for _, hit := range res.Hits {
+		b, err := json.Marshal([]interface{}{hit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, &pb.StreamSearchResults{
+			Contents: &pb.StreamSearchResults_Hits{
+				Hits: &pb.StreamSearchResults_Batch{Bytes: b, Total: 1},
+			},
+		})
+	}
+	msgs = append(msgs, &pb.StreamSearchResults{
+		Contents: &pb.StreamSearchResults_SearchResult{
+			SearchResult: []byte(`{"status":{"total":1,"failed":0,` +
+				`"successful":1},"hits":[]}`),
+		},
+	})
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	rh := newResponseHandler(index, "req", sr, opts)
+	defer rh.cleanupBackfill()
+
+	sender := &chanSender{ch: make(chan *datastore.IndexEntry, 1)}
+	conn := &testConn{sender: sender}
+
+	var waitGroup sync.WaitGroup
+	var backfillSync int64
+	rh.handleResponse(conn, &waitGroup, &backfillSync, &fakeStream{msgs: msgs})
+
+	if n := index.indexer.stats.TotalBackfillActivations; n != 1 {
+		t.Fatalf("Expected the backfill to be activated, got: %v", n)
+	}
+
+	got := map[string][]uint64{}
+	received := make(chan struct{})
+	go func() {
+		for entry := range sender.ch {
+			locations, _ := entry.MetaData.Field("locations")
+			b, _ := locations.MarshalJSON()
+
+			var ftls map[string]map[string][]struct {
+				Pos uint64 `json:"pos"`
+			}
+			_ = json.Unmarshal(b, &ftls)
+
+			for _, l := range ftls["title"]["quick"] {
+				got[entry.PrimaryKey] = append(got[entry.PrimaryKey], l.Pos)
+			}
+		}
+		close(received)
+	}()
+
+	atomic.StoreInt64(&backfillSync, doneRequest)
+	waitGroup.Wait()
+	sender.Close()
+	<-received
+
+	if len(conn.errs) > 0 {
+		t.Fatalf("Unexpected errors: %v", conn.errs)
+	}
+
+	expect := map[string][]uint64{"doc-a": {1, 3}, "doc-b": {2}}
+	if !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Expected the term positions: %v, got: %v", expect, got)
+	}
+}
+
+func TestResponseHandlerForwardsExplanations(t *testing.T) {
+	defer SetExplainBufferedHits(GetExplainBufferedHits())
+	SetExplainBufferedHits(1)
+
+	idx, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	for id, title := range map[string]string{
+		"doc-a": "quick brown quick",
+		"doc-b": "the quick fox",
+		"doc-c": "quick dog",
+	} {
+		if err = idx.Index(id, map[string]interface{}{"title": title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, explain := range []bool{false, true} {
+		index.indexer = &FTSIndexer{stats: &stats{}}
+
+		opts, err := util.ParseSearchOptions(value.NewValue(
+			map[string]interface{}{
+				"explain": explain,
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sr, _, err := util.BuildSearchRequest("", value.NewValue(
+			map[string]interface{}{
+				"query": map[string]interface{}{"match": "quick", "field": "title"},
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sr = util.ExplainInSearchRequest(sr, opts.Explain)
+
+		// the hits as FTS reports them, with the explanations if requested.
+		bsr, err := sr.ConvertToBleveSearchRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := idx.Search(bsr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var msgs []*pb.StreamSearchResults
+		for _, hit := range res.Hits {
+			b, err := json.Marshal([]interface{}{hit})
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, &pb.StreamSearchResults{
+				Contents: &pb.StreamSearchResults_Hits{
+					Hits: &pb.StreamSearchResults_Batch{Bytes: b, Total: 1},
+				},
+			})
+		}
+		msgs = append(msgs, &pb.StreamSearchResults{
+			Contents: &pb.StreamSearchResults_SearchResult{
+				SearchResult: []byte(`{"status":{"total":1,"failed":0,` +
+					`"successful":1},"hits":[]}`),
+			},
+		})
+
+		rh := newResponseHandler(index, "req", sr, opts)
+		sender := &chanSender{ch: make(chan *datastore.IndexEntry, 10)}
+		conn := &testConn{sender: sender}
+
+		var waitGroup sync.WaitGroup
+		var backfillSync int64
+		rh.handleResponse(conn, &waitGroup, &backfillSync,
+			&fakeStream{msgs: msgs})
+		atomic.StoreInt64(&backfillSync, doneRequest)
+		waitGroup.Wait()
+		rh.cleanupBackfill()
+		sender.Close()
+
+		if len(conn.errs) > 0 {
+			t.Fatalf("[%t] Unexpected errors: %v", explain, conn.errs)
+		}
+
+		// the hits carrying explanations spill over to the backfill sooner,
+		// the buffer having room for all of them.
+		activations := index.indexer.stats.TotalBackfillActivations
+		if (activations > 0) != explain {
+			t.Fatalf("[%t] Unexpected backfill activations: %d", explain,
+				activations)
+		}
+
+		var hits int
+		for entry := range sender.ch {
+			hits++
+
+			expl, ok := entry.MetaData.Field("explanation")
+			if ok != explain {
+				t.Fatalf("[%t] Unexpected explanation for %s: %v", explain,
+					entry.PrimaryKey, entry.MetaData)
+			}
+
+			if explain {
+				if v, ok := expl.Field("value"); !ok || v.Type() != value.NUMBER {
+					t.Fatalf("Expected the explanation of the score for %s,"+
+						" got: %v", entry.PrimaryKey, expl)
+				}
+			}
+		}
+
+		if hits != 3 {
+			t.Fatalf("[%t] Expected 3 hits, got: %d", explain, hits)
+		}
+	}
+}
+
+func TestResponseHandlerBackfillBufferedHits(t *testing.T) {
+	defer SetBackfillBufferedHits(getBackfillBufferedHits())
+	SetBackfillBufferedHits(2)
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	// a hit per message, with the consumer's buffer roomy enough for all.
+	var expect []string
+	var msgs []*pb.StreamSearchResults
+	for k := 0; k < 5; k++ {
+		id := fmt.Sprintf("hotel_%d", k)
+		expect = append(expect, id)
+		msgs = append(msgs, &pb.StreamSearchResults{
+			Contents: &pb.StreamSearchResults_Hits{
+				Hits: &pb.StreamSearchResults_Batch{
+					Bytes: []byte(fmt.Sprintf(`[{"id":%q}]`, id)),
+					Total: 1,
+				},
+			},
+		})
+	}
+
+	limitMB := int64(1)
+	rh := newResponseHandler(index, "req", &cbft.SearchRequest{},
+		&util.SearchOptions{BackfillLimitMB: &limitMB})
+	defer rh.cleanupBackfill()
+
+	sender := &chanSender{ch: make(chan *datastore.IndexEntry, 10)}
+	conn := &testConn{sender: sender}
+
+	var waitGroup sync.WaitGroup
+	var backfillSync int64
+	rh.handleResponse(conn, &waitGroup, &backfillSync, &fakeStream{msgs: msgs})
+
+	// the third hit would have exceeded the hits buffered, so spilled.
+	if n := index.indexer.stats.TotalBackfillActivations; n != 1 {
+		t.Fatalf("Expected the backfill to be activated, got: %v", n)
+	}
+
+	atomic.StoreInt64(&backfillSync, doneRequest)
+	waitGroup.Wait()
+	sender.Close()
+
+	var got []string
+	for entry := range sender.ch {
+		got = append(got, entry.PrimaryKey)
+	}
+
+	if len(conn.errs) > 0 {
+		t.Fatalf("Unexpected errors: %v", conn.errs)
+	}
+
+	if !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Expected the hits in order: %v, got: %v", expect, got)
+	}
+}
+
+func TestResponseHandlerBackfillBufferedBytes(t *testing.T) {
+	defer SetBackfillBufferedBytes(getBackfillBufferedBytes())
+
+	// a hit per message, each carrying a wide stored field, with the
+	// consumer's buffer roomy enough for all.
+	var expect []string
+	var msgs []*pb.StreamSearchResults
+	for k := 0; k < 5; k++ {
+		id := fmt.Sprintf("hotel_%d", k)
+		expect = append(expect, id)
+		msgs = append(msgs, &pb.StreamSearchResults{
+			Contents: &pb.StreamSearchResults_Hits{
+				Hits: &pb.StreamSearchResults_Batch{
+					Bytes: []byte(fmt.Sprintf(`[{"id":%q,"fields":`+
+						`{"desc":%q}}]`, id, strings.Repeat("x", 4000))),
+					Total: 1,
+				},
+			},
+		})
+	}
+
+	for _, maxBytes := range []int64{0, 10000} {
+		SetBackfillBufferedBytes(maxBytes)
+
+		index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index.indexer = &FTSIndexer{stats: &stats{}}
+
+		limitMB := int64(1)
+		rh := newResponseHandler(index, "req",
+			&cbft.SearchRequest{Fields: []string{"*"}},
+			&util.SearchOptions{BackfillLimitMB: &limitMB})
+
+		sender := &chanSender{ch: make(chan *datastore.IndexEntry, 10)}
+		conn := &testConn{sender: sender}
+
+		var waitGroup sync.WaitGroup
+		var backfillSync int64
+		rh.handleResponse(conn, &waitGroup, &backfillSync,
+			&fakeStream{msgs: append([]*pb.StreamSearchResults(nil), msgs...)})
+
+		// the third hit would have exceeded the bytes buffered, so spilled,
+		// though well within the count the buffer has room for.
+		activations := index.indexer.stats.TotalBackfillActivations
+		if (maxBytes > 0) != (activations == 1) {
+			t.Fatalf("[%d] Unexpected backfill activations: %v", maxBytes,
+				activations)
+		}
+
+		atomic.StoreInt64(&backfillSync, doneRequest)
+		waitGroup.Wait()
+		rh.cleanupBackfill()
+		sender.Close()
+
+		var got []string
+		for entry := range sender.ch {
+			got = append(got, entry.PrimaryKey)
+		}
+
+		if len(conn.errs) > 0 {
+			t.Fatalf("[%d] Unexpected errors: %v", maxBytes, conn.errs)
+		}
+
+		if !reflect.DeepEqual(expect, got) {
+			t.Fatalf("[%d] Expected the hits in order: %v, got: %v", maxBytes,
+				expect, got)
+		}
+	}
+}
+
+func TestResponseHandlerBackfillThroughput(t *testing.T) {
+	defer SetBackfillBufferedHits(getBackfillBufferedHits())
+	SetBackfillBufferedHits(2)
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	// a hit per message, those past the second spilled to the backfill.
+	var spilled int64
+	var msgs []*pb.StreamSearchResults
+	for k := 0; k < 5; k++ {
+		hits := []byte(fmt.Sprintf(`[{"id":"hotel_%d"}]`, k))
+		if k >= 2 {
+			spilled += int64(len(hits))
+		}
+		msgs = append(msgs, &pb.StreamSearchResults{
+			Contents: &pb.StreamSearchResults_Hits{
+				Hits: &pb.StreamSearchResults_Batch{Bytes: hits, Total: 1},
+			},
+		})
+	}
+
+	limitMB := int64(1)
+	rh := newResponseHandler(index, "req", &cbft.SearchRequest{},
+		&util.SearchOptions{BackfillLimitMB: &limitMB})
+	defer rh.cleanupBackfill()
+
+	sender := &chanSender{ch: make(chan *datastore.IndexEntry, 10)}
+	conn := &testConn{sender: sender}
+
+	var waitGroup sync.WaitGroup
+	var backfillSync int64
+	rh.handleResponse(conn, &waitGroup, &backfillSync, &fakeStream{msgs: msgs})
+
+	atomic.StoreInt64(&backfillSync, doneRequest)
+	waitGroup.Wait()
+	sender.Close()
+
+	if len(conn.errs) > 0 {
+		t.Fatalf("Unexpected errors: %v", conn.errs)
+	}
+
+	st := index.indexer.stats
+	if st.TotalBackfillBytes != spilled || st.TotalBackfillBytesRead != spilled {
+		t.Fatalf("Expected %d bytes written and read, got: %d, %d", spilled,
+			st.TotalBackfillBytes, st.TotalBackfillBytesRead)
+	}
+
+	if st.TotalBackfillEntriesWritten != 3 || st.TotalBackfillEntriesRead != 3 {
+		t.Fatalf("Expected 3 entries written and read, got: %d, %d",
+			st.TotalBackfillEntriesWritten, st.TotalBackfillEntriesRead)
+	}
+}
+
+func TestResponseHandlerMinScore(t *testing.T) {
+	defer SetBackfillBufferedHits(getBackfillBufferedHits())
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a couple of hits per message, of mixed scores.
+	scores := []float64{0.9, 0.2, 0.5, 0.49, 0.1, 0.05, 1.7, 0.6}
+	var expect []string
+	var msgs []*pb.StreamSearchResults
+	for k := 0; k < len(scores); k += 2 {
+		var hits []string
+		for _, x := range []int{k, k + 1} {
+			hits = append(hits, fmt.Sprintf(`{"id":"hotel_%d","score":%v}`,
+				x, scores[x]))
+			if scores[x] >= 0.5 {
+				expect = append(expect, fmt.Sprintf("hotel_%d", x))
+			}
+		}
+		msgs = append(msgs, &pb.StreamSearchResults{
+			Contents: &pb.StreamSearchResults_Hits{
+				Hits: &pb.StreamSearchResults_Batch{
+					Bytes: []byte("[" + strings.Join(hits, ",") + "]"),
+					Total: 2,
+				},
+			},
+		})
+	}
+
+	// sent directly, and through the backfill (past the first message).
+	for _, maxBuffered := range []int64{0, 2} {
+		SetBackfillBufferedHits(maxBuffered)
+		index.indexer = &FTSIndexer{stats: &stats{}}
+
+		opts, err := util.ParseSearchOptions(value.NewValue(
+			map[string]interface{}{"min_score": 0.5}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rh := newResponseHandler(index, "req", &cbft.SearchRequest{}, opts)
+
+		sender := &chanSender{ch: make(chan *datastore.IndexEntry, 10)}
+		conn := &testConn{sender: sender}
+
+		var waitGroup sync.WaitGroup
+		var backfillSync int64
+		rh.handleResponse(conn, &waitGroup, &backfillSync,
+			&fakeStream{msgs: append([]*pb.StreamSearchResults(nil), msgs...)})
+
+		atomic.StoreInt64(&backfillSync, doneRequest)
+		waitGroup.Wait()
+		sender.Close()
+		rh.cleanupBackfill()
+
+		if len(conn.errs) > 0 {
+			t.Fatalf("[%d] Unexpected errors: %v", maxBuffered, conn.errs)
+		}
+
+		var got []string
+		for entry := range sender.ch {
+			got = append(got, entry.PrimaryKey)
+		}
+
+		if !reflect.DeepEqual(expect, got) {
+			t.Fatalf("[%d] Expected the hits scoring at least 0.5: %v, got: %v",
+				maxBuffered, expect, got)
+		}
+
+		st := index.indexer.stats
+		if maxBuffered > 0 {
+			// the message of hits all scoring below wasn't spilled.
+			if st.TotalBackfillActivations != 1 ||
+				st.TotalBackfillEntriesWritten != 2 {
+				t.Fatalf("Expected 2 entries spilled, got: %+v", st)
+			}
+		}
+	}
+}
+
+func TestResponseHandlerKeysOnly(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	opts, err := util.ParseSearchOptions(value.NewValue(
+		map[string]interface{}{"keys_only": true, "distinct": true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// facets requested within the search request aren't held for.
+	sr := &cbft.SearchRequest{Facets: map[string]*bleve.FacetRequest{
+		"types": bleve.NewFacetRequest("type", 3)}}
+	rh := newResponseHandler(index, "req", sr, opts)
+	defer rh.cleanupDistinct()
+
+	sender := &chanSender{ch: make(chan *datastore.IndexEntry, 10)}
+	conn := &testConn{sender: sender}
+
+	if !rh.sendEntries([]byte(`[{"id":"a","score":1.2,"fields":{"f":"x"}},`+
+		`{"id":"b","score":0.4,"locations":{}},{"id":"a","score":1.2}]`),
+		conn) {
+		t.Fatalf("Expected the hits sent, got errors: %v", conn.errs)
+	}
+	sender.Close()
+
+	var got []string
+	for entry := range sender.ch {
+		got = append(got, entry.PrimaryKey)
+		if entry.MetaData != nil {
+			t.Fatalf("Expected no metadata for %s, got: %v",
+				entry.PrimaryKey, entry.MetaData)
+		}
+	}
+
+	// duplicates are still suppressed, when requested.
+	if expect := []string{"a", "b"}; !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Expected the keys: %v, got: %v", expect, got)
+	}
+}
+
+func TestResponseHandlerCollapse(t *testing.T) {
+	defer SetCollapseMemoryLimit(GetCollapseMemoryLimit())
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	opts, err := util.ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"collapse": map[string]interface{}{"field": "product_id"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the variants of 3 products (one of which with a numeric ID, differing
+	// from the string), in the order of their scores, along with hits
+	// lacking a product.
+	var hits []string
+	var expect []string
+	for k := 0; k < 30; k++ {
+		var product string
+		switch k % 5 {
+		case 0, 1:
+			product = fmt.Sprintf(`"p%d"`, k%2)
+		case 2:
+			product = "1"
+		case 3:
+			product = `"1"`
+		case 4:
+			product = "null"
+		}
+
+		id := fmt.Sprintf("doc-%02d", k)
+		hits = append(hits, fmt.Sprintf(`{"id":%q,"score":%d,`+
+			`"fields":{"product_id":%s}}`, id, 30-k, product))
+		if k < 4 || k%5 == 4 {
+			expect = append(expect, id)
+		}
+	}
+
+	for _, memLimit := range []int64{
+		1024 * 1024,             // all groups held in memory
+		2 * distinctKeyOverhead, // groups spilled to disk
+	} {
+		SetCollapseMemoryLimit(memLimit)
+
+		rh := newResponseHandler(index, "req", &cbft.SearchRequest{
+			Fields: []string{"product_id"}}, opts)
+		sender := &chanSender{ch: make(chan *datastore.IndexEntry, len(hits))}
+		conn := &testConn{sender: sender}
+
+		// the groups carry over from one batch of hits to the next.
+		if !rh.sendEntries([]byte("["+strings.Join(hits[:12], ",")+"]"),
+			conn) || !rh.sendEntries([]byte("["+strings.Join(hits[12:], ",")+
+			"]"), conn) {
+			t.Fatalf("[%d] Expected the hits sent, got errors: %v", memLimit,
+				conn.errs)
+		}
+		sender.Close()
+
+		var got []string
+		for entry := range sender.ch {
+			got = append(got, entry.PrimaryKey)
+		}
+
+		if !reflect.DeepEqual(expect, got) {
+			t.Fatalf("[%d] Expected a hit per group, along with those"+
+				" lacking one: %v, got: %v", memLimit, expect, got)
+		}
+
+		spilled := rh.collapse.spillFile != nil
+		if spilled != (memLimit < 1024*1024) {
+			t.Fatalf("[%d] Unexpected spill of the groups: %v", memLimit,
+				spilled)
+		}
+
+		rh.cleanupDistinct()
+	}
+}
+
+// discardSender drops the entries sent, never filling up.
+type discardSender struct {
+	datastore.Sender
+}
+
+func (s *discardSender) SendEntry(entry *datastore.IndexEntry) bool {
+	return true
+}
+
+func (s *discardSender) Capacity() int { return 1 }
+func (s *discardSender) Length() int   { return 0 }
+
+func benchmarkSendEntries(b *testing.B, keysOnly bool) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		b.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	var hits []string
+	for k := 0; k < 100; k++ {
+		hits = append(hits, fmt.Sprintf(`{"index":"idx_%d","id":"hotel_%d",`+
+			`"score":%v,"sort":["_score"]}`, k%6, k, 1/float64(k+1)))
+	}
+	batch := []byte("[" + strings.Join(hits, ",") + "]")
+
+	rh := newResponseHandler(index, "req", &cbft.SearchRequest{},
+		&util.SearchOptions{KeysOnly: keysOnly})
+	conn := &testConn{sender: &discardSender{}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if !rh.sendEntries(batch, conn) {
+			b.Fatalf("Expected the hits sent, got errors: %v", conn.errs)
+		}
+	}
+}
+
+func BenchmarkSendEntries(b *testing.B) {
+	benchmarkSendEntries(b, false)
+}
+
+func BenchmarkSendEntriesKeysOnly(b *testing.B) {
+	benchmarkSendEntries(b, true)
+}
+
+func TestResponseHandlerIncludePindex(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the hits tagged with the pindexes that produced them, as streamed,
+	// but for the last.
+	msgs := []*pb.StreamSearchResults{
+		{
+			Contents: &pb.StreamSearchResults_Hits{
+				Hits: &pb.StreamSearchResults_Batch{
+					Bytes: []byte(`[{"id":"a","index":"idx_0123_4567"},` +
+						`{"id":"b","index":"idx_89ab_cdef"}]`),
+					Total: 2,
+				},
+			},
+		},
+		{
+			Contents: &pb.StreamSearchResults_Hits{
+				Hits: &pb.StreamSearchResults_Batch{
+					Bytes: []byte(`[{"id":"c"}]`),
+					Total: 1,
+				},
+			},
+		},
+	}
+
+	expect := map[string]interface{}{
+		"a": "idx_0123_4567",
+		"b": "idx_89ab_cdef",
+	}
+
+	for _, includePindex := range []bool{false, true} {
+		index.indexer = &FTSIndexer{stats: &stats{}}
+
+		opts, err := util.ParseSearchOptions(value.NewValue(
+			map[string]interface{}{"include_pindex": includePindex}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rh := newResponseHandler(index, "req", &cbft.SearchRequest{}, opts)
+		sender := &chanSender{ch: make(chan *datastore.IndexEntry, 10)}
+		conn := &testConn{sender: sender}
+
+		var waitGroup sync.WaitGroup
+		var backfillSync int64
+		rh.handleResponse(conn, &waitGroup, &backfillSync,
+			&fakeStream{msgs: msgs})
+		sender.Close()
+
+		if len(conn.errs) > 0 {
+			t.Fatalf("Unexpected errors: %v", conn.errs)
+		}
+
+		got := map[string]interface{}{}
+		for entry := range sender.ch {
+			meta := entry.MetaData.Actual().(map[string]interface{})
+			if _, exists := meta["index"]; exists {
+				t.Fatalf("Expected no index within the metadata, got: %v", meta)
+			}
+			if pindex, exists := meta["pindex"]; exists {
+				got[entry.PrimaryKey] = pindex
+			}
+		}
+
+		if includePindex && !reflect.DeepEqual(expect, got) {
+			t.Fatalf("Expected the pindexes: %v, got: %v", expect, got)
+		} else if !includePindex && len(got) > 0 {
+			t.Fatalf("Expected no pindexes, got: %v", got)
+		}
+	}
+}
+
+func TestResponseHandlerTrailer(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a page of 2 hits, out of the 12345 matched.
+	msgs := []*pb.StreamSearchResults{
+		{
+			Contents: &pb.StreamSearchResults_Hits{
+				Hits: &pb.StreamSearchResults_Batch{
+					Bytes: []byte(`[{"id":"a","score":1.6},` +
+						`{"id":"b","score":0.8}]`),
+					Total: 2,
+				},
+			},
+		},
+		{
+			Contents: &pb.StreamSearchResults_SearchResult{
+				SearchResult: []byte(`{"status":{"total":1,"failed":0,` +
+					`"successful":1},"hits":[],"total_hits":12345,` +
+					`"max_score":1.6}`),
+			},
+		},
+	}
+
+	for _, trailer := range []bool{false, true} {
+		index.indexer = &FTSIndexer{stats: &stats{}}
+
+		opts, err := util.ParseSearchOptions(value.NewValue(
+			map[string]interface{}{"trailer": trailer}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rh := newResponseHandler(index, "req", &cbft.SearchRequest{}, opts)
+
+		var hits []string
+		_, cancel := context.WithCancel(context.Background())
+		conn := newVisitConn(func(dm *search.DocumentMatch) error {
+			hits = append(hits, dm.ID)
+			return nil
+		}, cancel)
+
+		var got *Trailer
+		conn.onTrailer = func(t *Trailer) { got = t }
+
+		err = conn.visitStream(rh, &fakeStream{msgs: msgs})
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the hits alone are visited, with the trailer handed over apart.
+		if !reflect.DeepEqual(hits, []string{"a", "b"}) {
+			t.Fatalf("[%t] Unexpected hits: %v", trailer, hits)
+		}
+
+		var expect *Trailer
+		if trailer {
+			expect = &Trailer{TotalHits: 12345, MaxScore: 1.6}
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("[%t] Expected the trailer: %+v, got: %+v", trailer,
+				expect, got)
+		}
+	}
+}
+
+func TestResponseHandlerHitDecoding(t *testing.T) {
+	defer SetStrictHitDecoding(GetStrictHitDecoding())
+
+	var sr *cbft.SearchRequest
+	err := json.Unmarshal([]byte(`{"query":{"match_all":{}}}`), &sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := func() []*pb.StreamSearchResults {
+		var rv []*pb.StreamSearchResults
+		for _, hits := range []string{
+			`[{"id":"doc-00"},{"id":"doc-01"}]`,
+			`[{"id":"doc-02"},{"id":]`, // malformed past the first hit
+			`[{"id":5},{"id":"doc-04"}]`,
+		} {
+			rv = append(rv, &pb.StreamSearchResults{
+				Contents: &pb.StreamSearchResults_Hits{
+					Hits: &pb.StreamSearchResults_Batch{
+						Bytes: []byte(hits),
+						Total: 2,
+					},
+				},
+			})
+		}
+		return append(rv, &pb.StreamSearchResults{
+			Contents: &pb.StreamSearchResults_SearchResult{
+				SearchResult: []byte(`{"status":{"total":1,"failed":0,` +
+					`"successful":1},"hits":[]}`),
+			},
+		})
+	}
+
+	tests := []struct {
+		strict  bool
+		expect  []string
+		errs    int
+		wrns    int
+		dropped int64
+	}{
+		// the search fails at the first hits that can't be decoded.
+		{strict: true, expect: []string{"doc-00", "doc-01", "doc-02"},
+			errs: 1},
+		// the hits that can't be decoded are dropped, and warned of once.
+		{strict: false, expect: []string{"doc-00", "doc-01", "doc-02",
+			"doc-04"}, wrns: 1, dropped: 2},
+	}
+
+	for testi, test := range tests {
+		SetStrictHitDecoding(test.strict)
+
+		index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index.indexer = &FTSIndexer{stats: &stats{}}
+
+		rh := newResponseHandler(index, "req", sr, &util.SearchOptions{})
+		sender := &chanSender{ch: make(chan *datastore.IndexEntry, 16)}
+		conn := &testConn{sender: sender}
+
+		var waitGroup sync.WaitGroup
+		var backfillSync int64
+		rh.handleResponse(conn, &waitGroup, &backfillSync,
+			&fakeStream{msgs: msgs()})
+		atomic.StoreInt64(&backfillSync, doneRequest)
+		waitGroup.Wait()
+		sender.Close()
+
+		var got []string
+		for entry := range sender.ch {
+			got = append(got, entry.PrimaryKey)
+		}
+
+		if !reflect.DeepEqual(test.expect, got) {
+			t.Fatalf("[%d] Expected hits: %v, got: %v", testi, test.expect, got)
+		}
+
+		if len(conn.errs) != test.errs || len(conn.wrns) != test.wrns {
+			t.Fatalf("[%d] Expected errs: %d, warnings: %d, got: %v, %v",
+				testi, test.errs, test.wrns, conn.errs, conn.wrns)
+		}
+
+		if n := index.indexer.stats.TotalHitsDropped; n != test.dropped {
+			t.Fatalf("[%d] Expected hits dropped: %d, got: %d", testi,
+				test.dropped, n)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/couchbase/cbft/protobuf"
+	"github.com/couchbase/query/logging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// searchRetryMaxAttempts is the number of times a search whose stream
+// couldn't be set up, with FTS unavailable, is retried; 0 disables
+// retries; as set by the "searchRetryMaxAttempts" config
+var searchRetryMaxAttempts = int64(3)
+
+func GetSearchRetryMaxAttempts() int64 {
+	return atomic.LoadInt64(&searchRetryMaxAttempts)
+}
+
+func SetSearchRetryMaxAttempts(v int64) {
+	atomic.StoreInt64(&searchRetryMaxAttempts, v)
+}
+
+// searchRetryBackoff is the delay ahead of the first retry of a search,
+// doubled for each retry that follows, up to searchRetryMaxBackoff; as set
+// by the "searchRetryBackoffMS" config (in ms)
+var searchRetryBackoff = int64(100 * time.Millisecond)
+
+func GetSearchRetryBackoff() time.Duration {
+	return time.Duration(atomic.LoadInt64(&searchRetryBackoff))
+}
+
+func SetSearchRetryBackoff(v time.Duration) {
+	atomic.StoreInt64(&searchRetryBackoff, int64(v))
+}
+
+// searchRetryMaxBackoff bounds the delay ahead of a retry of a search; as
+// set by the "searchRetryMaxBackoffMS" config (in ms)
+var searchRetryMaxBackoff = int64(2 * time.Second)
+
+func GetSearchRetryMaxBackoff() time.Duration {
+	return time.Duration(atomic.LoadInt64(&searchRetryMaxBackoff))
+}
+
+func SetSearchRetryMaxBackoff(v time.Duration) {
+	atomic.StoreInt64(&searchRetryMaxBackoff, int64(v))
+}
+
+// searchRetryJitter is the fraction (within [0, 1]) of the delay ahead of
+// a retry that's randomized, so the retries of the query nodes following
+// an FTS-wide hiccup aren't in step; as set by the "searchRetryJitter" config
+var searchRetryJitter = math.Float64bits(0.5)
+
+func GetSearchRetryJitter() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&searchRetryJitter))
+}
+
+func SetSearchRetryJitter(v float64) {
+	atomic.StoreUint64(&searchRetryJitter, math.Float64bits(v))
+}
+
+// searchRetryMaxTime bounds the total time a search is retried for, along
+// with the request's deadline, past which the search fails with the last
+// error, whatever the attempts remaining; 0 leaves it to the deadline; as
+// set by the "searchRetryMaxTimeMS" config (in ms)
+var searchRetryMaxTime = int64(5 * time.Second)
+
+func GetSearchRetryMaxTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&searchRetryMaxTime))
+}
+
+func SetSearchRetryMaxTime(v time.Duration) {
+	atomic.StoreInt64(&searchRetryMaxTime, int64(v))
+}
+
+// searchWithRetry sets up the stream of a search, retrying (with backoff)
+// as long as FTS is unavailable, up to searchRetryMaxAttempts times within
+// searchRetryMaxTime and the context's deadline, returning the last error
+// once they're reached. Only the stream's setup is retried, as no hits
+// have been sent then.
+func searchWithRetry(ctx context.Context, client pb.SearchServiceClient,
+	searchReq *pb.SearchRequest) (pb.SearchService_SearchClient, error) {
+	var stopAt time.Time
+	if maxTime := GetSearchRetryMaxTime(); maxTime > 0 {
+		stopAt = time.Now().Add(maxTime)
+	}
+	if deadline, ok := ctx.Deadline(); ok &&
+		(stopAt.IsZero() || deadline.Before(stopAt)) {
+		stopAt = deadline
+	}
+
+	maxAttempts := int(GetSearchRetryMaxAttempts())
+	for attempt := 0; ; attempt++ {
+		stream, err := client.Search(ctx, searchReq)
+		if err == nil || status.Code(err) != codes.Unavailable ||
+			attempt >= maxAttempts {
+			return stream, err
+		}
+
+		delay := searchRetryDelay(attempt)
+		if !stopAt.IsZero() && time.Now().Add(delay).After(stopAt) {
+			return stream, err
+		}
+
+		logging.Infof("n1fty: search retried in %v, attempt: %d, err: %v",
+			delay, attempt+1, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return stream, err
+		case <-timer.C:
+		}
+	}
+}
+
+// searchRetryDelay returns the delay ahead of the retry following the
+// attempt, the jittered fraction of which is picked at random.
+func searchRetryDelay(attempt int) time.Duration {
+	delay, maxBackoff := GetSearchRetryBackoff(), GetSearchRetryMaxBackoff()
+	for k := 0; k < attempt && delay < maxBackoff; k++ {
+		delay *= 2
+	}
+	if maxBackoff > 0 && delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	jitter := GetSearchRetryJitter()
+	if jitter > 1 {
+		jitter = 1
+	}
+	if jitter > 0 && delay > 0 {
+		spread := time.Duration(float64(delay) * jitter)
+		if spread > 0 {
+			delay = delay - spread + time.Duration(rand.Int63n(int64(spread)+1))
+		}
+	}
+
+	return delay
+}
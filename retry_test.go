@@ -0,0 +1,124 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	pb "github.com/couchbase/cbft/protobuf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSearchRetry(t *testing.T) {
+	defer SetSearchRetryMaxAttempts(GetSearchRetryMaxAttempts())
+	defer SetSearchRetryBackoff(GetSearchRetryBackoff())
+	defer SetSearchRetryMaxBackoff(GetSearchRetryMaxBackoff())
+	defer SetSearchRetryJitter(GetSearchRetryJitter())
+	defer SetSearchRetryMaxTime(GetSearchRetryMaxTime())
+
+	SetSearchRetryBackoff(10 * time.Millisecond)
+	SetSearchRetryMaxBackoff(10 * time.Millisecond)
+	SetSearchRetryJitter(0.5)
+
+	// the retries stop at the total time cap, with the attempts remaining,
+	// failing with the last error.
+	SetSearchRetryMaxAttempts(1000)
+	SetSearchRetryMaxTime(100 * time.Millisecond)
+
+	client := &fakeSearchClient{code: codes.Unavailable}
+	starttm := time.Now()
+	_, err := searchWithRetry(context.Background(), client, &pb.SearchRequest{})
+	elapsed := time.Since(starttm)
+
+	if client.searches() < 2 ||
+		int64(client.searches()) >= GetSearchRetryMaxAttempts() {
+		t.Fatalf("Expected the search retried until the cap, got: %d attempts",
+			client.searches())
+	}
+	if elapsed > time.Second {
+		t.Fatalf("Expected the retries to stop at the cap, took: %v", elapsed)
+	}
+	if expect := fmt.Sprintf("attempt %d", client.searches()); err == nil ||
+		status.Convert(err).Message() != expect {
+		t.Fatalf("Expected the last error: %s, got: %v", expect, err)
+	}
+
+	// as they do at the request's deadline, the sooner.
+	SetSearchRetryMaxTime(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+
+	client = &fakeSearchClient{code: codes.Unavailable}
+	starttm = time.Now()
+	if _, err = searchWithRetry(ctx, client, &pb.SearchRequest{}); err == nil {
+		t.Fatalf("Expected the search to fail")
+	}
+	if elapsed = time.Since(starttm); elapsed > time.Second ||
+		int64(client.searches()) >= GetSearchRetryMaxAttempts() {
+		t.Fatalf("Expected the retries to stop at the deadline, took: %v,"+
+			" attempts: %d", elapsed, client.searches())
+	}
+
+	// or once the attempts run out.
+	SetSearchRetryMaxAttempts(2)
+
+	client = &fakeSearchClient{code: codes.Unavailable}
+	searchWithRetry(context.Background(), client, &pb.SearchRequest{})
+	if client.searches() != 3 {
+		t.Fatalf("Expected 3 attempts, got: %d", client.searches())
+	}
+
+	// searches failing otherwise aren't retried.
+	client = &fakeSearchClient{code: codes.InvalidArgument}
+	searchWithRetry(context.Background(), client, &pb.SearchRequest{})
+	if client.searches() != 1 {
+		t.Fatalf("Expected a single attempt, got: %d", client.searches())
+	}
+}
+
+func TestSearchRetryDelay(t *testing.T) {
+	defer SetSearchRetryBackoff(GetSearchRetryBackoff())
+	defer SetSearchRetryMaxBackoff(GetSearchRetryMaxBackoff())
+	defer SetSearchRetryJitter(GetSearchRetryJitter())
+
+	SetSearchRetryBackoff(100 * time.Millisecond)
+	SetSearchRetryMaxBackoff(300 * time.Millisecond)
+
+	SetSearchRetryJitter(0)
+	for attempt, expect := range []time.Duration{100 * time.Millisecond,
+		200 * time.Millisecond, 300 * time.Millisecond,
+		300 * time.Millisecond} {
+		if delay := searchRetryDelay(attempt); delay != expect {
+			t.Fatalf("[%d] Expected delay: %v, got: %v", attempt, expect, delay)
+		}
+	}
+
+	// the jittered delays are spread within the fraction below the delay.
+	SetSearchRetryJitter(0.5)
+	seen := map[time.Duration]bool{}
+	for k := 0; k < 100; k++ {
+		delay := searchRetryDelay(1)
+		if delay < 100*time.Millisecond || delay > 200*time.Millisecond {
+			t.Fatalf("Expected a delay within [100ms, 200ms], got: %v", delay)
+		}
+		seen[delay] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("Expected the delays jittered, got: %v", seen)
+	}
+}
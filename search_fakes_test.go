@@ -0,0 +1,128 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/couchbase/cbft/protobuf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeStream is the gRPC stream of a search, serving the messages given
+// (or, if gated, those handed over until the gate's closed), each after
+// the delay, then ending with the error given (io.EOF if none).
+//
+// With a context, the stream ends once that's canceled, as a gRPC stream
+// does; if blocking, it holds off its end until then.
+type fakeStream struct {
+	grpc.ClientStream
+	ctx   context.Context
+	msgs  []*pb.StreamSearchResults
+	gate  chan *pb.StreamSearchResults
+	err   error
+	delay time.Duration
+	block bool
+	onEnd func() // called as the stream ends
+
+	received int32 // the messages served, updated atomically
+	ended    bool
+}
+
+func (s *fakeStream) Recv() (*pb.StreamSearchResults, error) {
+	if s.ctx != nil && s.ctx.Err() != nil {
+		return nil, s.end(status.Error(codes.Canceled, s.ctx.Err().Error()))
+	}
+
+	time.Sleep(s.delay)
+
+	if s.gate != nil {
+		if msg, ok := <-s.gate; ok {
+			atomic.AddInt32(&s.received, 1)
+			return msg, nil
+		}
+	} else if len(s.msgs) > 0 {
+		msg := s.msgs[0]
+		s.msgs = s.msgs[1:]
+		atomic.AddInt32(&s.received, 1)
+		return msg, nil
+	}
+
+	if s.block && s.ctx != nil {
+		<-s.ctx.Done()
+		return nil, s.end(s.ctx.Err())
+	}
+
+	if s.err != nil {
+		return nil, s.end(s.err)
+	}
+
+	return nil, s.end(io.EOF)
+}
+
+func (s *fakeStream) CloseSend() error { return nil }
+
+func (s *fakeStream) end(err error) error {
+	if !s.ended {
+		s.ended = true
+		if s.onEnd != nil {
+			s.onEnd()
+		}
+	}
+
+	return err
+}
+
+// fakeSearchClient serves the searches with the stream given (or a new
+// one per search, if newStream), unless it fails them with the error
+// given or else one with the code given, numbered by the attempt; started
+// (if any) is signaled of each search.
+type fakeSearchClient struct {
+	pb.SearchServiceClient
+	stream    pb.SearchService_SearchClient
+	newStream func(ctx context.Context) pb.SearchService_SearchClient
+	err       error
+	code      codes.Code
+	started   chan struct{}
+
+	attempts int32 // updated atomically
+}
+
+func (c *fakeSearchClient) Search(ctx context.Context, in *pb.SearchRequest,
+	opts ...grpc.CallOption) (pb.SearchService_SearchClient, error) {
+	attempt := atomic.AddInt32(&c.attempts, 1)
+	if c.started != nil {
+		c.started <- struct{}{}
+	}
+
+	switch {
+	case c.err != nil:
+		return nil, c.err
+	case c.code != codes.OK:
+		return nil, status.Error(c.code, fmt.Sprintf("attempt %d", attempt))
+	case c.newStream != nil:
+		return c.newStream(ctx), nil
+	}
+
+	return c.stream, nil
+}
+
+// searches returns the number of searches attempted.
+func (c *fakeSearchClient) searches() int {
+	return int(atomic.LoadInt32(&c.attempts))
+}
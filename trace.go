@@ -0,0 +1,173 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/cbft"
+	"github.com/couchbase/n1fty/util"
+	"github.com/couchbase/query/logging"
+)
+
+// slowQueryFirstByteThreshold is the time to the first response byte from
+// FTS past which a search is logged as slow (with a warning), 0 disables
+// it; as set by the "slowQueryFirstByteThresholdMS" config (in ms)
+var slowQueryFirstByteThreshold = int64(0)
+
+func GetSlowQueryFirstByteThreshold() time.Duration {
+	return time.Duration(atomic.LoadInt64(&slowQueryFirstByteThreshold))
+}
+
+func SetSlowQueryFirstByteThreshold(v time.Duration) {
+	atomic.StoreInt64(&slowQueryFirstByteThreshold, int64(v))
+}
+
+// slowQueryDurationThreshold is the duration past which a search is logged
+// as slow (with a warning), 0 disables it; as set by the
+// "slowQueryDurationThresholdMS" config (in ms)
+var slowQueryDurationThreshold = int64(0)
+
+func GetSlowQueryDurationThreshold() time.Duration {
+	return time.Duration(atomic.LoadInt64(&slowQueryDurationThreshold))
+}
+
+func SetSlowQueryDurationThreshold(v time.Duration) {
+	atomic.StoreInt64(&slowQueryDurationThreshold, int64(v))
+}
+
+// The stages of a search that are traced.
+const (
+	traceSargableCheck = "sargable-check"
+	traceBuildRequest  = "build-request"
+	traceStreamStart   = "stream-start"
+	traceFirstByte     = "first-byte"
+	traceBackfillStart = "backfill-start"
+	traceBackfillStop  = "backfill-stop"
+	traceDone          = "done"
+)
+
+// searchTrace logs a line per stage of a search, when the verbosity is at
+// least util.DebugVerbose, as:
+//
+//	n1fty: trace requestID="..." index="..." keyspace="..." stage=...
+//	  elapsed=... since=... [key=value ...]
+//
+// with elapsed being the time since the search started, and since that
+// since the previous stage; a nil searchTrace logs nothing.
+type searchTrace struct {
+	requestID string
+	index     string
+	keyspace  string
+	start     time.Time
+
+	m    sync.Mutex
+	last time.Time
+}
+
+func newSearchTrace(i *FTSIndex, requestID string) *searchTrace {
+	if util.Debug < util.DebugVerbose || i == nil {
+		return nil
+	}
+
+	t := &searchTrace{
+		requestID: requestID,
+		index:     i.Name(),
+		start:     time.Now(),
+	}
+	if i.indexer != nil {
+		t.keyspace = i.KeyspaceId()
+	}
+	t.last = t.start
+
+	return t
+}
+
+// stage logs the stage reached, along with the key/value pairs given.
+func (t *searchTrace) stage(stage string, kvs ...interface{}) {
+	if t == nil {
+		return
+	}
+
+	logging.Infof("%s", t.line(stage, time.Now(), kvs...))
+}
+
+func (t *searchTrace) line(stage string, now time.Time,
+	kvs ...interface{}) string {
+	t.m.Lock()
+	since := now.Sub(t.last)
+	t.last = now
+	t.m.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "n1fty: trace requestID=%q index=%q keyspace=%q"+
+		" stage=%s elapsed=%v since=%v", t.requestID, t.index, t.keyspace,
+		stage, now.Sub(t.start), since)
+
+	for x := 0; x+1 < len(kvs); x += 2 {
+		fmt.Fprintf(&b, " %v=%v", kvs[x], kvs[x+1])
+	}
+
+	return b.String()
+}
+
+// logSlowQuery warns of a search that reached the stage (traceFirstByte or
+// traceDone) past the threshold, if set.
+func logSlowQuery(i *FTSIndex, requestID string, sr *cbft.SearchRequest,
+	stage string, elapsed, threshold time.Duration, deadline time.Time) {
+	if line := slowQueryLine(i, requestID, sr, stage, elapsed, threshold,
+		deadline, time.Now()); line != "" {
+		logging.Warnf("%s", line)
+	}
+}
+
+// slowQueryLine returns the line logged of a slow search, as:
+//
+//	n1fty: slow query requestID="..." index="..." keyspace="..." stage=...
+//	  elapsed=... threshold=... deadline_in=... query=...
+//
+// with deadline_in being the time left until the request's deadline (if
+// any), or empty if the search isn't slow.
+func slowQueryLine(i *FTSIndex, requestID string, sr *cbft.SearchRequest,
+	stage string, elapsed, threshold time.Duration, deadline,
+	now time.Time) string {
+	if threshold <= 0 || elapsed <= threshold {
+		return ""
+	}
+
+	var index, keyspace string
+	if i != nil {
+		index = i.Name()
+		if i.indexer != nil {
+			keyspace = i.KeyspaceId()
+		}
+	}
+
+	deadlineIn := "none"
+	if !deadline.IsZero() {
+		deadlineIn = deadline.Sub(now).String()
+	}
+
+	var query string
+	if sr != nil {
+		query = string(sr.Q)
+	}
+
+	return fmt.Sprintf("n1fty: slow query requestID=%q index=%q keyspace=%q"+
+		" stage=%s elapsed=%v threshold=%v deadline_in=%s query=%s",
+		requestID, index, keyspace, stage, elapsed, threshold, deadlineIn,
+		query)
+}
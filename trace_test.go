@@ -0,0 +1,104 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/cbft"
+	"github.com/couchbase/n1fty/util"
+)
+
+func TestSearchTrace(t *testing.T) {
+	defer func(debug int) {
+		util.Debug = debug
+	}(util.Debug)
+
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.Debug = util.DebugOff
+	if trace := newSearchTrace(index, "req"); trace != nil {
+		t.Fatalf("Expected no trace with the verbosity off")
+	}
+	// a nil trace logs nothing, without failing.
+	(*searchTrace)(nil).stage(traceDone)
+
+	util.Debug = util.DebugOn
+	if trace := newSearchTrace(index, "req"); trace != nil {
+		t.Fatalf("Expected no trace with the verbosity at DebugOn")
+	}
+
+	util.Debug = util.DebugVerbose
+	trace := newSearchTrace(index, "req")
+	if trace == nil {
+		t.Fatalf("Expected a trace with the verbosity at DebugVerbose")
+	}
+
+	start := trace.start
+	line := trace.line(traceSargableCheck, start.Add(2*time.Millisecond),
+		"count", 1, "exact", true)
+	expect := `n1fty: trace requestID="req" index="` + index.Name() +
+		`" keyspace="" stage=sargable-check elapsed=2ms since=2ms` +
+		` count=1 exact=true`
+	if line != expect {
+		t.Fatalf("Expected: %s, got: %s", expect, line)
+	}
+
+	line = trace.line(traceDone, start.Add(5*time.Millisecond), "hits", 10)
+	expect = `n1fty: trace requestID="req" index="` + index.Name() +
+		`" keyspace="" stage=done elapsed=5ms since=3ms hits=10`
+	if line != expect {
+		t.Fatalf("Expected: %s, got: %s", expect, line)
+	}
+}
+
+func TestSlowQueryLine(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr := &cbft.SearchRequest{Q: []byte(`{"match":"paris","field":"city"}`)}
+	now := time.Now()
+
+	// off by default, and within the threshold.
+	if line := slowQueryLine(index, "req", sr, traceFirstByte, time.Hour,
+		GetSlowQueryFirstByteThreshold(), time.Time{}, now); line != "" {
+		t.Fatalf("Expected no line with the threshold off, got: %s", line)
+	}
+	if line := slowQueryLine(index, "req", sr, traceDone, time.Second,
+		2*time.Second, time.Time{}, now); line != "" {
+		t.Fatalf("Expected no line within the threshold, got: %s", line)
+	}
+
+	line := slowQueryLine(index, "req", sr, traceFirstByte, 3*time.Second,
+		2*time.Second, now.Add(5*time.Second), now)
+	expect := `n1fty: slow query requestID="req" index="` + index.Name() +
+		`" keyspace="" stage=first-byte elapsed=3s threshold=2s` +
+		` deadline_in=5s query={"match":"paris","field":"city"}`
+	if line != expect {
+		t.Fatalf("Expected: %s, got: %s", expect, line)
+	}
+
+	line = slowQueryLine(index, "req", sr, traceDone, 3*time.Second,
+		2*time.Second, time.Time{}, now)
+	expect = `n1fty: slow query requestID="req" index="` + index.Name() +
+		`" keyspace="" stage=done elapsed=3s threshold=2s` +
+		` deadline_in=none query={"match":"paris","field":"city"}`
+	if line != expect {
+		t.Fatalf("Expected: %s, got: %s", expect, line)
+	}
+}
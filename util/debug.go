@@ -16,7 +16,23 @@ import (
 	"strconv"
 )
 
-var Debug = 0
+// The verbosity levels of the logging, as set with CB_N1FTY_DEBUG.
+const (
+	// DebugOff logs nothing beyond the usual.
+	DebugOff = 0
+
+	// DebugOn logs each search, along with each of the sargability and
+	// pageability checks.
+	DebugOn = 1
+
+	// DebugVerbose additionally logs a line per stage of each search (with
+	// its timing), tagged with the request ID, index and keyspace.
+	DebugVerbose = 2
+)
+
+// Debug is the verbosity level of the logging, see DebugOn and
+// DebugVerbose.
+var Debug = DebugOff
 
 func init() {
 	v := os.Getenv("CB_N1FTY_DEBUG")
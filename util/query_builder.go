@@ -15,10 +15,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search"
 	"github.com/blevesearch/bleve/v2/search/query"
 	"github.com/couchbase/cbft"
 	pb "github.com/couchbase/cbft/protobuf"
@@ -77,6 +80,14 @@ func UpdateFieldsInQuery(q query.Query, field string) {
 		for i := 0; i < len(que.Disjuncts); i++ {
 			UpdateFieldsInQuery(que.Disjuncts[i], field)
 		}
+	case *query.PhraseQuery:
+		if que.Field == "" {
+			que.Field = field
+		}
+	case *query.MultiPhraseQuery:
+		if que.Field == "" {
+			que.Field = field
+		}
 	default:
 		if fq, ok := que.(query.FieldableQuery); ok {
 			if fq.Field() == "" {
@@ -86,6 +97,155 @@ func UpdateFieldsInQuery(q query.Query, field string) {
 	}
 }
 
+// RewriteQueryFields returns a copy of the search request, with the
+// fields of its query renamed per the provided aliases (field -> name
+// indexed under); the original search request is left untouched.
+func RewriteQueryFields(sr *cbft.SearchRequest, aliases map[string]string) (
+	*cbft.SearchRequest, error) {
+	if sr == nil || len(aliases) == 0 {
+		return sr, nil
+	}
+
+	q, err := query.ParseQuery(sr.Q)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err = rewriteQueryFields(q, aliases)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := *sr
+	rv.Q, err = json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rv, nil
+}
+
+// QueryConjuncts returns the clauses (as JSON) of the search request's
+// query, if it's a conjunction.
+func QueryConjuncts(sr *cbft.SearchRequest) ([]json.RawMessage, error) {
+	if sr == nil || len(sr.Q) == 0 {
+		return nil, nil
+	}
+
+	q, err := query.ParseQuery(sr.Q)
+	if err != nil {
+		return nil, err
+	}
+
+	cq, ok := q.(*query.ConjunctionQuery)
+	if !ok {
+		return nil, nil
+	}
+
+	rv := make([]json.RawMessage, 0, len(cq.Conjuncts))
+	for _, c := range cq.Conjuncts {
+		b, err := json.Marshal(c)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, b)
+	}
+
+	return rv, nil
+}
+
+// ConjunctsSearchRequest returns a copy of the search request, with its
+// query replaced by a conjunction of the provided clauses; the original
+// search request is left untouched.
+func ConjunctsSearchRequest(sr *cbft.SearchRequest,
+	conjuncts []json.RawMessage) (*cbft.SearchRequest, error) {
+	q, err := json.Marshal(map[string]interface{}{"conjuncts": conjuncts})
+	if err != nil {
+		return nil, err
+	}
+
+	rv := *sr
+	rv.Q = q
+
+	return &rv, nil
+}
+
+// QueryClauseTerm returns the field and the term of a clause (as JSON)
+// that's a term or a match query, with ok false for any other clause.
+func QueryClauseTerm(clause json.RawMessage) (field, term string, ok bool) {
+	q, err := query.ParseQuery(clause)
+	if err != nil {
+		return "", "", false
+	}
+
+	switch que := q.(type) {
+	case *query.TermQuery:
+		return que.FieldVal, que.Term, true
+	case *query.MatchQuery:
+		return que.FieldVal, que.Match, true
+	}
+
+	return "", "", false
+}
+
+func rewriteQueryFields(q query.Query, aliases map[string]string) (
+	query.Query, error) {
+	var err error
+	switch que := q.(type) {
+	case *query.BooleanQuery:
+		if que.Must, err = rewriteQueryFields(que.Must, aliases); err != nil {
+			return nil, err
+		}
+		if que.Should, err = rewriteQueryFields(que.Should, aliases); err != nil {
+			return nil, err
+		}
+		if que.MustNot, err = rewriteQueryFields(que.MustNot, aliases); err != nil {
+			return nil, err
+		}
+	case *query.ConjunctionQuery:
+		for i := 0; i < len(que.Conjuncts); i++ {
+			que.Conjuncts[i], err = rewriteQueryFields(que.Conjuncts[i], aliases)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case *query.DisjunctionQuery:
+		for i := 0; i < len(que.Disjuncts); i++ {
+			que.Disjuncts[i], err = rewriteQueryFields(que.Disjuncts[i], aliases)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case *query.QueryStringQuery:
+		// the fields are embedded within the query string, so it is
+		// replaced with the query it parses into, carrying over its boost.
+		parsed, err := que.Parse()
+		if err != nil {
+			return nil, err
+		}
+		if bq, ok := parsed.(query.BoostableQuery); ok && que.BoostVal != nil {
+			bq.SetBoost(que.Boost())
+		}
+		return rewriteQueryFields(parsed, aliases)
+	case *query.PhraseQuery:
+		if name, exists := aliases[que.Field]; exists {
+			que.Field = name
+		}
+	case *query.MultiPhraseQuery:
+		if name, exists := aliases[que.Field]; exists {
+			que.Field = name
+		}
+	default:
+		if fq, ok := que.(query.FieldableQuery); ok {
+			if name, exists := aliases[fq.Field()]; exists {
+				fq.SetField(name)
+			}
+		}
+	}
+
+	return q, nil
+}
+
 // -----------------------------------------------------------------------------
 
 func BuildQuery(field string, input value.Value) (q query.Query, err error) {
@@ -191,39 +351,237 @@ func CheckForPagination(input value.Value) bool {
 	return false
 }
 
+// ScoreOrderedOnly returns true if the only pagination within the search
+// request (see CheckForPagination) is a sort by descending score, i.e. the
+// native order of FTS, with the order (pushed down) either absent or the
+// same, so the hits up to offset+limit are those ordered as requested.
+func ScoreOrderedOnly(input value.Value, order []string) bool {
+	if input == nil {
+		return false
+	}
+
+	srBytes, err := input.MarshalJSON()
+	if err != nil {
+		return false
+	}
+
+	sr, _, err := unmarshalSearchRequest("", srBytes)
+	if err != nil {
+		return false
+	}
+
+	if (sr.Size != nil && *(sr.Size) >= 0 && *(sr.Size) != math.MaxInt64) ||
+		(sr.From != nil && *(sr.From) > 0) || len(sr.Sort) != 1 {
+		return false
+	}
+
+	if !sortsByDescendingScore(sr.Sort) {
+		return false
+	}
+
+	if len(order) == 0 {
+		return true
+	}
+
+	sortJSON, err := SortFromOrder(order)
+	return err == nil && sortsByDescendingScore(sortJSON)
+}
+
+// sortsByDescendingScore returns true if the sort is solely by descending
+// score.
+func sortsByDescendingScore(sortJSON []json.RawMessage) bool {
+	sortOrder, err := search.ParseSortOrderJSON(sortJSON)
+	if err != nil || len(sortOrder) != 1 {
+		return false
+	}
+
+	so, ok := sortOrder[0].(*search.SortScore)
+	return ok && so.Desc
+}
+
+// SkipScoring returns the search request with scoring disabled (a copy,
+// with its score set to "none") when the hits aren't to be scored, as
+// requested by the score option, or else when they're known to be ordered
+// (as per the search request's sort, else the order pushed down) by
+// anything but score; a score setting within the search request itself
+// is left as is.
+func SkipScoring(sr *cbft.SearchRequest, order []string,
+	score *bool) *cbft.SearchRequest {
+	if sr == nil || sr.Score != "" {
+		return sr
+	}
+
+	if score != nil {
+		if *score {
+			return sr
+		}
+	} else if len(sr.Sort) == 0 && len(order) == 0 {
+		// the hits could be ordered by score by the query engine itself.
+		return sr
+	} else if SortsByScore(sr.Sort, order) {
+		return sr
+	}
+
+	rv := *sr
+	rv.Score = "none"
+	return &rv
+}
+
+// KeysOnlyInSearchRequest returns a copy of the search request requesting
+// none of the metadata of the hits (stored fields, highlights, locations,
+// explanations and facets), nor their scores unless the hits are sorted by
+// score, if only the keys of the hits are to be returned.
+func KeysOnlyInSearchRequest(sr *cbft.SearchRequest, order []string,
+	keysOnly bool) *cbft.SearchRequest {
+	if sr == nil || !keysOnly {
+		return sr
+	}
+
+	rv := *sr
+	rv.Fields, rv.Highlight, rv.Facets = nil, nil, nil
+	rv.IncludeLocations, rv.Explain = false, false
+
+	// with no sort, the hits aren't ordered by the query engine by their
+	// scores, as those aren't returned.
+	if rv.Score == "" && ((len(rv.Sort) == 0 && len(order) == 0) ||
+		!SortsByScore(rv.Sort, order)) {
+		rv.Score = "none"
+	}
+
+	return &rv
+}
+
+// SortsByScore returns true if the sort (or else the order pushed down)
+// orders the hits by score, as it does in case the sort isn't parsable.
+func SortsByScore(sorts []json.RawMessage, order []string) bool {
+	if len(sorts) > 0 {
+		for _, s := range sorts {
+			ss, err := search.ParseSearchSortJSON(s)
+			if err != nil {
+				return true
+			}
+
+			if _, ok := ss.(*search.SortScore); ok {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, so := range order {
+		fields := strings.Fields(so)
+		if len(fields) > 0 && (fields[0] == "score" || fields[0] == "_score") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GeoDistanceSorts returns the geo distance sorts (over geopoint fields)
+// in the given sort order, ok is false if the order is empty or sorts by
+// anything but distance.
+func GeoDistanceSorts(sorts []json.RawMessage) (
+	rv []*search.SortGeoDistance, ok bool) {
+	if len(sorts) == 0 {
+		return nil, false
+	}
+
+	for _, s := range sorts {
+		ss, err := search.ParseSearchSortJSON(s)
+		if err != nil {
+			return nil, false
+		}
+
+		gs, isGeo := ss.(*search.SortGeoDistance)
+		if !isGeo {
+			return nil, false
+		}
+		rv = append(rv, gs)
+	}
+
+	return rv, true
+}
+
+// GeoDistanceSortFields returns the fields the search request in the given
+// value sorts by distance over, ok is false if the request carries any
+// other pagination details (from, size or sorts).
+func GeoDistanceSortFields(input value.Value) (fields []string, ok bool) {
+	if input == nil {
+		return nil, false
+	}
+
+	srBytes, err := input.MarshalJSON()
+	if err != nil {
+		return nil, false
+	}
+
+	sr, _, err := unmarshalSearchRequest("", srBytes)
+	if err != nil {
+		return nil, false
+	}
+
+	if (sr.Size != nil && *(sr.Size) >= 0 && *(sr.Size) != math.MaxInt64) ||
+		(sr.From != nil && *(sr.From) > 0) {
+		return nil, false
+	}
+
+	sorts, ok := GeoDistanceSorts(sr.Sort)
+	if !ok {
+		return nil, false
+	}
+
+	for _, gs := range sorts {
+		fields = append(fields, gs.Field)
+	}
+
+	return fields, true
+}
+
+// IndexIdentity identifies the FTS index that a request is routed to, by
+// its name qualified with the keyspace it's defined within, along with its
+// UUID, as the names alone may collide across keyspaces.
+type IndexIdentity struct {
+	Name   string
+	UUID   string
+	Bucket string
+	Scope  string
+}
+
+// QualifiedName returns the name of the index qualified with its bucket
+// and scope, as in "bucket.scope.name", unless it's qualified already, or
+// the index is defined within the default scope (or the keyspace isn't
+// known), such indexes being named as is.
+func (id IndexIdentity) QualifiedName() string {
+	if id.Bucket == "" || id.Scope == "" || id.Scope == "_default" {
+		return id.Name
+	}
+
+	prefix := id.Bucket + "." + id.Scope + "."
+	if strings.HasPrefix(id.Name, prefix) {
+		return id.Name
+	}
+
+	return prefix + id.Name
+}
+
 func BuildProtoSearchRequest(sr *cbft.SearchRequest,
 	searchInfo *datastore.FTSSearchInfo, vector timestamp.Vector,
 	consistencyLevel datastore.ScanConsistency,
-	indexName string) (*pb.SearchRequest, error) {
+	index IndexIdentity) (*pb.SearchRequest, error) {
 	searchRequest := &pb.SearchRequest{
-		IndexName: indexName,
+		IndexName: index.QualifiedName(),
+		IndexUUID: index.UUID,
 	}
 
 	// if original request was of query form then, override with
 	// searchInfo order details
 	if sr.Sort == nil && len(searchInfo.Order) > 0 {
-		var tempOrder []string
-		for _, so := range searchInfo.Order {
-			fields := strings.Fields(so)
-			field := fields[0]
-			if field == "score" || field == "id" {
-				field = "_" + field
-			}
-
-			if len(fields) == 1 || (len(fields) == 2 &&
-				fields[1] == "ASC") {
-				tempOrder = append(tempOrder, field)
-				continue
-			}
-
-			tempOrder = append(tempOrder, "-"+field)
-		}
-
-		sr.Sort = make([]json.RawMessage, len(tempOrder))
-		for i := range tempOrder {
-			if err := sr.Sort[i].UnmarshalJSON([]byte(tempOrder[i])); err != nil {
-				return nil, err
-			}
+		var err error
+		sr.Sort, err = SortFromOrder(searchInfo.Order)
+		if err != nil {
+			return nil, err
 		}
 	}
 
@@ -264,44 +622,483 @@ func BuildProtoSearchRequest(sr *cbft.SearchRequest,
 		return nil, err
 	}
 
-	if consistencyLevel == datastore.AT_PLUS &&
-		vector != nil && len(vector.Entries()) > 0 {
-		ctlParams := &pb.QueryCtlParams{
-			Ctl: &pb.QueryCtl{
-				Timeout: cbgt.QUERY_CTL_DEFAULT_TIMEOUT_MS,
-				Consistency: &pb.ConsistencyParams{
-					Level:   "at_plus",
-					Vectors: make(map[string]*pb.ConsistencyVectors, 1),
-				},
-			},
+	if consistencyLevel == datastore.AT_PLUS {
+		searchRequest.QueryCtlParams, err = buildAtPlusQueryCtlParams(
+			vector, searchRequest.IndexName)
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	return searchRequest, nil
+}
 
-		vMap := &pb.ConsistencyVectors{
-			ConsistencyVector: make(map[string]uint64, 1024),
+// SortFromOrder returns the sort of a search request as per the order
+// (for ex. "name DESC"), with the "score" and "id" sorted by as "_score"
+// and "_id".
+func SortFromOrder(order []string) ([]json.RawMessage, error) {
+	var tempOrder []string
+	for _, so := range order {
+		fields := strings.Fields(so)
+		field := fields[0]
+		if field == "score" || field == "id" {
+			field = "_" + field
 		}
 
-		for _, entry := range vector.Entries() {
-			key := strconv.FormatInt(int64(entry.Position()), 10) + "/" + entry.Guard()
-			vMap.ConsistencyVector[key] = uint64(entry.Value())
+		if len(fields) == 1 || (len(fields) == 2 &&
+			fields[1] == "ASC") {
+			tempOrder = append(tempOrder, field)
+			continue
 		}
 
-		ctlParams.Ctl.Consistency.Vectors[indexName] = vMap
+		tempOrder = append(tempOrder, "-"+field)
+	}
 
-		searchRequest.QueryCtlParams, err = json.Marshal(ctlParams)
+	rv := make([]json.RawMessage, len(tempOrder))
+	for i := range tempOrder {
+		sortBytes, err := json.Marshal(tempOrder[i])
 		if err != nil {
 			return nil, err
 		}
+		rv[i] = sortBytes
 	}
 
-	return searchRequest, nil
+	return rv, nil
+}
+
+// DeterministicSort returns the sort with the document ID appended to it
+// as the tie breaker (unless sorted by already), so the hits are ordered
+// totally, along with whether it was appended. A sort by score isn't
+// deterministic across searches resumed after a hit, so is rejected.
+func DeterministicSort(sortJSON []json.RawMessage) (
+	[]json.RawMessage, bool, error) {
+	if len(sortJSON) == 0 {
+		return nil, false, fmt.Errorf("a sort order is required")
+	}
+
+	sortOrder, err := search.ParseSortOrderJSON(sortJSON)
+	if err != nil {
+		return nil, false, err
+	}
+
+	byID := false
+	for _, so := range sortOrder {
+		if so.RequiresScoring() {
+			return nil, false, fmt.Errorf("sort order by score unsupported")
+		}
+		byID = byID || so.RequiresDocID()
+	}
+
+	if byID {
+		return sortJSON, false, nil
+	}
+
+	rv := append(append([]json.RawMessage(nil), sortJSON...),
+		json.RawMessage(`"_id"`))
+
+	return rv, true, nil
+}
+
+// BuildProtoCountRequest returns a request counting the documents that
+// the search request matches, i.e. fetching none of the hits (and so
+// neither sorting nor scoring them), but only the total.
+func BuildProtoCountRequest(sr *cbft.SearchRequest,
+	index IndexIdentity) (*pb.SearchRequest, error) {
+	csr := *sr
+	zero := 0
+	csr.Size, csr.From = &zero, &zero
+	csr.Limit, csr.Offset = nil, nil
+	csr.Sort, csr.SearchAfter, csr.SearchBefore = nil, nil, nil
+	csr.Highlight, csr.Fields, csr.Facets = nil, nil, nil
+	csr.Score = "none"
+
+	contents, err := json.Marshal(&csr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.SearchRequest{
+		IndexName: index.QualifiedName(),
+		IndexUUID: index.UUID,
+		Contents:  contents,
+	}, nil
+}
+
+// BuildProtoFreshnessRequest returns a count request over the index that
+// waits for it to catch up with the scan vector, for no longer than the
+// staleness bound (in milliseconds); as FTS doesn't support a time bounded
+// consistency, the bounded staleness is checked this way ahead of the
+// search, which is then performed without waiting.
+func BuildProtoFreshnessRequest(sr *cbft.SearchRequest,
+	vector timestamp.Vector, index IndexIdentity,
+	stalenessMS int64) (*pb.SearchRequest, error) {
+	countReq, err := BuildProtoCountRequest(sr, index)
+	if err != nil {
+		return nil, err
+	}
+
+	countReq.QueryCtlParams, err = buildAtPlusQueryCtlParams(vector,
+		countReq.IndexName)
+	if err != nil {
+		return nil, fmt.Errorf("bounded consistency: %v", err)
+	}
+
+	err = SetQueryCtlTimeout(countReq, stalenessMS)
+	if err != nil {
+		return nil, err
+	}
+
+	return countReq, nil
+}
+
+// DateRange is a date range query, with its start and end as given, as
+// bleve parses them into times (with the query's date/time parser) that
+// don't carry whether a time zone was set.
+type DateRange struct {
+	Field          string
+	Start          string
+	End            string
+	InclusiveStart *bool
+	InclusiveEnd   *bool
+}
+
+// timeZoneRE matches a date/time string ending with a time of day along
+// with a time zone, as an offset (Ex: "+05:30", "-0700") or as "Z".
+var timeZoneRE = regexp.MustCompile(
+	`\d{2}:\d{2}(:\d{2}(\.\d+)?)?\s*(Z|z|[+-]\d{2}(:?\d{2})?)$`)
+
+// HasTimeZone returns true if the start or end of the range carries a
+// time zone.
+func (dr *DateRange) HasTimeZone() bool {
+	return timeZoneRE.MatchString(dr.Start) || timeZoneRE.MatchString(dr.End)
+}
+
+// FetchDateRanges returns the date range queries within the query (or
+// that of the search request), with those without a field set being of
+// the field given; the date ranges of a query string aren't available.
+func FetchDateRanges(field string, input value.Value) ([]*DateRange, error) {
+	if input == nil || input.Type() != value.OBJECT {
+		return nil, nil
+	}
+
+	q := input.Actual()
+	if qf, ok := input.Field("query"); ok && qf.Type() == value.OBJECT {
+		q = qf.Actual()
+	}
+
+	field = CleanseField(field)
+
+	var rv []*DateRange
+	var walk func(v interface{}) error
+	walk = func(v interface{}) error {
+		switch vv := v.(type) {
+		case []interface{}:
+			for _, entry := range vv {
+				if err := walk(entry); err != nil {
+					return err
+				}
+			}
+		case map[string]interface{}:
+			_, hasStart := vv["start"]
+			_, hasEnd := vv["end"]
+			if !hasStart && !hasEnd {
+				keys := make([]string, 0, len(vv))
+				for k := range vv {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+
+				for _, k := range keys {
+					if err := walk(vv[k]); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			dr := &DateRange{Field: field}
+			if f, ok := vv["field"].(string); ok && f != "" {
+				dr.Field = f
+			}
+
+			for k, dst := range map[string]*string{
+				"start": &dr.Start, "end": &dr.End} {
+				if val, exists := vv[k]; exists {
+					str, ok := val.(string)
+					if !ok {
+						return fmt.Errorf("date range: %v, %s must be a string",
+							value.NewValue(vv).String(), k)
+					}
+					*dst = str
+				}
+			}
+
+			for k, dst := range map[string]**bool{
+				"inclusive_start": &dr.InclusiveStart,
+				"inclusive_end":   &dr.InclusiveEnd} {
+				if val, ok := vv[k].(bool); ok {
+					*dst = &val
+				}
+			}
+
+			rv = append(rv, dr)
+		}
+
+		return nil
+	}
+
+	if err := walk(q); err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+// buildAtPlusQueryCtlParams converts the mutation vector supplied with
+// the AT_PLUS scan consistency into the per-vbucket seqno consistency
+// requirements ("vbno/vbuuid" -> seqno) of the index.
+func buildAtPlusQueryCtlParams(vector timestamp.Vector, indexName string) (
+	[]byte, error) {
+	if vector == nil || len(vector.Entries()) == 0 {
+		return nil, fmt.Errorf("scan consistency at_plus requires a" +
+			" non-empty scan vector")
+	}
+
+	entries := vector.Entries()
+	vMap := &pb.ConsistencyVectors{
+		ConsistencyVector: make(map[string]uint64, len(entries)),
+	}
+
+	for _, entry := range entries {
+		if entry == nil {
+			return nil, fmt.Errorf("scan vector has a missing entry")
+		}
+
+		if len(entry.Guard()) == 0 {
+			return nil, fmt.Errorf("scan vector entry for vbucket: %d"+
+				" has no vbuuid", entry.Position())
+		}
+
+		key := strconv.FormatInt(int64(entry.Position()), 10) + "/" + entry.Guard()
+		if _, exists := vMap.ConsistencyVector[key]; exists {
+			return nil, fmt.Errorf("scan vector has duplicate entries for"+
+				" vbucket: %d", entry.Position())
+		}
+
+		vMap.ConsistencyVector[key] = entry.Value()
+	}
+
+	ctlParams := &pb.QueryCtlParams{
+		Ctl: &pb.QueryCtl{
+			Timeout: cbgt.QUERY_CTL_DEFAULT_TIMEOUT_MS,
+			Consistency: &pb.ConsistencyParams{
+				Level: "at_plus",
+				Vectors: map[string]*pb.ConsistencyVectors{
+					indexName: vMap,
+				},
+			},
+		},
+	}
+
+	return json.Marshal(ctlParams)
+}
+
+// SetQueryCtlTimeout applies the timeout over the request's query control
+// params, retaining the consistency requirements already set within.
+func SetQueryCtlTimeout(searchRequest *pb.SearchRequest, timeoutMS int64) error {
+	ctlParams := &pb.QueryCtlParams{}
+	if len(searchRequest.QueryCtlParams) > 0 {
+		err := json.Unmarshal(searchRequest.QueryCtlParams, ctlParams)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ctlParams.Ctl == nil {
+		ctlParams.Ctl = &pb.QueryCtl{}
+	}
+	ctlParams.Ctl.Timeout = timeoutMS
+
+	var err error
+	searchRequest.QueryCtlParams, err = json.Marshal(ctlParams)
+	return err
+}
+
+// IncludeFieldsInSearchRequest returns a copy of the SearchRequest with
+// the fields added to those requested to be returned (if stored) along
+// with the hits.
+func IncludeFieldsInSearchRequest(sr *cbft.SearchRequest,
+	fields []string) *cbft.SearchRequest {
+	if sr == nil || len(fields) == 0 {
+		return sr
+	}
+
+	rv := *sr
+	rv.Fields = copyStrings(sr.Fields)
+	for _, field := range fields {
+		rv.Fields = appendUnique(rv.Fields, field)
+	}
+
+	return &rv
+}
+
+// IncludeLocationsInSearchRequest returns a copy of the search request
+// requesting the locations of the terms matched be reported along with
+// the hits, if include is set.
+func IncludeLocationsInSearchRequest(sr *cbft.SearchRequest,
+	include bool) *cbft.SearchRequest {
+	if sr == nil || !include {
+		return sr
+	}
+
+	rv := *sr
+	rv.IncludeLocations = true
+	return &rv
+}
+
+// ExplainInSearchRequest returns a copy of the search request requesting
+// the breakdown of the score of each hit be reported along with it, if
+// explain is set.
+func ExplainInSearchRequest(sr *cbft.SearchRequest,
+	explain bool) *cbft.SearchRequest {
+	if sr == nil || !explain {
+		return sr
+	}
+
+	rv := *sr
+	rv.Explain = true
+	return &rv
+}
+
+// HighlightInSearchRequest returns a copy of the search request requesting
+// the terms matched within the hits be highlighted, in the style and over
+// the fields given, if requested.
+func HighlightInSearchRequest(sr *cbft.SearchRequest,
+	highlight *HighlightOption) *cbft.SearchRequest {
+	if sr == nil || highlight == nil {
+		return sr
+	}
+
+	rv := *sr
+	rv.Highlight = &bleve.HighlightRequest{
+		Fields: append([]string(nil), highlight.Fields...),
+	}
+	if highlight.Style != "" {
+		style := highlight.Style
+		rv.Highlight.Style = &style
+	}
+
+	return &rv
+}
+
+// CollapseInSearchRequest returns a copy of the search request requesting
+// the value of the field the hits are collapsed by be returned along with
+// them, if collapsing is requested.
+func CollapseInSearchRequest(sr *cbft.SearchRequest,
+	collapse *CollapseOption) *cbft.SearchRequest {
+	if collapse == nil {
+		return sr
+	}
+
+	return IncludeFieldsInSearchRequest(sr, []string{collapse.Field})
+}
+
+// SortInSearchRequest returns a copy of the search request sorted as per
+// the sort option (see SearchOptions.Sort), if requested, unless the
+// request sorts the hits itself.
+func SortInSearchRequest(sr *cbft.SearchRequest,
+	sortOpt []string) (*cbft.SearchRequest, error) {
+	if sr == nil || len(sortOpt) == 0 || len(sr.Sort) > 0 {
+		return sr, nil
+	}
+
+	rv := make([]json.RawMessage, len(sortOpt))
+	for x, s := range sortOpt {
+		sortBytes, err := json.Marshal(s)
+		if err != nil {
+			return nil, err
+		}
+		rv[x] = sortBytes
+	}
+
+	srCopy := *sr
+	srCopy.Sort = rv
+	return &srCopy, nil
+}
+
+// SortMatchesOrder returns true if the order (of the query engine, as
+// pushed down) is that of the sort, i.e. sorts by the same fields in the
+// same directions.
+func SortMatchesOrder(sortOpt []string, order []string) bool {
+	sortJSON, err := SortFromOrder(order)
+	if err != nil || len(sortJSON) != len(sortOpt) {
+		return false
+	}
+
+	for x, s := range sortOpt {
+		var got string
+		if err = json.Unmarshal(sortJSON[x], &got); err != nil || got != s {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CursorInSearchRequest returns a copy of the search request with the
+// cursor the hits are to follow (after) or precede (before), if any; an
+// empty cursor to follow is that of the first page.
+func CursorInSearchRequest(sr *cbft.SearchRequest,
+	after, before []string) *cbft.SearchRequest {
+	if sr == nil || (len(after) == 0 && len(before) == 0) {
+		return sr
+	}
+
+	rv := *sr
+	if len(after) > 0 {
+		rv.SearchAfter = copyStrings(after)
+	}
+	if len(before) > 0 {
+		rv.SearchBefore = copyStrings(before)
+	}
+
+	return &rv
+}
+
+// ExcludeFieldsFromSearchRequest returns a copy of the search request with
+// the fields dropped from those requested to be fetched along with the
+// hits; fields matched by a "*" requested are dropped from the hits as
+// they're received instead.
+func ExcludeFieldsFromSearchRequest(sr *cbft.SearchRequest,
+	fields []string) *cbft.SearchRequest {
+	if sr == nil || len(sr.Fields) == 0 || len(fields) == 0 {
+		return sr
+	}
+
+	excluded := make(map[string]struct{}, len(fields))
+	for _, field := range fields {
+		excluded[field] = struct{}{}
+	}
+
+	rv := *sr
+	rv.Fields = nil
+	for _, field := range sr.Fields {
+		if _, exists := excluded[field]; !exists {
+			rv.Fields = append(rv.Fields, field)
+		}
+	}
+
+	return &rv
 }
 
-// Sets collection information within the provided SearchRequest
+// Returns a copy of the provided SearchRequest with the collection
+// information set
 func DecorateSearchRequest(sr *cbft.SearchRequest, collection string) *cbft.SearchRequest {
 	if sr == nil || len(collection) == 0 {
 		return sr
 	}
 
-	sr.Collections = []string{collection}
-	return sr
+	rv := *sr
+	rv.Collections = []string{collection}
+	return &rv
 }
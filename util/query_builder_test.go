@@ -17,7 +17,11 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/blevesearch/bleve/v2"
 	"github.com/blevesearch/bleve/v2/search/query"
+	pb "github.com/couchbase/cbft/protobuf"
+	"github.com/couchbase/query/datastore"
+	"github.com/couchbase/query/timestamp"
 	"github.com/couchbase/query/value"
 )
 
@@ -315,3 +319,1198 @@ func TestBuildSearchRequest(t *testing.T) {
 		}
 	}
 }
+
+type testVectorEntry struct {
+	position uint32
+	guard    string
+	value    uint64
+}
+
+func (e *testVectorEntry) Position() uint32 { return e.position }
+func (e *testVectorEntry) Guard() string    { return e.guard }
+func (e *testVectorEntry) Value() uint64    { return e.value }
+
+type testVector []timestamp.Entry
+
+func (v testVector) Entries() []timestamp.Entry { return v }
+
+func TestBuildProtoSearchRequestAtPlus(t *testing.T) {
+	sr, _, err := BuildSearchRequest("", value.NewValue(map[string]interface{}{
+		"query": map[string]interface{}{
+			"match": "avengers",
+			"field": "title",
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vector := testVector{
+		&testVectorEntry{position: 0, guard: "171238347563", value: 12},
+		&testVectorEntry{position: 5, guard: "28919283712", value: 100},
+		&testVectorEntry{position: 1023, guard: "3837126371", value: 7},
+	}
+
+	searchReq, err := BuildProtoSearchRequest(sr,
+		&datastore.FTSSearchInfo{Limit: math.MaxInt64},
+		vector, datastore.AT_PLUS, IndexIdentity{Name: "idx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ctlParams pb.QueryCtlParams
+	err = json.Unmarshal(searchReq.QueryCtlParams, &ctlParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ctlParams.Ctl == nil || ctlParams.Ctl.Consistency == nil ||
+		ctlParams.Ctl.Consistency.Level != "at_plus" ||
+		len(ctlParams.Ctl.Consistency.Vectors) != 1 ||
+		ctlParams.Ctl.Consistency.Vectors["idx"] == nil {
+		t.Fatalf("Unexpected consistency params: %s", searchReq.QueryCtlParams)
+	}
+
+	expect := map[string]uint64{
+		"0/171238347563":  12,
+		"5/28919283712":   100,
+		"1023/3837126371": 7,
+	}
+	got := ctlParams.Ctl.Consistency.Vectors["idx"].ConsistencyVector
+	if !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Expected consistency vector: %v, got: %v", expect, got)
+	}
+
+	// the timeout applied thereafter should retain the consistency params
+	err = SetQueryCtlTimeout(searchReq, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctlParams = pb.QueryCtlParams{}
+	err = json.Unmarshal(searchReq.QueryCtlParams, &ctlParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ctlParams.Ctl.Timeout != 5000 || ctlParams.Ctl.Consistency == nil ||
+		!reflect.DeepEqual(expect,
+			ctlParams.Ctl.Consistency.Vectors["idx"].ConsistencyVector) {
+		t.Fatalf("Unexpected ctl params: %s", searchReq.QueryCtlParams)
+	}
+}
+
+func TestSearchTimeoutEncoded(t *testing.T) {
+	sr, _, err := BuildSearchRequest("", value.NewValue(map[string]interface{}{
+		"query": map[string]interface{}{"match": "paris", "field": "city"},
+		"ctl":   map[string]interface{}{"timeout": 10000},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		options    map[string]interface{}
+		ctlTimeout int64
+		expect     int64
+	}{
+		{expect: 120000},
+		{ctlTimeout: 10000, expect: 10000},
+		// the timeout option overrides that of the search request
+		{options: map[string]interface{}{"timeout": 250}, ctlTimeout: 10000,
+			expect: 250},
+		{options: map[string]interface{}{"timeout": 250}, expect: 250},
+	}
+
+	for testi, test := range tests {
+		opts, err := ParseSearchOptions(value.NewValue(test.options))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		searchReq, err := BuildProtoSearchRequest(sr,
+			&datastore.FTSSearchInfo{Limit: math.MaxInt64}, nil,
+			datastore.UNBOUNDED, IndexIdentity{Name: "idx"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = SetQueryCtlTimeout(searchReq,
+			SearchTimeoutMS(test.ctlTimeout, opts))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ctlParams pb.QueryCtlParams
+		err = json.Unmarshal(searchReq.QueryCtlParams, &ctlParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ctlParams.Ctl == nil || ctlParams.Ctl.Timeout != test.expect {
+			t.Fatalf("[%d] Expected the timeout: %d, got ctl params: %s",
+				testi, test.expect, searchReq.QueryCtlParams)
+		}
+	}
+}
+
+func TestBuildProtoSearchRequestQualifiedIndex(t *testing.T) {
+	tests := []struct {
+		index IndexIdentity
+		name  string
+	}{
+		{index: IndexIdentity{Name: "idx", UUID: "u1", Bucket: "travel",
+			Scope: "inventory"}, name: "travel.inventory.idx"},
+		// qualified already, as with the definitions of scoped indexes
+		{index: IndexIdentity{Name: "travel.inventory.idx", UUID: "u2",
+			Bucket: "travel", Scope: "inventory"}, name: "travel.inventory.idx"},
+		// the indexes over the default scope are named as is
+		{index: IndexIdentity{Name: "idx", UUID: "u3", Bucket: "travel",
+			Scope: "_default"}, name: "idx"},
+		{index: IndexIdentity{Name: "idx", UUID: "u4"}, name: "idx"},
+	}
+
+	vector := testVector{
+		&testVectorEntry{position: 5, guard: "28919283712", value: 100},
+	}
+
+	for _, test := range tests {
+		sr, _, err := BuildSearchRequest("", value.NewValue(
+			map[string]interface{}{
+				"query": map[string]interface{}{"match": "x", "field": "f"},
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		searchReq, err := BuildProtoSearchRequest(sr,
+			&datastore.FTSSearchInfo{Limit: 10}, vector, datastore.AT_PLUS,
+			test.index)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if searchReq.IndexName != test.name ||
+			searchReq.IndexUUID != test.index.UUID {
+			t.Fatalf("[%+v] Expected the index: %s (%s), got: %s (%s)",
+				test.index, test.name, test.index.UUID, searchReq.IndexName,
+				searchReq.IndexUUID)
+		}
+
+		// the consistency requirements are of the index as named.
+		var ctlParams *pb.QueryCtlParams
+		if err = json.Unmarshal(searchReq.QueryCtlParams, &ctlParams); err != nil {
+			t.Fatal(err)
+		}
+		if _, exists := ctlParams.Ctl.Consistency.Vectors[test.name]; !exists {
+			t.Fatalf("[%+v] Expected the vectors of: %s, got: %v", test.index,
+				test.name, ctlParams.Ctl.Consistency.Vectors)
+		}
+
+		countReq, err := BuildProtoCountRequest(sr, test.index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if countReq.IndexName != test.name ||
+			countReq.IndexUUID != test.index.UUID {
+			t.Fatalf("[%+v] Expected the count request of: %s, got: %s",
+				test.index, test.name, countReq.IndexName)
+		}
+	}
+}
+
+func TestBuildProtoSearchRequestHighlight(t *testing.T) {
+	tests := []struct {
+		highlight *HighlightOption
+		expect    string
+	}{
+		{highlight: &HighlightOption{Style: "html", Fields: []string{"body"}},
+			expect: `{"style":"html","fields":["body"]}`},
+		// bleve's default style (html), over all the fields
+		{highlight: &HighlightOption{}, expect: `{"style":null,"fields":null}`},
+		{expect: `null`},
+	}
+
+	for _, test := range tests {
+		sr, _, err := BuildSearchRequest("", value.NewValue(
+			map[string]interface{}{
+				"query": map[string]interface{}{"match": "x", "field": "body"},
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sr = HighlightInSearchRequest(sr, test.highlight)
+
+		searchReq, err := BuildProtoSearchRequest(sr,
+			&datastore.FTSSearchInfo{Limit: 10}, nil, datastore.UNBOUNDED,
+			IndexIdentity{Name: "idx"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var contents struct {
+			Highlight json.RawMessage `json:"highlight"`
+		}
+		if err = json.Unmarshal(searchReq.Contents, &contents); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(contents.Highlight) != test.expect {
+			t.Fatalf("[%+v] Expected the highlight: %s, got: %s",
+				test.highlight, test.expect, contents.Highlight)
+		}
+	}
+}
+
+func TestBuildProtoSearchRequestGeoDistanceSort(t *testing.T) {
+	for _, unit := range []string{"mi", "km", "m"} {
+		sr, _, err := BuildSearchRequest("", value.NewValue(map[string]interface{}{
+			"query": map[string]interface{}{
+				"match": "hotel",
+				"field": "name",
+			},
+			"sort": []interface{}{
+				map[string]interface{}{
+					"by":    "geo_distance",
+					"field": "geo",
+					"unit":  unit,
+					"location": map[string]interface{}{
+						"lon": -2.235143,
+						"lat": 53.482358,
+					},
+				},
+			},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		searchReq, err := BuildProtoSearchRequest(sr,
+			&datastore.FTSSearchInfo{Offset: 10, Limit: 20},
+			nil, datastore.UNBOUNDED, IndexIdentity{Name: "idx"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var contents struct {
+			From int                      `json:"from"`
+			Size int                      `json:"size"`
+			Sort []map[string]interface{} `json:"sort"`
+		}
+		err = json.Unmarshal(searchReq.Contents, &contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if contents.From != 10 || contents.Size != 20 || searchReq.Stream {
+			t.Fatalf("[%s] Unexpected pagination: %s", unit, searchReq.Contents)
+		}
+
+		if len(contents.Sort) != 1 ||
+			contents.Sort[0]["by"] != "geo_distance" ||
+			contents.Sort[0]["field"] != "geo" ||
+			contents.Sort[0]["unit"] != unit {
+			t.Fatalf("[%s] Expected the geo distance sort to be preserved,"+
+				" got: %s", unit, searchReq.Contents)
+		}
+
+		sorts, ok := GeoDistanceSorts(sr.Sort)
+		if !ok || len(sorts) != 1 || sorts[0].Field != "geo" {
+			t.Fatalf("[%s] Expected a geo distance sort over geo, got: %v",
+				unit, sorts)
+		}
+	}
+}
+
+func TestBuildProtoSearchRequestPreservesBoosts(t *testing.T) {
+	idx, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	for id, doc := range map[string]interface{}{
+		"doc-red":  map[string]interface{}{"color": "red", "title": "shirt"},
+		"doc-blue": map[string]interface{}{"color": "blue", "title": "shirt"},
+	} {
+		if err = idx.Index(id, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		field   string
+		query   interface{}
+		aliases map[string]string
+		first   string
+	}{
+		{
+			query: map[string]interface{}{
+				"disjuncts": []interface{}{
+					map[string]interface{}{"match": "red", "field": "color", "boost": 1},
+					map[string]interface{}{"match": "blue", "field": "color", "boost": 10},
+				},
+			},
+			first: "doc-blue",
+		},
+		{
+			query: map[string]interface{}{
+				"query": map[string]interface{}{
+					"disjuncts": []interface{}{
+						map[string]interface{}{"match": "red", "field": "color", "boost": 10},
+						map[string]interface{}{"match": "blue", "field": "color", "boost": 1},
+					},
+				},
+			},
+			first: "doc-red",
+		},
+		{
+			// field provided as the SEARCH() function's argument
+			field: "color",
+			query: map[string]interface{}{
+				"disjuncts": []interface{}{
+					map[string]interface{}{"match": "red", "boost": 1},
+					map[string]interface{}{"match": "blue", "boost": 10},
+				},
+			},
+			first: "doc-blue",
+		},
+		{
+			query: "color:red^10 color:blue",
+			first: "doc-red",
+		},
+		{
+			query: map[string]interface{}{
+				"disjuncts": []interface{}{
+					map[string]interface{}{"match": "red", "field": "colour", "boost": 2},
+					map[string]interface{}{"match": "blue", "field": "colour", "boost": 10},
+				},
+			},
+			aliases: map[string]string{"colour": "color"},
+			first:   "doc-blue",
+		},
+	}
+
+	for testi, test := range tests {
+		_, sr, _, err := ParseQueryToSearchRequest(test.field, value.NewValue(test.query))
+		if err != nil {
+			t.Fatal(testi, err)
+		}
+
+		sr, err = RewriteQueryFields(sr, test.aliases)
+		if err != nil {
+			t.Fatal(testi, err)
+		}
+
+		searchReq, err := BuildProtoSearchRequest(sr,
+			&datastore.FTSSearchInfo{Limit: math.MaxInt64},
+			nil, datastore.UNBOUNDED, IndexIdentity{Name: "idx"})
+		if err != nil {
+			t.Fatal(testi, err)
+		}
+
+		var contents struct {
+			Q json.RawMessage `json:"query"`
+		}
+		if err = json.Unmarshal(searchReq.Contents, &contents); err != nil {
+			t.Fatal(testi, err)
+		}
+
+		q, err := query.ParseQuery(contents.Q)
+		if err != nil {
+			t.Fatal(testi, err)
+		}
+
+		res, err := idx.Search(bleve.NewSearchRequest(q))
+		if err != nil {
+			t.Fatal(testi, err)
+		}
+
+		if len(res.Hits) != 2 || res.Hits[0].ID != test.first {
+			t.Fatalf("[%d] Expected %s to be the first hit, got: %v, query: %s",
+				testi, test.first, res.Hits, contents.Q)
+		}
+	}
+}
+
+func TestBuildProtoSearchRequestSortFromOrder(t *testing.T) {
+	_, sr, _, err := ParseQueryToSearchRequest("", value.NewValue(
+		map[string]interface{}{"match": "hotel", "field": "name"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the order pushed down is sorted by, as JSON strings.
+	searchReq, err := BuildProtoSearchRequest(sr,
+		&datastore.FTSSearchInfo{Limit: 10,
+			Order: []string{"score DESC", "city", "name DESC"}},
+		nil, datastore.UNBOUNDED, IndexIdentity{Name: "idx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var contents struct {
+		Sort []string `json:"sort"`
+	}
+	err = json.Unmarshal(searchReq.Contents, &contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expect := []string{"-_score", "city", "-name"}; !reflect.DeepEqual(
+		contents.Sort, expect) {
+		t.Fatalf("Expected the sort: %v, got: %s", expect, searchReq.Contents)
+	}
+}
+
+func TestBuildProtoSearchRequestAtPlusBadVector(t *testing.T) {
+	tests := []timestamp.Vector{
+		nil,
+		testVector{},
+		testVector{
+			&testVectorEntry{position: 1, guard: "", value: 10},
+		},
+		testVector{
+			&testVectorEntry{position: 1, guard: "28919283712", value: 10},
+			&testVectorEntry{position: 1, guard: "28919283712", value: 12},
+		},
+	}
+
+	for i, vector := range tests {
+		sr, _, err := BuildSearchRequest("", value.NewValue(map[string]interface{}{
+			"query": map[string]interface{}{
+				"match": "avengers",
+				"field": "title",
+			},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = BuildProtoSearchRequest(sr,
+			&datastore.FTSSearchInfo{Limit: math.MaxInt64},
+			vector, datastore.AT_PLUS, IndexIdentity{Name: "idx"})
+		if err == nil {
+			t.Fatalf("[%d] Expected an error for the scan vector", i)
+		}
+	}
+}
+
+func TestRewriteQueryFields(t *testing.T) {
+	sr, _, err := BuildSearchRequest("", value.NewValue(map[string]interface{}{
+		"query": map[string]interface{}{
+			"conjuncts": []interface{}{
+				map[string]interface{}{"match": "main st", "field": "addr"},
+				map[string]interface{}{"query": "addr:elm city:paris"},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	origQ := string(sr.Q)
+
+	rewritten, err := RewriteQueryFields(sr, map[string]string{"addr": "address"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(sr.Q) != origQ {
+		t.Fatalf("Expected original search request to be left untouched")
+	}
+
+	q, err := query.ParseQuery(rewritten.Q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields, err := FetchFieldsToSearchFromQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]bool{}
+	for f := range fields {
+		names[f.Name] = true
+	}
+
+	if !reflect.DeepEqual(names, map[string]bool{"address": true, "city": true}) {
+		t.Fatalf("Unexpected fields in rewritten query: %s", rewritten.Q)
+	}
+
+	// the boost of a query string survives its rewrite
+	sr, _, err = BuildSearchRequest("", value.NewValue(map[string]interface{}{
+		"query": map[string]interface{}{"query": "addr:elm", "boost": 5},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewritten, err = RewriteQueryFields(sr, map[string]string{"addr": "address"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = query.ParseQuery(rewritten.Q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bq, ok := q.(query.BoostableQuery); !ok || bq.Boost() != 5 {
+		t.Fatalf("Expected the boost to be retained, got: %s", rewritten.Q)
+	}
+}
+
+func TestIncludeFieldsInSearchRequest(t *testing.T) {
+	sr, _, err := BuildSearchRequest("", value.NewValue(map[string]interface{}{
+		"query":  map[string]interface{}{"match": "avengers", "field": "title"},
+		"fields": []interface{}{"title"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr = IncludeFieldsInSearchRequest(sr, []string{"title", "year"})
+	if !reflect.DeepEqual(sr.Fields, []string{"title", "year"}) {
+		t.Fatalf("Unexpected fields: %v", sr.Fields)
+	}
+
+	bsr, err := sr.ConvertToBleveSearchRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(bsr.Fields, []string{"title", "year"}) {
+		t.Fatalf("Unexpected fields in bleve search request: %v", bsr.Fields)
+	}
+}
+
+func TestBuildProtoFreshnessRequest(t *testing.T) {
+	sr, _, err := BuildSearchRequest("", value.NewValue(map[string]interface{}{
+		"query":  map[string]interface{}{"match": "avengers", "field": "title"},
+		"fields": []interface{}{"title"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vector := testVector{
+		&testVectorEntry{position: 5, guard: "28919283712", value: 100},
+	}
+
+	req, err := BuildProtoFreshnessRequest(sr, vector,
+		IndexIdentity{Name: "idx"}, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ctlParams pb.QueryCtlParams
+	if err = json.Unmarshal(req.QueryCtlParams, &ctlParams); err != nil {
+		t.Fatal(err)
+	}
+
+	// waits on the index to catch up, for no longer than the bound.
+	if ctlParams.Ctl == nil || ctlParams.Ctl.Timeout != 500 ||
+		ctlParams.Ctl.Consistency == nil ||
+		ctlParams.Ctl.Consistency.Level != "at_plus" ||
+		ctlParams.Ctl.Consistency.Vectors["idx"] == nil {
+		t.Fatalf("Unexpected ctl params: %s", req.QueryCtlParams)
+	}
+
+	// fetching none of the hits.
+	var contents struct {
+		Size   *int     `json:"size"`
+		Fields []string `json:"fields"`
+	}
+	if err = json.Unmarshal(req.Contents, &contents); err != nil {
+		t.Fatal(err)
+	}
+	if contents.Size == nil || *contents.Size != 0 || len(contents.Fields) > 0 {
+		t.Fatalf("Expected a count request, got: %s", req.Contents)
+	}
+
+	// the staleness can't be checked for without a scan vector.
+	if _, err = BuildProtoFreshnessRequest(sr, nil,
+		IndexIdentity{Name: "idx"}, 500); err == nil {
+		t.Fatalf("Expected an error without a scan vector")
+	}
+}
+
+func TestBuildProtoSearchRequestPreservesFuzziness(t *testing.T) {
+	sr, _, err := BuildSearchRequest("", value.NewValue(map[string]interface{}{
+		"query": map[string]interface{}{
+			"term":          "avngers",
+			"field":         "title",
+			"fuzziness":     2,
+			"prefix_length": 1,
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	psr, err := BuildProtoSearchRequest(sr, &datastore.FTSSearchInfo{
+		Limit: 10}, nil, datastore.UNBOUNDED, IndexIdentity{Name: "idx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var contents struct {
+		Query struct {
+			Fuzziness int `json:"fuzziness"`
+			Prefix    int `json:"prefix_length"`
+		} `json:"query"`
+	}
+	if err = json.Unmarshal(psr.Contents, &contents); err != nil {
+		t.Fatal(err)
+	}
+
+	if contents.Query.Fuzziness != 2 || contents.Query.Prefix != 1 {
+		t.Fatalf("Expected the fuzziness and prefix length, got: %s",
+			psr.Contents)
+	}
+}
+
+func TestDeterministicSort(t *testing.T) {
+	raw := func(sorts ...string) []json.RawMessage {
+		rv := make([]json.RawMessage, len(sorts))
+		for i, s := range sorts {
+			rv[i] = json.RawMessage(s)
+		}
+		return rv
+	}
+
+	tests := []struct {
+		sort     []json.RawMessage
+		expect   []json.RawMessage
+		appended bool
+		err      bool
+	}{
+		{sort: raw(`"-color"`), expect: raw(`"-color"`, `"_id"`), appended: true},
+		{sort: raw(`"color"`, `"-_id"`), expect: raw(`"color"`, `"-_id"`)},
+		{sort: raw(`{"by":"id","desc":true}`), expect: raw(`{"by":"id","desc":true}`)},
+		{sort: raw(`"-_score"`), err: true},
+		{sort: nil, err: true},
+	}
+
+	for _, test := range tests {
+		got, appended, err := DeterministicSort(test.sort)
+		if (err != nil) != test.err {
+			t.Fatalf("[%s] Expected err: %t, got: %v", test.sort, test.err, err)
+		}
+
+		if !test.err && (appended != test.appended ||
+			!reflect.DeepEqual(test.expect, got)) {
+			t.Fatalf("[%s] Expected: %s (appended: %t), got: %s (appended: %t)",
+				test.sort, test.expect, test.appended, got, appended)
+		}
+	}
+}
+
+func TestExcludeFieldsFromSearchRequest(t *testing.T) {
+	sr, _, err := BuildSearchRequest("", value.NewValue(map[string]interface{}{
+		"query":  map[string]interface{}{"match": "avengers", "field": "title"},
+		"fields": []interface{}{"title", "body"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr = IncludeFieldsInSearchRequest(sr, []string{"year"})
+	sr = ExcludeFieldsFromSearchRequest(sr, []string{"body"})
+
+	psr, err := BuildProtoSearchRequest(sr, &datastore.FTSSearchInfo{
+		Limit: 10}, nil, datastore.UNBOUNDED, IndexIdentity{Name: "idx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var contents struct {
+		Fields []string `json:"fields"`
+	}
+	if err = json.Unmarshal(psr.Contents, &contents); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(contents.Fields, []string{"title", "year"}) {
+		t.Fatalf("Expected exactly the requested fields, got: %v",
+			contents.Fields)
+	}
+}
+
+func TestSearchRequestHelpersReturnCopies(t *testing.T) {
+	sr, _, err := BuildSearchRequest("", value.NewValue(map[string]interface{}{
+		"query":  map[string]interface{}{"match": "avengers", "field": "title"},
+		"fields": []interface{}{"title", "body"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := CopySearchRequest(sr)
+
+	got := DecorateSearchRequest(sr, "collection")
+	got = IncludeFieldsInSearchRequest(got, []string{"year"})
+	got = ExcludeFieldsFromSearchRequest(got, []string{"body"})
+	got = IncludeLocationsInSearchRequest(got, true)
+	got = ExplainInSearchRequest(got, true)
+	got = HighlightInSearchRequest(got, &HighlightOption{Fields: []string{"title"}})
+	got = CollapseInSearchRequest(got, &CollapseOption{Field: "genre"})
+	got = CursorInSearchRequest(got, []string{"a"}, nil)
+	got = KeysOnlyInSearchRequest(got, nil, false)
+	got = SkipScoring(got, []string{"year"}, nil)
+	if got, err = SortInSearchRequest(got, []string{"year"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(expect, sr) {
+		t.Fatalf("Expected the search request left as is: %+v, got: %+v",
+			expect, sr)
+	}
+
+	if !reflect.DeepEqual(got.Fields, []string{"title", "year", "genre"}) ||
+		!reflect.DeepEqual(got.Collections, []string{"collection"}) ||
+		!got.IncludeLocations || !got.Explain || got.Highlight == nil ||
+		!reflect.DeepEqual(got.SearchAfter, []string{"a"}) ||
+		len(got.Sort) != 1 || got.Score != "none" {
+		t.Fatalf("Unexpected search request: %+v", got)
+	}
+}
+
+func TestFetchDateRanges(t *testing.T) {
+	ranges, err := FetchDateRanges("`created`", value.NewValue(
+		map[string]interface{}{
+			"query": map[string]interface{}{
+				"conjuncts": []interface{}{
+					map[string]interface{}{
+						"start":           "2019-03-25T10:00:00+05:30",
+						"end":             "2019-03-26T10:00:00-0700",
+						"inclusive_start": true,
+						"inclusive_end":   false,
+					},
+					map[string]interface{}{
+						"end": "2019-03-25", "field": "birthday"},
+					map[string]interface{}{"match": "x", "field": "name"},
+				},
+			},
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inclusiveStart, inclusiveEnd := true, false
+	expect := []*DateRange{
+		{
+			Field:          "created",
+			Start:          "2019-03-25T10:00:00+05:30",
+			End:            "2019-03-26T10:00:00-0700",
+			InclusiveStart: &inclusiveStart,
+			InclusiveEnd:   &inclusiveEnd,
+		},
+		{Field: "birthday", End: "2019-03-25"},
+	}
+	if !reflect.DeepEqual(expect, ranges) {
+		t.Fatalf("Expected: %+v, got: %+v", expect, ranges)
+	}
+
+	for _, test := range []struct {
+		dt          string
+		hasTimeZone bool
+	}{
+		{dt: "2019-03-25T10:00:00+05:30", hasTimeZone: true},
+		{dt: "2019-03-25T10:00:00.123-07:00", hasTimeZone: true},
+		{dt: "2019-03-25T10:00:00Z", hasTimeZone: true},
+		{dt: "2019-03-25 10:00:00 +0700", hasTimeZone: true},
+		{dt: "2019-03-25T10:00:00"},
+		{dt: "2019-03-25"},
+		{dt: "2019-03-25-07"},
+	} {
+		dr := &DateRange{Start: test.dt}
+		if dr.HasTimeZone() != test.hasTimeZone {
+			t.Fatalf("[%s] Expected time zone: %t", test.dt, test.hasTimeZone)
+		}
+	}
+
+	_, err = FetchDateRanges("", value.NewValue(map[string]interface{}{
+		"start": 20190325, "field": "created"}))
+	if err == nil {
+		t.Fatalf("Expected an error for a start that isn't a string")
+	}
+
+	// the date ranges of a query string aren't available.
+	ranges, err = FetchDateRanges("", value.NewValue(
+		`created:>"2019-03-25T10:00:00+05:30"`))
+	if err != nil || len(ranges) != 0 {
+		t.Fatalf("Expected no date ranges, got: %v, err: %v", ranges, err)
+	}
+}
+
+func TestBuildProtoSearchRequestPreservesDisjunctionMin(t *testing.T) {
+	disjuncts := []interface{}{
+		map[string]interface{}{"match": "hotel", "field": "name"},
+		map[string]interface{}{"match": "london", "field": "city"},
+		map[string]interface{}{"match": "uk", "field": "country"},
+	}
+
+	minOf := func(contents []byte, path ...string) interface{} {
+		var sr map[string]interface{}
+		if err := json.Unmarshal(contents, &sr); err != nil {
+			t.Fatal(err)
+		}
+
+		q, _ := sr["query"].(map[string]interface{})
+		for _, p := range path {
+			q, _ = q[p].(map[string]interface{})
+		}
+		return q["min"]
+	}
+
+	tests := []struct {
+		field   string
+		query   map[string]interface{}
+		aliases map[string]string
+		path    []string
+	}{
+		{
+			query: map[string]interface{}{"disjuncts": disjuncts, "min": 2},
+		},
+		{
+			// the query is re-marshalled, with the field applied
+			field: "name",
+			query: map[string]interface{}{"disjuncts": disjuncts, "min": 2},
+		},
+		{
+			// the query is re-marshalled, with the fields rewritten
+			query:   map[string]interface{}{"disjuncts": disjuncts, "min": 2},
+			aliases: map[string]string{"city": "town"},
+		},
+		{
+			query: map[string]interface{}{
+				"must": map[string]interface{}{
+					"conjuncts": []interface{}{
+						map[string]interface{}{"match": "hotel", "field": "type"},
+					},
+				},
+				"should": map[string]interface{}{
+					"disjuncts": disjuncts, "min": 2,
+				},
+			},
+			aliases: map[string]string{"city": "town"},
+			path:    []string{"should"},
+		},
+	}
+
+	for testi, test := range tests {
+		for _, input := range []map[string]interface{}{
+			test.query,
+			{"query": test.query},
+		} {
+			_, sr, _, err := ParseQueryToSearchRequest(test.field,
+				value.NewValue(input))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sr, err = RewriteQueryFields(sr, test.aliases)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			searchReq, err := BuildProtoSearchRequest(sr,
+				&datastore.FTSSearchInfo{Limit: math.MaxInt64},
+				nil, datastore.UNBOUNDED, IndexIdentity{Name: "idx"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if min := minOf(searchReq.Contents, test.path...); min != float64(2) {
+				t.Fatalf("[%d] Expected min: 2 to be preserved, got: %v, %s",
+					testi, min, searchReq.Contents)
+			}
+		}
+	}
+}
+
+func TestBuildProtoSearchRequestPreservesMatchOperator(t *testing.T) {
+	query := map[string]interface{}{
+		"match":    "quick fox",
+		"field":    "body",
+		"operator": "and",
+		"analyzer": "en",
+	}
+
+	tests := []struct {
+		field       string
+		aliases     map[string]string
+		expectField string
+	}{
+		{
+			expectField: "body",
+		},
+		{
+			// the query is re-marshalled, with the field applied
+			field:       "body",
+			expectField: "body",
+		},
+		{
+			// the query is re-marshalled, with the field rewritten
+			aliases:     map[string]string{"body": "text"},
+			expectField: "text",
+		},
+	}
+
+	for testi, test := range tests {
+		for _, input := range []map[string]interface{}{
+			query,
+			{"query": query},
+		} {
+			queryFields, sr, _, err := ParseQueryToSearchRequest(test.field,
+				value.NewValue(input))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the analyzer drives the sargability of the field
+			if _, exists := queryFields[SearchField{
+				Name: "body", Type: "text", Analyzer: "en"}]; !exists {
+				t.Fatalf("[%d] Expected the field with the analyzer within: %v",
+					testi, queryFields)
+			}
+
+			sr, err = RewriteQueryFields(sr, test.aliases)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			searchReq, err := BuildProtoSearchRequest(sr,
+				&datastore.FTSSearchInfo{Limit: math.MaxInt64},
+				nil, datastore.UNBOUNDED, IndexIdentity{Name: "idx"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var contents struct {
+				Query map[string]interface{} `json:"query"`
+			}
+			err = json.Unmarshal(searchReq.Contents, &contents)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if contents.Query["match"] != "quick fox" ||
+				contents.Query["field"] != test.expectField ||
+				contents.Query["operator"] != "and" ||
+				contents.Query["analyzer"] != "en" {
+				t.Fatalf("[%d] Expected the match query to be preserved,"+
+					" got: %s", testi, searchReq.Contents)
+			}
+		}
+	}
+}
+
+func TestBuildProtoCountRequest(t *testing.T) {
+	input := value.NewValue(map[string]interface{}{
+		"query": map[string]interface{}{"match": "hotel", "field": "name"},
+		"size":  10,
+		"from":  20,
+		"sort":  []interface{}{"-_score"},
+	})
+
+	_, sr, _, err := ParseQueryToSearchRequest("", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countReq, err := BuildProtoCountRequest(sr, IndexIdentity{Name: "idx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if countReq.IndexName != "idx" || countReq.Stream {
+		t.Fatalf("Unexpected count request: %+v", countReq)
+	}
+
+	var contents map[string]interface{}
+	err = json.Unmarshal(countReq.Contents, &contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if contents["size"] != float64(0) || contents["from"] != float64(0) ||
+		contents["sort"] != nil || contents["score"] != "none" ||
+		contents["query"] == nil {
+		t.Fatalf("Unexpected count request contents: %s", countReq.Contents)
+	}
+
+	// the search request itself is left as is
+	if *sr.Size != 10 || len(sr.Sort) != 1 {
+		t.Fatalf("Expected the search request to be left as is, got: %+v", sr)
+	}
+}
+
+func TestKeysOnlyInSearchRequest(t *testing.T) {
+	tests := []struct {
+		query        map[string]interface{}
+		order        []string
+		expectScored bool
+	}{
+		// the scores aren't returned for the query engine to order by
+		{query: map[string]interface{}{"match": "hotel", "field": "name"}},
+		{query: map[string]interface{}{"match": "hotel", "field": "name"},
+			order: []string{"id ASC"}},
+		{query: map[string]interface{}{"match": "hotel", "field": "name"},
+			order: []string{"score DESC"}, expectScored: true},
+		{query: map[string]interface{}{
+			"query":  map[string]interface{}{"match": "hotel", "field": "name"},
+			"sort":   []interface{}{"-_score"},
+			"fields": []interface{}{"*"},
+			"facets": map[string]interface{}{
+				"types": map[string]interface{}{"field": "type", "size": 3}},
+			"highlight":        map[string]interface{}{"style": "html"},
+			"explain":          true,
+			"includeLocations": true,
+		}, expectScored: true},
+	}
+
+	for _, test := range tests {
+		_, sr, _, err := ParseQueryToSearchRequest("", value.NewValue(test.query))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := KeysOnlyInSearchRequest(sr, test.order, false); got != sr {
+			t.Fatalf("[%v] Expected the search request untouched", test.query)
+		}
+
+		got := KeysOnlyInSearchRequest(sr, test.order, true)
+		if (got.Score != "none") != test.expectScored {
+			t.Fatalf("[%v, %v] Expected scored: %t, got score: %q",
+				test.query, test.order, test.expectScored, got.Score)
+		}
+
+		if got.Fields != nil || got.Facets != nil || got.Highlight != nil ||
+			got.Explain || got.IncludeLocations {
+			t.Fatalf("[%v] Expected none of the metadata requested, got: %+v",
+				test.query, got)
+		}
+
+		if sr.Score != "" {
+			t.Fatalf("[%v] Expected the original search request untouched",
+				test.query)
+		}
+	}
+}
+
+func TestSkipScoring(t *testing.T) {
+	yes, no := true, false
+
+	tests := []struct {
+		query        map[string]interface{}
+		order        []string
+		score        *bool
+		expectScored bool
+	}{
+		{
+			// the order isn't known, the query engine may order by score
+			query:        map[string]interface{}{"match": "hotel", "field": "name"},
+			expectScored: true,
+		},
+		{
+			query:        map[string]interface{}{"match": "hotel", "field": "name"},
+			order:        []string{"id ASC"},
+			expectScored: false,
+		},
+		{
+			query:        map[string]interface{}{"match": "hotel", "field": "name"},
+			order:        []string{"id ASC", "score DESC"},
+			expectScored: true,
+		},
+		{
+			query: map[string]interface{}{
+				"query": map[string]interface{}{"match": "hotel", "field": "name"},
+				"sort":  []interface{}{"city", "-name"},
+			},
+			expectScored: false,
+		},
+		{
+			query: map[string]interface{}{
+				"query": map[string]interface{}{"match": "hotel", "field": "name"},
+				"sort":  []interface{}{"city", "-_score"},
+			},
+			expectScored: true,
+		},
+		{
+			query: map[string]interface{}{
+				"query": map[string]interface{}{"match": "hotel", "field": "name"},
+				"sort": []interface{}{
+					map[string]interface{}{"by": "score", "desc": true},
+				},
+			},
+			expectScored: true,
+		},
+		{
+			// overridden by the score option, either way
+			query:        map[string]interface{}{"match": "hotel", "field": "name"},
+			order:        []string{"id ASC"},
+			score:        &yes,
+			expectScored: true,
+		},
+		{
+			query:        map[string]interface{}{"match": "hotel", "field": "name"},
+			score:        &no,
+			expectScored: false,
+		},
+	}
+
+	for testi, test := range tests {
+		_, sr, _, err := ParseQueryToSearchRequest("", value.NewValue(test.query))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		skipped := SkipScoring(sr, test.order, test.score)
+		if sr.Score != "" {
+			t.Fatalf("[%d] Expected the search request to be left as is", testi)
+		}
+
+		searchReq, err := BuildProtoSearchRequest(skipped,
+			&datastore.FTSSearchInfo{Order: test.order, Limit: math.MaxInt64},
+			nil, datastore.UNBOUNDED, IndexIdentity{Name: "idx"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var contents struct {
+			Score string        `json:"score"`
+			Sort  []interface{} `json:"sort"`
+		}
+		err = json.Unmarshal(searchReq.Contents, &contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.expectScored != (contents.Score != "none") {
+			t.Fatalf("[%d] Expected scored: %v, got: %s", testi,
+				test.expectScored, searchReq.Contents)
+		}
+
+		// the order pushed down is carried as the sort
+		if len(test.order) > 0 && len(contents.Sort) != len(test.order) {
+			t.Fatalf("[%d] Expected the order as the sort, got: %s", testi,
+				searchReq.Contents)
+		}
+	}
+
+	// the search request's own score setting is left as is
+	_, sr, _, err := ParseQueryToSearchRequest("", value.NewValue(
+		map[string]interface{}{
+			"query": map[string]interface{}{"match": "hotel", "field": "name"},
+			"score": "none",
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if SkipScoring(sr, nil, &yes) != sr || sr.Score != "none" {
+		t.Fatalf("Expected the search request's score to be left as is")
+	}
+}
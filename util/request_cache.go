@@ -0,0 +1,225 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package util
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/couchbase/cbft"
+	"github.com/couchbase/query/value"
+)
+
+// parsedRequestCacheBytes bounds the bytes of the search requests (parsed
+// out of the queries searched for) cached, so a query searched for
+// repeatedly isn't parsed over again, with the least recently used
+// requests evicted past it; 0 disables the caching; as set by the
+// "parsedRequestCacheBytes" config
+var parsedRequestCacheBytes = int64(4 * 1024 * 1024)
+
+func GetParsedRequestCacheBytes() int64 {
+	return atomic.LoadInt64(&parsedRequestCacheBytes)
+}
+
+func SetParsedRequestCacheBytes(v int64) {
+	atomic.StoreInt64(&parsedRequestCacheBytes, v)
+}
+
+// parsedRequestOverhead is the approximate size of a cached request,
+// beyond its key and query.
+const parsedRequestOverhead = 512
+
+// parsedRequest is a search request as parsed, along with the fields its
+// query searches; it's shared by the lookups, and so never modified.
+type parsedRequest struct {
+	queryFields map[SearchField]struct{}
+	sr          *cbft.SearchRequest
+	ctlTimeout  int64
+
+	key  string
+	size int64
+}
+
+// parsedRequestCache is keyed by the field and the query (as JSON), its
+// list ordered from the most to the least recently used request.
+type parsedRequestCache struct {
+	m       sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int64
+}
+
+var parsedRequests = &parsedRequestCache{
+	entries: map[string]*list.Element{},
+	lru:     list.New(),
+}
+
+// parsedRequestKey returns the key of the search request parsed out of
+// the input for the field, empty if the request isn't to be cached.
+func parsedRequestKey(field string, input value.Value) string {
+	if GetParsedRequestCacheBytes() <= 0 || input == nil {
+		return ""
+	}
+
+	b, err := input.MarshalJSON()
+	if err != nil {
+		return ""
+	}
+
+	return field + "/" + string(b)
+}
+
+// getParsedRequest returns the fields and a copy of the search request
+// cached under the key, if any.
+func getParsedRequest(key string) (map[SearchField]struct{},
+	*cbft.SearchRequest, int64, bool) {
+	if key == "" {
+		return nil, nil, 0, false
+	}
+
+	c := parsedRequests
+	c.m.Lock()
+	elem, exists := c.entries[key]
+	if exists {
+		c.lru.MoveToFront(elem)
+	}
+	c.m.Unlock()
+
+	if !exists {
+		return nil, nil, 0, false
+	}
+
+	pr := elem.Value.(*parsedRequest)
+	queryFields := make(map[SearchField]struct{}, len(pr.queryFields))
+	for f := range pr.queryFields {
+		queryFields[f] = struct{}{}
+	}
+
+	return queryFields, CopySearchRequest(pr.sr), pr.ctlTimeout, true
+}
+
+// putParsedRequest caches (copies of) the fields and the search request
+// under the key, evicting the least recently used requests past the
+// bound on bytes.
+func putParsedRequest(key string, queryFields map[SearchField]struct{},
+	sr *cbft.SearchRequest, ctlTimeout int64) {
+	if key == "" {
+		return
+	}
+
+	pr := &parsedRequest{
+		queryFields: make(map[SearchField]struct{}, len(queryFields)),
+		sr:          CopySearchRequest(sr),
+		ctlTimeout:  ctlTimeout,
+		key:         key,
+	}
+	for f := range queryFields {
+		pr.queryFields[f] = struct{}{}
+	}
+	pr.size = int64(len(key)+parsedRequestOverhead) + int64(len(pr.sr.Q))
+
+	limit := GetParsedRequestCacheBytes()
+	if pr.size > limit {
+		return
+	}
+
+	c := parsedRequests
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if elem, exists := c.entries[key]; exists {
+		c.remove(elem)
+	}
+
+	c.entries[key] = c.lru.PushFront(pr)
+	c.bytes += pr.size
+
+	for c.bytes > limit {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *parsedRequestCache) remove(elem *list.Element) {
+	pr := c.lru.Remove(elem).(*parsedRequest)
+	delete(c.entries, pr.key)
+	c.bytes -= pr.size
+}
+
+// CopySearchRequest returns a deep copy of the search request, that may
+// be modified (for ex. while decorated with the collection, or paged)
+// without affecting the original; a nil Sort is kept apart from an empty
+// one.
+func CopySearchRequest(sr *cbft.SearchRequest) *cbft.SearchRequest {
+	if sr == nil {
+		return nil
+	}
+
+	rv := *sr
+
+	rv.Q = append(json.RawMessage(nil), sr.Q...)
+	rv.Size = copyIntPtr(sr.Size)
+	rv.From = copyIntPtr(sr.From)
+	rv.Limit = copyIntPtr(sr.Limit)
+	rv.Offset = copyIntPtr(sr.Offset)
+
+	if sr.Highlight != nil {
+		h := *sr.Highlight
+		h.Fields = copyStrings(sr.Highlight.Fields)
+		rv.Highlight = &h
+	}
+
+	rv.Fields = copyStrings(sr.Fields)
+
+	if sr.Facets != nil {
+		rv.Facets = make(bleve.FacetsRequest, len(sr.Facets))
+		for name, fr := range sr.Facets {
+			if fr != nil {
+				frCopy := *fr
+				fr = &frCopy
+			}
+			rv.Facets[name] = fr
+		}
+	}
+
+	if sr.Sort != nil {
+		rv.Sort = make([]json.RawMessage, len(sr.Sort))
+		for i, s := range sr.Sort {
+			rv.Sort[i] = append(json.RawMessage(nil), s...)
+		}
+	}
+
+	rv.SearchAfter = copyStrings(sr.SearchAfter)
+	rv.SearchBefore = copyStrings(sr.SearchBefore)
+	rv.Collections = copyStrings(sr.Collections)
+
+	return &rv
+}
+
+func copyIntPtr(p *int) *int {
+	if p == nil {
+		return nil
+	}
+
+	v := *p
+	return &v
+}
+
+func copyStrings(arr []string) []string {
+	if arr == nil {
+		return nil
+	}
+
+	return append([]string{}, arr...)
+}
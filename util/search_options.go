@@ -0,0 +1,801 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/couchbase/query/value"
+)
+
+// SearchOptions holds the settings provided within the options
+// argument of the SEARCH() function, that apply to the execution of
+// the search request (as opposed to index selection, see "index" and
+// "indexUUID").
+type SearchOptions struct {
+	// Distinct requests that duplicate primary keys (for example, those
+	// emitted by different pindexes during a rebalance) be suppressed.
+	Distinct bool
+
+	// BackfillDir is the subdirectory (a relative path) of the configured
+	// backfill directory that search results are spilled to when the
+	// consumer is slow, empty implies the configured directory itself. A
+	// query can't have the results spilled anywhere else.
+	BackfillDir string
+
+	// BackfillLimitMB overrides the limit (in MB) on the space results
+	// may be spilled over to, nil implies the configured default, while
+	// 0 disables backfill (the search blocks on the consumer instead).
+	BackfillLimitMB *int64
+
+	// NoBackfill disables backfill for the search, regardless of the
+	// configured limit, for the latency sensitive searches that would
+	// rather block on a slow consumer (up to the request's deadline) than
+	// spill the results to disk.
+	NoBackfill bool
+
+	// IncludeFields lists the stored fields to be fetched along with
+	// each hit, carried within the metadata of the index entries.
+	IncludeFields []string
+
+	// ExcludeFields lists the stored fields never to be carried within the
+	// metadata of the index entries, even if requested (for ex. with "*").
+	ExcludeFields []string
+
+	// MaxFieldBytes caps the bytes of the stored field values carried
+	// with each hit, past which string values are truncated and others
+	// dropped (listed under "truncated_fields"), 0 implies no cap.
+	MaxFieldBytes int64
+
+	// IncludeLocations requests the locations of the terms matched within
+	// each hit (field -> term -> positions), carried within the metadata of
+	// the index entries under "locations", for clients rendering their own
+	// highlights.
+	IncludeLocations bool
+
+	// Explain requests the breakdown of each hit's score (the tree of how
+	// it was computed), carried within the metadata of the index entries
+	// under "explanation", for debugging relevance.
+	Explain bool
+
+	// IncludePindex requests the pindex (partition of the index) that
+	// produced each hit, as reported by FTS, be carried within the metadata
+	// of the index entries under "pindex", for debugging the distribution
+	// of the hits (for ex. during a rebalance); hits reported without it
+	// carry none.
+	IncludePindex bool
+
+	// Highlight requests the terms matched within each hit be highlighted,
+	// in fragments of the fields (stored, with their term vectors) carried
+	// within the metadata of the index entries under "fragments"; nil
+	// implies no highlighting beyond that of the search request (if any).
+	Highlight *HighlightOption
+
+	// RawResult requests the complete search result (total hits, max
+	// score, took, per partition status and the hits) rather than the hits
+	// one by one: sent as a single index entry carrying it as metadata,
+	// or handed over to the visitor of FTSIndex.SearchVisitRaw(..) (which
+	// implies it).
+	RawResult bool
+
+	// Trailer requests the total hits and the max score of the search (as
+	// FTS reports them, ahead of any hits skipped by n1fty) be returned by
+	// FTSIndex.SearchVisitTrailer(..) (which implies it) following the
+	// hits, for clients paginating over the hits to show the total along
+	// with a page of them; it's unsupported by N1QL searches.
+	Trailer bool
+
+	// AllowPartialResults requests the hits from the partitions that
+	// responded be returned (with a warning) when others failed, rather
+	// than failing the search.
+	AllowPartialResults bool
+
+	// Timeout (in milliseconds, if set) bounds the work FTS does for the
+	// search, with the partitions yet to respond once it elapses failing,
+	// and the hits of the rest returned as partial results (with a
+	// warning), whether or not AllowPartialResults is requested. It's
+	// separate from the request's deadline, past which the search (if not
+	// done) fails instead.
+	Timeout int64
+
+	// DeepPaging requests an offset+limit past the max result window be
+	// paged through with successive searches (each resuming after the last
+	// hit of the previous), for a search sorted other than by score; as
+	// the hits up to offset+limit are all fetched, it comes at a cost.
+	DeepPaging bool
+
+	// SearchAfter is the cursor (the sort values of a hit, as carried
+	// within the metadata of its index entry under "cursor") that the hits
+	// are to follow, for a page of them that's after the page ending with
+	// that hit; an empty cursor requests the first page, along with the
+	// hits' cursors. Like DeepPaging, it requires a sort other than by score.
+	SearchAfter []string
+
+	// SearchBefore is the cursor that the hits are to precede, for a page
+	// of them that's before the page starting with that hit.
+	SearchBefore []string
+
+	// Consistency overrides the consistency the search is performed with,
+	// nil implies that of the request's scan consistency.
+	Consistency *ConsistencyOption
+
+	// Score overrides whether the hits are to be scored, nil implies only
+	// when they're ordered by score (or their order isn't known).
+	Score *bool
+
+	// MinScore (if set) is the score below which hits are skipped rather
+	// than returned, with the hits then always scored. As the scores are
+	// relative to the search (its query and the index's contents at the
+	// time), a threshold meaningful for one search needn't be for another.
+	// The offset and limit can't be pushed down to FTS (with the hits they
+	// count filtered out after), and a count estimated over the index is
+	// that of the hits regardless of their score.
+	MinScore *float64
+
+	// KeysOnly requests the index entries carry just the primary keys of
+	// the hits, without any metadata (score, fields, facets, ..), for the
+	// least overhead when only the keys matter (for ex. an existence check
+	// or an anti-join); the hits then aren't scored unless sorted by score.
+	KeysOnly bool
+
+	// Collapse requests a single hit per group of the hits sharing the
+	// value of a field, the first in the order of the hits, for ex. one
+	// per product across its variants, as {"field": "product_id"}. As FTS
+	// doesn't collapse the hits, n1fty does over those streamed, by the
+	// field's stored value (carried within the metadata of the index
+	// entries under "fields"), with the hits lacking a value never
+	// collapsed. The offset and limit can't be pushed down to FTS (with
+	// the hits they count collapsed after).
+	Collapse *CollapseOption
+
+	// Sort requests the hits in the order of their document keys, as
+	// ["_id"] (ascending) or ["-_id"] (descending), for ex. for the query
+	// engine to merge join them with those of another index by key. FTS
+	// sorts by the document ID itself, merging the hits of the pindexes
+	// in that order, which (the keys being unique) is total and stable, so
+	// no sorting's left to n1fty. It applies unless the search request
+	// sorts the hits itself.
+	Sort []string
+}
+
+// KeyOrders are the sorts the sort option may request, by document key.
+var KeyOrders = []string{"_id", "-_id"}
+
+// CollapseOption is the collapsing requested within the options, as
+// {"field": "product_id"}.
+type CollapseOption struct {
+	Field string
+}
+
+// HighlightStyles are the styles of highlighting that bleve supports, the
+// first being its default.
+var HighlightStyles = []string{"html", "ansi"}
+
+// HighlightOption is the highlighting requested within the options, as
+// {"style": "html", "fields": ["body"]}.
+type HighlightOption struct {
+	Style  string   // one of HighlightStyles, empty implies bleve's default
+	Fields []string // the fields highlighted, none implies all of them
+}
+
+// ConsistencyBounded is the consistency level of a search that's to be
+// performed over the index once it's caught up with the scan vector, but
+// only if it does so within the staleness bound.
+const ConsistencyBounded = "bounded"
+
+// ConsistencyNotBounded is the consistency level of a search that's
+// performed over the index as is.
+const ConsistencyNotBounded = "not_bounded"
+
+// ConsistencyOption is the consistency requested within the options, as
+// {"level": "bounded", "staleness_ms": 500}.
+type ConsistencyOption struct {
+	Level       string
+	StalenessMS int64 // with the "bounded" level, the staleness tolerated
+}
+
+// ParseSearchOptions extracts the SearchOptions from the options value,
+// a nil options value yields the defaults.
+func ParseSearchOptions(options value.Value) (*SearchOptions, error) {
+	rv := &SearchOptions{}
+	if options == nil || options.Type() != value.OBJECT {
+		return rv, nil
+	}
+
+	if v, exists := options.Field("distinct"); exists {
+		if v.Type() != value.BOOLEAN {
+			return nil, fmt.Errorf("distinct option: %v, must be a boolean",
+				v.String())
+		}
+		rv.Distinct = v.Truth()
+	}
+
+	if v, exists := options.Field("backfill_dir"); exists {
+		dir, ok := v.Actual().(string)
+		if !ok || len(dir) == 0 {
+			return nil, fmt.Errorf("backfill_dir option: %v, must be a"+
+				" non-empty string", v.String())
+		}
+
+		// the subdirectory can't be outside of the configured directory.
+		clean := filepath.ToSlash(filepath.Clean(dir))
+		if filepath.IsAbs(dir) || filepath.VolumeName(dir) != "" ||
+			clean == ".." || strings.HasPrefix(clean, "../") {
+			return nil, fmt.Errorf("backfill_dir option: %q, must be a"+
+				" subdirectory of the configured backfill directory", dir)
+		}
+		rv.BackfillDir = filepath.Clean(dir)
+	}
+
+	if v, exists := options.Field("backfill_limit_mb"); exists {
+		var limitMB int64
+		switch limit := v.Actual().(type) {
+		case int64:
+			limitMB = limit
+		case float64:
+			if limit != math.Trunc(limit) {
+				limitMB = -1
+			} else {
+				limitMB = int64(limit)
+			}
+		default:
+			limitMB = -1
+		}
+
+		if limitMB < 0 {
+			return nil, fmt.Errorf("backfill_limit_mb option: %v, must be a"+
+				" non-negative integer", v.String())
+		}
+		rv.BackfillLimitMB = &limitMB
+	}
+
+	if v, exists := options.Field("no_backfill"); exists {
+		if v.Type() != value.BOOLEAN {
+			return nil, fmt.Errorf("no_backfill option: %v, must be a boolean",
+				v.String())
+		}
+		rv.NoBackfill = v.Truth()
+
+		if rv.NoBackfill && rv.BackfillLimitMB != nil && *rv.BackfillLimitMB > 0 {
+			return nil, fmt.Errorf("no_backfill option: unsupported with" +
+				" backfill_limit_mb")
+		}
+	}
+
+	if v, exists := options.Field("include_fields"); exists {
+		fields, err := parseFieldNames("include_fields", v)
+		if err != nil {
+			return nil, err
+		}
+		rv.IncludeFields = fields
+	}
+
+	if v, exists := options.Field("exclude_fields"); exists {
+		fields, err := parseFieldNames("exclude_fields", v)
+		if err != nil {
+			return nil, err
+		}
+		rv.ExcludeFields = fields
+	}
+
+	if v, exists := options.Field("max_field_bytes"); exists {
+		var maxBytes int64
+		switch limit := v.Actual().(type) {
+		case int64:
+			maxBytes = limit
+		case float64:
+			if limit != math.Trunc(limit) {
+				maxBytes = -1
+			} else {
+				maxBytes = int64(limit)
+			}
+		default:
+			maxBytes = -1
+		}
+
+		if maxBytes <= 0 {
+			return nil, fmt.Errorf("max_field_bytes option: %v, must be a"+
+				" positive integer", v.String())
+		}
+		rv.MaxFieldBytes = maxBytes
+	}
+
+	if v, exists := options.Field("include_locations"); exists {
+		if v.Type() != value.BOOLEAN {
+			return nil, fmt.Errorf("include_locations option: %v, must be a"+
+				" boolean", v.String())
+		}
+		rv.IncludeLocations = v.Truth()
+	}
+
+	if v, exists := options.Field("explain"); exists {
+		if v.Type() != value.BOOLEAN {
+			return nil, fmt.Errorf("explain option: %v, must be a boolean",
+				v.String())
+		}
+		rv.Explain = v.Truth()
+	}
+
+	if v, exists := options.Field("include_pindex"); exists {
+		if v.Type() != value.BOOLEAN {
+			return nil, fmt.Errorf("include_pindex option: %v, must be a"+
+				" boolean", v.String())
+		}
+		rv.IncludePindex = v.Truth()
+	}
+
+	if v, exists := options.Field("highlight"); exists {
+		highlight, err := parseHighlightOption(v)
+		if err != nil {
+			return nil, err
+		}
+		rv.Highlight = highlight
+	}
+
+	if v, exists := options.Field("raw_result"); exists {
+		if v.Type() != value.BOOLEAN {
+			return nil, fmt.Errorf("raw_result option: %v, must be a boolean",
+				v.String())
+		}
+		rv.RawResult = v.Truth()
+	}
+
+	if v, exists := options.Field("trailer"); exists {
+		if v.Type() != value.BOOLEAN {
+			return nil, fmt.Errorf("trailer option: %v, must be a boolean",
+				v.String())
+		}
+		if v.Truth() && rv.RawResult {
+			// the raw search result carries the totals itself.
+			return nil, fmt.Errorf("trailer option: unsupported with" +
+				" raw_result")
+		}
+		rv.Trailer = v.Truth()
+	}
+
+	if v, exists := options.Field("allow_partial_results"); exists {
+		if v.Type() != value.BOOLEAN {
+			return nil, fmt.Errorf("allow_partial_results option: %v,"+
+				" must be a boolean", v.String())
+		}
+		rv.AllowPartialResults = v.Truth()
+	}
+
+	if v, exists := options.Field("timeout"); exists {
+		timeout, err := parseTimeoutOption(v)
+		if err != nil {
+			return nil, err
+		}
+		rv.Timeout = timeout
+	}
+
+	if v, exists := options.Field("deep_paging"); exists {
+		if v.Type() != value.BOOLEAN {
+			return nil, fmt.Errorf("deep_paging option: %v, must be a boolean",
+				v.String())
+		}
+		rv.DeepPaging = v.Truth()
+	}
+
+	if v, exists := options.Field("search_after"); exists {
+		cursor, err := parseCursor("search_after", v)
+		if err != nil {
+			return nil, err
+		}
+		rv.SearchAfter = cursor
+	}
+
+	if v, exists := options.Field("search_before"); exists {
+		cursor, err := parseCursor("search_before", v)
+		if err != nil {
+			return nil, err
+		}
+		if len(cursor) == 0 {
+			return nil, fmt.Errorf("search_before option: %v, must be a"+
+				" non-empty array", v.String())
+		}
+		rv.SearchBefore = cursor
+	}
+
+	if rv.SearchAfter != nil && rv.SearchBefore != nil {
+		return nil, fmt.Errorf("search_after and search_before options" +
+			" can't be used together")
+	}
+
+	if rv.RawResult &&
+		(rv.DeepPaging || rv.SearchAfter != nil || rv.SearchBefore != nil) {
+		return nil, fmt.Errorf("raw_result option: unsupported with" +
+			" deep_paging, search_after and search_before")
+	}
+
+	if v, exists := options.Field("consistency"); exists {
+		consistency, err := parseConsistencyOption(v)
+		if err != nil {
+			return nil, err
+		}
+		rv.Consistency = consistency
+	}
+
+	if v, exists := options.Field("score"); exists {
+		if v.Type() != value.BOOLEAN {
+			return nil, fmt.Errorf("score option: %v, must be a boolean",
+				v.String())
+		}
+		score := v.Truth()
+		rv.Score = &score
+	}
+
+	if v, exists := options.Field("min_score"); exists {
+		minScore, ok := v.Actual().(float64)
+		if !ok {
+			if n, isInt := v.Actual().(int64); isInt {
+				minScore, ok = float64(n), true
+			}
+		}
+		if !ok || minScore < 0 {
+			return nil, fmt.Errorf("min_score option: %v, must be a"+
+				" non-negative number", v.String())
+		}
+
+		switch {
+		case rv.Score != nil && !*rv.Score:
+			return nil, fmt.Errorf("min_score option: the hits need to be" +
+				" scored")
+		case rv.RawResult:
+			return nil, fmt.Errorf("min_score option: unsupported with" +
+				" raw_result")
+		case rv.DeepPaging || rv.SearchAfter != nil || rv.SearchBefore != nil:
+			return nil, fmt.Errorf("min_score option: unsupported with" +
+				" deep_paging, search_after and search_before")
+		}
+
+		score := true
+		rv.Score = &score
+		rv.MinScore = &minScore
+	}
+
+	if v, exists := options.Field("keys_only"); exists {
+		if v.Type() != value.BOOLEAN {
+			return nil, fmt.Errorf("keys_only option: %v, must be a boolean",
+				v.String())
+		}
+		rv.KeysOnly = v.Truth()
+	}
+
+	if v, exists := options.Field("collapse"); exists {
+		collapse, err := parseCollapseOption(v)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case rv.RawResult:
+			return nil, fmt.Errorf("collapse option: unsupported with" +
+				" raw_result")
+		case rv.DeepPaging || rv.SearchAfter != nil || rv.SearchBefore != nil:
+			return nil, fmt.Errorf("collapse option: unsupported with" +
+				" deep_paging, search_after and search_before")
+		}
+
+		rv.Collapse = collapse
+	}
+
+	if v, exists := options.Field("sort"); exists {
+		keyOrder, err := parseSortOption(v)
+		if err != nil {
+			return nil, err
+		}
+		rv.Sort = keyOrder
+	}
+
+	if rv.KeysOnly {
+		var metadata []string
+		for option, requested := range map[string]bool{
+			"include_fields":    len(rv.IncludeFields) > 0,
+			"include_locations": rv.IncludeLocations,
+			"explain":           rv.Explain,
+			"include_pindex":    rv.IncludePindex,
+			"highlight":         rv.Highlight != nil,
+			"raw_result":        rv.RawResult,
+			"min_score":         rv.MinScore != nil,
+			"collapse":          rv.Collapse != nil,
+			"search_after":      rv.SearchAfter != nil,
+			"search_before":     rv.SearchBefore != nil,
+		} {
+			if requested {
+				metadata = append(metadata, option)
+			}
+		}
+
+		if len(metadata) > 0 {
+			sort.Strings(metadata)
+			return nil, fmt.Errorf("keys_only option: unsupported with %s,"+
+				" which return metadata", strings.Join(metadata, ", "))
+		}
+	}
+
+	return rv, nil
+}
+
+// MinScoreRequested returns true if the options carry a min_score, without
+// validating the rest of them, see SearchOptions.MinScore.
+func MinScoreRequested(options value.Value) bool {
+	if options == nil || options.Type() != value.OBJECT {
+		return false
+	}
+
+	_, exists := options.Field("min_score")
+	return exists
+}
+
+// CollapseField returns the field the hits are to be collapsed by, if the
+// options carry one, without validating the rest of them, see
+// SearchOptions.Collapse.
+func CollapseField(options value.Value) string {
+	if options == nil || options.Type() != value.OBJECT {
+		return ""
+	}
+
+	v, exists := options.Field("collapse")
+	if !exists || v.Type() != value.OBJECT {
+		return ""
+	}
+
+	field, _ := v.Field("field")
+	name, _ := field.Actual().(string)
+	return name
+}
+
+// SortOption returns the sort option, if the options carry a valid one,
+// without validating the rest of them, see SearchOptions.Sort.
+func SortOption(options value.Value) []string {
+	if options == nil || options.Type() != value.OBJECT {
+		return nil
+	}
+
+	v, exists := options.Field("sort")
+	if !exists {
+		return nil
+	}
+
+	rv, _ := parseSortOption(v)
+	return rv
+}
+
+// DeepPagingRequested returns true if the options request deep paging,
+// without validating the rest of them, see SearchOptions.DeepPaging.
+func DeepPagingRequested(options value.Value) bool {
+	if options == nil || options.Type() != value.OBJECT {
+		return false
+	}
+
+	v, exists := options.Field("deep_paging")
+	return exists && v.Type() == value.BOOLEAN && v.Truth()
+}
+
+// PreferExactRequested returns true if the options request the indexes
+// whose fields are mapped explicitly be preferred over dynamic ones, see
+// the "prefer_exact" option, without validating the rest of them.
+func PreferExactRequested(options value.Value) bool {
+	if options == nil || options.Type() != value.OBJECT {
+		return false
+	}
+
+	v, exists := options.Field("prefer_exact")
+	return exists && v.Type() == value.BOOLEAN && v.Truth()
+}
+
+// CursorRequested returns true if the options carry a cursor to page from,
+// without validating the rest of them, see SearchOptions.SearchAfter.
+func CursorRequested(options value.Value) bool {
+	if options == nil || options.Type() != value.OBJECT {
+		return false
+	}
+
+	_, after := options.Field("search_after")
+	_, before := options.Field("search_before")
+	return after || before
+}
+
+// parseCursor returns the sort values of the cursor option, as strings.
+func parseCursor(option string, v value.Value) ([]string, error) {
+	vals, ok := v.Actual().([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s option: %v, must be an array of strings",
+			option, v.String())
+	}
+
+	rv := make([]string, 0, len(vals))
+	for _, val := range vals {
+		s, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s option: %v, must be an array of"+
+				" strings", option, v.String())
+		}
+		rv = append(rv, s)
+	}
+
+	return rv, nil
+}
+
+func parseHighlightOption(v value.Value) (*HighlightOption, error) {
+	if v.Type() != value.OBJECT {
+		return nil, fmt.Errorf("highlight option: %v, must be an object",
+			v.String())
+	}
+
+	rv := &HighlightOption{}
+	for k, val := range v.Fields() {
+		switch k {
+		case "style":
+			rv.Style, _ = val.(string)
+			var supported bool
+			for _, style := range HighlightStyles {
+				supported = supported || rv.Style == style
+			}
+			if !supported {
+				return nil, fmt.Errorf("highlight option: %v, style must be"+
+					" one of: %q", v.String(), HighlightStyles)
+			}
+		case "fields":
+			fields, err := parseFieldNames("highlight", value.NewValue(val))
+			if err != nil {
+				return nil, err
+			}
+			rv.Fields = fields
+		default:
+			return nil, fmt.Errorf("highlight option: %v, unknown setting: %q",
+				v.String(), k)
+		}
+	}
+
+	return rv, nil
+}
+
+func parseCollapseOption(v value.Value) (*CollapseOption, error) {
+	if v.Type() != value.OBJECT {
+		return nil, fmt.Errorf("collapse option: %v, must be an object",
+			v.String())
+	}
+
+	rv := &CollapseOption{}
+	for k, val := range v.Fields() {
+		switch k {
+		case "field":
+			rv.Field, _ = val.(string)
+		default:
+			return nil, fmt.Errorf("collapse option: %v, unknown setting: %q",
+				v.String(), k)
+		}
+	}
+
+	if rv.Field == "" {
+		return nil, fmt.Errorf("collapse option: %v, field must be a"+
+			" non-empty string", v.String())
+	}
+
+	return rv, nil
+}
+
+func parseSortOption(v value.Value) ([]string, error) {
+	vals, ok := v.Actual().([]interface{})
+	if ok && len(vals) == 1 {
+		if s, _ := vals[0].(string); s != "" {
+			for _, keyOrder := range KeyOrders {
+				if s == keyOrder {
+					return []string{s}, nil
+				}
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("sort option: %v, must be one of: [\"_id\"],"+
+		" [\"-_id\"]", v.String())
+}
+
+func parseConsistencyOption(v value.Value) (*ConsistencyOption, error) {
+	if v.Type() != value.OBJECT {
+		return nil, fmt.Errorf("consistency option: %v, must be an object",
+			v.String())
+	}
+
+	rv := &ConsistencyOption{}
+
+	level, _ := v.Field("level")
+	rv.Level, _ = level.Actual().(string)
+	switch rv.Level {
+	case ConsistencyBounded:
+	case ConsistencyNotBounded:
+		return rv, nil
+	default:
+		return nil, fmt.Errorf("consistency option: %v, level must be one"+
+			" of: %q, %q", v.String(), ConsistencyBounded, ConsistencyNotBounded)
+	}
+
+	staleness, _ := v.Field("staleness_ms")
+	switch ms := staleness.Actual().(type) {
+	case int64:
+		rv.StalenessMS = ms
+	case float64:
+		if ms == math.Trunc(ms) {
+			rv.StalenessMS = int64(ms)
+		}
+	}
+
+	if rv.StalenessMS <= 0 {
+		return nil, fmt.Errorf("consistency option: %v, staleness_ms must be"+
+			" a positive integer", v.String())
+	}
+
+	return rv, nil
+}
+
+// SearchTimeoutMS returns the timeout (in milliseconds) that FTS is to
+// bound the search by, that of the timeout option if set (see
+// SearchOptions.Timeout), else that of the search request (its ctl params),
+// else 2 minutes.
+func SearchTimeoutMS(ctlTimeoutMS int64, opts *SearchOptions) int64 {
+	if opts != nil && opts.Timeout > 0 {
+		return opts.Timeout
+	}
+
+	if ctlTimeoutMS <= 0 {
+		return 120000 // defaults to 2min
+	}
+
+	return ctlTimeoutMS
+}
+
+func parseTimeoutOption(v value.Value) (int64, error) {
+	var rv int64
+	switch ms := v.Actual().(type) {
+	case int64:
+		rv = ms
+	case float64:
+		if ms == math.Trunc(ms) {
+			rv = int64(ms)
+		}
+	}
+
+	if rv <= 0 {
+		return 0, fmt.Errorf("timeout option: %v, must be a positive"+
+			" integer (milliseconds)", v.String())
+	}
+
+	return rv, nil
+}
+
+// parseFieldNames returns the field names of the option's value, which
+// must be an array of non-empty strings.
+func parseFieldNames(option string, v value.Value) ([]string, error) {
+	fields, ok := v.Actual().([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s option: %v, must be an array of field"+
+			" names", option, v.String())
+	}
+
+	var rv []string
+	for _, field := range fields {
+		name, ok := field.(string)
+		if !ok || len(name) == 0 {
+			return nil, fmt.Errorf("%s option: %v, must be an array of field"+
+				" names", option, v.String())
+		}
+		rv = append(rv, name)
+	}
+
+	return rv, nil
+}
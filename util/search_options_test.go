@@ -0,0 +1,654 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/query/value"
+)
+
+func TestParseSearchOptions(t *testing.T) {
+	opts, err := ParseSearchOptions(nil)
+	if err != nil || opts.Distinct {
+		t.Fatalf("Unexpected options: %+v, err: %v", opts, err)
+	}
+
+	opts, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"index":    "idx",
+		"distinct": true,
+	}))
+	if err != nil || !opts.Distinct {
+		t.Fatalf("Unexpected options: %+v, err: %v", opts, err)
+	}
+
+	_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"distinct": "yes",
+	}))
+	if err == nil {
+		t.Fatalf("Expected an error for a non-boolean distinct option")
+	}
+}
+
+func TestParseSearchOptionsBackfill(t *testing.T) {
+	opts, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"backfill_dir":      "n1fty/backfill/",
+		"backfill_limit_mb": 0,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.BackfillDir != filepath.Join("n1fty", "backfill") ||
+		opts.BackfillLimitMB == nil || *opts.BackfillLimitMB != 0 {
+		t.Fatalf("Unexpected options: %+v", opts)
+	}
+
+	opts, err = ParseSearchOptions(value.NewValue(map[string]interface{}{}))
+	if err != nil || opts.BackfillDir != "" || opts.BackfillLimitMB != nil {
+		t.Fatalf("Unexpected options: %+v, err: %v", opts, err)
+	}
+
+	opts, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"no_backfill":       true,
+		"backfill_limit_mb": 0,
+	}))
+	if err != nil || !opts.NoBackfill {
+		t.Fatalf("Unexpected options: %+v, err: %v", opts, err)
+	}
+
+	for _, bad := range []map[string]interface{}{
+		// outside of the configured backfill directory
+		{"backfill_dir": os.TempDir()},
+		{"backfill_dir": ".."},
+		{"backfill_dir": "../n1fty"},
+		{"backfill_dir": "n1fty/../../etc"},
+		{"backfill_dir": ""},
+		{"backfill_dir": 10},
+		{"backfill_limit_mb": -1},
+		{"backfill_limit_mb": 1.5},
+		{"backfill_limit_mb": "100"},
+		{"no_backfill": "yes"},
+		{"no_backfill": true, "backfill_limit_mb": 10},
+	} {
+		_, err = ParseSearchOptions(value.NewValue(bad))
+		if err == nil {
+			t.Fatalf("Expected an error for options: %v", bad)
+		}
+	}
+}
+
+func TestParseSearchOptionsIncludeFields(t *testing.T) {
+	opts, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"include_fields": []interface{}{"name", "reviews.author"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(opts.IncludeFields, []string{"name", "reviews.author"}) {
+		t.Fatalf("Unexpected include fields: %v", opts.IncludeFields)
+	}
+
+	for _, bad := range []interface{}{
+		"name",
+		[]interface{}{"name", 10},
+		[]interface{}{""},
+	} {
+		_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+			"include_fields": bad,
+		}))
+		if err == nil {
+			t.Fatalf("Expected an error for include_fields: %v", bad)
+		}
+	}
+}
+
+func TestParseSearchOptionsFieldLimits(t *testing.T) {
+	opts, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"exclude_fields":  []interface{}{"body"},
+		"max_field_bytes": 1024,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(opts.ExcludeFields, []string{"body"}) ||
+		opts.MaxFieldBytes != 1024 {
+		t.Fatalf("Unexpected field limits: %v, %d", opts.ExcludeFields,
+			opts.MaxFieldBytes)
+	}
+
+	for _, bad := range []map[string]interface{}{
+		{"exclude_fields": "body"},
+		{"max_field_bytes": 0},
+		{"max_field_bytes": 10.5},
+		{"max_field_bytes": "1024"},
+	} {
+		if _, err = ParseSearchOptions(value.NewValue(bad)); err == nil {
+			t.Fatalf("Expected an error for options: %v", bad)
+		}
+	}
+}
+
+func TestParseSearchOptionsIncludeLocations(t *testing.T) {
+	opts, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"include_locations": true,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !opts.IncludeLocations {
+		t.Fatalf("Expected the locations to be requested")
+	}
+
+	_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"include_locations": 1,
+	}))
+	if err == nil {
+		t.Fatalf("Expected an error for a non-boolean include_locations")
+	}
+}
+
+func TestParseSearchOptionsExplain(t *testing.T) {
+	opts, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"explain": true,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !opts.Explain {
+		t.Fatalf("Expected the explanations to be requested")
+	}
+
+	if opts, _ = ParseSearchOptions(nil); opts.Explain {
+		t.Fatalf("Expected the explanations not requested by default")
+	}
+
+	_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"explain": "true",
+	}))
+	if err == nil {
+		t.Fatalf("Expected an error for a non-boolean explain")
+	}
+}
+
+func TestParseSearchOptionsIncludePindex(t *testing.T) {
+	opts, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"include_pindex": true,
+	}))
+	if err != nil || !opts.IncludePindex {
+		t.Fatalf("Expected the pindexes requested, err: %v", err)
+	}
+
+	_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"include_pindex": 1,
+	}))
+	if err == nil {
+		t.Fatalf("Expected an error for a non-boolean include_pindex")
+	}
+
+	_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"include_pindex": true, "keys_only": true,
+	}))
+	if err == nil {
+		t.Fatalf("Expected an error for include_pindex with keys_only")
+	}
+}
+
+func TestParseSearchOptionsTrailer(t *testing.T) {
+	opts, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"trailer": true,
+	}))
+	if err != nil || !opts.Trailer {
+		t.Fatalf("Expected the trailer requested, err: %v", err)
+	}
+
+	_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"trailer": "yes",
+	}))
+	if err == nil {
+		t.Fatalf("Expected an error for a non-boolean trailer")
+	}
+
+	_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"trailer": true, "raw_result": true,
+	}))
+	if err == nil {
+		t.Fatalf("Expected an error for trailer with raw_result")
+	}
+}
+
+func TestParseSearchOptionsHighlight(t *testing.T) {
+	tests := []struct {
+		highlight interface{}
+		expect    *HighlightOption
+	}{
+		{highlight: map[string]interface{}{
+			"style": "html", "fields": []interface{}{"body"}},
+			expect: &HighlightOption{Style: "html", Fields: []string{"body"}}},
+		{highlight: map[string]interface{}{"style": "ansi"},
+			expect: &HighlightOption{Style: "ansi"}},
+		// bleve's default style, over all the fields
+		{highlight: map[string]interface{}{}, expect: &HighlightOption{}},
+	}
+
+	for _, test := range tests {
+		opts, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+			"highlight": test.highlight,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(test.expect, opts.Highlight) {
+			t.Fatalf("[%v] Expected: %+v, got: %+v", test.highlight,
+				test.expect, opts.Highlight)
+		}
+	}
+
+	if opts, _ := ParseSearchOptions(nil); opts.Highlight != nil {
+		t.Fatalf("Expected no highlighting by default")
+	}
+
+	for _, highlight := range []interface{}{
+		true,
+		map[string]interface{}{"style": "xml"},
+		map[string]interface{}{"style": 1},
+		map[string]interface{}{"fields": "body"},
+		map[string]interface{}{"size": 100},
+	} {
+		_, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+			"highlight": highlight,
+		}))
+		if err == nil || !strings.Contains(err.Error(), "highlight option") {
+			t.Fatalf("[%v] Expected a highlight option error, got: %v",
+				highlight, err)
+		}
+	}
+
+	_, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"highlight": map[string]interface{}{"style": "xml"},
+	}))
+	if err == nil || !strings.Contains(err.Error(), `["html" "ansi"]`) {
+		t.Fatalf("Expected the supported styles listed, got: %v", err)
+	}
+}
+
+func TestParseSearchOptionsKeysOnly(t *testing.T) {
+	opts, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"keys_only": true, "distinct": true,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !opts.KeysOnly {
+		t.Fatalf("Expected only the keys requested")
+	}
+
+	if opts, _ = ParseSearchOptions(nil); opts.KeysOnly {
+		t.Fatalf("Expected the metadata requested by default")
+	}
+
+	_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"keys_only": "true",
+	}))
+	if err == nil {
+		t.Fatalf("Expected an error for a non-boolean keys_only")
+	}
+
+	// the options returning metadata don't go with it.
+	_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"keys_only":      true,
+		"explain":        true,
+		"include_fields": []interface{}{"name"},
+	}))
+	if err == nil || !strings.Contains(err.Error(),
+		"unsupported with explain, include_fields") {
+		t.Fatalf("Expected the options returning metadata listed, got: %v",
+			err)
+	}
+}
+
+func TestParseSearchOptionsCollapse(t *testing.T) {
+	opts, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"collapse": map[string]interface{}{"field": "product_id"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(opts.Collapse, &CollapseOption{Field: "product_id"}) {
+		t.Fatalf("Unexpected collapse: %+v", opts.Collapse)
+	}
+
+	for _, collapse := range []interface{}{
+		"product_id",
+		map[string]interface{}{},
+		map[string]interface{}{"field": ""},
+		map[string]interface{}{"field": 10},
+		map[string]interface{}{"field": "product_id", "size": 2},
+	} {
+		_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+			"collapse": collapse,
+		}))
+		if err == nil {
+			t.Fatalf("Expected an error for collapse: %v", collapse)
+		}
+	}
+
+	// the hits collapsed aren't counted by the offset/limit paged through.
+	for _, option := range []string{"deep_paging", "raw_result", "keys_only"} {
+		_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+			"collapse": map[string]interface{}{"field": "product_id"},
+			option:     true,
+		}))
+		if err == nil {
+			t.Fatalf("Expected an error for collapse with %s", option)
+		}
+	}
+
+	if field := CollapseField(value.NewValue(map[string]interface{}{
+		"collapse": map[string]interface{}{"field": "product_id"},
+	})); field != "product_id" {
+		t.Fatalf("Expected the collapse field, got: %q", field)
+	}
+}
+
+func TestParseSearchOptionsSort(t *testing.T) {
+	for _, keyOrder := range KeyOrders {
+		opts, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+			"sort": []interface{}{keyOrder},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(opts.Sort, []string{keyOrder}) {
+			t.Fatalf("Unexpected sort: %v", opts.Sort)
+		}
+	}
+
+	for _, sort := range []interface{}{
+		"_id",
+		[]interface{}{},
+		[]interface{}{"color"},
+		[]interface{}{"_id", "-_id"},
+		[]interface{}{10},
+	} {
+		_, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+			"sort": sort,
+		}))
+		if err == nil {
+			t.Fatalf("Expected an error for sort: %v", sort)
+		}
+	}
+
+	if keyOrder := SortOption(value.NewValue(map[string]interface{}{
+		"sort": []interface{}{"-_id"},
+	})); !reflect.DeepEqual(keyOrder, []string{"-_id"}) {
+		t.Fatalf("Expected the sort option, got: %v", keyOrder)
+	}
+
+	if !SortMatchesOrder([]string{"-_id"}, []string{"id DESC"}) ||
+		SortMatchesOrder([]string{"_id"}, []string{"id DESC"}) ||
+		SortMatchesOrder([]string{"_id"}, []string{"id", "color"}) {
+		t.Fatalf("Unexpected match of the sort to the order")
+	}
+}
+
+func TestParseSearchOptionsConsistency(t *testing.T) {
+	opts, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"consistency": map[string]interface{}{
+			"level":        "bounded",
+			"staleness_ms": 500,
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(opts.Consistency, &ConsistencyOption{
+		Level: ConsistencyBounded, StalenessMS: 500}) {
+		t.Fatalf("Unexpected consistency: %+v", opts.Consistency)
+	}
+
+	opts, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"consistency": map[string]interface{}{"level": "not_bounded"},
+	}))
+	if err != nil || opts.Consistency == nil ||
+		opts.Consistency.Level != ConsistencyNotBounded {
+		t.Fatalf("Unexpected consistency: %+v, err: %v", opts.Consistency, err)
+	}
+
+	for _, bad := range []interface{}{
+		"bounded",
+		map[string]interface{}{"level": "at_plus"},
+		map[string]interface{}{"level": "bounded"},
+		map[string]interface{}{"level": "bounded", "staleness_ms": 0},
+		map[string]interface{}{"level": "bounded", "staleness_ms": 0.5},
+		map[string]interface{}{"level": "bounded", "staleness_ms": "500"},
+	} {
+		_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+			"consistency": bad,
+		}))
+		if err == nil {
+			t.Fatalf("Expected an error for consistency: %v", bad)
+		}
+	}
+}
+
+func TestParseSearchOptionsDeepPaging(t *testing.T) {
+	options := value.NewValue(map[string]interface{}{"deep_paging": true})
+
+	opts, err := ParseSearchOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !opts.DeepPaging || !DeepPagingRequested(options) {
+		t.Fatalf("Expected deep paging to be requested")
+	}
+
+	options = value.NewValue(map[string]interface{}{"deep_paging": "true"})
+	if _, err = ParseSearchOptions(options); err == nil {
+		t.Fatalf("Expected an error for a non-boolean deep_paging")
+	}
+
+	if DeepPagingRequested(options) || DeepPagingRequested(nil) {
+		t.Fatalf("Expected deep paging not to be requested")
+	}
+}
+
+func TestParseSearchOptionsCursor(t *testing.T) {
+	options := value.NewValue(map[string]interface{}{
+		"search_after": []interface{}{"red", "doc-03"},
+	})
+
+	opts, err := ParseSearchOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(opts.SearchAfter, []string{"red", "doc-03"}) ||
+		opts.SearchBefore != nil || !CursorRequested(options) {
+		t.Fatalf("Expected the cursor to follow, got: %+v", opts)
+	}
+
+	// an empty cursor to follow is that of the first page.
+	opts, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"search_after": []interface{}{},
+	}))
+	if err != nil || opts.SearchAfter == nil || len(opts.SearchAfter) != 0 {
+		t.Fatalf("Expected an empty cursor, got: %+v, err: %v", opts, err)
+	}
+
+	invalid := []map[string]interface{}{
+		{"search_after": "red"},
+		{"search_after": []interface{}{"red", 3}},
+		{"search_before": []interface{}{}},
+		{"search_after": []interface{}{"red"},
+			"search_before": []interface{}{"blue"}},
+	}
+	for _, options := range invalid {
+		if _, err = ParseSearchOptions(value.NewValue(options)); err == nil {
+			t.Fatalf("Expected an error for the options: %v", options)
+		}
+	}
+
+	if CursorRequested(value.NewValue(map[string]interface{}{})) ||
+		CursorRequested(nil) {
+		t.Fatalf("Expected no cursor requested")
+	}
+}
+
+func TestParseSearchOptionsMinScore(t *testing.T) {
+	options := value.NewValue(map[string]interface{}{"min_score": 0.5})
+
+	opts, err := ParseSearchOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.MinScore == nil || *opts.MinScore != 0.5 || !MinScoreRequested(options) {
+		t.Fatalf("Expected a min score of 0.5, got: %+v", opts)
+	}
+
+	// the hits are then scored, whatever their order.
+	if opts.Score == nil || !*opts.Score {
+		t.Fatalf("Expected the hits to be scored, got: %+v", opts)
+	}
+
+	invalid := []map[string]interface{}{
+		{"min_score": "0.5"},
+		{"min_score": -1},
+		{"min_score": 0.5, "score": false},
+		{"min_score": 0.5, "raw_result": true},
+		{"min_score": 0.5, "deep_paging": true},
+		{"min_score": 0.5, "search_after": []interface{}{}},
+	}
+	for _, options := range invalid {
+		if _, err = ParseSearchOptions(value.NewValue(options)); err == nil {
+			t.Fatalf("Expected an error for the options: %v", options)
+		}
+	}
+
+	if MinScoreRequested(value.NewValue(map[string]interface{}{})) ||
+		MinScoreRequested(nil) {
+		t.Fatalf("Expected no min score requested")
+	}
+}
+
+func TestParseSearchOptionsRawResult(t *testing.T) {
+	opts, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"raw_result": true,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !opts.RawResult {
+		t.Fatalf("Expected raw result to be requested")
+	}
+
+	_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"raw_result": "true",
+	}))
+	if err == nil {
+		t.Fatalf("Expected an error for a non-boolean raw_result")
+	}
+
+	for option, v := range map[string]interface{}{
+		"deep_paging":  true,
+		"search_after": []interface{}{},
+	} {
+		_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+			"raw_result": true,
+			option:       v,
+		}))
+		if err == nil {
+			t.Fatalf("Expected an error for raw_result with %s", option)
+		}
+	}
+}
+
+func TestParseSearchOptionsTimeout(t *testing.T) {
+	opts, err := ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"timeout": 500,
+	}))
+	if err != nil || opts.Timeout != 500 {
+		t.Fatalf("Expected the timeout, got: %+v, err: %v", opts, err)
+	}
+
+	for _, timeout := range []interface{}{0, -1, 2.5, "500ms", true} {
+		_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+			"timeout": timeout,
+		}))
+		if err == nil {
+			t.Fatalf("Expected an error for timeout: %v", timeout)
+		}
+	}
+}
+
+func TestParseSearchOptionsAllowPartialResults(t *testing.T) {
+	opts, err := ParseSearchOptions(nil)
+	if err != nil || opts.AllowPartialResults {
+		t.Fatalf("Expected partial results to be disallowed by default,"+
+			" err: %v", err)
+	}
+
+	opts, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"allow_partial_results": true,
+	}))
+	if err != nil || !opts.AllowPartialResults {
+		t.Fatalf("Expected partial results to be allowed, err: %v", err)
+	}
+
+	_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"allow_partial_results": 1,
+	}))
+	if err == nil {
+		t.Fatalf("Expected an error for a non-boolean allow_partial_results")
+	}
+}
+
+func TestParseSearchOptionsScore(t *testing.T) {
+	opts, err := ParseSearchOptions(nil)
+	if err != nil || opts.Score != nil {
+		t.Fatalf("Expected scoring to be left undecided by default,"+
+			" err: %v", err)
+	}
+
+	for _, score := range []bool{true, false} {
+		opts, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+			"score": score,
+		}))
+		if err != nil || opts.Score == nil || *opts.Score != score {
+			t.Fatalf("Expected score: %v, got: %v, err: %v",
+				score, opts.Score, err)
+		}
+	}
+
+	_, err = ParseSearchOptions(value.NewValue(map[string]interface{}{
+		"score": "none",
+	}))
+	if err == nil {
+		t.Fatalf("Expected an error for a non-boolean score")
+	}
+}
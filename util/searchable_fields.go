@@ -13,13 +13,20 @@ package util
 
 import (
 	"encoding/json"
+	"fmt"
 	"math"
+	"regexp"
+	"sort"
 	"strings"
+	"sync/atomic"
 
 	"github.com/blevesearch/bleve/v2/mapping"
 	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/blevesearch/bleve/v2/search/searcher"
 	"github.com/couchbase/cbft"
 	"github.com/couchbase/cbgt"
+	"github.com/couchbase/query/expression"
+	"github.com/couchbase/query/expression/parser"
 )
 
 type SearchField struct {
@@ -44,7 +51,8 @@ type ProcessedIndexParams struct {
 	DocConfig             *cbft.BleveDocumentConfig
 	SearchFields          map[SearchField]bool
 	IndexedCount          int64
-	CondExpr              string
+	CondExpr              string            // Condition of the docid_prefix/regexp modes
+	CondTypes             []string          // Enabled type mappings, in type_field modes
 	DynamicMappings       map[string]string // Default Analyzers of enabled dynamic mappings
 	AllFieldSearchable    bool
 	DefaultAnalyzer       string
@@ -52,6 +60,325 @@ type ProcessedIndexParams struct {
 	MultipleTypeStrs      bool
 	Scope                 string
 	Collection            string
+	MappingInfo           *MappingInfo
+
+	// FieldlessQueriesDisallowed is set by the index definition's params
+	// ("n1fty": {"disallow_fieldless_queries": true}), to have the queries
+	// without fields (over the _all field) not sargable for the index.
+	FieldlessQueriesDisallowed bool
+}
+
+// Cond returns the condition of the documents the index covers, nil if
+// it covers all of them: in the type_field modes it's synthesized from the
+// (custom) type field and the enabled type mappings, else it's parsed from
+// the CondExpr.
+func (pip *ProcessedIndexParams) Cond() (expression.Expression, error) {
+	if pip.DocConfig != nil && len(pip.CondTypes) > 0 {
+		return typeMappingsCondExpr(pip.DocConfig.TypeField, pip.CondTypes), nil
+	}
+
+	if len(pip.CondExpr) > 0 {
+		return parser.Parse(pip.CondExpr)
+	}
+
+	return nil, nil
+}
+
+// typeMappingsCondExpr returns the expression that holds for documents
+// whose type field (possibly nested, ex: "meta.kind") matches one of the
+// types, for ex: `type` = "beer" OR `type` = "brewery".
+func typeMappingsCondExpr(typeField string, types []string) expression.Expression {
+	path := strings.Split(typeField, ".")
+	var typeFieldExpr expression.Expression = expression.NewIdentifier(path[0])
+	for _, name := range path[1:] {
+		typeFieldExpr = expression.NewField(typeFieldExpr,
+			expression.NewFieldName(name, false))
+	}
+
+	preds := make(expression.Expressions, 0, len(types))
+	for _, typ := range types {
+		preds = append(preds,
+			expression.NewEq(typeFieldExpr, expression.NewConstant(typ)))
+	}
+
+	if len(preds) == 1 {
+		return preds[0]
+	}
+
+	return expression.NewOr(preds...)
+}
+
+// MappingInfo carries the details of an index mapping gathered while
+// processing it, that aren't captured by the searchable fields.
+type MappingInfo struct {
+	// FieldAliases maps a document path to the name(s) its fields are
+	// indexed under, for those fields whose mapping "name" differs from
+	// the path (and where the path itself isn't indexed under its name).
+	FieldAliases map[string][]string
+
+	// FieldAnalyzers maps the name of an indexed text field to the
+	// analyzer(s) it is indexed with.
+	FieldAnalyzers map[string][]string
+
+	// AllFieldAnalyzers lists the analyzers of the text content that
+	// makes up the _all field, i.e. of the text fields that are included
+	// in _all and the default analyzers of dynamic mappings.
+	AllFieldAnalyzers []string
+
+	// FieldDateFormats maps the name of an indexed datetime field to the
+	// date/time parser(s) it is indexed with.
+	FieldDateFormats map[string][]string
+
+	// DateFormatTimeZones maps the name of a custom date/time parser (of
+	// the index mapping) to whether any of its layouts carry a time zone.
+	DateFormatTimeZones map[string]bool
+
+	// DynamicMappingAnalyzers maps the path of a nested dynamic mapping to
+	// its default analyzer(s), i.e. its own, else that of the nearest
+	// mapping above it that sets one, that the text of the fields under it
+	// (but for those mapped explicitly) is indexed with.
+	DynamicMappingAnalyzers map[string][]string
+
+	// FieldTermVectors maps the name of an indexed text field to whether
+	// it's indexed with term vectors (the terms' positions), as phrases
+	// are matched with, under all of its mappings.
+	FieldTermVectors map[string]bool
+
+	// StoredFields holds the names of the fields that are stored, and so
+	// retrievable along with the hits, whether or not they're indexed for
+	// search (those with "index": false aren't searchable).
+	StoredFields map[string]bool
+
+	// TypeFields maps each of the enabled type mappings (of an index with
+	// them) to its searchable fields (and their dynamic-ness), apart from
+	// those of the other type mappings.
+	TypeFields map[string]map[SearchField]bool
+}
+
+func NewMappingInfo() *MappingInfo {
+	return &MappingInfo{
+		FieldAliases:        map[string][]string{},
+		FieldAnalyzers:      map[string][]string{},
+		FieldDateFormats:    map[string][]string{},
+		DateFormatTimeZones: map[string]bool{},
+		FieldTermVectors:    map[string]bool{},
+		StoredFields:        map[string]bool{},
+		TypeFields:          map[string]map[SearchField]bool{},
+
+		DynamicMappingAnalyzers: map[string][]string{},
+	}
+}
+
+func appendUnique(arr []string, s string) []string {
+	for _, existing := range arr {
+		if existing == s {
+			return arr
+		}
+	}
+
+	return append(arr, s)
+}
+
+// TypesOf returns the (sorted) type mappings under which the field is
+// searchable, directly or under a dynamic mapping, none if the index
+// doesn't have type mappings.
+func (mi *MappingInfo) TypesOf(name string) []string {
+	if mi == nil {
+		return nil
+	}
+
+	var rv []string
+	for typ, fields := range mi.TypeFields {
+		for f, dynamic := range fields {
+			if (!dynamic && f.Name == name) || (dynamic &&
+				(f.Name == "" || strings.HasPrefix(name, f.Name+"."))) {
+				rv = append(rv, typ)
+				break
+			}
+		}
+	}
+	sort.Strings(rv)
+
+	return rv
+}
+
+// HasFieldAnalyzer returns true if the text field is indexed with the
+// analyzer, or if the field's analyzers aren't known.
+func (mi *MappingInfo) HasFieldAnalyzer(name, analyzer string) bool {
+	if mi == nil {
+		return true
+	}
+
+	analyzers, exists := mi.FieldAnalyzers[name]
+	if !exists {
+		return true
+	}
+
+	for _, a := range analyzers {
+		if a == analyzer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AnalyzersOf returns the analyzers the text field is indexed with, if
+// known.
+func (mi *MappingInfo) AnalyzersOf(name string) []string {
+	if mi == nil {
+		return nil
+	}
+
+	return mi.FieldAnalyzers[name]
+}
+
+// HasFieldDateFormat returns true if the datetime field is indexed with
+// the date/time parser, or if the field's parsers aren't known.
+func (mi *MappingInfo) HasFieldDateFormat(name, dateFormat string) bool {
+	if mi == nil {
+		return true
+	}
+
+	formats, exists := mi.FieldDateFormats[name]
+	if !exists {
+		return true
+	}
+
+	for _, f := range formats {
+		if f == dateFormat {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DateFormatsOf returns the date/time parsers the datetime field is
+// indexed with, if known.
+func (mi *MappingInfo) DateFormatsOf(name string) []string {
+	if mi == nil {
+		return nil
+	}
+
+	return mi.FieldDateFormats[name]
+}
+
+// DateFormatHasTimeZone returns true if the date/time parser parses time
+// zones, as do the built-in parsers (for ex. dateTimeOptional), or if the
+// parser isn't known.
+func (mi *MappingInfo) DateFormatHasTimeZone(dateFormat string) bool {
+	if mi == nil {
+		return true
+	}
+
+	hasTimeZone, exists := mi.DateFormatTimeZones[dateFormat]
+	return !exists || hasTimeZone
+}
+
+// layoutTimeZones are the elements of a Go time layout (as of a flexiblego
+// date/time parser) that carry a time zone.
+var layoutTimeZones = []string{"MST", "Z07", "-07"}
+
+// processDateTimeParsers records whether the custom date/time parsers of
+// the index mapping carry a time zone within any of their layouts.
+func processDateTimeParsers(im *mapping.IndexMappingImpl, mi *MappingInfo) {
+	if im.CustomAnalysis == nil {
+		return
+	}
+
+	for name, config := range im.CustomAnalysis.DateTimeParsers {
+		layouts, _ := config["layouts"].([]interface{})
+
+		var hasTimeZone bool
+		for _, layout := range layouts {
+			str, _ := layout.(string)
+			for _, tz := range layoutTimeZones {
+				if strings.Contains(str, tz) {
+					hasTimeZone = true
+				}
+			}
+		}
+
+		mi.DateFormatTimeZones[name] = hasTimeZone
+	}
+}
+
+// HasAllFieldAnalyzer returns true if the _all field carries content
+// analyzed with the analyzer.
+func (mi *MappingInfo) HasAllFieldAnalyzer(analyzer string) bool {
+	if mi == nil {
+		return true
+	}
+
+	for _, a := range mi.AllFieldAnalyzers {
+		if a == analyzer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DynamicParentOf returns the path of the nearest dynamic mapping the
+// field by the name is under (if any), along with its default analyzers,
+// a nested dynamic mapping overriding those above it.
+func (mi *MappingInfo) DynamicParentOf(name string) (string, []string) {
+	if mi == nil {
+		return "", nil
+	}
+
+	for x := strings.LastIndex(name, "."); x > 0; x = strings.LastIndex(
+		name[:x], ".") {
+		if analyzers, exists := mi.DynamicMappingAnalyzers[name[:x]]; exists {
+			return name[:x], analyzers
+		}
+	}
+
+	return "", nil
+}
+
+// HasTermVectors returns true unless the text field by the name is indexed
+// without term vectors (by any of its mappings), those of the dynamic
+// mappings being indexed with them.
+func (mi *MappingInfo) HasTermVectors(name string) bool {
+	if mi == nil {
+		return true
+	}
+
+	tv, exists := mi.FieldTermVectors[name]
+	return !exists || tv
+}
+
+// IsStoredField returns true if the field by the name is stored, and so
+// retrievable along with the hits.
+func (mi *MappingInfo) IsStoredField(name string) bool {
+	return mi != nil && mi.StoredFields[name]
+}
+
+func (mi *MappingInfo) addFieldAlias(path, name string) {
+	mi.FieldAliases[path] = appendUnique(mi.FieldAliases[path], name)
+}
+
+// ResolveFieldAlias returns the name the field at the document path is
+// indexed under, or "" if the path isn't aliased. A path whose fields
+// are indexed under more than one name is ambiguous, and is reported.
+func (mi *MappingInfo) ResolveFieldAlias(path string) (string, error) {
+	if mi == nil {
+		return "", nil
+	}
+
+	names := mi.FieldAliases[path]
+	if len(names) > 1 {
+		return "", fmt.Errorf("field: %q is ambiguous, as it's indexed"+
+			" under names: %v", path, names)
+	}
+
+	if len(names) == 1 {
+		return names[0], nil
+	}
+
+	return "", nil
 }
 
 // ProcessIndexDef determines if an indexDef is supportable as an
@@ -76,6 +403,13 @@ func ProcessIndexDef(indexDef *cbgt.IndexDef, scope, collection string) (
 		return
 	}
 
+	defer func() {
+		if err == nil && pip.IndexMapping != nil {
+			pip.FieldlessQueriesDisallowed, err =
+				processN1ftyParams([]byte(indexDef.Params))
+		}
+	}()
+
 	var condExpr string
 
 	switch bp.DocConfig.Mode {
@@ -87,7 +421,7 @@ func ProcessIndexDef(indexDef *cbgt.IndexDef, scope, collection string) (
 		}
 
 		m, indexedCount, typeStrs, dynamicMappings, allFieldSearchable,
-			defaultAnalyzer, defaultDateTimeParser := ProcessIndexMapping(im)
+			defaultAnalyzer, defaultDateTimeParser, mi := ProcessIndexMapping(im)
 		var types []string
 		if typeStrs != nil {
 			for typeMapping, enabled := range typeStrs.S {
@@ -99,24 +433,7 @@ func ProcessIndexDef(indexDef *cbgt.IndexDef, scope, collection string) (
 					types = append(types, typeMapping)
 				}
 			}
-
-			if len(types) == 1 {
-				// Ex: condExpr == '`type`="beer"'.
-				condExpr = "`" + typeField + "`" + "=\"" + types[0] + "\""
-			} else if len(types) > 1 {
-				for i := range types {
-					// Ex: condExpr: '`type` IN ["beer", "brewery"]'.
-					if len(condExpr) == 0 {
-						condExpr = "`" + typeField + "` IN [\"" + types[i] + "\""
-					} else {
-						condExpr += ", \"" + types[i] + "\""
-					}
-				}
-
-				if len(condExpr) > 0 {
-					condExpr += "]"
-				}
-			}
+			sort.Strings(types)
 		}
 
 		return ProcessedIndexParams{
@@ -124,7 +441,7 @@ func ProcessIndexDef(indexDef *cbgt.IndexDef, scope, collection string) (
 			DocConfig:             &bp.DocConfig,
 			SearchFields:          m,
 			IndexedCount:          indexedCount,
-			CondExpr:              condExpr,
+			CondTypes:             types,
 			DynamicMappings:       dynamicMappings,
 			AllFieldSearchable:    allFieldSearchable,
 			DefaultAnalyzer:       defaultAnalyzer,
@@ -132,6 +449,7 @@ func ProcessIndexDef(indexDef *cbgt.IndexDef, scope, collection string) (
 			MultipleTypeStrs:      len(types) > 1,
 			Scope:                 scope,
 			Collection:            collection,
+			MappingInfo:           mi,
 		}, nil
 
 	case "docid_prefix":
@@ -144,7 +462,7 @@ func ProcessIndexDef(indexDef *cbgt.IndexDef, scope, collection string) (
 
 		var multipleTypeStrs bool
 		m, indexedCount, typeStrs, dynamicMappings, allFieldSearchable,
-			defaultAnalyzer, defaultDateTimeParser := ProcessIndexMapping(im)
+			defaultAnalyzer, defaultDateTimeParser, mi := ProcessIndexMapping(im)
 		if typeStrs != nil {
 			for typeMapping, enabled := range typeStrs.S {
 				if !enabled {
@@ -179,6 +497,7 @@ func ProcessIndexDef(indexDef *cbgt.IndexDef, scope, collection string) (
 			MultipleTypeStrs:      multipleTypeStrs,
 			Scope:                 scope,
 			Collection:            collection,
+			MappingInfo:           mi,
 		}, nil
 
 	case "scope.collection.type_field":
@@ -188,9 +507,17 @@ func ProcessIndexDef(indexDef *cbgt.IndexDef, scope, collection string) (
 			return
 		}
 
+		scim := scopeCollIndexMapping(im, scope, collection)
+		if scim == nil {
+			// Do not consider index, as nothing relevant to the scope.collection is
+			// indexed.
+			return
+		}
+
 		var multipleTypeStrs bool
+		var types []string
 		m, indexedCount, typeStrs, dynamicMappings, allFieldSearchable,
-			defaultAnalyzer, defaultDateTimeParser := ProcessIndexMapping(im)
+			defaultAnalyzer, defaultDateTimeParser, mi := ProcessIndexMapping(scim)
 		if typeStrs != nil {
 			scopeCollTypes := map[string]bool{}
 			var entireScopeCollIndexed bool
@@ -221,34 +548,21 @@ func ProcessIndexDef(indexDef *cbgt.IndexDef, scope, collection string) (
 					// Do not consider this index, to avoid the possibility of false negatives.
 					return
 				}
-				// condExpr is nil
+				// types is nil, so no condition
 			} else {
-				var types []string
 				for typeName, enabled := range scopeCollTypes {
 					if enabled {
 						types = append(types, typeName)
 					}
 				}
+				sort.Strings(types)
 
 				if len(types) == 0 {
 					// Do not consider index, as nothing relevant to the scope.collection is
 					// indexed.
 					return
-				} else if len(types) == 1 {
-					// Ex: condExpr == '`type`="beer"'
-					condExpr = "`" + typeField + "`" + "=\"" + types[0] + "\""
-				} else {
-					multipleTypeStrs = true
-					for i := range types {
-						// Ex: condExpr: '`type` IN ["beer", "brewery"]'.
-						if len(condExpr) == 0 {
-							condExpr = "`" + typeField + "` IN [\"" + types[i] + "\""
-						} else {
-							condExpr += ", \"" + types[i] + "\""
-						}
-					}
-					condExpr += "]"
 				}
+				multipleTypeStrs = len(types) > 1
 			}
 		}
 
@@ -257,7 +571,7 @@ func ProcessIndexDef(indexDef *cbgt.IndexDef, scope, collection string) (
 			DocConfig:             &bp.DocConfig,
 			SearchFields:          m,
 			IndexedCount:          indexedCount,
-			CondExpr:              condExpr,
+			CondTypes:             types,
 			DynamicMappings:       dynamicMappings,
 			AllFieldSearchable:    allFieldSearchable,
 			DefaultAnalyzer:       defaultAnalyzer,
@@ -265,6 +579,7 @@ func ProcessIndexDef(indexDef *cbgt.IndexDef, scope, collection string) (
 			MultipleTypeStrs:      multipleTypeStrs,
 			Scope:                 scope,
 			Collection:            collection,
+			MappingInfo:           mi,
 		}, nil
 
 	case "scope.collection.docid_prefix":
@@ -275,9 +590,16 @@ func ProcessIndexDef(indexDef *cbgt.IndexDef, scope, collection string) (
 			return
 		}
 
+		scim := scopeCollIndexMapping(im, scope, collection)
+		if scim == nil {
+			// Do not consider index, as nothing relevant to the scope.collection is
+			// indexed.
+			return
+		}
+
 		var multipleTypeStrs bool
 		m, indexedCount, typeStrs, dynamicMappings, allFieldSearchable,
-			defaultAnalyzer, defaultDateTimeParser := ProcessIndexMapping(im)
+			defaultAnalyzer, defaultDateTimeParser, mi := ProcessIndexMapping(scim)
 		if typeStrs != nil {
 			scopeCollTypes := map[string]bool{}
 			var entireScopeCollIndexed bool
@@ -351,6 +673,7 @@ func ProcessIndexDef(indexDef *cbgt.IndexDef, scope, collection string) (
 			MultipleTypeStrs:      multipleTypeStrs,
 			Scope:                 scope,
 			Collection:            collection,
+			MappingInfo:           mi,
 		}, nil
 
 	case "docid_regexp", "scope.collection.docid_regexp":
@@ -363,34 +686,78 @@ func ProcessIndexDef(indexDef *cbgt.IndexDef, scope, collection string) (
 	}
 }
 
+// scopeCollIndexMapping returns a copy of the index mapping (of an index
+// in one of the scope.collection modes), carrying only the type mappings
+// that apply to the scope.collection, so the fields mapped for the other
+// collections of the index aren't deemed searchable over this one, nil
+// if none of the index's type mappings apply to the scope.collection.
+func scopeCollIndexMapping(im *mapping.IndexMappingImpl,
+	scope, collection string) *mapping.IndexMappingImpl {
+	if im.DefaultMapping != nil && im.DefaultMapping.Enabled {
+		// left for ProcessIndexMapping to turn down, if there are type
+		// mappings alongside.
+		return im
+	}
+
+	rv := *im
+	rv.TypeMapping = make(map[string]*mapping.DocumentMapping,
+		len(im.TypeMapping))
+	for typeMapping, tm := range im.TypeMapping {
+		arr := strings.SplitN(typeMapping, ".", 3)
+		if len(arr) == 1 {
+			if (scope == "" || scope == "_default") &&
+				(collection == "" || collection == "_default") {
+				rv.TypeMapping[typeMapping] = tm
+			}
+		} else if scope == arr[0] && collection == arr[1] {
+			rv.TypeMapping[typeMapping] = tm
+		}
+	}
+
+	if len(rv.TypeMapping) == 0 {
+		return nil
+	}
+
+	return &rv
+}
+
 // ProcessIndexMapping currently checks the index mapping for two
 // limited, simple cases of datastore.FTSIndex supportability...
 //
 // A) there's only an enabled default mapping (with no other type
-//    mappings), where the returned typeStr will be nil.
+// mappings), where the returned typeStr will be nil.
 //
 // B) more than one type mapping is OK for as long as the default
-//    mapping is NOT enabled, where typeStrs will be for example ..
-//    &types{{"beer":true}, {"brewery":true}, ..]}
+// mapping is NOT enabled, where typeStrs will be for example ..
+// &types{{"beer":true}, {"brewery":true}, ..]}
 func ProcessIndexMapping(im *mapping.IndexMappingImpl) (m map[SearchField]bool,
 	indexedCount int64, typeStrs *Types, dynamicMappings map[string]string,
-	allFieldSearchable bool, defaultAnalyzer string, defaultDateTimeParser string) {
-	var ok bool
+	allFieldSearchable bool, defaultAnalyzer string, defaultDateTimeParser string,
+	mi *MappingInfo) {
+	var ok, searchable bool
 	dynamicMappings = map[string]string{}
 
 	m = map[SearchField]bool{}
+	mi = NewMappingInfo()
+	processDateTimeParsers(im, mi)
 
 	for t, tm := range im.TypeMapping {
 		if typeStrs == nil {
 			typeStrs = &Types{S: make(map[string]bool)}
 		}
 		if tm.Enabled {
-			m, indexedCount, allFieldSearchable, ok = ProcessDocumentMapping(
+			m, indexedCount, searchable, ok = ProcessDocumentMapping(
 				im, im.DefaultAnalyzer, im.DefaultDateTimeParser,
-				nil, tm, m, 0)
+				nil, tm, m, mi, 0)
 			if !ok {
-				return nil, 0, nil, nil, false, "", ""
+				return nil, 0, nil, nil, false, "", "", nil
 			}
+			allFieldSearchable = allFieldSearchable || searchable
+
+			// the fields of the type mapping by itself.
+			mi.TypeFields[t], _, _, _ = ProcessDocumentMapping(
+				im, im.DefaultAnalyzer, im.DefaultDateTimeParser,
+				nil, tm, nil, nil, 0)
 
 			if tm.Dynamic {
 				if tm.DefaultAnalyzer != "" {
@@ -406,14 +773,14 @@ func ProcessIndexMapping(im *mapping.IndexMappingImpl) (m map[SearchField]bool,
 	if im.DefaultMapping != nil && im.DefaultMapping.Enabled {
 		// Saw both type mapping(s) & default mapping, so not-FTSIndex'able.
 		if typeStrs != nil {
-			return nil, 0, nil, nil, false, "", ""
+			return nil, 0, nil, nil, false, "", "", nil
 		}
 
 		m, indexedCount, allFieldSearchable, ok = ProcessDocumentMapping(
 			im, im.DefaultAnalyzer, im.DefaultDateTimeParser,
-			nil, im.DefaultMapping, m, 0)
+			nil, im.DefaultMapping, m, mi, 0)
 		if !ok {
-			return nil, 0, nil, nil, false, "", ""
+			return nil, 0, nil, nil, false, "", "", nil
 		}
 
 		if im.DefaultMapping.Dynamic {
@@ -433,18 +800,23 @@ func ProcessIndexMapping(im *mapping.IndexMappingImpl) (m map[SearchField]bool,
 
 	if len(m) == 0 && len(dynamicMappings) == 0 {
 		// No indexed fields or dynamic mappings
-		return nil, 0, nil, nil, false, "", ""
+		return nil, 0, nil, nil, false, "", "", nil
+	}
+
+	// A path that is also indexed under its own name needs no aliasing.
+	for f := range m {
+		delete(mi.FieldAliases, f.Name)
 	}
 
 	return m, indexedCount, typeStrs, dynamicMappings,
-		allFieldSearchable, im.DefaultAnalyzer, im.DefaultDateTimeParser
+		allFieldSearchable, im.DefaultAnalyzer, im.DefaultDateTimeParser, mi
 }
 
 func ProcessDocumentMapping(im *mapping.IndexMappingImpl,
 	defaultAnalyzer, defaultDateTimeParser string,
 	path []string, dm *mapping.DocumentMapping, m map[SearchField]bool,
-	indexedCount int64) (map[SearchField]bool, int64, bool, bool) {
-	var allFieldSearchable, ok bool
+	mi *MappingInfo, indexedCount int64) (map[SearchField]bool, int64, bool, bool) {
+	var allFieldSearchable, searchable, ok bool
 	if !dm.Enabled {
 		return m, indexedCount, allFieldSearchable, true
 	}
@@ -458,28 +830,57 @@ func ProcessDocumentMapping(im *mapping.IndexMappingImpl,
 	}
 
 	for _, f := range dm.Fields {
-		if !f.Index || len(path) <= 0 {
+		if len(path) <= 0 {
 			continue
 		}
 
 		fpath := append([]string(nil), path...) // Copy.
 		fpath[len(fpath)-1] = f.Name
 
+		if f.Store && mi != nil {
+			mi.StoredFields[strings.Join(fpath, ".")] = true
+		}
+
+		// a field that's stored but not indexed isn't searchable.
+		if !f.Index {
+			continue
+		}
+
 		searchField := SearchField{
 			Name: strings.Join(fpath, "."),
 			Type: f.Type,
 		}
 
+		if mi != nil {
+			if docPath := strings.Join(path, "."); docPath != searchField.Name {
+				mi.addFieldAlias(docPath, searchField.Name)
+			}
+		}
+
 		if f.Type == "text" {
 			searchField.Analyzer = f.Analyzer
 			if searchField.Analyzer == "" {
 				searchField.Analyzer = defaultAnalyzer
 			}
+
+			if mi != nil {
+				mi.FieldAnalyzers[searchField.Name] = appendUnique(
+					mi.FieldAnalyzers[searchField.Name], searchField.Analyzer)
+
+				if tv, exists := mi.FieldTermVectors[searchField.Name]; !exists || tv {
+					mi.FieldTermVectors[searchField.Name] = f.IncludeTermVectors
+				}
+			}
 		} else if f.Type == "datetime" {
 			searchField.DateFormat = f.DateFormat
 			if searchField.DateFormat == "" {
 				searchField.DateFormat = defaultDateTimeParser
 			}
+
+			if mi != nil {
+				mi.FieldDateFormats[searchField.Name] = appendUnique(
+					mi.FieldDateFormats[searchField.Name], searchField.DateFormat)
+			}
 		}
 
 		if _, exists := m[searchField]; exists {
@@ -492,6 +893,10 @@ func ProcessDocumentMapping(im *mapping.IndexMappingImpl,
 
 		if f.IncludeInAll {
 			allFieldSearchable = true
+			if mi != nil && f.Type == "text" {
+				mi.AllFieldAnalyzers = appendUnique(mi.AllFieldAnalyzers,
+					searchField.Analyzer)
+			}
 		}
 
 		m[searchField] = false
@@ -507,24 +912,40 @@ func ProcessDocumentMapping(im *mapping.IndexMappingImpl,
 	}
 
 	for prop, propDM := range dm.Properties {
+		// a property's default analyzer applies to it and its descendants,
+		// but not to its siblings.
+		propDefaultAnalyzer := defaultAnalyzer
 		if propDM.DefaultAnalyzer != "" {
-			defaultAnalyzer = propDM.DefaultAnalyzer
+			propDefaultAnalyzer = propDM.DefaultAnalyzer
 		}
-		m, indexedCount, allFieldSearchable, ok = ProcessDocumentMapping(
-			im, defaultAnalyzer, defaultDateTimeParser,
-			append(path, prop), propDM, m, indexedCount)
+		m, indexedCount, searchable, ok = ProcessDocumentMapping(
+			im, propDefaultAnalyzer, defaultDateTimeParser,
+			append(path, prop), propDM, m, mi, indexedCount)
 		if !ok {
 			return nil, 0, false, false
 		}
+		// the _all field is searchable if any of the properties' fields
+		// are included in it.
+		allFieldSearchable = allFieldSearchable || searchable
 	}
 
 	if dm.Dynamic {
 		allFieldSearchable = true
+		if mi != nil {
+			mi.AllFieldAnalyzers = appendUnique(mi.AllFieldAnalyzers,
+				defaultAnalyzer)
+		}
+
 		searchField := SearchField{
 			Name:     strings.Join(path, "."),
 			Analyzer: defaultAnalyzer,
 		}
 
+		if mi != nil && len(path) > 0 {
+			mi.DynamicMappingAnalyzers[searchField.Name] = appendUnique(
+				mi.DynamicMappingAnalyzers[searchField.Name], defaultAnalyzer)
+		}
+
 		if _, exists := m[searchField]; !exists {
 			m[searchField] = true
 			indexedCount = math.MaxInt64
@@ -534,33 +955,203 @@ func ProcessDocumentMapping(im *mapping.IndexMappingImpl,
 	return m, indexedCount, allFieldSearchable, true
 }
 
+// processN1ftyParams reads the n1fty specific settings off the index
+// params, i.e. whether the fieldless queries are disallowed.
+func processN1ftyParams(params []byte) (
+	fieldlessQueriesDisallowed bool, err error) {
+	var ip struct {
+		N1fty struct {
+			DisallowFieldlessQueries bool `json:"disallow_fieldless_queries"`
+		} `json:"n1fty"`
+	}
+
+	if err = json.Unmarshal(params, &ip); err != nil {
+		return false, err
+	}
+
+	return ip.N1fty.DisallowFieldlessQueries, nil
+}
+
+// checkFuzziness returns an error for an edit distance past that which
+// bleve supports, rather than have FTS reject the search late.
+func checkFuzziness(fuzziness int) error {
+	if fuzziness < 0 || fuzziness > searcher.MaxFuzziness {
+		return fmt.Errorf("fuzziness: %d, must be within [0, %d]",
+			fuzziness, searcher.MaxFuzziness)
+	}
+
+	return nil
+}
+
+// checkRegexp returns an error unless the pattern of a regexp query is
+// a valid regular expression, as FTS would otherwise fail the search.
+func checkRegexp(pattern string) error {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return fmt.Errorf("regexp: %q, invalid pattern: %v", pattern, err)
+	}
+
+	return nil
+}
+
 // -----------------------------------------------------------------------------
 
+// UnsupportedQueryTypeError is returned for a query of a type whose fields
+// aren't known to be extracted, for ex. one of a newer bleve, rather than
+// have the query deemed sargable (or not) over fields it doesn't reference.
+type UnsupportedQueryTypeError struct {
+	Type string // the query's type, as in "*query.TermQuery"
+}
+
+func (e *UnsupportedQueryTypeError) Error() string {
+	return "unsupported query type: " + e.Type
+}
+
+// maxQueryDepth is the depth (of the nested objects and arrays) of a query
+// past which its fields aren't extracted, the query then not sargable; as
+// set by the "maxQueryDepth" config
+var maxQueryDepth = int64(100)
+
+func GetMaxQueryDepth() int64 {
+	return atomic.LoadInt64(&maxQueryDepth)
+}
+
+func SetMaxQueryDepth(v int64) {
+	atomic.StoreInt64(&maxQueryDepth, v)
+}
+
+// QueryTooDeepError is returned for a query nested past maxQueryDepth,
+// rather than have the extraction of its fields exhaust the stack.
+type QueryTooDeepError struct {
+	Max int
+}
+
+func (e *QueryTooDeepError) Error() string {
+	return fmt.Sprintf("query nested too deep, past: %d levels", e.Max)
+}
+
+// FetchPhraseFields returns the names of the fields the search request's
+// query matches phrases over, i.e. those of its phrase, multi-phrase and
+// match-phrase queries, that the fields need be indexed with term vectors
+// for (the terms' positions), else the phrases wouldn't match.
+func FetchPhraseFields(sr *cbft.SearchRequest) (map[string]bool, error) {
+	if sr == nil || len(sr.Q) == 0 {
+		return nil, nil
+	}
+
+	que, err := query.ParseQuery(sr.Q)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv map[string]bool
+	addField := func(name string) {
+		if name == "" {
+			return // over the _all field
+		}
+		if rv == nil {
+			rv = map[string]bool{}
+		}
+		rv[name] = true
+	}
+
+	maxDepth := int(GetMaxQueryDepth())
+	var walk func(que query.Query, depth int) error
+	walk = func(que query.Query, depth int) error {
+		if depth >= maxDepth {
+			return &QueryTooDeepError{Max: maxDepth}
+		}
+
+		var children []query.Query
+		switch qq := que.(type) {
+		case *query.BooleanQuery:
+			children = []query.Query{qq.Must, qq.MustNot, qq.Should}
+		case *query.ConjunctionQuery:
+			children = qq.Conjuncts
+		case *query.DisjunctionQuery:
+			children = qq.Disjuncts
+		case *query.QueryStringQuery:
+			q, err := qq.Parse()
+			if err != nil {
+				return fmt.Errorf("query string: %q, parse err: %v", qq.Query, err)
+			}
+			children = []query.Query{q}
+		case *query.PhraseQuery:
+			addField(qq.Field)
+		case *query.MultiPhraseQuery:
+			addField(qq.Field)
+		case *query.MatchPhraseQuery:
+			addField(qq.Field())
+		}
+
+		for _, childQ := range children {
+			if err := walk(childQ, depth+1); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err = walk(que, 0); err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
 func FetchFieldsToSearchFromQuery(que query.Query) (map[SearchField]struct{}, error) {
 	queryFields := map[SearchField]struct{}{}
 
-	var walk func(que query.Query) error
+	maxDepth := int(GetMaxQueryDepth())
+	var walk func(que query.Query, depth int) error
+
+	walk = func(que query.Query, depth int) error {
+		if depth >= maxDepth {
+			return &QueryTooDeepError{Max: maxDepth}
+		}
 
-	walk = func(que query.Query) error {
 		switch qq := que.(type) {
 		case *query.BooleanQuery:
-			walk(qq.Must)
-			walk(qq.MustNot)
-			walk(qq.Should)
+			for _, childQ := range []query.Query{qq.Must, qq.MustNot, qq.Should} {
+				if err := walk(childQ, depth+1); err != nil {
+					return err
+				}
+			}
 		case *query.ConjunctionQuery:
 			for _, childQ := range qq.Conjuncts {
-				walk(childQ)
+				if err := walk(childQ, depth+1); err != nil {
+					return err
+				}
 			}
 		case *query.DisjunctionQuery:
 			for _, childQ := range qq.Disjuncts {
-				walk(childQ)
+				if err := walk(childQ, depth+1); err != nil {
+					return err
+				}
 			}
 		case *query.QueryStringQuery:
+			// The query string syntax is parsed into its constituent
+			// queries, so the fields it references (along with types
+			// inferred from the operators, e.g. "age:>30" is numeric)
+			// are subjected to the sargability checks.
 			q, err := qq.Parse()
 			if err != nil {
-				return err
+				return fmt.Errorf("query string: %q, parse err: %v", qq.Query, err)
 			}
-			walk(q)
+			return walk(q, depth+1)
+		case *query.PhraseQuery:
+			// not fieldable (as of this bleve), the terms are matched as
+			// is, so sargable over fields with the keyword analyzer.
+			queryFields[SearchField{Name: qq.Field, Type: "text",
+				Analyzer: "keyword"}] = struct{}{}
+		case *query.MultiPhraseQuery:
+			queryFields[SearchField{Name: qq.Field, Type: "text",
+				Analyzer: "keyword"}] = struct{}{}
+		case nil,
+			*query.DocIDQuery,
+			*query.MatchAllQuery,
+			*query.MatchNoneQuery:
+			// non-fieldable queries (or an absent clause of a boolean query)
 		default:
 			if fq, ok := que.(query.FieldableQuery); ok {
 				fieldDesc := SearchField{
@@ -579,36 +1170,65 @@ func FetchFieldsToSearchFromQuery(que query.Query) (map[SearchField]struct{}, er
 					*query.GeoBoundingPolygonQuery:
 					fieldDesc.Type = "geopoint"
 				case *query.MatchQuery:
+					if err := checkFuzziness(qqq.Fuzziness); err != nil {
+						return err
+					}
 					fieldDesc.Type = "text"
 					fieldDesc.Analyzer = qqq.Analyzer
+				case *query.FuzzyQuery:
+					// the fuzzy term is matched against the terms of the
+					// field as analyzed, so is sargable (as with a match
+					// query) over a text field, whatever its analyzer.
+					if err := checkFuzziness(qqq.Fuzziness); err != nil {
+						return err
+					}
+					fieldDesc.Type = "text"
 				case *query.MatchPhraseQuery:
 					fieldDesc.Type = "text"
 					fieldDesc.Analyzer = qqq.Analyzer
-				default:
-					// The analyzer expectation for the following queries is keyword:
-					//   - *query.TermQuery
-					//   - *query.PhraseQuery
-					//   - *query.MultiPhraseQuery
-					//   - *query.FuzzyQuery
-					//   - *query.PrefixQuery
-					//   - *query.RegexpQuery
-					//   - *query.WildcardQuery
+				case *query.RegexpQuery:
+					// The pattern's matched against the indexed terms as is
+					// (as with a wildcard query), so over a field analyzed
+					// otherwise (for ex. by the standard analyzer) it'd match
+					// the field's tokens rather than its value; hence it's
+					// sargable only over fields indexed with the keyword
+					// analyzer. An invalid pattern is caught ahead of FTS.
+					if err := checkRegexp(qqq.Regexp); err != nil {
+						return err
+					}
+					fieldDesc.Type = "text"
+					fieldDesc.Analyzer = "keyword"
+				case *query.TermQuery:
+					// The term's matched against the indexed terms exactly,
+					// bypassing analysis, so it'd match over an analyzed
+					// field only if it happened to be one of the field's
+					// tokens; hence it's sargable only over fields indexed
+					// with the keyword analyzer, and not over analyzed ones.
 					fieldDesc.Type = "text"
 					fieldDesc.Analyzer = "keyword"
+				case *query.PrefixQuery,
+					*query.WildcardQuery,
+					*query.TermRangeQuery:
+					// The analyzer expectation for these queries is keyword.
+					// The patterns of prefix & wildcard queries are matched
+					// against the indexed terms as is, so these are sargable
+					// only over fields indexed with the keyword analyzer.
+					fieldDesc.Type = "text"
+					fieldDesc.Analyzer = "keyword"
+				default:
+					return &UnsupportedQueryTypeError{Type: fmt.Sprintf("%T", que)}
 				}
 
 				queryFields[fieldDesc] = struct{}{}
+			} else {
+				return &UnsupportedQueryTypeError{Type: fmt.Sprintf("%T", que)}
 			}
-			// The following are non-Fieldable queries:
-			//   - *query.DocIDQuery
-			//   - *query.MatchAllQuery
-			//   - *query.MatchNoneQuery
 		}
 
 		return nil
 	}
 
-	err := walk(que)
+	err := walk(que, 0)
 	if err != nil {
 		return nil, err
 	}
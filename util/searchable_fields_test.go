@@ -15,9 +15,12 @@ import (
 	"encoding/json"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 
+	"github.com/blevesearch/bleve/v2/search/query"
 	"github.com/couchbase/cbgt"
+	"github.com/couchbase/query/expression"
 	"github.com/couchbase/query/expression/parser"
 	"github.com/couchbase/query/value"
 )
@@ -119,6 +122,230 @@ func TestFieldsToSearch(t *testing.T) {
 	}
 }
 
+func TestFieldsToSearchFromFuzzyQuery(t *testing.T) {
+	for _, fuzziness := range []int{1, 2} {
+		q, err := BuildQuery("", value.NewValue(map[string]interface{}{
+			"term":          "avngers",
+			"field":         "title",
+			"fuzziness":     fuzziness,
+			"prefix_length": 1,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fieldDescs, err := FetchFieldsToSearchFromQuery(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// checked as a match query is, against the field's analyzer.
+		expect := map[SearchField]struct{}{{Name: "title", Type: "text"}: {}}
+		if !reflect.DeepEqual(expect, fieldDescs) {
+			t.Fatalf("[fuzziness: %d] Expected: %v, got: %v", fuzziness,
+				expect, fieldDescs)
+		}
+	}
+
+	for _, query := range []interface{}{
+		map[string]interface{}{"term": "avngers", "field": "title",
+			"fuzziness": 3},
+		map[string]interface{}{"match": "avngers", "field": "title",
+			"fuzziness": 3},
+		"title:avngers~3",
+	} {
+		q, err := BuildQuery("", value.NewValue(query))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = FetchFieldsToSearchFromQuery(q); err == nil ||
+			!strings.Contains(err.Error(), "fuzziness: 3") {
+			t.Fatalf("[%v] Expected a fuzziness error, got: %v", query, err)
+		}
+	}
+}
+
+func TestFieldsToSearchFromTermQuery(t *testing.T) {
+	q, err := BuildQuery("", value.NewValue(map[string]interface{}{
+		"term":  "Avengers",
+		"field": "title",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fieldDescs, err := FetchFieldsToSearchFromQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the term's matched as is, so against the keyword analyzer.
+	expect := map[SearchField]struct{}{
+		{Name: "title", Type: "text", Analyzer: "keyword"}: {},
+	}
+	if !reflect.DeepEqual(expect, fieldDescs) {
+		t.Fatalf("Expected: %v, got: %v", expect, fieldDescs)
+	}
+}
+
+func TestFieldsToSearchFromRegexpQuery(t *testing.T) {
+	q, err := BuildQuery("", value.NewValue(map[string]interface{}{
+		"regexp": "avenger[s]?",
+		"field":  "title",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fieldDescs, err := FetchFieldsToSearchFromQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[SearchField]struct{}{
+		{Name: "title", Type: "text", Analyzer: "keyword"}: {},
+	}
+	if !reflect.DeepEqual(expect, fieldDescs) {
+		t.Fatalf("Expected: %v, got: %v", expect, fieldDescs)
+	}
+
+	for _, query := range []interface{}{
+		map[string]interface{}{"regexp": "avenger[s", "field": "title"},
+		"title:/avenger[s/",
+	} {
+		q, err := BuildQuery("", value.NewValue(query))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = FetchFieldsToSearchFromQuery(q); err == nil ||
+			!strings.Contains(err.Error(), "invalid pattern") {
+			t.Fatalf("[%v] Expected an invalid pattern err, got: %v", query, err)
+		}
+	}
+}
+
+func TestFieldsToSearchFromQueryString(t *testing.T) {
+	q, err := BuildQuery("", value.NewValue(map[string]interface{}{
+		"query": "name:john age:>30",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fieldDescs, err := FetchFieldsToSearchFromQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[SearchField]struct{}{
+		SearchField{Name: "name", Type: "text"}:  struct{}{},
+		SearchField{Name: "age", Type: "number"}: struct{}{},
+	}
+	if !reflect.DeepEqual(expect, fieldDescs) {
+		t.Fatalf("Expected: %v, Got: %v", expect, fieldDescs)
+	}
+}
+
+func TestFieldsToSearchFromMalformedQueryString(t *testing.T) {
+	for _, qs := range []string{
+		"age:>",
+		"+",
+		"name:john age:<=",
+	} {
+		q, err := BuildQuery("", value.NewValue(map[string]interface{}{
+			"query": qs,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = FetchFieldsToSearchFromQuery(q)
+		if err == nil {
+			t.Fatalf("Expected an error for query string: %q", qs)
+		}
+
+		if !strings.Contains(err.Error(), qs) {
+			t.Fatalf("Expected error to describe query string: %q, got: %v",
+				qs, err)
+		}
+	}
+}
+
+// futureQuery and futureFieldQuery stand in for query types (a compound,
+// and a fieldable one) that n1fty doesn't know of.
+type futureQuery struct {
+	query.Query
+}
+
+type futureFieldQuery struct {
+	*query.TermQuery
+}
+
+func TestFieldsToSearchFromUnsupportedQueryTypes(t *testing.T) {
+	match := query.NewMatchQuery("avengers")
+	match.SetField("title")
+
+	future := &futureFieldQuery{query.NewTermQuery("marvel")}
+	future.SetField("studio")
+
+	tests := []struct {
+		q     query.Query
+		qtype string
+	}{
+		{q: query.NewConjunctionQuery([]query.Query{match, future}),
+			qtype: "*util.futureFieldQuery"},
+		{q: query.NewBooleanQuery([]query.Query{match},
+			[]query.Query{&futureQuery{}}, nil),
+			qtype: "*util.futureQuery"},
+	}
+
+	for _, test := range tests {
+		_, err := FetchFieldsToSearchFromQuery(test.q)
+		uerr, ok := err.(*UnsupportedQueryTypeError)
+		if !ok || uerr.Type != test.qtype ||
+			err.Error() != "unsupported query type: "+test.qtype {
+			t.Fatalf("Expected the unsupported query type: %s, got: %v",
+				test.qtype, err)
+		}
+	}
+
+	// the queries known not to carry fields, and absent boolean clauses.
+	for _, q := range []query.Query{
+		query.NewMatchAllQuery(),
+		query.NewMatchNoneQuery(),
+		query.NewDocIDQuery([]string{"a"}),
+		query.NewBooleanQuery([]query.Query{match}, nil, nil),
+	} {
+		if _, err := FetchFieldsToSearchFromQuery(q); err != nil {
+			t.Fatalf("[%T] Unexpected err: %v", q, err)
+		}
+	}
+
+	// phrase queries, though not fieldable, carry their field.
+	fields, err := FetchFieldsToSearchFromQuery(
+		query.NewPhraseQuery([]string{"iron", "man"}, "title"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[SearchField]struct{}{
+		SearchField{Name: "title", Type: "text", Analyzer: "keyword"}: struct{}{},
+	}
+	if !reflect.DeepEqual(expect, fields) {
+		t.Fatalf("Expected: %v, got: %v", expect, fields)
+	}
+
+	// a query parsed (say, by a newer bleve) into an unsupported type is
+	// reported so, rather than deemed to carry no fields.
+	_, err = FetchFieldsToSearchFromQuery(
+		query.NewConjunctionQuery([]query.Query{match, future}))
+	if err == nil ||
+		err.Error() != "unsupported query type: *util.futureFieldQuery" {
+		t.Fatalf("Expected the unsupported query type, got: %v", err)
+	}
+}
+
 func TestProcessIndexDef(t *testing.T) {
 	tests := []struct {
 		about                       string
@@ -521,7 +748,7 @@ func TestProcessIndexDef(t *testing.T) {
 			expectSearchFields: map[SearchField]bool{
 				{Name: "country", Type: "text", Analyzer: "standard"}: false,
 			},
-			expectCondExpr:              "`type` IN [\"hotel\", \"locations\"]",
+			expectCondExpr:              "`type`=\"hotel\" OR `type`=\"locations\"",
 			expectDynamic:               false,
 			expectDefaultAnalyzer:       "standard",
 			expectDefaultDateTimeParser: "dateTimeOptional",
@@ -779,8 +1006,8 @@ func TestProcessIndexDef(t *testing.T) {
 			if err != nil {
 				t.Fatalf("testi: %d, err: %v", testi, err)
 			}
-			gotCondExpr, err := parser.Parse(pip.CondExpr)
-			if err != nil {
+			gotCondExpr, err := pip.Cond()
+			if err != nil || gotCondExpr == nil {
 				t.Fatalf("testi: %d, err: %v", testi, err)
 			}
 
@@ -816,3 +1043,255 @@ func TestProcessIndexDef(t *testing.T) {
 		}
 	}
 }
+
+func TestProcessIndexDefAllFieldSearchable(t *testing.T) {
+	// the name field is included in _all, its siblings aren't; the _all
+	// field's searchable whichever of them is processed last.
+	var indexDef *cbgt.IndexDef
+	err := json.Unmarshal([]byte(`{
+		"name": "default",
+		"type": "fulltext-index",
+		"sourceName": "default",
+		"params": {
+			"doc_config": {
+				"mode": "type_field",
+				"type_field": "type"
+			},
+			"mapping": {
+				"default_mapping": {
+					"dynamic": false,
+					"enabled": true,
+					"properties": {
+						"name": {
+							"enabled": true,
+							"dynamic": false,
+							"fields": [{"name": "name", "type": "text",
+								"index": true, "include_in_all": true}]
+						},
+						"city": {
+							"enabled": true,
+							"dynamic": false,
+							"fields": [{"name": "city", "type": "text",
+								"index": true, "include_in_all": false}]
+						},
+						"country": {
+							"enabled": true,
+							"dynamic": false,
+							"fields": [{"name": "country", "type": "text",
+								"index": true, "include_in_all": false}]
+						},
+						"state": {
+							"enabled": true,
+							"dynamic": false,
+							"fields": [{"name": "state", "type": "text",
+								"index": true, "include_in_all": false}]
+						}
+					}
+				},
+				"default_analyzer": "standard",
+				"default_datetime_parser": "dateTimeOptional",
+				"default_field": "_all",
+				"type_field": "_type"
+			},
+			"store": {
+				"indexType": "scorch"
+			}
+		}
+	}`), &indexDef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the properties are processed in (random) map order.
+	for k := 0; k < 20; k++ {
+		pip, err := ProcessIndexDef(indexDef, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !pip.AllFieldSearchable {
+			t.Fatalf("[%d] Expected the _all field searchable", k)
+		}
+	}
+}
+
+func TestProcessIndexDefStoredOnlyField(t *testing.T) {
+	var indexDef *cbgt.IndexDef
+	err := json.Unmarshal(SampleIndexDefWithStoredOnlyField, &indexDef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pip, err := ProcessIndexDef(indexDef, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	searchable := map[string]bool{}
+	for f := range pip.SearchFields {
+		searchable[f.Name] = true
+	}
+
+	if !searchable["name"] || !searchable["city"] || searchable["notes"] {
+		t.Fatalf("Expected only the indexed fields searchable, got: %v",
+			pip.SearchFields)
+	}
+
+	if pip.IndexedCount != 2 {
+		t.Fatalf("Expected an indexed count of 2, got: %d", pip.IndexedCount)
+	}
+
+	for name, stored := range map[string]bool{
+		"name": true, "notes": true, "city": false} {
+		if pip.MappingInfo.IsStoredField(name) != stored {
+			t.Fatalf("[%s] Expected stored: %t, got: %v", name, stored,
+				pip.MappingInfo.StoredFields)
+		}
+	}
+}
+
+func TestProcessIndexDefTypeFields(t *testing.T) {
+	var indexDef *cbgt.IndexDef
+	err := json.Unmarshal(SampleIndexDefWithMultipleTypeMappings, &indexDef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pip, err := ProcessIndexDef(indexDef, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the searchable fields are those across the type mappings.
+	city := SearchField{Name: "city", Type: "text", Analyzer: "keyword"}
+	if _, exists := pip.SearchFields[city]; !exists {
+		t.Fatalf("Expected city searchable, got: %v", pip.SearchFields)
+	}
+
+	if _, exists := pip.MappingInfo.TypeFields["airline"][city]; exists {
+		t.Fatalf("Expected city not under airline, got: %v",
+			pip.MappingInfo.TypeFields["airline"])
+	}
+
+	for name, expect := range map[string][]string{
+		"city":    {"airport"},
+		"country": {"airline", "airport"},
+		"name":    nil,
+	} {
+		if got := pip.MappingInfo.TypesOf(name); !reflect.DeepEqual(expect, got) {
+			t.Fatalf("[%s] Expected types: %v, got: %v", name, expect, got)
+		}
+	}
+}
+
+func TestProcessIndexDefOverMultipleCollections(t *testing.T) {
+	var indexDef *cbgt.IndexDef
+	err := json.Unmarshal([]byte(`{
+		"name": "TestProcessIndexDefOverMultipleCollections",
+		"type": "fulltext-index",
+		"sourceName": "default",
+		"params": {
+			"doc_config": {
+				"mode": "scope.collection.type_field",
+				"type_field": "type"
+			},
+			"mapping": {
+				"default_mapping": {
+					"enabled": false
+				},
+				"types": {
+					"scope1.collection1.hotel": {
+						"enabled": true,
+						"dynamic": false,
+						"properties": {
+							"name": {
+								"enabled": true,
+								"dynamic": false,
+								"fields": [{
+									"name": "name",
+									"type": "text",
+									"index": true
+								}]
+							}
+						}
+					},
+					"scope1.collection2.airline": {
+						"enabled": true,
+						"dynamic": false,
+						"properties": {
+							"callsign": {
+								"enabled": true,
+								"dynamic": false,
+								"fields": [{
+									"name": "callsign",
+									"type": "text",
+									"analyzer": "keyword",
+									"index": true
+								}]
+							}
+						}
+					}
+				}
+			}
+		}
+	}`), &indexDef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		collection         string
+		expectSearchFields map[SearchField]bool
+		expectCondExpr     string
+	}{
+		{
+			collection: "collection1",
+			expectSearchFields: map[SearchField]bool{
+				{Name: "name", Type: "text", Analyzer: "standard"}: false,
+			},
+			expectCondExpr: "`type`=\"hotel\"",
+		},
+		{
+			collection: "collection2",
+			expectSearchFields: map[SearchField]bool{
+				{Name: "callsign", Type: "text", Analyzer: "keyword"}:  false,
+				{Name: "callsign", Type: "text", Analyzer: "standard"}: false,
+			},
+			expectCondExpr: "`type`=\"airline\"",
+		},
+		{
+			collection: "collection3",
+		},
+	}
+
+	for testi, test := range tests {
+		pip, err := ProcessIndexDef(indexDef, "scope1", test.collection)
+		if err != nil {
+			t.Fatalf("testi: %d, err: %v", testi, err)
+		}
+
+		if !reflect.DeepEqual(test.expectSearchFields, pip.SearchFields) {
+			t.Fatalf("testi: %d, mismatch searchFields, got: %#v",
+				testi, pip.SearchFields)
+		}
+
+		cond, err := pip.Cond()
+		if err != nil {
+			t.Fatalf("testi: %d, err: %v", testi, err)
+		}
+
+		var expectCond expression.Expression
+		if test.expectCondExpr != "" {
+			expectCond, err = parser.Parse(test.expectCondExpr)
+			if err != nil {
+				t.Fatalf("testi: %d, err: %v", testi, err)
+			}
+		}
+
+		if (expectCond == nil) != (cond == nil) ||
+			(cond != nil && !cond.EquivalentTo(expectCond)) {
+			t.Fatalf("testi: %d, expected condExpr: %v, got: %v",
+				testi, expectCond, cond)
+		}
+	}
+}
@@ -883,3 +883,492 @@ var SampleIndexDefWithDocIdPrefixMultipleTypeMappings = []byte(`
 	}
 }
 `)
+
+var SampleIndexDefWithAliasedFields = []byte(`
+{
+	"name": "SampleIndexDefWithAliasedFields",
+	"type": "fulltext-index",
+	"params": {
+		"doc_config": {
+			"docid_prefix_delim": "",
+			"docid_regexp": "",
+			"mode": "type_field",
+			"type_field": "type"
+		},
+		"mapping": {
+			"default_analyzer": "standard",
+			"default_datetime_parser": "dateTimeOptional",
+			"default_field": "_all",
+			"default_mapping": {
+				"dynamic": false,
+				"enabled": true,
+				"properties": {
+					"addr": {
+						"enabled": true,
+						"dynamic": false,
+						"fields": [
+						{
+							"include_in_all": true,
+							"index": true,
+							"name": "address",
+							"type": "text"
+						}
+						]
+					},
+					"city": {
+						"enabled": true,
+						"dynamic": false,
+						"fields": [
+						{
+							"include_in_all": true,
+							"index": true,
+							"name": "town",
+							"type": "text"
+						},
+						{
+							"include_in_all": true,
+							"index": true,
+							"name": "municipality",
+							"type": "text"
+						}
+						]
+					},
+					"country": {
+						"enabled": true,
+						"dynamic": false,
+						"fields": [
+						{
+							"include_in_all": true,
+							"index": true,
+							"name": "country",
+							"type": "text"
+						},
+						{
+							"include_in_all": true,
+							"index": true,
+							"name": "nation",
+							"type": "text"
+						}
+						]
+					}
+				}
+			},
+			"default_type": "_default",
+			"docvalues_dynamic": false,
+			"index_dynamic": false,
+			"store_dynamic": false,
+			"type_field": "_type"
+		},
+		"store": {
+			"indexType": "scorch"
+		}
+	},
+	"sourceType": "couchbase",
+	"sourceName": "travel-sample",
+	"sourceUUID": "",
+	"sourceParams": {},
+	"planParams": {
+		"maxPartitionsPerPIndex": 171,
+		"numReplicas": 0
+	},
+	"uuid": ""
+}
+`)
+
+var SampleIndexDefWithNestedAnalyzers = []byte(`
+{
+	"name": "SampleIndexDefWithNestedAnalyzers",
+	"type": "fulltext-index",
+	"params": {
+		"doc_config": {
+			"docid_prefix_delim": "",
+			"docid_regexp": "",
+			"mode": "type_field",
+			"type_field": "type"
+		},
+		"mapping": {
+			"default_analyzer": "standard",
+			"default_datetime_parser": "dateTimeOptional",
+			"default_field": "_all",
+			"default_mapping": {
+				"dynamic": false,
+				"enabled": true,
+				"properties": {
+					"reviews": {
+						"enabled": true,
+						"dynamic": false,
+						"properties": {
+							"content": {
+								"enabled": true,
+								"dynamic": false,
+								"fields": [
+								{
+									"analyzer": "en",
+									"include_in_all": true,
+									"include_term_vectors": true,
+									"index": true,
+									"name": "content",
+									"type": "text"
+								}
+								]
+							},
+							"notes": {
+								"enabled": true,
+								"dynamic": true,
+								"default_analyzer": "keyword"
+							},
+							"meta": {
+								"enabled": true,
+								"dynamic": true
+							}
+						}
+					}
+				}
+			},
+			"default_type": "_default",
+			"docvalues_dynamic": false,
+			"index_dynamic": true,
+			"store_dynamic": false,
+			"type_field": "_type"
+		},
+		"store": {
+			"indexType": "scorch"
+		}
+	},
+	"sourceType": "couchbase",
+	"sourceName": "travel-sample",
+	"sourceUUID": "",
+	"sourceParams": {},
+	"planParams": {
+		"maxPartitionsPerPIndex": 171,
+		"numReplicas": 0
+	},
+	"uuid": ""
+}
+`)
+
+var SampleIndexDefWithMixedAnalyzersInAllField = []byte(`
+{
+	"name": "SampleIndexDefWithMixedAnalyzersInAllField",
+	"type": "fulltext-index",
+	"params": {
+		"doc_config": {
+			"docid_prefix_delim": "",
+			"docid_regexp": "",
+			"mode": "type_field",
+			"type_field": "type"
+		},
+		"mapping": {
+			"default_analyzer": "standard",
+			"default_datetime_parser": "dateTimeOptional",
+			"default_field": "_all",
+			"default_mapping": {
+				"dynamic": false,
+				"enabled": true,
+				"properties": {
+					"name": {
+						"enabled": true,
+						"dynamic": false,
+						"fields": [
+						{
+							"include_in_all": true,
+							"index": true,
+							"name": "name",
+							"type": "text"
+						}
+						]
+					},
+					"description": {
+						"enabled": true,
+						"dynamic": false,
+						"fields": [
+						{
+							"analyzer": "en",
+							"include_in_all": true,
+							"index": true,
+							"name": "description",
+							"type": "text"
+						}
+						]
+					},
+					"code": {
+						"enabled": true,
+						"dynamic": false,
+						"fields": [
+						{
+							"analyzer": "keyword",
+							"include_in_all": false,
+							"index": true,
+							"name": "code",
+							"type": "text"
+						}
+						]
+					}
+				}
+			},
+			"default_type": "_default",
+			"docvalues_dynamic": false,
+			"index_dynamic": false,
+			"store_dynamic": false,
+			"type_field": "_type"
+		},
+		"store": {
+			"indexType": "scorch"
+		}
+	},
+	"sourceType": "couchbase",
+	"sourceName": "travel-sample",
+	"sourceUUID": "",
+	"sourceParams": {},
+	"planParams": {
+		"maxPartitionsPerPIndex": 171,
+		"numReplicas": 0
+	},
+	"uuid": ""
+}
+`)
+
+var SampleIndexDefWithGeoPointField = []byte(`
+{
+	"name": "SampleIndexDefWithGeoPointField",
+	"type": "fulltext-index",
+	"params": {
+		"doc_config": {
+			"docid_prefix_delim": "",
+			"docid_regexp": "",
+			"mode": "type_field",
+			"type_field": "type"
+		},
+		"mapping": {
+			"default_analyzer": "standard",
+			"default_datetime_parser": "dateTimeOptional",
+			"default_field": "_all",
+			"default_mapping": {
+				"dynamic": false,
+				"enabled": true,
+				"properties": {
+					"geo": {
+						"enabled": true,
+						"dynamic": false,
+						"fields": [
+						{
+							"docvalues": true,
+							"include_in_all": false,
+							"index": true,
+							"name": "geo",
+							"type": "geopoint"
+						}
+						]
+					},
+					"name": {
+						"enabled": true,
+						"dynamic": false,
+						"fields": [
+						{
+							"include_in_all": true,
+							"index": true,
+							"name": "name",
+							"type": "text"
+						}
+						]
+					}
+				}
+			},
+			"default_type": "_default",
+			"docvalues_dynamic": false,
+			"index_dynamic": false,
+			"store_dynamic": false,
+			"type_field": "_type"
+		},
+		"store": {
+			"indexType": "scorch"
+		}
+	},
+	"sourceType": "couchbase",
+	"sourceName": "travel-sample",
+	"sourceUUID": "",
+	"sourceParams": {},
+	"planParams": {
+		"maxPartitionsPerPIndex": 171,
+		"numReplicas": 0
+	},
+	"uuid": ""
+}
+`)
+
+var SampleIndexDefWithDateTimeParsers = []byte(`
+{
+	"name": "SampleIndexDefWithDateTimeParsers",
+	"type": "fulltext-index",
+	"params": {
+		"doc_config": {
+			"docid_prefix_delim": "",
+			"docid_regexp": "",
+			"mode": "type_field",
+			"type_field": "type"
+		},
+		"mapping": {
+			"analysis": {
+				"date_time_parsers": {
+					"dateOnly": {
+						"layouts": [
+							"2006-01-02"
+						],
+						"type": "flexiblego"
+					},
+					"dateTimeZoned": {
+						"layouts": [
+							"2006-01-02T15:04:05Z07:00"
+						],
+						"type": "flexiblego"
+					}
+				}
+			},
+			"default_analyzer": "standard",
+			"default_datetime_parser": "dateTimeOptional",
+			"default_field": "_all",
+			"default_mapping": {
+				"dynamic": false,
+				"enabled": true,
+				"properties": {
+					"created": {
+						"enabled": true,
+						"dynamic": false,
+						"fields": [
+						{
+							"include_in_all": true,
+							"index": true,
+							"name": "created",
+							"type": "datetime"
+						}
+						]
+					},
+					"birthday": {
+						"enabled": true,
+						"dynamic": false,
+						"fields": [
+						{
+							"date_format": "dateOnly",
+							"include_in_all": true,
+							"index": true,
+							"name": "birthday",
+							"type": "datetime"
+						}
+						]
+					},
+					"departure": {
+						"enabled": true,
+						"dynamic": false,
+						"fields": [
+						{
+							"date_format": "dateTimeZoned",
+							"include_in_all": true,
+							"index": true,
+							"name": "departure",
+							"type": "datetime"
+						}
+						]
+					}
+				}
+			},
+			"default_type": "_default",
+			"docvalues_dynamic": false,
+			"index_dynamic": true,
+			"store_dynamic": false,
+			"type_field": "_type"
+		},
+		"store": {
+			"indexType": "scorch"
+		}
+	},
+	"sourceType": "couchbase",
+	"sourceName": "travel-sample",
+	"sourceUUID": "",
+	"sourceParams": {},
+	"planParams": {
+		"maxPartitionsPerPIndex": 171,
+		"numReplicas": 0
+	},
+	"uuid": ""
+}
+`)
+
+var SampleIndexDefWithStoredOnlyField = []byte(`
+{
+	"name": "SampleIndexDefWithStoredOnlyField",
+	"type": "fulltext-index",
+	"params": {
+		"doc_config": {
+			"docid_prefix_delim": "",
+			"docid_regexp": "",
+			"mode": "type_field",
+			"type_field": "type"
+		},
+		"mapping": {
+			"default_analyzer": "standard",
+			"default_datetime_parser": "dateTimeOptional",
+			"default_field": "_all",
+			"default_mapping": {
+				"dynamic": false,
+				"enabled": true,
+				"properties": {
+					"name": {
+						"enabled": true,
+						"dynamic": false,
+						"fields": [
+						{
+							"include_in_all": true,
+							"index": true,
+							"name": "name",
+							"store": true,
+							"type": "text"
+						}
+						]
+					},
+					"city": {
+						"enabled": true,
+						"dynamic": false,
+						"fields": [
+						{
+							"include_in_all": true,
+							"index": true,
+							"name": "city",
+							"type": "text"
+						}
+						]
+					},
+					"notes": {
+						"enabled": true,
+						"dynamic": false,
+						"fields": [
+						{
+							"index": false,
+							"name": "notes",
+							"store": true,
+							"type": "text"
+						}
+						]
+					}
+				}
+			},
+			"default_type": "_default",
+			"docvalues_dynamic": false,
+			"index_dynamic": true,
+			"store_dynamic": false,
+			"type_field": "_type"
+		},
+		"store": {
+			"indexType": "scorch"
+		}
+	},
+	"sourceType": "couchbase",
+	"sourceName": "travel-sample",
+	"sourceUUID": "",
+	"sourceParams": {},
+	"planParams": {
+		"maxPartitionsPerPIndex": 171,
+		"numReplicas": 0
+	},
+	"uuid": ""
+}
+`)
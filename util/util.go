@@ -25,6 +25,8 @@ import (
 	"github.com/couchbase/cbft"
 	"github.com/couchbase/query/errors"
 	"github.com/couchbase/query/value"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var bleveMaxResultWindow = int64(10000)
@@ -38,13 +40,27 @@ type MappingDetails struct {
 	DocConfig  *cbft.BleveDocumentConfig
 }
 
+// keyspace returns the keyspace the index mapping applies to, i.e. the
+// source name, qualified by the scope and collection if available.
+func (md *MappingDetails) keyspace() string {
+	rv := md.SourceName
+	if len(md.Scope) > 0 && len(md.Collection) > 0 {
+		rv += "." + md.Scope + "." + md.Collection
+	}
+	return rv
+}
+
 var mappingsCacheLock sync.RWMutex
-var mappingsCache map[string]*MappingDetails
+
+// mappingsCache maps index names to the mappings of the index by the
+// keyspace, as an index over multiple collections is set up (with its
+// mapping) for each of them.
+var mappingsCache map[string]map[string]*MappingDetails
 
 var EmptyIndexMapping mapping.IndexMapping
 
 func init() {
-	mappingsCache = make(map[string]*MappingDetails)
+	mappingsCache = make(map[string]map[string]*MappingDetails)
 
 	EmptyIndexMapping = bleve.NewIndexMapping()
 }
@@ -54,7 +70,10 @@ func SetIndexMapping(name string, mappingDetails *MappingDetails) {
 	// existing mapping?  Consider a race where a slow goroutine
 	// incorrectly "wins" by setting an outdated mapping?
 	mappingsCacheLock.Lock()
-	mappingsCache[name] = mappingDetails
+	if mappingsCache[name] == nil {
+		mappingsCache[name] = map[string]*MappingDetails{}
+	}
+	mappingsCache[name][mappingDetails.keyspace()] = mappingDetails
 	mappingsCacheLock.Unlock()
 }
 
@@ -66,16 +85,31 @@ func FetchIndexMapping(name, uuid, keyspace string) (
 	}
 	mappingsCacheLock.RLock()
 	defer mappingsCacheLock.RUnlock()
-	if info, exists := mappingsCache[name]; exists {
-		// validate sourceName/keyspace, additionally check UUID if provided
-		indexKeyspace := info.SourceName
-		if len(info.Scope) > 0 && len(info.Collection) > 0 {
-			indexKeyspace += "." + info.Scope + "." + info.Collection
-		}
-		if indexKeyspace == keyspace {
-			if uuid == "" || info.UUID == uuid {
-				return info.IMapping, info.DocConfig, info.Scope, info.Collection, nil
+	// look up the mapping for the keyspace, additionally check UUID if provided
+	if info, exists := mappingsCache[name][keyspace]; exists {
+		if uuid == "" || info.UUID == uuid {
+			return info.IMapping, info.DocConfig, info.Scope, info.Collection, nil
+		}
+	}
+	if GetIndexHintCaseInsensitive() {
+		// the name (as hinted) may differ in case from that of the index,
+		// which is then to be the only one it matches.
+		var found *MappingDetails
+		for k, infos := range mappingsCache {
+			info, exists := infos[keyspace]
+			if k == name || !exists || !IndexNameMatches(k, name) ||
+				(uuid != "" && info.UUID != uuid) {
+				continue
+			}
+			if found != nil {
+				return nil, nil, "", "", fmt.Errorf("index mapping ambiguous"+
+					" for: %v", name)
 			}
+			found = info
+		}
+		if found != nil {
+			return found.IMapping, found.DocConfig, found.Scope,
+				found.Collection, nil
 		}
 	}
 	return nil, nil, "", "", fmt.Errorf("index mapping not found for: %v", name)
@@ -160,6 +194,40 @@ func CleanseField(field string) string {
 	return strings.Replace(field, "`", "", -1)
 }
 
+// ArrayElementPath returns the path of the field with its array element
+// selectors (Ex: "reviews[].rating") dropped, as bleve indexes the fields
+// of an array's elements under the path of the array; positional is true
+// if any selects an element by its position (Ex: "reviews[0].rating"),
+// which isn't retained within the index.
+func ArrayElementPath(name string) (path string, positional bool) {
+	if !strings.Contains(name, "[") {
+		return name, false
+	}
+
+	var b strings.Builder
+	for len(name) > 0 {
+		start := strings.IndexByte(name, '[')
+		if start < 0 {
+			b.WriteString(name)
+			break
+		}
+
+		end := strings.IndexByte(name[start:], ']')
+		if end < 0 {
+			b.WriteString(name)
+			break
+		}
+
+		b.WriteString(name[:start])
+		if end > 1 {
+			positional = true
+		}
+		name = name[start+end+1:]
+	}
+
+	return b.String(), positional
+}
+
 func FetchKeySpace(nameAndKeyspace string) string {
 	// Ex: namePlusKeySpace --> keySpace
 	// - "`travel`" --> travel
@@ -184,6 +252,76 @@ func ParseQueryToSearchRequest(field string, input value.Value) (
 		return queryFields, nil, 0, nil
 	}
 
+	// a query nested past the max depth isn't parsed at all.
+	if err := CheckQueryDepth(input); err != nil {
+		return nil, nil, 0, err
+	}
+
+	// the request parsed earlier for the same field and input (for ex.
+	// by a prepared statement executed again) is reused, as a copy.
+	key := parsedRequestKey(field, input)
+	queryFields, rv, ctlTimeout, cached := getParsedRequest(key)
+	if !cached {
+		q, sr, timeout, err := parseQueryToSearchRequest(field, input)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		queryFields, err = FetchFieldsToSearchFromQuery(q)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		putParsedRequest(key, queryFields, sr, timeout)
+		rv, ctlTimeout = sr, timeout
+	}
+
+	return queryFields, rv, ctlTimeout, nil
+}
+
+// CheckQueryDepth returns a *QueryTooDeepError if the query (or search
+// request) nests objects and arrays past maxQueryDepth.
+func CheckQueryDepth(input value.Value) error {
+	maxDepth := int(GetMaxQueryDepth())
+	var exceeds func(v interface{}, depth int) bool
+	exceeds = func(v interface{}, depth int) bool {
+		switch vv := v.(type) {
+		case value.Value:
+			if vv.Type() == value.OBJECT || vv.Type() == value.ARRAY {
+				return exceeds(vv.Actual(), depth)
+			}
+		case map[string]interface{}:
+			if depth >= maxDepth {
+				return true
+			}
+			for _, child := range vv {
+				if exceeds(child, depth+1) {
+					return true
+				}
+			}
+		case []interface{}:
+			if depth >= maxDepth {
+				return true
+			}
+			for _, child := range vv {
+				if exceeds(child, depth+1) {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	if input != nil && exceeds(input, 0) {
+		return &QueryTooDeepError{Max: maxDepth}
+	}
+
+	return nil
+}
+
+func parseQueryToSearchRequest(field string, input value.Value) (
+	query.Query, *cbft.SearchRequest, int64, error) {
 	var err error
 	var q query.Query
 
@@ -221,12 +359,52 @@ func ParseQueryToSearchRequest(field string, input value.Value) (
 		rv.Sort = nil
 	}
 
-	queryFields, err = FetchFieldsToSearchFromQuery(q)
-	if err != nil {
-		return nil, nil, 0, err
+	return q, rv, ctlTimeout, nil
+}
+
+// indexHintCaseInsensitive has the index named by the "index" option
+// (as a string, or the "name" of an object) matched case-insensitively,
+// for ex. "MyIndex" selecting the index named "myindex"; index names
+// being case-sensitive, they're matched exactly by default
+var indexHintCaseInsensitive = int32(0)
+
+func GetIndexHintCaseInsensitive() bool {
+	return atomic.LoadInt32(&indexHintCaseInsensitive) != 0
+}
+
+func SetIndexHintCaseInsensitive(v bool) {
+	var flag int32
+	if v {
+		flag = 1
 	}
+	atomic.StoreInt32(&indexHintCaseInsensitive, flag)
+}
 
-	return queryFields, rv, ctlTimeout, nil
+// IndexNameMatches returns true if the index name matches that named by
+// the "index" option, see indexHintCaseInsensitive.
+func IndexNameMatches(name, hint string) bool {
+	if GetIndexHintCaseInsensitive() {
+		return strings.EqualFold(name, hint)
+	}
+
+	return name == hint
+}
+
+// IsIndexSelector returns true if the "index" option (an object) selects
+// the index by its "name" and/or "uuid", rather than carrying a mapping.
+func IsIndexSelector(val value.Value) bool {
+	fields := val.Fields()
+	if len(fields) == 0 {
+		return false
+	}
+
+	for k := range fields {
+		if k != "name" && k != "uuid" {
+			return false
+		}
+	}
+
+	return true
 }
 
 // Value MUST be an object
@@ -246,6 +424,40 @@ func N1QLError(err error, desc string) errors.Error {
 	return errors.NewError(err, "n1fty: "+desc)
 }
 
+// GrpcN1QLError is N1QLError for errors returned by the FTS gRPC service,
+// surfacing the FTS reason (and code) carried within the gRPC status so
+// it's visible to the user, while retaining the original error as the
+// cause.
+func GrpcN1QLError(err error, desc string) errors.Error {
+	if reason := describeGrpcError(err); reason != "" {
+		desc += ", " + reason
+	}
+
+	return N1QLError(err, desc)
+}
+
+func describeGrpcError(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	st, ok := status.FromError(err)
+	if !ok || st.Code() == codes.OK {
+		return ""
+	}
+
+	rv := fmt.Sprintf("fts error code: %s, reason: %s", st.Code(), st.Message())
+	for _, detail := range st.Details() {
+		if detailErr, ok := detail.(error); ok {
+			rv += fmt.Sprintf(", detail: %v", detailErr)
+		} else {
+			rv += fmt.Sprintf(", detail: %+v", detail)
+		}
+	}
+
+	return rv
+}
+
 func GetBleveMaxResultWindow() int64 {
 	return atomic.LoadInt64(&bleveMaxResultWindow)
 }
@@ -253,3 +465,25 @@ func GetBleveMaxResultWindow() int64 {
 func SetBleveMaxResultWindow(v int64) {
 	atomic.StoreInt64(&bleveMaxResultWindow, v)
 }
+
+// CheckResultWindow returns an error if the hits up to offset+limit
+// exceed the max result window (of the FTS nodes), unless the limit is
+// unbounded (the hits then being streamed) or 0 (counting the hits only).
+func CheckResultWindow(offset, limit int64) error {
+	if limit <= 0 || limit == math.MaxInt64 {
+		return nil
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	max := GetBleveMaxResultWindow()
+	if offset > max || limit > max-offset {
+		return fmt.Errorf("result window exceeded; use pagination, offset: %d"+
+			" + limit: %d is over the max result window: %d (bleveMaxResultWindow)",
+			offset, limit, max)
+	}
+
+	return nil
+}
@@ -12,11 +12,18 @@
 package util
 
 import (
+	"container/list"
 	"encoding/json"
+	"fmt"
+	"math"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/couchbase/query/value"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestBuildIndexMappingOnFields(t *testing.T) {
@@ -185,3 +192,392 @@ func TestParseQueryToSearchRequest(t *testing.T) {
 		}
 	}
 }
+
+func TestParseQueryToSearchRequestBooleanQuery(t *testing.T) {
+	q := value.NewValue(map[string]interface{}{
+		"must": map[string]interface{}{
+			"conjuncts": []interface{}{
+				map[string]interface{}{"match": "dark", "field": "app_name"},
+			},
+		},
+		"should": map[string]interface{}{
+			"disjuncts": []interface{}{
+				map[string]interface{}{"match": "games", "field": "category"},
+			},
+		},
+		"must_not": map[string]interface{}{
+			"disjuncts": []interface{}{
+				map[string]interface{}{"match": "beta", "field": "release"},
+			},
+		},
+	})
+
+	expectQueryFields := map[SearchField]struct{}{
+		{Name: "app_name", Type: "text"}: struct{}{},
+		{Name: "category", Type: "text"}: struct{}{},
+		{Name: "release", Type: "text"}:  struct{}{},
+	}
+
+	gotQueryFields, _, _, err := ParseQueryToSearchRequest("", q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(expectQueryFields, gotQueryFields) {
+		t.Fatalf("Expected the fields of all the clauses: %v, got: %v",
+			expectQueryFields, gotQueryFields)
+	}
+}
+
+func TestParseQueryToSearchRequestCached(t *testing.T) {
+	input := value.NewValue(map[string]interface{}{
+		"query":  map[string]interface{}{"match": "dark", "field": "app_name"},
+		"fields": []interface{}{"app_name"},
+		"sort":   []interface{}{"-_score"},
+	})
+
+	expectQueryFields := map[SearchField]struct{}{
+		{Name: "app_name", Type: "text"}: struct{}{},
+	}
+
+	_, first, _, err := ParseQueryToSearchRequest("", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := parsedRequestKey("", input)
+	if _, _, _, cached := getParsedRequest(key); !cached {
+		t.Fatalf("Expected the parsed request to be cached")
+	}
+
+	// the request returned is modified as by a search, leaving the cached
+	// request (and so those returned later on) unaffected.
+	expect := CopySearchRequest(first)
+	first = DecorateSearchRequest(first, "collection")
+	first = IncludeFieldsInSearchRequest(first, []string{"reviews"})
+	*first.Size = 10
+	first.Sort[0] = json.RawMessage(`"_id"`)
+
+	var wg sync.WaitGroup
+	for k := 0; k < 4; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			queryFields, sr, _, err := ParseQueryToSearchRequest("", input)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if !reflect.DeepEqual(expectQueryFields, queryFields) {
+				t.Errorf("Unexpected query fields: %v", queryFields)
+			}
+
+			if !reflect.DeepEqual(expect, sr) {
+				t.Errorf("Expected the cached request: %+v, got: %+v", expect, sr)
+			}
+
+			DecorateSearchRequest(sr, "other")
+			IncludeFieldsInSearchRequest(sr, []string{"other"})
+		}()
+	}
+	wg.Wait()
+
+	// a query (rather than a search request) keeps its sort unset.
+	for k := 0; k < 2; k++ {
+		_, sr, _, err := ParseQueryToSearchRequest("", value.NewValue("app_name:dark"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sr.Sort != nil {
+			t.Fatalf("Expected the sort unset, got: %v", sr.Sort)
+		}
+	}
+}
+
+func TestParsedRequestCacheEvictsLRU(t *testing.T) {
+	defer SetParsedRequestCacheBytes(GetParsedRequestCacheBytes())
+	defer func(cache *parsedRequestCache) {
+		parsedRequests = cache
+	}(parsedRequests)
+	parsedRequests = &parsedRequestCache{
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+
+	input := func(term string) value.Value {
+		return value.NewValue(map[string]interface{}{
+			"match": term, "field": "app_name"})
+	}
+
+	// room for two of the requests (about the size of the first).
+	_, _, _, err := ParseQueryToSearchRequest("", input("dark"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	elem := parsedRequests.entries[parsedRequestKey("", input("dark"))]
+	SetParsedRequestCacheBytes(5 * elem.Value.(*parsedRequest).size / 2)
+
+	for _, term := range []string{"dark", "light", "dark", "grey"} {
+		if _, _, _, err := ParseQueryToSearchRequest("",
+			input(term)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// "light" was the least recently used.
+	for term, expect := range map[string]bool{
+		"dark": true, "light": false, "grey": true} {
+		_, _, _, cached := getParsedRequest(parsedRequestKey("", input(term)))
+		if cached != expect {
+			t.Fatalf("Expected %q cached: %t, got: %t", term, expect, cached)
+		}
+	}
+
+	parsedRequests.m.Lock()
+	bytes := parsedRequests.bytes
+	parsedRequests.m.Unlock()
+	if bytes > GetParsedRequestCacheBytes() {
+		t.Fatalf("Expected the cache bounded by %d bytes, got: %d",
+			GetParsedRequestCacheBytes(), bytes)
+	}
+
+	// the fields returned are a copy, that may be modified.
+	fields, _, _, _ := getParsedRequest(parsedRequestKey("", input("dark")))
+	fields[SearchField{Name: "other"}] = struct{}{}
+	fields, _, _, _ = getParsedRequest(parsedRequestKey("", input("dark")))
+	if _, exists := fields[SearchField{Name: "other"}]; exists {
+		t.Fatalf("Expected the cached fields unaffected, got: %v", fields)
+	}
+
+	// a request past the bound isn't cached.
+	SetParsedRequestCacheBytes(16)
+	_, _, _, err = ParseQueryToSearchRequest("", input("white"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, cached := getParsedRequest(
+		parsedRequestKey("", input("white"))); cached {
+		t.Fatalf("Expected the request past the bound not cached")
+	}
+}
+
+func TestParseQueryToSearchRequestOpenEndedNumericRanges(t *testing.T) {
+	tests := []struct {
+		field  string
+		query  map[string]interface{}
+		expect map[string]interface{}
+	}{
+		{
+			query:  map[string]interface{}{"min": 5, "field": "id"},
+			expect: map[string]interface{}{"min": float64(5), "field": "id"},
+		},
+		{
+			query:  map[string]interface{}{"max": 10, "field": "id"},
+			expect: map[string]interface{}{"max": float64(10), "field": "id"},
+		},
+		{
+			query: map[string]interface{}{"min": 5, "max": 10,
+				"inclusive_min": false, "field": "id"},
+			expect: map[string]interface{}{"min": float64(5), "max": float64(10),
+				"inclusive_min": false, "field": "id"},
+		},
+		{
+			// field provided as the SEARCH() function's argument
+			field: "id",
+			query: map[string]interface{}{"max": 10, "inclusive_max": true},
+			expect: map[string]interface{}{"max": float64(10),
+				"inclusive_max": true, "field": "id"},
+		},
+	}
+
+	expectQueryFields := map[SearchField]struct{}{
+		{Name: "id", Type: "number"}: struct{}{},
+	}
+
+	for testi, test := range tests {
+		for _, input := range []interface{}{
+			test.query,
+			map[string]interface{}{"query": test.query},
+		} {
+			gotQueryFields, sr, _, err := ParseQueryToSearchRequest(test.field,
+				value.NewValue(input))
+			if err != nil {
+				t.Fatal(testi, err)
+			}
+
+			if !reflect.DeepEqual(expectQueryFields, gotQueryFields) {
+				t.Fatalf("[%d] Expected query fields: %v, got: %v",
+					testi, expectQueryFields, gotQueryFields)
+			}
+
+			var got map[string]interface{}
+			if err = json.Unmarshal(sr.Q, &got); err != nil {
+				t.Fatal(testi, err)
+			}
+
+			if !reflect.DeepEqual(test.expect, got) {
+				t.Fatalf("[%d] Expected query: %v, got: %s",
+					testi, test.expect, sr.Q)
+			}
+		}
+	}
+}
+
+func TestGrpcN1QLError(t *testing.T) {
+	err := status.Error(codes.InvalidArgument,
+		"bleve: QueryBleve parsing searchRequest, err: unknown query type")
+
+	n1qlErr := GrpcN1QLError(err, "search failed")
+	if n1qlErr.Cause() != err {
+		t.Fatalf("Expected the original error as the cause, got: %v",
+			n1qlErr.Cause())
+	}
+
+	for _, expect := range []string{"search failed", "InvalidArgument",
+		"unknown query type"} {
+		if !strings.Contains(n1qlErr.Error(), expect) {
+			t.Fatalf("Expected %q within the error: %v", expect, n1qlErr)
+		}
+	}
+
+	// non-gRPC errors are left as is
+	n1qlErr = GrpcN1QLError(fmt.Errorf("EOF"), "search failed")
+	if strings.Contains(n1qlErr.Error(), "fts error code") {
+		t.Fatalf("Unexpected error: %v", n1qlErr)
+	}
+}
+
+func TestIndexMappingCachedPerKeyspace(t *testing.T) {
+	name := "TestIndexMappingCachedPerKeyspace"
+	defer func() {
+		mappingsCacheLock.Lock()
+		delete(mappingsCache, name)
+		mappingsCacheLock.Unlock()
+	}()
+
+	for _, collection := range []string{"collection1", "collection2"} {
+		SetIndexMapping(name, &MappingDetails{
+			UUID:       "uuid",
+			SourceName: "default",
+			Scope:      "scope1",
+			Collection: collection,
+			IMapping:   EmptyIndexMapping,
+		})
+	}
+
+	for _, collection := range []string{"collection1", "collection2"} {
+		_, _, scope, coll, err := FetchIndexMapping(name, "uuid",
+			"default.scope1."+collection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scope != "scope1" || coll != collection {
+			t.Fatalf("Expected the mapping over scope1.%s, got: %s.%s",
+				collection, scope, coll)
+		}
+	}
+
+	if _, _, _, _, err := FetchIndexMapping(name, "",
+		"default.scope1.collection3"); err == nil {
+		t.Fatalf("Expected no mapping over scope1.collection3")
+	}
+
+	if _, _, _, _, err := FetchIndexMapping(name, "other-uuid",
+		"default.scope1.collection1"); err == nil {
+		t.Fatalf("Expected no mapping for a mismatched uuid")
+	}
+}
+
+func TestIndexMappingNameCase(t *testing.T) {
+	defer SetIndexHintCaseInsensitive(GetIndexHintCaseInsensitive())
+
+	name := "TestIndexMappingNameCase"
+	defer func() {
+		mappingsCacheLock.Lock()
+		delete(mappingsCache, name)
+		mappingsCacheLock.Unlock()
+	}()
+
+	SetIndexMapping(name, &MappingDetails{
+		UUID:       "uuid",
+		SourceName: "default",
+		IMapping:   EmptyIndexMapping,
+	})
+
+	hint := strings.ToLower(name)
+
+	SetIndexHintCaseInsensitive(false)
+	if _, _, _, _, err := FetchIndexMapping(hint, "", "default"); err == nil {
+		t.Fatalf("Expected no mapping for: %s", hint)
+	}
+
+	SetIndexHintCaseInsensitive(true)
+	if _, _, _, _, err := FetchIndexMapping(hint, "", "default"); err != nil {
+		t.Fatalf("Expected the mapping for: %s, err: %v", hint, err)
+	}
+
+	if _, _, _, _, err := FetchIndexMapping(hint, "other-uuid",
+		"default"); err == nil {
+		t.Fatalf("Expected no mapping for a mismatched uuid")
+	}
+}
+
+func TestCheckResultWindow(t *testing.T) {
+	defer SetBleveMaxResultWindow(GetBleveMaxResultWindow())
+	SetBleveMaxResultWindow(100)
+
+	tests := []struct {
+		offset, limit int64
+		expectErr     bool
+	}{
+		{offset: 0, limit: 100},
+		{offset: 50, limit: 50},
+		{offset: 50, limit: 51, expectErr: true},
+		{offset: 101, limit: 1, expectErr: true},
+		{offset: math.MaxInt64 - 1, limit: 10, expectErr: true},
+		// unbounded limit, the hits streamed
+		{offset: 500, limit: math.MaxInt64},
+		// counting the hits only
+		{offset: 500, limit: 0},
+	}
+
+	for testi, test := range tests {
+		err := CheckResultWindow(test.offset, test.limit)
+		if test.expectErr != (err != nil) {
+			t.Fatalf("[%d] offset: %d, limit: %d, unexpected err: %v",
+				testi, test.offset, test.limit, err)
+		}
+
+		if err != nil && (!strings.Contains(err.Error(), "use pagination") ||
+			!strings.Contains(err.Error(), "100")) {
+			t.Fatalf("[%d] Expected the max result window within: %v",
+				testi, err)
+		}
+	}
+}
+
+func TestArrayElementPath(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		positional bool
+	}{
+		{name: "reviews.rating", path: "reviews.rating"},
+		{name: "reviews[].rating", path: "reviews.rating"},
+		{name: "reviews[].tags[]", path: "reviews.tags"},
+		{name: "reviews[0].rating", path: "reviews.rating", positional: true},
+		{name: "reviews[].ratings[2]", path: "reviews.ratings", positional: true},
+		{name: "reviews[.rating", path: "reviews[.rating"},
+	}
+
+	for _, test := range tests {
+		path, positional := ArrayElementPath(test.name)
+		if path != test.path || positional != test.positional {
+			t.Fatalf("[%s] Expected path: %s, positional: %t, got: %s, %t",
+				test.name, test.path, test.positional, path, positional)
+		}
+	}
+}
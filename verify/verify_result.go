@@ -109,20 +109,42 @@ func (v *VerifyCtx) initVerifyCtx() errors.Error {
 		idxMapping = util.BuildIndexMappingOnFields(queryFields, "", "")
 	} else {
 		indexVal, _ := v.options.Field("index")
-		if indexVal.Type() == value.STRING {
+
+		// the index may also be selected by an object carrying its "name"
+		// and/or "uuid", rather than a mapping.
+		var indexName, indexUUID string
+		isSelector := indexVal.Type() == value.OBJECT &&
+			util.IsIndexSelector(indexVal)
+		if isSelector {
+			if nameVal, ok := indexVal.Field("name"); ok &&
+				nameVal.Type() == value.STRING {
+				indexName = nameVal.Actual().(string)
+			}
+			if uuidVal, ok := indexVal.Field("uuid"); ok &&
+				uuidVal.Type() == value.STRING {
+				indexUUID = uuidVal.Actual().(string)
+			}
+		} else if indexVal.Type() == value.STRING {
+			indexName = indexVal.Actual().(string)
+		}
+
+		if isSelector && len(indexName) == 0 {
+			// selected by UUID alone, use the query fields to build an
+			// index mapping that covers all the necessary fields.
+			idxMapping = util.BuildIndexMappingOnFields(queryFields, "", "")
+		} else if isSelector || indexVal.Type() == value.STRING {
 			keyspace := util.FetchKeySpace(v.nameAndKeyspace)
 
 			// check if indexUUID string is also available from the options.
-			var indexUUID string
 			indexUUIDVal, indexUUIDAvailable := v.options.Field("indexUUID")
-			if indexUUIDAvailable {
+			if indexUUIDAvailable && len(indexUUID) == 0 {
 				if indexUUIDVal.Type() == value.STRING {
 					indexUUID = indexUUIDVal.Actual().(string)
 				}
 			}
 
 			idxMapping, docConfig, scope, collection, err = util.FetchIndexMapping(
-				indexVal.Actual().(string), indexUUID, keyspace)
+				indexName, indexUUID, keyspace)
 			if err != nil {
 				return util.N1QLError(nil, "index mapping not found")
 			}
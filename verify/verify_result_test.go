@@ -150,6 +150,55 @@ func TestNewVerifyWithInvalidIndexUUID(t *testing.T) {
 	}
 }
 
+func TestNewVerifyWithIndexSelectorObject(t *testing.T) {
+	util.SetIndexMapping("temp", &util.MappingDetails{
+		UUID:       "tempUUID",
+		SourceName: "temp_keyspace",
+		IMapping:   bleve.NewIndexMapping(),
+	})
+
+	tests := []struct {
+		index     map[string]interface{}
+		expectErr bool
+	}{
+		{
+			index: map[string]interface{}{"name": "temp", "uuid": "tempUUID"},
+		},
+		{
+			index: map[string]interface{}{"name": "temp"},
+		},
+		{
+			index: map[string]interface{}{"uuid": "tempUUID"},
+		},
+		{
+			index:     map[string]interface{}{"name": "temp", "uuid": "incorrectUUID"},
+			expectErr: true,
+		},
+	}
+
+	for testi, test := range tests {
+		vctx, err := NewVerify("`temp_keyspace`", "",
+			value.NewValue(`search_term`),
+			value.NewValue(map[string]interface{}{"index": test.index}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := vctx.Evaluate(value.NewValue([]byte(`{"f": "search_term"}`)))
+		if test.expectErr {
+			if err == nil {
+				t.Fatalf("[%d] Expected error for index: %v", testi, test.index)
+			}
+			continue
+		}
+
+		if err != nil || !got {
+			t.Fatalf("[%d] Expected match for index: %v, got: %v, err: %v",
+				testi, test.index, got, err)
+		}
+	}
+}
+
 func TestMB33444(t *testing.T) {
 	q := struct {
 		field   string
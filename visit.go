@@ -0,0 +1,495 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blevesearch/bleve/v2/search"
+	pb "github.com/couchbase/cbft/protobuf"
+	"github.com/couchbase/n1fty/util"
+	"github.com/couchbase/query/datastore"
+	"github.com/couchbase/query/errors"
+	"github.com/couchbase/query/value"
+)
+
+// visitBufferSize is the number of hits buffered ahead of the visitor of
+// SearchVisit(..), past which the hits that follow are backfilled; as set
+// by the "visitBufferSize" config
+var visitBufferSize = int64(256)
+
+func GetVisitBufferSize() int64 {
+	return atomic.LoadInt64(&visitBufferSize)
+}
+
+func SetVisitBufferSize(v int64) {
+	atomic.StoreInt64(&visitBufferSize, v)
+}
+
+// SearchVisit performs a search over this index, as Search(..) does but
+// for tooling embedded within the same process, invoking the visitor with
+// each of the hits (in the order streamed) rather than sending them over
+// an IndexConnection. The hits the visitor falls behind on are backfilled,
+// as per the options. The search stops early should the visitor return an
+// error, which is then returned.
+func (i *FTSIndex) SearchVisit(ctx context.Context, field string,
+	query, options value.Value,
+	visit func(*search.DocumentMatch) error) error {
+	if visit == nil {
+		return fmt.Errorf("search visit: no visitor provided")
+	}
+
+	return i.searchVisit(ctx, field, query, options, visit, nil, nil)
+}
+
+// SearchVisitTrailer performs a search over this index, as SearchVisit(..)
+// does, returning the trailer of the search (see the "trailer" option,
+// which is implied) once the hits are visited.
+func (i *FTSIndex) SearchVisitTrailer(ctx context.Context, field string,
+	query, options value.Value,
+	visit func(*search.DocumentMatch) error) (*Trailer, error) {
+	if visit == nil {
+		return nil, fmt.Errorf("search visit: no visitor provided")
+	}
+
+	var trailer *Trailer
+	err := i.searchVisit(ctx, field, query, withOption(options, "trailer"),
+		visit, nil, func(t *Trailer) { trailer = t })
+
+	return trailer, err
+}
+
+// SearchVisitRaw performs a search over this index, as SearchVisit(..)
+// does, but for the complete search result (see the "raw_result" option,
+// which is implied), handed over to the visitor once the search is done.
+func (i *FTSIndex) SearchVisitRaw(ctx context.Context, field string,
+	query, options value.Value, visitor RawResultVisitor) error {
+	if visitor == nil {
+		return fmt.Errorf("search visit: no visitor provided")
+	}
+
+	return i.searchVisit(ctx, field, query, withOption(options, "raw_result"),
+		nil, visitor, nil)
+}
+
+// withOption returns a copy of the options with the boolean option set,
+// leaving options that aren't an object to be refused as they are.
+func withOption(options value.Value, name string) value.Value {
+	if options != nil && options.Type() != value.OBJECT {
+		return options
+	}
+
+	rv := map[string]interface{}{}
+	if options != nil {
+		for k, v := range options.Fields() {
+			rv[k] = v
+		}
+	}
+	rv[name] = true
+
+	return value.NewValue(rv)
+}
+
+// searchVisit performs the search of SearchVisit(..), or (given the raw
+// result visitor) that of SearchVisitRaw(..), or (given the trailer's
+// callback) that of SearchVisitTrailer(..).
+func (i *FTSIndex) searchVisit(ctx context.Context, field string,
+	query, options value.Value, visit func(*search.DocumentMatch) error,
+	rawVisitor RawResultVisitor, onTrailer func(*Trailer)) error {
+	if query == nil {
+		return fmt.Errorf("search visit: no search parameters provided")
+	}
+
+	if i.indexer == nil {
+		return fmt.Errorf("search visit: indexer unavailable")
+	}
+
+	sargRV := i.buildQueryAndCheckIfSargable(field, query, options, nil)
+	if sargRV.err != nil || sargRV.count == 0 {
+		return fmt.Errorf("search visit: not sargable over index: %s",
+			i.Name())
+	}
+
+	searchOpts, err := util.ParseSearchOptions(options)
+	if err != nil {
+		return fmt.Errorf("search visit: search options err: %v", err)
+	}
+
+	if searchOpts.RawResult != (rawVisitor != nil) {
+		return fmt.Errorf("search visit: raw_result option: requires" +
+			" SearchVisitRaw(..)")
+	}
+
+	if searchOpts.Trailer != (onTrailer != nil) {
+		return fmt.Errorf("search visit: trailer option: requires" +
+			" SearchVisitTrailer(..)")
+	}
+
+	searchRequest := sargRV.searchRequest
+	if i.indexer.collectionAware {
+		searchRequest = util.DecorateSearchRequest(searchRequest,
+			i.indexer.collection)
+	}
+	searchRequest = util.IncludeFieldsInSearchRequest(searchRequest,
+		searchOpts.IncludeFields)
+	searchRequest = util.ExcludeFieldsFromSearchRequest(searchRequest,
+		searchOpts.ExcludeFields)
+	searchRequest = util.IncludeLocationsInSearchRequest(searchRequest,
+		searchOpts.IncludeLocations)
+	searchRequest = util.ExplainInSearchRequest(searchRequest,
+		searchOpts.Explain)
+	searchRequest = util.HighlightInSearchRequest(searchRequest,
+		searchOpts.Highlight)
+	searchRequest = util.CollapseInSearchRequest(searchRequest,
+		searchOpts.Collapse)
+	searchRequest, err = util.SortInSearchRequest(searchRequest,
+		searchOpts.Sort)
+	if err != nil {
+		return fmt.Errorf("search visit: sort option err: %v", err)
+	}
+	searchRequest = util.CursorInSearchRequest(searchRequest,
+		searchOpts.SearchAfter, searchOpts.SearchBefore)
+	searchRequest = util.KeysOnlyInSearchRequest(searchRequest, nil,
+		searchOpts.KeysOnly)
+
+	// all of the hits are visited, the index waited on as requested.
+	searchInfo := &datastore.FTSSearchInfo{
+		Query:   query,
+		Options: options,
+		Limit:   math.MaxInt64,
+	}
+	cons := datastore.UNBOUNDED
+	if c := searchOpts.Consistency; c != nil &&
+		c.Level == util.ConsistencyBounded {
+		if n1qlErr := i.checkStaleness(searchRequest, nil,
+			c.StalenessMS); n1qlErr != nil {
+			return n1qlErr
+		}
+	}
+
+	timeoutMS := util.SearchTimeoutMS(sargRV.timeoutMS, searchOpts)
+
+	var cancel context.CancelFunc
+	if searchOpts.Timeout > 0 {
+		// FTS returns the partial results once its timeout elapses, so
+		// the search's canceled only past it.
+		ctx, cancel = context.WithTimeout(ctx,
+			time.Duration(searchOpts.Timeout)*time.Millisecond+
+				GetSearchTimeoutGrace())
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	// the search is canceled should the indexer be closed meanwhile.
+	untrack, err := i.indexer.trackSearch(cancel)
+	if err != nil {
+		return fmt.Errorf("search visit: search err: %v", err)
+	}
+	defer untrack()
+
+	rh := newResponseHandler(i, "", searchRequest, searchOpts)
+	if deadline, ok := ctx.Deadline(); ok {
+		rh.reqDeadline = deadline
+	}
+
+	conn := newVisitConn(visit, cancel)
+	conn.onTrailer = onTrailer
+	if rawVisitor != nil {
+		rh.rawVisitor = &rawResultRecorder{visitor: rawVisitor, c: conn}
+	}
+
+	if searchOpts.SearchAfter != nil || searchOpts.SearchBefore != nil {
+		// the hits are paged through, from the cursor.
+		n1qlErr := i.pageThrough(ctx, i.fetchHits, searchRequest, searchInfo,
+			nil, cons, timeoutMS, rh, conn)
+		conn.finish(rh)
+		if err = conn.err(); err == nil && n1qlErr != nil {
+			return n1qlErr
+		}
+		return err
+	}
+
+	searchReq, err := util.BuildProtoSearchRequest(searchRequest, searchInfo,
+		nil, cons, i.identity())
+	if err != nil {
+		return fmt.Errorf("search visit: search request parse err: %v", err)
+	}
+
+	if err = util.SetQueryCtlTimeout(searchReq, timeoutMS); err != nil {
+		return fmt.Errorf("search visit: search request ctl params err: %v",
+			err)
+	}
+
+	client, err := i.indexer.searchClient(i.indexDef.UUID)
+	if err != nil {
+		return fmt.Errorf("search visit: %v", err)
+	}
+
+	if err = i.indexer.acquireSearch(ctx); err != nil {
+		return fmt.Errorf("search visit: search throttled: %v", err)
+	}
+	defer func() {
+		i.indexer.releaseSearch()
+		cancel()
+		rh.drainAbandoned()
+	}()
+
+	starttm := time.Now()
+	defer func() {
+		i.indexer.countSearch(time.Since(starttm))
+	}()
+
+	stream, err := searchWithRetry(ctx, client, searchReq)
+	if err != nil || stream == nil {
+		return util.GrpcN1QLError(err, grpcErrDesc(err, "search failed"))
+	}
+
+	return conn.visitStream(rh, stream)
+}
+
+// -----------------------------------------------------------------------------
+
+// visitConn is the searchConn the hits of SearchVisit(..) are sent over,
+// to the visitor, with the first error reported (or returned by the
+// visitor) kept.
+type visitConn struct {
+	sender *visitSender
+	cancel context.CancelFunc
+
+	// takes in the trailer of SearchVisitTrailer(..), if any.
+	onTrailer func(*Trailer)
+
+	m        sync.Mutex
+	connErr  errors.Error
+	visitErr error
+}
+
+func newVisitConn(visit func(*search.DocumentMatch) error,
+	cancel context.CancelFunc) *visitConn {
+	c := &visitConn{cancel: cancel}
+	c.sender = newVisitSender(int(GetVisitBufferSize()), func(
+		entry *datastore.IndexEntry) error {
+		return c.visited(visitEntry(entry, visit))
+	})
+
+	return c
+}
+
+// visited keeps the error returned by the visitor (if any), with the
+// search then abandoned; returns the error.
+func (c *visitConn) visited(err error) error {
+	if err != nil {
+		c.m.Lock()
+		if c.visitErr == nil {
+			c.visitErr = err
+		}
+		c.m.Unlock()
+		c.cancel() // the search's abandoned
+	}
+	return err
+}
+
+func (c *visitConn) Sender() datastore.Sender { return c.sender }
+
+func (c *visitConn) Error(err errors.Error) {
+	c.m.Lock()
+	if c.connErr == nil {
+		c.connErr = err
+	}
+	c.m.Unlock()
+}
+
+func (c *visitConn) Warning(wrn errors.Error) {}
+
+func (c *visitConn) setTrailer(trailer *Trailer) {
+	if c.onTrailer != nil {
+		c.onTrailer(trailer)
+	}
+}
+
+// visitStream sends the hits streamed over to the visitor, returning once
+// they're all visited (or the visitor has stopped the search).
+func (c *visitConn) visitStream(rh *responseHandler,
+	stream pb.SearchService_SearchClient) error {
+	var waitGroup sync.WaitGroup
+	var backfillSync int64
+
+	rh.handleResponse(c, &waitGroup, &backfillSync, stream)
+
+	atomic.StoreInt64(&backfillSync, doneRequest)
+	waitGroup.Wait()
+
+	c.finish(rh)
+
+	return c.err()
+}
+
+// finish sends the hit held back (if any), waiting for all the hits sent
+// to be visited, hands over the trailer (if any) and cleans up after the
+// response handler.
+func (c *visitConn) finish(rh *responseHandler) {
+	rh.flushLastHit(c.sender)
+	c.sender.Close()
+	<-c.sender.done
+	rh.flushTrailer(c)
+
+	rh.stopSends()
+	rh.cleanupBackfill()
+	rh.cleanupDistinct()
+	rh.cleanupRawResult()
+}
+
+// err returns the error returned by the visitor, else that reported.
+func (c *visitConn) err() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.visitErr != nil {
+		return c.visitErr
+	}
+	if c.connErr != nil {
+		return c.connErr
+	}
+	return nil
+}
+
+// rawResultRecorder keeps the error returned by the raw result visitor
+// of SearchVisitRaw(..) (if any), for it to be returned as is.
+type rawResultRecorder struct {
+	visitor RawResultVisitor
+	c       *visitConn
+}
+
+func (r *rawResultRecorder) VisitResult(result map[string]interface{}) error {
+	return r.c.visited(r.visitor.VisitResult(result))
+}
+
+func (r *rawResultRecorder) VisitHits(hits []byte) error {
+	return r.c.visited(r.visitor.VisitHits(hits))
+}
+
+// visitEntry invokes the visitor with the hit the entry carries.
+func visitEntry(entry *datastore.IndexEntry,
+	visit func(*search.DocumentMatch) error) error {
+	dm := &search.DocumentMatch{}
+	if entry.MetaData != nil {
+		buf, err := json.Marshal(entry.MetaData)
+		if err != nil {
+			return fmt.Errorf("search visit: hit: %s, marshal err: %v",
+				entry.PrimaryKey, err)
+		}
+		if err = json.Unmarshal(buf, dm); err != nil {
+			return fmt.Errorf("search visit: hit: %s, unmarshal err: %v",
+				entry.PrimaryKey, err)
+		}
+	}
+	dm.ID = entry.PrimaryKey
+
+	return visit(dm)
+}
+
+// -----------------------------------------------------------------------------
+
+// visitSender buffers the hits ahead of the visitor, which is invoked for
+// each of them in turn; once the visitor returns an error, the hits that
+// follow are refused (with the search then stopped), and those buffered
+// dropped.
+type visitSender struct {
+	entries chan *datastore.IndexEntry
+	visit   func(*datastore.IndexEntry) error
+
+	stopped   chan struct{} // closed once the visitor's returned an error
+	closed    chan struct{} // closed once no more hits are to be sent
+	closeOnce sync.Once
+	done      chan struct{} // closed once the visitor's done
+}
+
+func newVisitSender(size int,
+	visit func(*datastore.IndexEntry) error) *visitSender {
+	if size <= 0 {
+		size = 1
+	}
+
+	s := &visitSender{
+		entries: make(chan *datastore.IndexEntry, size),
+		visit:   visit,
+		stopped: make(chan struct{}),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s
+}
+
+func (s *visitSender) run() {
+	defer close(s.done)
+
+	for {
+		select {
+		case entry := <-s.entries:
+			if s.visit(entry) != nil {
+				close(s.stopped)
+				return
+			}
+		case <-s.closed:
+			// the hits buffered ahead of the close are visited still.
+			for {
+				select {
+				case entry := <-s.entries:
+					if s.visit(entry) != nil {
+						close(s.stopped)
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *visitSender) SendEntry(entry *datastore.IndexEntry) bool {
+	select {
+	case <-s.stopped:
+		return false
+	case <-s.closed:
+		return false
+	default:
+	}
+
+	select {
+	case s.entries <- entry:
+		return true
+	case <-s.stopped:
+		return false
+	case <-s.closed:
+		return false
+	}
+}
+
+func (s *visitSender) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+}
+
+func (s *visitSender) Capacity() int { return cap(s.entries) }
+func (s *visitSender) Length() int   { return len(s.entries) }
@@ -0,0 +1,176 @@
+//  Copyright (c) 2021 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package n1fty
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2/search"
+	"github.com/couchbase/cbft"
+	pb "github.com/couchbase/cbft/protobuf"
+	"github.com/couchbase/n1fty/util"
+	"github.com/couchbase/query/value"
+)
+
+// visitMsgs returns the messages streaming the hits doc-00, doc-01, ... in
+// batches of 2, followed by the search's result.
+func visitMsgs(batches int) ([]*pb.StreamSearchResults, []string) {
+	var ids []string
+	var msgs []*pb.StreamSearchResults
+	for batch := 0; batch < batches; batch++ {
+		var hits []string
+		for j := 0; j < 2; j++ {
+			id := fmt.Sprintf("doc-%02d", batch*2+j)
+			ids = append(ids, id)
+			hits = append(hits, fmt.Sprintf(`{"id":%q,"score":%d}`,
+				id, batch*2+j))
+		}
+		msgs = append(msgs, &pb.StreamSearchResults{
+			Contents: &pb.StreamSearchResults_Hits{
+				Hits: &pb.StreamSearchResults_Batch{
+					Bytes: []byte("[" + strings.Join(hits, ",") + "]"),
+					Total: uint64(len(hits)),
+				},
+			},
+		})
+	}
+	msgs = append(msgs, &pb.StreamSearchResults{
+		Contents: &pb.StreamSearchResults_SearchResult{
+			SearchResult: []byte(`{"status":{"total":1,"failed":0,` +
+				`"successful":1},"hits":[]}`),
+		},
+	})
+
+	return msgs, ids
+}
+
+func TestSearchVisit(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	var sr *cbft.SearchRequest
+	err = json.Unmarshal([]byte(`{"query":{"match_all":{}}}`), &sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer SetVisitBufferSize(GetVisitBufferSize())
+	SetVisitBufferSize(2)
+
+	// the visitor falls behind, so the hits that follow are backfilled,
+	// and visited still in the order streamed.
+	msgs, expect := visitMsgs(8)
+
+	limitMB := int64(1)
+	rh := newResponseHandler(index, "", sr, &util.SearchOptions{
+		BackfillLimitMB: &limitMB,
+	})
+
+	var got []string
+	var scores []float64
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := newVisitConn(func(dm *search.DocumentMatch) error {
+		time.Sleep(time.Millisecond)
+		got = append(got, dm.ID)
+		scores = append(scores, dm.Score)
+		return nil
+	}, cancel)
+
+	if err = conn.visitStream(rh, &fakeStream{msgs: msgs}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(expect, got) {
+		t.Fatalf("Expected the hits visited in order: %v, got: %v",
+			expect, got)
+	}
+	for x, score := range scores {
+		if score != float64(x) {
+			t.Fatalf("Expected hit: %s scored: %d, got: %v", got[x], x, score)
+		}
+	}
+
+	// the visitor returning an error stops the search, with no more hits
+	// visited, and the error returned; the hits aren't backfilled, so the
+	// search is held up by the visitor.
+	msgs, _ = visitMsgs(50)
+
+	rh = newResponseHandler(index, "", sr, &util.SearchOptions{
+		NoBackfill: true,
+	})
+
+	visitErr := fmt.Errorf("visited enough")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	visited := 0
+	conn = newVisitConn(func(dm *search.DocumentMatch) error {
+		visited++
+		if visited == 3 {
+			return visitErr
+		}
+		return nil
+	}, cancel)
+
+	stream := &fakeStream{msgs: msgs, ctx: ctx}
+	if err = conn.visitStream(rh, stream); err != visitErr {
+		t.Fatalf("Expected the visitor's error, got: %v", err)
+	}
+
+	if visited != 3 {
+		t.Fatalf("Expected 3 hits visited, got: %d", visited)
+	}
+
+	if ctx.Err() == nil {
+		t.Fatalf("Expected the search canceled")
+	}
+
+	if len(stream.msgs) == 0 {
+		t.Fatalf("Expected the stream abandoned ahead of its end")
+	}
+}
+
+func TestSearchVisitTrailerOption(t *testing.T) {
+	index, err := setupSampleIndex(util.SampleIndexDefDynamicDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.indexer = &FTSIndexer{stats: &stats{}}
+
+	query := value.NewValue(map[string]interface{}{
+		"match": "shirt", "field": "kind",
+	})
+	visit := func(*search.DocumentMatch) error { return nil }
+
+	// the trailer's only for SearchVisitTrailer(..),
+	err = index.SearchVisit(context.Background(), "", query,
+		value.NewValue(map[string]interface{}{"trailer": true}), visit)
+	if err == nil || !strings.Contains(err.Error(), "trailer") {
+		t.Fatalf("Expected the trailer option refused, got: %v", err)
+	}
+
+	// which implies the option, along with the checks of the others.
+	_, err = index.SearchVisitTrailer(context.Background(), "", query,
+		value.NewValue(map[string]interface{}{"raw_result": true}), visit)
+	if err == nil || !strings.Contains(err.Error(), "raw_result") {
+		t.Fatalf("Expected the raw_result option refused, got: %v", err)
+	}
+}